@@ -0,0 +1,178 @@
+package uploader
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// AdaptiveChunkConcurrencyConfig finds how many chunks of a file to send at a
+// time, up to chunk_parallelism, from how the server copes instead of
+// sending chunk_parallelism all along. Starting from one, the limit grows
+// while chunks go through quickly, and is halved when the server answers 429
+// or 5xx, a request times out or the time a chunk takes per byte rises above
+// LatencyTolerance times the fastest seen: additive increase, multiplicative
+// decrease. Every target has a limit of its own, shared by the chunks of the
+// files uploaded to it at the same time.
+type AdaptiveChunkConcurrencyConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// LatencyTolerance is how many times slower than the fastest seen a
+	// chunk may be before the limit is lowered
+	LatencyTolerance float64 `yaml:"latency_tolerance"`
+}
+
+// uploadConcurrency is the adaptive limit of server_url, or of the backend.
+var uploadConcurrency *concurrencyLimit
+
+// concurrencyLimit is the number of chunks that may be in flight to a
+// server. A nil concurrencyLimit leaves it at chunk_parallelism.
+type concurrencyLimit struct {
+	conf AdaptiveChunkConcurrencyConfig
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// limit grows by one per chunk until the first sign of congestion, then
+	// by one per round of chunks
+	limit    float64
+	inFlight int
+	growing  bool
+	// fastest is the shortest time per byte seen, in seconds. It follows
+	// slower chunks a little, so a network that got slower for good is
+	// learned again.
+	fastest float64
+	// lowered is when the limit was last lowered. Chunks that started
+	// before do not lower it again.
+	lowered time.Time
+}
+
+func newConcurrencyLimit(conf AdaptiveChunkConcurrencyConfig) *concurrencyLimit {
+	if !conf.Enabled {
+		return nil
+	}
+	l := &concurrencyLimit{conf: conf, limit: 1, growing: true}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// acquire waits until another chunk may be sent and returns when it starts.
+func (l *concurrencyLimit) acquire() time.Time {
+	if l == nil {
+		return time.Now()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.inFlight >= int(l.limit) {
+		l.cond.Wait()
+	}
+	l.inFlight++
+	return time.Now()
+}
+
+// skip gives back the slot of a chunk that was not sent after all.
+func (l *concurrencyLimit) skip() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+	l.cond.Broadcast()
+}
+
+// release adjusts the limit to how the chunk of size bytes that started at
+// started went. Failures that say nothing about the load of the server,
+// such as a rejected file or a shutdown, leave it alone.
+func (l *concurrencyLimit) release(name string, started time.Time, size int64, err error) {
+	if l == nil {
+		return
+	}
+	perByte := time.Since(started).Seconds() / float64(max(size, 1))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	defer l.cond.Broadcast()
+	l.inFlight--
+
+	switch {
+	case congested(err):
+		l.lower(name, started, err.Error())
+	case err != nil:
+	case l.fastest == 0 || perByte < l.fastest:
+		l.fastest = perByte
+		l.raise(name)
+	case perByte > l.fastest*l.conf.LatencyTolerance:
+		l.fastest += (perByte - l.fastest) / 100
+		l.lower(name, started, "responses got slower")
+	default:
+		l.fastest += (perByte - l.fastest) / 100
+		l.raise(name)
+	}
+}
+
+// raise grows the limit, unless it is not used up, which says nothing about
+// whether the server could take more. l.mu must be held.
+func (l *concurrencyLimit) raise(name string) {
+	if l.inFlight+1 < int(l.limit) {
+		return
+	}
+	before := int(l.limit)
+	if l.growing {
+		l.limit++
+	} else {
+		l.limit += 1 / l.limit
+	}
+	l.limit = min(l.limit, float64(max(cfg.ChunkParallelism, 1)))
+	if int(l.limit) != before {
+		logrus.Debugf("Sending up to %d chunks at a time to %s", int(l.limit), name)
+	}
+}
+
+// lower halves the limit, once for the chunks that were in flight
+// together. l.mu must be held.
+func (l *concurrencyLimit) lower(name string, started time.Time, reason string) {
+	if started.Before(l.lowered) {
+		return
+	}
+	l.limit = max(l.limit/2, 1)
+	l.growing = false
+	l.lowered = time.Now()
+	logrus.Debugf("Sending up to %d chunks at a time to %s: %s", int(l.limit), name, reason)
+}
+
+// current returns the limit, for the status.
+func (l *concurrencyLimit) current() int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.limit)
+}
+
+// congested reports whether err is a sign of an overloaded server or link:
+// a 429 or 5xx response or a timeout.
+func congested(err error) bool {
+	if err == nil {
+		return false
+	}
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode >= 500
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// concurrencyLimit returns the adaptive limit of the server the job uploads
+// to.
+func (j *uploadJob) concurrencyLimit() *concurrencyLimit {
+	if j.Target != nil {
+		return j.Target.concurrency
+	}
+	return uploadConcurrency
+}
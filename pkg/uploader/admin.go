@@ -0,0 +1,400 @@
+package uploader
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// AdminConfig enables the control API, which lets operators look at and
+// steer a running instance over HTTP.
+type AdminConfig struct {
+	// Listen is the address to serve the API on, e.g. 127.0.0.1:8090
+	Listen string `yaml:"listen"`
+	// Token is required as a bearer token when set; it defaults to
+	// AUTO_UPLOAD_ADMIN_TOKEN
+	Token string `yaml:"token"`
+}
+
+var (
+	// paused stops new uploads from starting; files seen in the meantime
+	// are picked up by a rescan on resume
+	paused atomic.Bool
+
+	controlMu sync.Mutex
+	requeued  []string
+	rescan    bool
+
+	// controlRequests wakes up the watch loop to run the requeued uploads
+	// and rescans asked for through the API
+	controlRequests = make(chan struct{}, 1)
+)
+
+// adminStatus is the response of GET /status.
+type adminStatus struct {
+	Paused      bool             `json:"paused"`
+	Uploads     []progressReport `json:"uploads"`
+	Failed      int              `json:"failed"`
+	Rejected    int              `json:"rejected"`
+	Requeued    int              `json:"requeued"`
+	Queued      int              `json:"queued"`
+	Queue       []queuedStatus   `json:"queue"`
+	Directories []string         `json:"directories"`
+	// ChunkConcurrency is the chunks sent at a time to the server, with
+	// adaptive chunk concurrency
+	ChunkConcurrency int `json:"chunk_concurrency,omitempty"`
+}
+
+// fileStatus is the response of GET /files.
+type fileStatus struct {
+	Path      string          `json:"path"`
+	Uploaded  *fileRecord     `json:"uploaded,omitempty"`
+	Failed    *failedUpload   `json:"failed,omitempty"`
+	Uploading *progressReport `json:"uploading,omitempty"`
+	Queued    *queuedStatus   `json:"queued,omitempty"`
+}
+
+// startAdmin serves the control API on conf.Listen:
+//
+//	GET  /status           paused state, running uploads, the next queued
+//	                       files with their priority and queue counts
+//	GET  /files?path=...   what is known about a file
+//	GET  /failed           files whose upload failed for good
+//	POST /pause            stop starting new uploads
+//	POST /resume           start uploading again
+//	POST /rescan           scan the watched directories now
+//	POST /requeue[?path=]  upload failed files again, all or the given ones
+//	POST /ignore?path=...  give up on a failed file
+//	POST /cancel?path=...  abort a running upload, which counts as failed
+//	GET  /history[?limit=] the most recent uploads
+//	GET  /throughput       the upload rate over the last hour
+//	GET  /healthz, /readyz the health checks, see HealthConfig
+//
+// The dashboard at / uses these endpoints.
+func startAdmin(conf AdminConfig) error {
+	token := firstNonEmpty(conf.Token, os.Getenv("AUTO_UPLOAD_ADMIN_TOKEN"))
+	listener, err := net.Listen("tcp", conf.Listen)
+	if err != nil {
+		return fmt.Errorf("starting admin API: %w", err)
+	}
+	if host, _, _ := net.SplitHostPort(conf.Listen); token == "" && !isLoopback(host) {
+		logrus.Warnf("The admin API on %s has no token, anyone who can reach it can control the uploader", conf.Listen)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", adminHandler(http.MethodGet, handleAdminStatus))
+	mux.HandleFunc("/files", adminHandler(http.MethodGet, handleAdminFile))
+	mux.HandleFunc("/failed", adminHandler(http.MethodGet, handleAdminFailed))
+	mux.HandleFunc("/pause", adminHandler(http.MethodPost, handleAdminPause))
+	mux.HandleFunc("/resume", adminHandler(http.MethodPost, handleAdminResume))
+	mux.HandleFunc("/rescan", adminHandler(http.MethodPost, handleAdminRescan))
+	mux.HandleFunc("/requeue", adminHandler(http.MethodPost, handleAdminRequeue))
+	mux.HandleFunc("/ignore", adminHandler(http.MethodPost, handleAdminIgnore))
+	mux.HandleFunc("/cancel", adminHandler(http.MethodPost, handleAdminCancel))
+	mux.HandleFunc("/history", adminHandler(http.MethodGet, handleAdminHistory))
+	mux.HandleFunc("/throughput", adminHandler(http.MethodGet, handleAdminThroughput))
+	registerHealth(mux)
+	mux.HandleFunc("/", handleDashboard)
+
+	server := &http.Server{Handler: requireToken(token, mux), ReadHeaderTimeout: 10 * time.Second}
+	go recordThroughput()
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			logrus.Error("Admin API stopped:", err)
+		}
+	}()
+	logrus.Infof("Admin API listening on %s", listener.Addr())
+	return nil
+}
+
+func isPublicPath(path string) bool {
+	return path == "/" || path == "/healthz" || path == "/readyz"
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// requireToken checks the bearer token on every request except for the
+// dashboard page itself, which holds no data and passes the token on to the
+// API from its URL, and the health checks, which container probes call.
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" && !isPublicPath(r.URL.Path) && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAdminError(w, http.StatusUnauthorized, "invalid or missing token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminHandler restricts a handler to one method and writes the value it
+// returns as JSON.
+func adminHandler(method string, handle func(r *http.Request) (interface{}, int, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		value, status, err := handle(r)
+		if err != nil {
+			writeAdminError(w, status, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(value)
+	}
+}
+
+func writeAdminError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+func handleAdminStatus(r *http.Request) (interface{}, int, error) {
+	failed, err := state.failedUploads()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	controlMu.Lock()
+	queued := len(requeued)
+	controlMu.Unlock()
+
+	status := adminStatus{
+		Paused:   paused.Load(),
+		Uploads:  currentUploads(),
+		Failed:   len(failed),
+		Requeued: queued,
+		Queued:   queue.len(),
+		Queue:    queue.list(queueStatusLimit),
+
+		ChunkConcurrency: uploadConcurrency.current(),
+	}
+	for _, upload := range failed {
+		if upload.Rejected {
+			status.Rejected++
+		}
+	}
+	for _, dir := range dirs {
+		status.Directories = append(status.Directories, dir.Path)
+	}
+	return status, http.StatusOK, nil
+}
+
+func handleAdminFile(r *http.Request) (interface{}, int, error) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		return nil, http.StatusBadRequest, errors.New("missing path")
+	}
+
+	status := fileStatus{Path: path}
+	var err error
+	if status.Uploaded, err = state.get(path); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	failed := &failedUpload{}
+	found, err := state.getJSON(failedBucket, path, failed)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if found {
+		status.Failed = failed
+	}
+	uploads := currentUploads()
+	for i := range uploads {
+		if uploads[i].Path == path {
+			status.Uploading = &uploads[i]
+		}
+	}
+
+	status.Queued = queue.status(path)
+
+	if status.Uploaded == nil && status.Failed == nil && status.Uploading == nil && status.Queued == nil {
+		return nil, http.StatusNotFound, fmt.Errorf("nothing known about %s", path)
+	}
+	return status, http.StatusOK, nil
+}
+
+func handleAdminFailed(r *http.Request) (interface{}, int, error) {
+	failed, err := state.failedUploads()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return failed, http.StatusOK, nil
+}
+
+func handleAdminPause(r *http.Request) (interface{}, int, error) {
+	if !paused.Swap(true) {
+		logrus.Info("Uploads paused")
+	}
+	return map[string]bool{"paused": true}, http.StatusOK, nil
+}
+
+func handleAdminResume(r *http.Request) (interface{}, int, error) {
+	if paused.Swap(false) {
+		logrus.Info("Uploads resumed")
+		requestControl(nil, true)
+	}
+	return map[string]bool{"paused": false}, http.StatusOK, nil
+}
+
+func handleAdminRescan(r *http.Request) (interface{}, int, error) {
+	requestControl(nil, true)
+	return map[string]bool{"rescan": true}, http.StatusAccepted, nil
+}
+
+func handleAdminRequeue(r *http.Request) (interface{}, int, error) {
+	failed, err := state.failedUploads()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	known := make(map[string]bool, len(failed))
+	var paths []string
+	for _, upload := range failed {
+		known[upload.Path] = true
+		paths = append(paths, upload.Path)
+	}
+
+	if requested := r.URL.Query()["path"]; len(requested) > 0 {
+		for _, path := range requested {
+			if !known[path] {
+				return nil, http.StatusNotFound, fmt.Errorf("%s has not failed", path)
+			}
+		}
+		paths = requested
+	}
+
+	requestControl(paths, false)
+	return map[string]int{"requeued": len(paths)}, http.StatusAccepted, nil
+}
+
+func handleAdminIgnore(r *http.Request) (interface{}, int, error) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		return nil, http.StatusBadRequest, errors.New("missing path")
+	}
+	found, err := state.getJSON(failedBucket, path, &failedUpload{})
+	switch {
+	case err != nil:
+		return nil, http.StatusInternalServerError, err
+	case !found:
+		return nil, http.StatusNotFound, fmt.Errorf("%s has not failed", path)
+	}
+
+	// Without a checksum the file does not count as the original of
+	// duplicates found later
+	if info, err := os.Stat(path); err == nil {
+		rec := newFileRecord(path, info, "")
+		rec.Ignored = true
+		if err := state.put(rec); err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+	}
+	if err := state.delete(failedBucket, path); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	logrus.Infof("Ignoring failed file %s", path)
+	return map[string]string{"ignored": path}, http.StatusOK, nil
+}
+
+func handleAdminCancel(r *http.Request) (interface{}, int, error) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		return nil, http.StatusBadRequest, errors.New("missing path")
+	}
+	if !cancelUpload(path) {
+		return nil, http.StatusNotFound, fmt.Errorf("%s is not being uploaded", path)
+	}
+	logrus.Infof("Canceling the upload of %s", path)
+	return map[string]string{"canceled": path}, http.StatusOK, nil
+}
+
+func handleAdminHistory(r *http.Request) (interface{}, int, error) {
+	limit := 50
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid limit: %s", value)
+		}
+	}
+
+	records, err := state.recentHistory(limit)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return records, http.StatusOK, nil
+}
+
+func handleAdminThroughput(r *http.Request) (interface{}, int, error) {
+	return throughputHistory(), http.StatusOK, nil
+}
+
+// requestControl queues files to be uploaded again and optionally a rescan,
+// and wakes up the watch loop to run them.
+func requestControl(paths []string, rescanDirs bool) {
+	controlMu.Lock()
+	requeued = append(requeued, paths...)
+	rescan = rescan || rescanDirs
+	controlMu.Unlock()
+
+	select {
+	case controlRequests <- struct{}{}:
+	default:
+	}
+}
+
+// runControlRequests runs the uploads and the rescan queued through the
+// admin API. It is called by the watch loop; while paused the requests wait
+// for the resume.
+func runControlRequests() {
+	if paused.Load() {
+		return
+	}
+
+	controlMu.Lock()
+	paths, rescanDirs := requeued, rescan
+	requeued, rescan = nil, false
+	controlMu.Unlock()
+
+	for _, path := range paths {
+		if dir := dirFor(dirs, path); dir != nil {
+			uploadFile(dir, path, time.Time{})
+		}
+	}
+	flushBatch()
+	if rescanDirs {
+		for _, dir := range dirs {
+			watchForNewFiles(dir)
+		}
+	}
+}
+
+// recordFailure remembers a file whose upload failed for good, so it can be
+// listed and requeued through the admin API, together with where it was moved
+// to if it went to the dead-letter or quarantine directory.
+func recordFailure(filePath string, err error, movedTo string) {
+	failed := &failedUpload{Path: filePath, Error: err.Error(), FailedAt: time.Now(), Rejected: isRejection(err), MovedTo: movedTo}
+	if err := state.putJSON(failedBucket, filePath, failed); err != nil {
+		logrus.Error("Error saving upload state:", err)
+	}
+}
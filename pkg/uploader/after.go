@@ -0,0 +1,190 @@
+package uploader
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	afterUploadKeep    = "keep"
+	afterUploadDelete  = "delete"
+	afterUploadMove    = "move"
+	afterUploadArchive = "archive"
+)
+
+// afterUploadAction is what happens to a source file once it has been
+// uploaded: it is kept, deleted, moved to a directory or gzip-compressed into
+// an archive directory. Moved and archived files keep their path relative to
+// the upload directory.
+type afterUploadAction struct {
+	kind string
+	dir  string
+}
+
+// parseAfterUpload reads a policy of the form keep, delete, move:<dir> or
+// archive.
+func parseAfterUpload(policy, archiveDir string) (afterUploadAction, error) {
+	kind, dir, _ := strings.Cut(policy, ":")
+
+	switch kind {
+	case "", afterUploadKeep:
+		return afterUploadAction{kind: afterUploadKeep}, nil
+	case afterUploadDelete:
+		return afterUploadAction{kind: afterUploadDelete}, nil
+	case afterUploadMove:
+		if dir == "" {
+			return afterUploadAction{}, errors.New("after-upload move needs a directory, e.g. move:/data/done")
+		}
+	case afterUploadArchive:
+		if dir == "" {
+			dir = archiveDir
+		}
+		if dir == "" {
+			return afterUploadAction{}, errors.New("after-upload archive needs an archive directory")
+		}
+	default:
+		return afterUploadAction{}, fmt.Errorf("unknown after-upload action: %s", policy)
+	}
+
+	return afterUploadAction{kind: kind, dir: dir}, nil
+}
+
+func (a afterUploadAction) apply(filePath, uploadDir string) error {
+	if a.kind == afterUploadKeep {
+		return nil
+	}
+	if a.kind == afterUploadDelete {
+		if info, err := os.Stat(filePath); err == nil && info.IsDir() {
+			return os.RemoveAll(filePath)
+		}
+		return os.Remove(filePath)
+	}
+
+	relPath, err := filepath.Rel(uploadDir, filePath)
+	if err != nil || strings.HasPrefix(relPath, "..") {
+		relPath = filepath.Base(filePath)
+	}
+
+	if a.kind == afterUploadArchive {
+		return archiveFile(filePath, uniquePath(filepath.Join(a.dir, relPath+".gz")))
+	}
+	return moveFile(filePath, uniquePath(filepath.Join(a.dir, relPath)))
+}
+
+// moveFile renames src to dst, falling back to copying when they are on
+// different filesystems.
+func moveFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	if err := writeCopy(src, dst, func(w io.Writer) io.WriteCloser { return nopWriteCloser{w} }); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// archiveFile stores a gzip-compressed copy of src as dst and removes src.
+func archiveFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	err := writeCopy(src, dst, func(w io.Writer) io.WriteCloser {
+		zw := gzip.NewWriter(w)
+		zw.Name = filepath.Base(src)
+		return zw
+	})
+	if err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// writeCopy copies src to dst through the writer returned by wrap, keeping
+// the modification time. A partial dst is removed on failure.
+func writeCopy(src, dst string, wrap func(io.Writer) io.WriteCloser) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	w := wrap(out)
+	_, err = io.Copy(w, in)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+
+	return os.Chtimes(dst, time.Now(), info.ModTime())
+}
+
+// uniquePath returns path, or path with a timestamp added before the
+// extension if a file with that name already exists.
+func uniquePath(path string) string {
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return path
+	}
+
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	stamp := time.Now().Format("20060102-150405")
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s.%s%s", base, stamp, ext)
+		if i > 1 {
+			candidate = fmt.Sprintf("%s.%s-%d%s", base, stamp, i, ext)
+		}
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
+
+// isInside reports whether path is dir or somewhere below it.
+func isInside(path, dir string) bool {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+
+	rel, err := filepath.Rel(absDir, absPath)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,217 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// AuthConfig configures how requests of the HTTP backend are authorized,
+// for APIs whose tokens expire too quickly for a static header.
+type AuthConfig struct {
+	// Type is "" (only the configured headers), "oauth2" (client
+	// credentials grant), "command" (a token printed by a command) or
+	// "sigv4" (AWS Signature Version 4)
+	Type string `yaml:"type"`
+
+	TokenURL     string            `yaml:"token_url"`
+	ClientID     string            `yaml:"client_id"`
+	ClientSecret string            `yaml:"client_secret"`
+	Scopes       []string          `yaml:"scopes"`
+	Params       map[string]string `yaml:"params"`
+
+	// Command is run with the shell and prints either a bare token or a JSON
+	// object with access_token and expires_in. A bare token is reused for
+	// TokenTTL.
+	Command  string        `yaml:"command"`
+	TokenTTL time.Duration `yaml:"token_ttl"`
+
+	// Region and Service scope SigV4 signatures, e.g. eu-west-1 and
+	// execute-api for API Gateway. The credentials come from the AWS_*
+	// environment variables. The body is hashed for the signature, which
+	// means spooling it to a temporary file, unless UnsignedPayload is set
+	// for services that accept that.
+	Region          string `yaml:"region"`
+	Service         string `yaml:"service"`
+	UnsignedPayload bool   `yaml:"unsigned_payload"`
+}
+
+// authTransport wraps base so that every request carries a bearer token
+// from the configured source, or a SigV4 signature. Tokens are cached and
+// fetched again shortly before they expire.
+func authTransport(conf AuthConfig, base http.RoundTripper) (http.RoundTripper, error) {
+	var source oauth2.TokenSource
+	switch conf.Type {
+	case "":
+		return base, nil
+	case "sigv4":
+		return newSigV4Transport(conf, base)
+	case "oauth2":
+		if conf.TokenURL == "" || conf.ClientID == "" {
+			return nil, errors.New("oauth2 auth needs a token url and a client id")
+		}
+		credentials := &clientcredentials.Config{
+			ClientID:     conf.ClientID,
+			ClientSecret: firstNonEmpty(conf.ClientSecret, os.Getenv("OAUTH_CLIENT_SECRET")),
+			TokenURL:     conf.TokenURL,
+			Scopes:       conf.Scopes,
+		}
+		for key, value := range conf.Params {
+			if credentials.EndpointParams == nil {
+				credentials.EndpointParams = make(map[string][]string)
+			}
+			credentials.EndpointParams.Set(key, value)
+		}
+		// The token request itself must not go through the auth transport
+		ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: base})
+		source = credentials.TokenSource(ctx)
+	case "command":
+		if conf.Command == "" {
+			return nil, errors.New("command auth needs a command")
+		}
+		source = oauth2.ReuseTokenSource(nil, commandTokenSource{command: conf.Command, ttl: conf.TokenTTL})
+	default:
+		return nil, fmt.Errorf("unknown auth type: %s", conf.Type)
+	}
+
+	return &oauth2.Transport{Source: source, Base: base}, nil
+}
+
+// commandTokenSource gets a token from the output of a command such as
+// "vault read -field=token secret/upload" or "gcloud auth print-access-token".
+type commandTokenSource struct {
+	command string
+	ttl     time.Duration
+}
+
+func (s commandTokenSource) Token() (*oauth2.Token, error) {
+	var stderr bytes.Buffer
+	cmd := shellCommand(context.Background(), s.command)
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("running token command: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	output = bytes.TrimSpace(output)
+
+	var response struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if json.Unmarshal(output, &response) == nil && response.AccessToken != "" {
+		token := &oauth2.Token{AccessToken: response.AccessToken, TokenType: response.TokenType}
+		if response.ExpiresIn > 0 {
+			token.Expiry = time.Now().Add(time.Duration(response.ExpiresIn) * time.Second)
+		}
+		return token, nil
+	}
+
+	if len(output) == 0 {
+		return nil, errors.New("token command printed nothing")
+	}
+	token := &oauth2.Token{AccessToken: string(output)}
+	if s.ttl > 0 {
+		token.Expiry = time.Now().Add(s.ttl)
+	}
+	return token, nil
+}
+
+// sigV4Transport signs every request with AWS Signature Version 4, for
+// endpoints behind API Gateway or other IAM-authorized AWS services.
+type sigV4Transport struct {
+	base     http.RoundTripper
+	creds    awsCredentials
+	region   string
+	service  string
+	unsigned bool
+}
+
+func newSigV4Transport(conf AuthConfig, base http.RoundTripper) (*sigV4Transport, error) {
+	if conf.Service == "" {
+		return nil, errors.New("sigv4 auth needs a service, e.g. execute-api")
+	}
+	creds := awsCredentials{
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.AccessKey == "" || creds.SecretKey == "" {
+		return nil, errors.New("sigv4 auth needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+
+	return &sigV4Transport{
+		base:     base,
+		creds:    creds,
+		region:   firstNonEmpty(conf.Region, os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), "us-east-1"),
+		service:  conf.Service,
+		unsigned: conf.UnsignedPayload,
+	}, nil
+}
+
+func (t *sigV4Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	signed := req.Clone(req.Context())
+
+	payloadHash := emptyPayload
+	switch {
+	case req.Body == nil || req.Body == http.NoBody:
+	case t.unsigned:
+		payloadHash = unsignedPayload
+	default:
+		spooled, hash, err := spoolBody(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		signed.Body, payloadHash = spooled, hash
+	}
+
+	signV4(signed, t.creds, t.region, t.service, payloadHash, time.Now())
+	return t.base.RoundTrip(signed)
+}
+
+// spoolBody copies a request body to a temporary file while hashing it, so a
+// streamed body can be signed without holding it in memory. The returned
+// body removes the file when it is closed.
+func spoolBody(body io.ReadCloser) (io.ReadCloser, string, error) {
+	defer body.Close()
+
+	file, err := os.CreateTemp("", "auto-upload-body-*")
+	if err != nil {
+		return nil, "", err
+	}
+	spooled := spooledBody{file}
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(file, hash), body); err != nil {
+		spooled.Close()
+		return nil, "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		spooled.Close()
+		return nil, "", err
+	}
+
+	return spooled, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+type spooledBody struct {
+	*os.File
+}
+
+func (b spooledBody) Close() error {
+	err := b.File.Close()
+	os.Remove(b.Name())
+	return err
+}
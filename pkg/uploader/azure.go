@@ -0,0 +1,174 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+)
+
+// AzureConfig configures the Azure Blob Storage backend.
+type AzureConfig struct {
+	Account          string   `yaml:"account"`
+	Container        string   `yaml:"container"`
+	Prefix           string   `yaml:"prefix"`
+	AccessTier       string   `yaml:"access_tier"`
+	Endpoint         string   `yaml:"endpoint"`
+	ConnectionString string   `yaml:"connection_string"`
+	AccountKey       string   `yaml:"account_key"`
+	SASToken         string   `yaml:"sas_token"`
+	BlockSize        ByteSize `yaml:"block_size"`
+	Concurrency      int      `yaml:"concurrency"`
+}
+
+// azureBackend uploads files as block blobs with the Azure SDK. Large files
+// are staged in blocks, several at a time, and committed as a block list.
+type azureBackend struct {
+	conf   AzureConfig
+	client *azblob.Client
+}
+
+func newAzureBackend(conf AzureConfig) (*azureBackend, error) {
+	if conf.Container == "" {
+		return nil, errors.New("azure backend needs a container")
+	}
+
+	client, err := azureClient(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &azureBackend{conf: conf, client: client}, nil
+}
+
+// azureClient picks the first available credential: a connection string, an
+// account key, a SAS token, and otherwise the default Azure credential chain
+// (environment, workload or managed identity, Azure CLI).
+func azureClient(conf AzureConfig) (*azblob.Client, error) {
+	options := &azblob.ClientOptions{}
+	options.Transport = &http.Client{Transport: newTransport(), Timeout: cfg.HTTPClient.RequestTimeout}
+
+	if connectionString := firstNonEmpty(conf.ConnectionString, os.Getenv("AZURE_STORAGE_CONNECTION_STRING")); connectionString != "" {
+		return azblob.NewClientFromConnectionString(connectionString, options)
+	}
+
+	account := firstNonEmpty(conf.Account, os.Getenv("AZURE_STORAGE_ACCOUNT"))
+	serviceURL := conf.Endpoint
+	if serviceURL == "" {
+		if account == "" {
+			return nil, errors.New("azure backend needs an account, endpoint or connection string")
+		}
+		serviceURL = "https://" + account + ".blob.core.windows.net/"
+	}
+
+	if key := firstNonEmpty(conf.AccountKey, os.Getenv("AZURE_STORAGE_KEY")); key != "" {
+		cred, err := azblob.NewSharedKeyCredential(account, key)
+		if err != nil {
+			return nil, fmt.Errorf("parsing azure account key: %w", err)
+		}
+		return azblob.NewClientWithSharedKeyCredential(serviceURL, cred, options)
+	}
+
+	if sas := firstNonEmpty(conf.SASToken, os.Getenv("AZURE_STORAGE_SAS_TOKEN")); sas != "" {
+		return azblob.NewClientWithNoCredential(serviceURL+"?"+strings.TrimPrefix(sas, "?"), options)
+	}
+
+	cred, err := azidentity.NewDefaultAzureCredential(&azidentity.DefaultAzureCredentialOptions{ClientOptions: options.ClientOptions})
+	if err != nil {
+		return nil, fmt.Errorf("finding azure credentials: %w", err)
+	}
+	return azblob.NewClient(serviceURL, cred, options)
+}
+
+func (b *azureBackend) upload(job *uploadJob) (*fileRecord, error) {
+	filePath := job.Path
+	file, info, err := openFile(job.context(), filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	prefix, err := renderTemplate(b.conf.Prefix, newFileTemplateData(job, info))
+	if err != nil {
+		return nil, fmt.Errorf("rendering azure prefix: %w", err)
+	}
+	name := strings.TrimPrefix(prefix+job.uploadName(), "/")
+
+	checksum, err := job.checksum()
+	if err != nil {
+		return nil, fmt.Errorf("hashing file: %w", err)
+	}
+
+	contentType := job.contentType()
+
+	options := &azblob.UploadStreamOptions{
+		BlockSize:   int64(b.conf.BlockSize),
+		Concurrency: b.conf.Concurrency,
+		HTTPHeaders: &blob.HTTPHeaders{BlobContentType: to.Ptr(contentType)},
+		Metadata:    make(map[string]*string, len(job.Fields)),
+	}
+	for key, value := range job.Fields {
+		options.Metadata[key] = to.Ptr(fmt.Sprintf("%v", value))
+	}
+	if b.conf.AccessTier != "" {
+		options.AccessTier = to.Ptr(blob.AccessTier(b.conf.AccessTier))
+	}
+
+	if _, err := b.client.UploadStream(job.context(), b.conf.Container, name, file, options); err != nil {
+		var respErr *azcore.ResponseError
+		if errors.As(err, &respErr) {
+			statusErr := &statusError{StatusCode: respErr.StatusCode, Status: fmt.Sprintf("%d %s", respErr.StatusCode, http.StatusText(respErr.StatusCode))}
+			if respErr.RawResponse != nil {
+				statusErr.RetryAfter = retryAfter(respErr.RawResponse)
+			}
+			return nil, fmt.Errorf("%w: %s", statusErr, respErr.ErrorCode)
+		}
+		return nil, retryable(err)
+	}
+
+	rec := newFileRecord(filePath, info, checksum)
+	if blobURL, err := url.Parse(b.client.URL()); err == nil {
+		// Leave out a SAS token
+		blobURL.RawQuery = ""
+		rec.RemoteURL = blobURL.JoinPath(b.conf.Container, name).String()
+	}
+	return rec, nil
+}
+
+// stat reads the size from the properties of the blob at remoteURL.
+func (b *azureBackend) stat(ctx context.Context, remoteURL string) (int64, error) {
+	remote, err := url.Parse(remoteURL)
+	if err != nil {
+		return 0, ErrUnknownRemote
+	}
+	serviceURL, err := url.Parse(b.client.URL())
+	if err != nil || remote.Host != serviceURL.Host {
+		return 0, ErrUnknownRemote
+	}
+	name, ok := strings.CutPrefix(remote.Path, serviceURL.JoinPath(b.conf.Container).Path+"/")
+	if !ok {
+		return 0, ErrUnknownRemote
+	}
+
+	props, err := b.client.ServiceClient().NewContainerClient(b.conf.Container).NewBlobClient(name).GetProperties(ctx, nil)
+	if err != nil {
+		var respErr *azcore.ResponseError
+		if errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound {
+			return 0, ErrRemoteMissing
+		}
+		return 0, err
+	}
+	if props.ContentLength == nil {
+		return -1, nil
+	}
+	return *props.ContentLength, nil
+}
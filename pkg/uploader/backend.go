@@ -0,0 +1,471 @@
+package uploader
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// backend delivers files to an upload destination.
+type backend interface {
+	// upload makes a single attempt at uploading the file and returns the
+	// state record to store on success. Retries are handled by the caller.
+	upload(job *uploadJob) (*fileRecord, error)
+}
+
+// closer is implemented by backends that keep connections open or work in
+// the background, which has to stop when a config reload replaces them.
+type closer interface {
+	close()
+}
+
+// uploadJob is a single file to upload together with the form fields, or
+// object metadata, sent along with it. The fields start out as the body
+// setting of the watched directory and can be extended per file.
+type uploadJob struct {
+	Path   string
+	Dir    *watchDir
+	Fields map[string]interface{}
+
+	// RelPath is the slash-separated path of the file below Dir
+	RelPath string
+
+	// URL is the server URL of Dir, or of the route matching the file,
+	// rendered for this file once expand has run
+	URL string
+
+	// FieldName is the form field that carries the file
+	FieldName string
+
+	// FileName is the name the file is uploaded as, rendered from the
+	// filename setting once expand has run; empty keeps the file's own
+	FileName string
+
+	// ContentType is the MIME type of the file, forced by a route or
+	// detected on first use
+	ContentType string
+
+	// Compress is the compression the file is sent with, if any
+	Compress string
+
+	// Encrypted is the encrypted copy uploaded in place of the file, if
+	// encryption is on
+	Encrypted *encryptedFile
+
+	// tempDirs hold copies made for the upload, such as archives and
+	// encrypted files
+	tempDirs []string
+
+	// Checksum is the SHA-256 of the file content once it has been computed
+	Checksum string
+
+	// SentChecksum is the checksum sent along with the file, if checksum
+	// is set
+	SentChecksum string
+
+	// IdempotencyKey identifies the file to the server across retries and
+	// restarts, if idempotency_header is set
+	IdempotencyKey string
+
+	// Original is the watched file when Path is a copy made by the
+	// pre-upload hook
+	Original string
+
+	// Response is the body of the server's last response, for the hooks
+	Response []byte
+
+	// Target is the additional server the job uploads to, nil for the
+	// server URL of Dir
+	Target *uploadTarget
+
+	// ctx ends once the upload is canceled, times out or is aborted for a
+	// shutdown, see trackUploads
+	ctx context.Context
+
+	// queued and started are when the file was queued, zero if it was not,
+	// and when its upload started, for its trace
+	queued, started time.Time
+	// span is the file's trace, see startTrace
+	span trace.Span
+
+	// claim is the file's claim while it is uploaded, if claims are on
+	claim *fileClaim
+}
+
+// removeTemp deletes the copies made for the upload once the job is done
+// with, and gives up the claim on the file unless the upload completed it.
+func (j *uploadJob) removeTemp() {
+	j.claim.finish(nil)
+	for _, dir := range j.tempDirs {
+		if err := os.RemoveAll(dir); err != nil {
+			logrus.Error("Error removing temporary files:", err)
+		}
+	}
+	j.tempDirs = nil
+}
+
+func newUploadJob(dir *watchDir, filePath string) *uploadJob {
+	relPath, err := filepath.Rel(dir.Path, filePath)
+	if err != nil {
+		relPath = filepath.Base(filePath)
+	}
+	relPath = filepath.ToSlash(relPath)
+
+	job := &uploadJob{Path: filePath, Dir: dir, RelPath: relPath, URL: dir.ServerURL, FieldName: dir.FieldName, FileName: dir.Filename}
+	job.Fields = make(map[string]interface{}, len(dir.Body)+1)
+	for key, value := range dir.Body {
+		job.Fields[key] = value
+	}
+	if route := dir.route(relPath); route != nil {
+		job.URL = firstNonEmpty(route.ServerURL, job.URL)
+		job.FieldName = firstNonEmpty(route.FieldName, job.FieldName)
+		job.FileName = firstNonEmpty(route.Filename, job.FileName)
+		job.ContentType = route.ContentType
+		job.Compress = route.Compress
+		for key, value := range route.Body {
+			job.Fields[key] = value
+		}
+	}
+	if cfg.RelPathField != "" {
+		job.Fields[cfg.RelPathField] = relPath
+	}
+	return job
+}
+
+// uploadName returns the name the file is uploaded as.
+func (j *uploadJob) uploadName() string {
+	return firstNonEmpty(j.FileName, filepath.Base(j.Path))
+}
+
+// checksum returns the SHA-256 of the file, hashing it on first use.
+func (j *uploadJob) checksum() (string, error) {
+	if j.Checksum == "" {
+		checksum, err := hashFile(j.Path)
+		if err != nil {
+			return "", err
+		}
+		j.Checksum = checksum
+	}
+	return j.Checksum, nil
+}
+
+func newBackend(name string) (backend, error) {
+	if len(cfg.Targets) > 0 && name != "http" {
+		return nil, errors.New("targets can only be used with the http backend")
+	}
+	if cfg.Batch.MaxFiles > 1 && (name != "http" || cfg.Protocol != "multipart" || len(cfg.Targets) > 0) {
+		return nil, errors.New("batching only works with multipart uploads to the http backend without targets")
+	}
+	if usesCompression(&cfg) && (name != "http" || cfg.Protocol != "multipart" || cfg.ChunkSize > 0) {
+		return nil, errors.New("compression only works with multipart uploads to the http backend without chunking")
+	}
+	if err := cfg.Checksum.validate(); err != nil {
+		return nil, err
+	}
+	if cfg.Checksum.Algorithm != "" && (name != "http" || cfg.Batch.MaxFiles > 1) {
+		return nil, errors.New("checksums can only be sent by the http backend without batching")
+	}
+	if cfg.IdempotencyHeader != "" && name != "http" {
+		return nil, errors.New("idempotency keys can only be sent by the http backend")
+	}
+	if usesCompression(&cfg) && cfg.Encryption.Algorithm != "" {
+		return nil, errors.New("encrypted files do not compress, turn off compression or encryption")
+	}
+
+	switch name {
+	case "http":
+		b, err := newRegisteredBackend("http")
+		if err != nil {
+			return nil, err
+		}
+		targets, err := newTargets(cfg.Targets)
+		switch {
+		case err != nil:
+			return nil, err
+		case cfg.Failover.Enabled && len(targets) == 0:
+			return nil, errors.New("failover needs at least one target")
+		case cfg.Failover.Enabled:
+			return newFailoverBackend(guardedBackend{b}, targets, cfg.Failover), nil
+		case len(targets) > 0:
+			return mirrorBackend{backend: guardedBackend{b}, targets: targets}, nil
+		default:
+			return guardedBackend{b}, nil
+		}
+	case "s3":
+		return guarded(newS3Backend(cfg.S3))
+	case "sftp":
+		return guarded(newSFTPBackend(cfg.SFTP))
+	case "scp":
+		return guarded(newSCPBackend(cfg.SFTP))
+	case "ftp":
+		return guarded(newFTPBackend(cfg.FTP))
+	case "smb":
+		return guarded(newSMBBackend(cfg.SMB))
+	case "email":
+		return guarded(newEmailBackend(cfg.Email))
+	case "webdav":
+		return guarded(newWebDAVBackend(cfg.WebDAV))
+	case "gcs":
+		return guarded(newGCSBackend(cfg.GCS))
+	case "azure":
+		return guarded(newAzureBackend(cfg.Azure))
+	case "grpc":
+		return guarded(newGRPCBackend(cfg.GRPC))
+	case "websocket":
+		return guarded(newWebSocketBackend(cfg.WebSocket))
+	case "bus":
+		return guarded(newBusBackend(cfg.Bus))
+	case "chat":
+		return guarded(newChatBackend(cfg.Chat))
+	case "drive":
+		return guarded(newDriveBackend(cfg.Drive))
+	default:
+		if conf := cfg.plugin(name); conf != nil {
+			return guarded(newPluginBackend(*conf))
+		}
+		return guarded(newRegisteredBackend(name))
+	}
+}
+
+func init() {
+	RegisterBackend("http", func() Backend { return httpBackend{} })
+}
+
+// httpBackend uploads to a custom HTTP endpoint, as a multipart form or the
+// raw file, with the tus protocol, to a presigned URL the endpoint hands out
+// or as a GraphQL multipart request. Its settings are the top-level ones
+// rather than backend_options.
+type httpBackend struct{}
+
+// httpClient sends the requests of the HTTP backend.
+var httpClient = &http.Client{}
+
+func (httpBackend) Init(func(v interface{}) error) error {
+	switch cfg.Protocol {
+	case "multipart", "raw", "tus":
+	case "graphql":
+		if err := cfg.GraphQL.validate(); err != nil {
+			return err
+		}
+	case "presigned":
+		if err := cfg.Presigned.validate(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown upload protocol: %s", cfg.Protocol)
+	}
+	transport, err := newHTTPTransport()
+	if err != nil {
+		return err
+	}
+	httpClient = &http.Client{Transport: transport, Timeout: cfg.HTTPClient.RequestTimeout}
+	if cfg.Protocol == "presigned" {
+		tlsTransport, err := newTLSTransport()
+		if err != nil {
+			return err
+		}
+		presignedClient = &http.Client{Transport: tracingTransport{userAgentTransport{newDebugTransport(cfg.DebugHTTP, tlsTransport)}}, Timeout: cfg.HTTPClient.RequestTimeout}
+	}
+	return nil
+}
+
+func (httpBackend) Upload(_ context.Context, file *File) (*Result, error) {
+	var rec *fileRecord
+	var err error
+	switch cfg.Protocol {
+	case "raw":
+		rec, err = sendFileRaw(file.job)
+	case "tus":
+		rec, err = sendFileTus(file.job)
+	case "presigned":
+		rec, err = sendFilePresigned(file.job)
+	case "graphql":
+		rec, err = sendFileGraphQL(file.job)
+	default:
+		rec, err = sendFile(file.job)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Result{RemoteURL: rec.RemoteURL, Checksum: rec.SHA256, Response: file.job.Response, record: rec}, nil
+}
+
+// Verify only asks whether the server has the file, as the response URL may
+// point to a page rather than the file itself.
+func (httpBackend) Verify(ctx context.Context, remoteURL string) (int64, error) {
+	if !strings.HasPrefix(remoteURL, "http://") && !strings.HasPrefix(remoteURL, "https://") {
+		return 0, ErrUnknownRemote
+	}
+	return -1, checkRemote(ctx, remoteURL)
+}
+
+func (httpBackend) Close() error {
+	return nil
+}
+
+// newHTTPTransport builds the transport of the HTTP backend from the TLS,
+// proxy and auth settings.
+func newHTTPTransport() (http.RoundTripper, error) {
+	if cfg.TLS.InsecureSkipVerify {
+		logrus.Warn("TLS certificate verification is disabled for uploads: anyone on the network path can intercept or alter them. Use -tls-ca to trust a private CA instead.")
+	}
+	transport, err := newTLSTransport()
+	if err != nil {
+		return nil, err
+	}
+	conf := cfg.HTTPClient
+	protocols := 0
+	for _, set := range []bool{conf.ForceHTTP1, conf.ForceHTTP2, conf.HTTP3} {
+		if set {
+			protocols++
+		}
+	}
+	var base http.RoundTripper = transport
+	switch {
+	case protocols > 1:
+		return nil, errors.New("only one of force_http1, force_http2 and http3 can be set")
+	case conf.ForceHTTP2:
+		base = newHTTP2Transport(transport)
+	case conf.HTTP3:
+		base = newHTTP3Transport(transport)
+	}
+	authed, err := authTransport(cfg.Auth, newDebugTransport(cfg.DebugHTTP, base))
+	if err != nil {
+		return nil, err
+	}
+	return tracingTransport{userAgentTransport{authed}}, nil
+}
+
+// newTLSTransport builds a transport with the TLS and proxy settings of the
+// HTTP backend, but without its auth.
+func newTLSTransport() (*http.Transport, error) {
+	tlsConfig, err := tlsClientConfig(cfg.TLS.CAFile, cfg.TLS.InsecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.TLS.CertFile != "" || cfg.TLS.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLS.CertFile, firstNonEmpty(cfg.TLS.KeyFile, cfg.TLS.CertFile))
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := newTransport()
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
+
+// HTTPClientConfig holds the timeouts and connection pool settings of the
+// HTTP based backends, so a server that stops answering fails the upload
+// instead of stalling the uploader forever. A zero timeout waits forever.
+type HTTPClientConfig struct {
+	ConnectTimeout        time.Duration `yaml:"connect_timeout"`
+	TLSHandshakeTimeout   time.Duration `yaml:"tls_handshake_timeout"`
+	ResponseHeaderTimeout time.Duration `yaml:"response_header_timeout"`
+	// RequestTimeout limits a whole request, including the upload of the
+	// body, so it has to allow for the largest file at the slowest rate
+	RequestTimeout time.Duration `yaml:"request_timeout"`
+	// KeepAlive is how long idle connections are kept for reuse, 0 closes
+	// them after every request
+	KeepAlive           time.Duration `yaml:"keep_alive"`
+	MaxIdleConnsPerHost int           `yaml:"max_idle_conns_per_host"`
+	// ForceHTTP1 turns HTTP/2 off, for servers that get it wrong
+	ForceHTTP1 bool `yaml:"force_http1"`
+	// ForceHTTP2 requires HTTP/2 from the upload server, with cleartext
+	// HTTP/2 for http:// URLs
+	ForceHTTP2 bool `yaml:"force_http2"`
+	// HTTP3 uploads to https:// URLs of the upload server over QUIC
+	HTTP3 bool `yaml:"http3"`
+	// UserAgent is sent with every request, unless the headers set one
+	UserAgent string `yaml:"user_agent"`
+}
+
+// newTransport returns a copy of the default HTTP transport that connects
+// through the configured proxies with the configured timeouts. It uses
+// HTTP/2 with servers that offer it, unless HTTP/1 is forced, and keeps
+// enough connections idle for the chunks sent in parallel.
+func newTransport() *http.Transport {
+	conf := cfg.HTTPClient
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = func(req *http.Request) (*url.URL, error) {
+		return proxyFor(req.URL)
+	}
+	transport.DialContext = (&net.Dialer{Timeout: conf.ConnectTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = conf.TLSHandshakeTimeout
+	transport.ResponseHeaderTimeout = conf.ResponseHeaderTimeout
+	transport.IdleConnTimeout = conf.KeepAlive
+	transport.DisableKeepAlives = conf.KeepAlive <= 0
+	transport.MaxIdleConnsPerHost = max(conf.MaxIdleConnsPerHost, cfg.ChunkParallelism)
+	if conf.ForceHTTP1 {
+		// A non-nil empty map keeps HTTP/2 from being set up
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return transport
+}
+
+// openFile opens a file for upload together with its current info. Reads of
+// it fail once ctx ends, which aborts the upload whatever the backend.
+func openFile(ctx context.Context, filePath string) (*sourceFile, os.FileInfo, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening file: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("reading file info: %w", err)
+	}
+
+	return newSourceFile(ctx, file, info.Size()), info, nil
+}
+
+// TLSConfig holds the TLS settings of the HTTP backend: a client certificate
+// for mutual TLS and the CAs trusted for the server.
+type TLSConfig struct {
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	CAFile             string `yaml:"ca_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// tlsClientConfig returns TLS settings that trust the certificates in caFile
+// in addition to the system roots, for servers with a private or self-signed
+// certificate. Verification can be switched off entirely with insecure.
+func tlsClientConfig(caFile string, insecure bool) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: insecure}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading ca file: %w", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+
+	return config, nil
+}
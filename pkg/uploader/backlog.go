@@ -0,0 +1,112 @@
+package uploader
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	backlogOldestFirst = "oldest-first"
+	backlogNewestFirst = "newest-first"
+)
+
+var (
+	leftBacklogMu sync.Mutex
+	// leftBacklog are the files the initial scan left for the next start,
+	// with their modification time then
+	leftBacklog = make(map[string]time.Time)
+)
+
+// backlogFile is a file found by the initial scan that is not uploaded yet.
+type backlogFile struct {
+	dir     *watchDir
+	path    string
+	modTime time.Time
+}
+
+func validateBacklog(c *Config) error {
+	switch c.BacklogOrder {
+	case "", backlogOldestFirst, backlogNewestFirst:
+	default:
+		return fmt.Errorf("unknown backlog order: %s (use oldest-first or newest-first)", c.BacklogOrder)
+	}
+	if c.BacklogLimit < 0 {
+		return fmt.Errorf("backlog limit %d is negative", c.BacklogLimit)
+	}
+	return nil
+}
+
+// scanBacklog queues the files that are already in the watched directories
+// when watching starts. With skip_existing none of them are uploaded, and
+// with backlog_limit only that many, taken in backlog_order; the others are
+// left alone until the next start, unless they change.
+func scanBacklog(dirs []*watchDir) {
+	defer watchStarted.Store(true)
+	if !cfg.SkipExisting && cfg.BacklogOrder == "" && cfg.BacklogLimit == 0 {
+		for _, dir := range dirs {
+			watchForNewFiles(dir)
+		}
+		return
+	}
+
+	var files []backlogFile
+	for _, dir := range dirs {
+		walkDir(dir, func(path string, info os.FileInfo) {
+			if relPath, err := filepath.Rel(dir.Path, path); err == nil && (!dir.filter.allows(relPath) || isSkippedName(relPath)) || isLeftBacklog(path, info) {
+				return
+			}
+			// Files that are uploaded already do not count towards the limit
+			if needsUpload(path) {
+				files = append(files, backlogFile{dir: dir, path: path, modTime: info.ModTime()})
+			}
+		})
+	}
+
+	switch cfg.BacklogOrder {
+	case backlogOldestFirst:
+		sort.SliceStable(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	case backlogNewestFirst:
+		sort.SliceStable(files, func(i, j int) bool { return files[i].modTime.After(files[j].modTime) })
+	}
+
+	queued := len(files)
+	if cfg.SkipExisting {
+		queued = 0
+	} else if cfg.BacklogLimit > 0 {
+		queued = min(queued, cfg.BacklogLimit)
+	}
+	for _, file := range files[:queued] {
+		queue.add(file.dir, file.path)
+	}
+
+	leftBacklogMu.Lock()
+	for _, file := range files[queued:] {
+		leftBacklog[file.path] = file.modTime
+	}
+	leftBacklogMu.Unlock()
+	if left := len(files) - queued; left > 0 {
+		logrus.Infof("Leaving %d files of the backlog for the next start, uploading %d", left, queued)
+	}
+}
+
+// isLeftBacklog reports whether the initial scan left the file at path for
+// the next start and it has not changed since.
+func isLeftBacklog(path string, info os.FileInfo) bool {
+	leftBacklogMu.Lock()
+	defer leftBacklogMu.Unlock()
+	modTime, ok := leftBacklog[path]
+	if !ok {
+		return false
+	}
+	if !info.ModTime().Equal(modTime) {
+		delete(leftBacklog, path)
+		return false
+	}
+	return true
+}
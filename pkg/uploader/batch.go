@@ -0,0 +1,177 @@
+package uploader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// BatchConfig bundles several files into one multipart request for servers
+// that accept multi-file uploads, which saves a request per file. Batching is
+// on when MaxFiles is above 1.
+type BatchConfig struct {
+	MaxFiles int `yaml:"max_files"`
+	// MaxSize limits the combined size of the files in a request, 0 is no
+	// limit; a larger file is sent in a batch of its own
+	MaxSize ByteSize `yaml:"max_size"`
+	// FieldName is the form field of every file part
+	FieldName string `yaml:"field_name"`
+}
+
+// The batch being collected, and the errors of the batched uploads that
+// failed since the last flushBatch.
+var (
+	batchMu     sync.Mutex
+	batchJobs   []*uploadJob
+	batchSize   int64
+	batchErrors []error
+)
+
+// addToBatch adds a job to the batch, sending the batch first if the job does
+// not fit in, and right away once it is full. Jobs only share a batch if they
+// come from the same directory and go to the same URL; the request carries the
+// form fields of the first one.
+func addToBatch(job *uploadJob, size int64) {
+	batchMu.Lock()
+	defer batchMu.Unlock()
+
+	limit := int64(cfg.Batch.MaxSize)
+	if len(batchJobs) > 0 {
+		first := batchJobs[0]
+		if first.Dir != job.Dir || first.URL != job.URL || limit > 0 && batchSize+size > limit {
+			sendBatch()
+		}
+	}
+
+	batchJobs = append(batchJobs, job)
+	batchSize += size
+	if len(batchJobs) >= cfg.Batch.MaxFiles || limit > 0 && batchSize >= limit {
+		sendBatch()
+	}
+}
+
+// flushBatch sends the files collected so far. The watch loop calls it after
+// every scan, so files do not wait for a batch to fill up. It returns the
+// errors of the batched uploads that failed since the last call, and
+// errShutdown for each file left for the next run by a shutdown.
+func flushBatch() []error {
+	batchMu.Lock()
+	defer batchMu.Unlock()
+
+	if len(batchJobs) > 0 {
+		// Leave the files for the next run once shutting down
+		if !beginUpload() {
+			errs := make([]error, len(batchJobs))
+			for i, job := range batchJobs {
+				job.removeTemp()
+				job.endTrace(errShutdown)
+				errs[i] = errShutdown
+			}
+			batchJobs, batchSize = nil, 0
+			return errs
+		}
+		configMu.RLock()
+		sendBatch()
+		configMu.RUnlock()
+		endUpload()
+	}
+
+	errs := batchErrors
+	batchErrors = nil
+	return errs
+}
+
+// sendBatch uploads the batch and completes every file in it. batchMu must be
+// held.
+func sendBatch() {
+	jobs := batchJobs
+	batchJobs, batchSize = nil, 0
+
+	var recs []*fileRecord
+	links := make([]trace.Link, len(jobs))
+	for i, job := range jobs {
+		links[i] = trace.LinkFromContext(job.context())
+	}
+	ctx, span := tracer.Start(uploadsCtx, "batch", trace.WithLinks(links...), trace.WithAttributes(attribute.Int("batch.files", len(jobs))))
+	done := trackUploads(ctx, jobs...)
+	err := withRetry(jobs[0].context(), fmt.Sprintf("a batch of %d files", len(jobs)), func() error {
+		if err := uploadRate.wait(jobs[0].context(), jobs[0].URL); err != nil {
+			return err
+		}
+		if err := uploadBreaker.allow(jobs[0].URL); err != nil {
+			return err
+		}
+		var err error
+		recs, err = sendFiles(jobs)
+		uploadRate.pause(retryAfterOf(err))
+		uploadBreaker.record(jobs[0].URL, err)
+		return err
+	})
+	done()
+	endSpan(span, err)
+
+	for i, job := range jobs {
+		var rec *fileRecord
+		if err == nil {
+			rec = recs[i]
+		}
+		if err := completeUpload(job, rec, err); err != nil {
+			batchErrors = append(batchErrors, fmt.Errorf("%s: %w", firstNonEmpty(job.Original, job.Path), err))
+		}
+	}
+}
+
+// sendFiles performs a single attempt at uploading the files of the jobs in
+// one multipart request and returns their state records on success.
+func sendFiles(jobs []*uploadJob) ([]*fileRecord, error) {
+	form := newMultipartBody("", "", "", jobs[0].Fields)
+	contents := make([]io.Reader, len(jobs))
+	hashes := make([]hash.Hash, len(jobs))
+	infos := make([]os.FileInfo, len(jobs))
+	compressed := make([]*compressReader, len(jobs))
+	var total int64
+
+	for i, job := range jobs {
+		file, info, err := openFile(job.context(), job.Path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		hashes[i] = sha256.New()
+		content, size, cr, err := job.addFilePart(form, cfg.Batch.FieldName, io.TeeReader(file, hashes[i]), info.Size())
+		if err != nil {
+			return nil, err
+		}
+		contents[i], infos[i], compressed[i] = content, info, cr
+		if size < 0 || total < 0 {
+			total = -1
+		} else {
+			total += size
+		}
+	}
+
+	batchJob := *jobs[0]
+	batchJob.IdempotencyKey = batchIdempotencyKey(jobs)
+	body, err := postForm(&batchJob, jobs[0].URL, form, contents, total)
+	for _, job := range jobs {
+		job.Response = body
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	recs := make([]*fileRecord, len(jobs))
+	for i, job := range jobs {
+		recs[i] = newFileRecord(job.Path, infos[i], hex.EncodeToString(hashes[i].Sum(nil)))
+		compressed[i].annotate(recs[i])
+	}
+	return recs, nil
+}
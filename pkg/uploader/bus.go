@@ -0,0 +1,341 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	busNATS  = "nats"
+	busKafka = "kafka"
+)
+
+// BusConfig connects to a message bus for event-driven processing of the
+// uploads: an event is published for each upload, like to a webhook, and
+// backend: bus publishes small files themselves as messages. Kafka is only
+// reached through a REST proxy that speaks the v2 API of the Confluent REST
+// Proxy, such as Redpanda's HTTP proxy; there is no Kafka client to talk to
+// the brokers.
+type BusConfig struct {
+	// Kind is nats or kafka
+	Kind string `yaml:"kind"`
+	// URL is the NATS server, e.g. nats://localhost:4222, or the Kafka REST
+	// proxy, e.g. http://localhost:8082
+	URL string `yaml:"url"`
+	// User and Password log in to either; Token and CredsFile to NATS only.
+	// The password can also come from BUS_PASSWORD and the token from
+	// BUS_TOKEN.
+	User      string `yaml:"user"`
+	Password  string `yaml:"password"`
+	Token     string `yaml:"token"`
+	CredsFile string `yaml:"creds_file"`
+	CAFile    string `yaml:"ca_file"`
+
+	// EventsTopic is the subject or topic upload events are published to;
+	// empty publishes none
+	EventsTopic string `yaml:"events_topic"`
+	// Events limits the events published like for webhooks; empty means
+	// all of them
+	Events []string `yaml:"events"`
+	// FilesTopic is the subject or topic backend: bus publishes files to
+	FilesTopic string `yaml:"files_topic"`
+	// MaxFileSize is the largest file backend: bus publishes; NATS servers
+	// take 1MB messages by default
+	MaxFileSize ByteSize      `yaml:"max_file_size"`
+	Timeout     time.Duration `yaml:"timeout"`
+}
+
+// busPublisher publishes messages to a NATS subject or a Kafka topic. The
+// key is used by Kafka to pick the partition, and the headers are sent with
+// NATS messages only, as the REST proxy cannot pass them.
+type busPublisher interface {
+	publish(ctx context.Context, topic, key string, headers map[string]string, value []byte) error
+	close()
+}
+
+// busEvents publishes the upload events, if an events topic is configured.
+var busEvents *eventBus
+
+type eventBus struct {
+	conf      BusConfig
+	events    map[string]bool
+	publisher busPublisher
+}
+
+func newEventBus(conf BusConfig) (*eventBus, error) {
+	if conf.EventsTopic == "" {
+		return nil, nil
+	}
+	bus := &eventBus{conf: conf}
+	for _, event := range conf.Events {
+		switch event {
+		case eventSuccess, eventFailure, eventRetryExhausted, eventRejected:
+		default:
+			return nil, fmt.Errorf("unknown bus event: %s", event)
+		}
+		if bus.events == nil {
+			bus.events = make(map[string]bool)
+		}
+		bus.events[event] = true
+	}
+	publisher, err := newBusPublisher(conf)
+	if err != nil {
+		return nil, err
+	}
+	bus.publisher = publisher
+	return bus, nil
+}
+
+func (b *eventBus) close() {
+	if b != nil {
+		b.publisher.close()
+	}
+}
+
+// notifyBus publishes the outcome of an upload to the events topic. Failures
+// to publish are logged and otherwise ignored.
+func notifyBus(job *uploadJob, rec *fileRecord, uploadErr error) {
+	if busEvents == nil {
+		return
+	}
+	event := newUploadEvent(job, rec, uploadErr)
+	if busEvents.events != nil && !busEvents.events[event.Event] {
+		return
+	}
+	value, err := json.Marshal(event)
+	if err == nil {
+		err = busEvents.publisher.publish(uploadsCtx, busEvents.conf.EventsTopic, event.RelPath, map[string]string{"Content-Type": "application/json"}, value)
+	}
+	if err != nil {
+		logrus.Errorf("Publishing the %s event of %s to %s failed: %v", event.Event, event.File, busEvents.conf.EventsTopic, err)
+	}
+}
+
+func newBusPublisher(conf BusConfig) (busPublisher, error) {
+	if conf.URL == "" {
+		return nil, errors.New("the message bus needs a url")
+	}
+	if conf.Timeout <= 0 {
+		conf.Timeout = 30 * time.Second
+	}
+	conf.Password = firstNonEmpty(conf.Password, os.Getenv("BUS_PASSWORD"))
+	conf.Token = firstNonEmpty(conf.Token, os.Getenv("BUS_TOKEN"))
+
+	switch conf.Kind {
+	case busNATS:
+		return newNATSPublisher(conf)
+	case busKafka:
+		return newKafkaPublisher(conf)
+	default:
+		return nil, fmt.Errorf("unknown message bus: %s (use nats or kafka)", conf.Kind)
+	}
+}
+
+// natsPublisher publishes to NATS. The connection reconnects by itself, and
+// every message is flushed so a publish only succeeds once the server has it.
+type natsPublisher struct {
+	conn    *nats.Conn
+	timeout time.Duration
+}
+
+// natsDialer connects to NATS servers through the configured proxies.
+type natsDialer struct{}
+
+func (natsDialer) Dial(_, addr string) (net.Conn, error) {
+	return dialThroughProxy("nats", addr, cfg.HTTPClient.ConnectTimeout)
+}
+
+func newNATSPublisher(conf BusConfig) (*natsPublisher, error) {
+	options := []nats.Option{
+		nats.Name("auto-upload"),
+		nats.Timeout(conf.Timeout),
+		nats.SetCustomDialer(natsDialer{}),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+	}
+	if conf.User != "" {
+		options = append(options, nats.UserInfo(conf.User, conf.Password))
+	}
+	if conf.Token != "" {
+		options = append(options, nats.Token(conf.Token))
+	}
+	if conf.CredsFile != "" {
+		options = append(options, nats.UserCredentials(conf.CredsFile))
+	}
+	if conf.CAFile != "" {
+		options = append(options, nats.RootCAs(conf.CAFile))
+	}
+
+	conn, err := nats.Connect(conf.URL, options...)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %s: %w", conf.URL, err)
+	}
+	return &natsPublisher{conn: conn, timeout: conf.Timeout}, nil
+}
+
+func (p *natsPublisher) publish(_ context.Context, topic, _ string, headers map[string]string, value []byte) error {
+	msg := nats.NewMsg(topic)
+	msg.Data = value
+	for key, value := range headers {
+		msg.Header.Set(key, value)
+	}
+	if err := p.conn.PublishMsg(msg); err != nil {
+		return retryable(err)
+	}
+	if err := p.conn.FlushTimeout(p.timeout); err != nil {
+		return retryable(err)
+	}
+	return nil
+}
+
+// close sends what is still buffered, e.g. after a flush that timed out,
+// before it disconnects.
+func (p *natsPublisher) close() {
+	if err := p.conn.FlushTimeout(p.timeout); err != nil {
+		logrus.Warn("Error flushing the NATS connection: ", err)
+	}
+	p.conn.Close()
+}
+
+// kafkaPublisher produces Kafka records through the v2 API of a REST proxy.
+type kafkaPublisher struct {
+	conf   BusConfig
+	client *http.Client
+}
+
+func newKafkaPublisher(conf BusConfig) (*kafkaPublisher, error) {
+	transport := newTransport()
+	tlsConfig, err := tlsClientConfig(conf.CAFile, false)
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+	return &kafkaPublisher{conf: conf, client: &http.Client{Transport: transport, Timeout: conf.Timeout}}, nil
+}
+
+func (p *kafkaPublisher) publish(ctx context.Context, topic, key string, _ map[string]string, value []byte) error {
+	record := map[string]string{"value": base64.StdEncoding.EncodeToString(value)}
+	if key != "" {
+		record["key"] = base64.StdEncoding.EncodeToString([]byte(key))
+	}
+	body, err := json.Marshal(map[string]interface{}{"records": []interface{}{record}})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(p.conf.URL, "/")+"/topics/"+url.PathEscape(topic), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.binary.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	if p.conf.User != "" {
+		req.SetBasicAuth(p.conf.User, p.conf.Password)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return newStatusError(resp)
+	}
+
+	// The proxy answers 200 even when the record was refused, with an error
+	// for it among the offsets
+	var result struct {
+		Offsets []struct {
+			ErrorCode *int   `json:"error_code"`
+			Error     string `json:"error"`
+		} `json:"offsets"`
+	}
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return fmt.Errorf("reading the proxy's response: %w", err)
+	}
+	for _, offset := range result.Offsets {
+		if offset.ErrorCode != nil {
+			return retryable(fmt.Errorf("kafka error %d: %s", *offset.ErrorCode, offset.Error))
+		}
+	}
+	return nil
+}
+
+func (p *kafkaPublisher) close() {
+	p.client.CloseIdleConnections()
+}
+
+// busBackend publishes each file as a single message to the files topic,
+// for small files that downstream consumers take straight off the bus.
+type busBackend struct {
+	conf      BusConfig
+	publisher busPublisher
+}
+
+func newBusBackend(conf BusConfig) (*busBackend, error) {
+	if conf.FilesTopic == "" {
+		return nil, errors.New("bus backend needs a files topic")
+	}
+	publisher, err := newBusPublisher(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &busBackend{conf: conf, publisher: publisher}, nil
+}
+
+func (b *busBackend) close() {
+	b.publisher.close()
+}
+
+func (b *busBackend) upload(job *uploadJob) (*fileRecord, error) {
+	filePath := job.Path
+	file, info, err := openFile(job.context(), filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if b.conf.MaxFileSize > 0 && info.Size() > int64(b.conf.MaxFileSize) {
+		return nil, fmt.Errorf("the file has %d bytes, bus messages are limited to %d by max_file_size", info.Size(), b.conf.MaxFileSize)
+	}
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading file: %w", err)
+	}
+	hash := sha256.Sum256(content)
+	checksum := hex.EncodeToString(hash[:])
+
+	headers := map[string]string{
+		"Filename":     job.uploadName(),
+		"Rel-Path":     job.RelPath,
+		"Content-Type": job.contentType(),
+		"Sha256":       checksum,
+	}
+	for key, value := range job.Fields {
+		headers[key] = fmt.Sprintf("%v", value)
+	}
+	if err := b.publisher.publish(job.context(), b.conf.FilesTopic, job.RelPath, headers, content); err != nil {
+		return nil, err
+	}
+	return newFileRecord(filePath, info, checksum), nil
+}
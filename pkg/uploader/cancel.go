@@ -0,0 +1,118 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// errShutdown is why uploads still running when a shutdown runs out of
+	// time are aborted
+	errShutdown = errors.New("interrupted by shutdown")
+	// errCanceled is why an upload canceled through the admin API stopped
+	errCanceled = errors.New("canceled by an operator")
+)
+
+var (
+	// uploadsCtx is the context every upload runs in. It is canceled when
+	// the running uploads are aborted for a shutdown.
+	uploadsCtx, abortUploads = context.WithCancelCause(context.Background())
+
+	runningMu sync.Mutex
+	// running holds the cancel functions of the uploads in progress, by
+	// the path of their watched file
+	running = make(map[string]context.CancelCauseFunc)
+)
+
+// abortTimeout is how long aborted uploads get to stop and save their
+// progress before the state database is closed.
+const abortTimeout = 5 * time.Second
+
+// abortRunning aborts the running uploads for a shutdown and waits up to
+// abortTimeout for done, closed once they have stopped.
+func abortRunning(done <-chan struct{}) {
+	abortUploads(errShutdown)
+	select {
+	case <-done:
+	case <-time.After(abortTimeout):
+		logrus.Warn("Aborted uploads did not stop in time")
+	}
+}
+
+// resetUploadsContext gives the uploads a fresh context, for an uploader
+// that is opened again after a shutdown.
+func resetUploadsContext() {
+	uploadsCtx, abortUploads = context.WithCancelCause(context.Background())
+}
+
+// context returns the context of the job's upload, which ends once the
+// upload is canceled, times out or a shutdown aborts it.
+func (j *uploadJob) context() context.Context {
+	if j.ctx != nil {
+		return j.ctx
+	}
+	return uploadsCtx
+}
+
+// trackUploads gives jobs, which are uploaded together, a context below
+// parent that the admin API can cancel and that ends after
+// cfg.UploadTimeout. The returned function must be called once the upload is
+// over.
+func trackUploads(parent context.Context, jobs ...*uploadJob) func() {
+	ctx, cancel := context.WithCancelCause(parent)
+	if len(jobs) == 1 {
+		ctx = context.WithValue(ctx, uploadPathKey{}, firstNonEmpty(jobs[0].Original, jobs[0].Path))
+	}
+	stopTimeout := context.CancelFunc(func() {})
+	if cfg.UploadTimeout > 0 {
+		ctx, stopTimeout = context.WithTimeoutCause(ctx, cfg.UploadTimeout, fmt.Errorf("timed out after %s", cfg.UploadTimeout))
+	}
+
+	runningMu.Lock()
+	for _, job := range jobs {
+		job.ctx = ctx
+		running[job.Path] = cancel
+		if job.Original != "" {
+			running[job.Original] = cancel
+		}
+	}
+	runningMu.Unlock()
+
+	return func() {
+		stopTimeout()
+		runningMu.Lock()
+		for _, job := range jobs {
+			delete(running, job.Path)
+			delete(running, job.Original)
+		}
+		runningMu.Unlock()
+		cancel(nil)
+	}
+}
+
+// cancelUpload cancels the running upload of the file at path, the watched
+// file or the copy being sent for it. It reports whether there was one.
+func cancelUpload(path string) bool {
+	runningMu.Lock()
+	cancel, ok := running[path]
+	runningMu.Unlock()
+	if ok {
+		cancel(errCanceled)
+	}
+	return ok
+}
+
+// uploadErr returns the reason ctx ended for an error an upload failed with
+// after it did, as the error itself is often only a broken read or
+// connection.
+func uploadErr(ctx context.Context, err error) error {
+	if ctx.Err() == nil {
+		return err
+	}
+	return context.Cause(ctx)
+}
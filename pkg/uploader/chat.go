@@ -0,0 +1,390 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	chatTelegram = "telegram"
+	chatSlack    = "slack"
+	chatDiscord  = "discord"
+)
+
+// ChatConfig configures the chat backend, which posts files to a Telegram
+// chat, a Slack channel or a Discord channel, e.g. camera snapshots or
+// reports for a team.
+type ChatConfig struct {
+	// Kind is telegram, slack or discord
+	Kind string `yaml:"kind"`
+	// Token is the Telegram bot token or the Slack bot token (xoxb-...) and
+	// can also come from CHAT_TOKEN. Discord needs none, its webhook URLs
+	// carry their own.
+	Token string `yaml:"token"`
+	// Channel is where files go unless a rule in Channels says otherwise: a
+	// Telegram chat id or @channel, a Slack channel id or a Discord webhook
+	// URL
+	Channel string `yaml:"channel"`
+	// Caption is a template for the message posted with each file, with the
+	// same fields as remote directories
+	Caption string `yaml:"caption"`
+	// Channels send the files matching their patterns elsewhere; the first
+	// matching rule wins
+	Channels []ChatChannelConfig `yaml:"channels"`
+	// MaxFileSize is the largest file posted, by default what the service
+	// takes: 50MB for Telegram bots, 10MB for Discord webhooks and 1GB for
+	// Slack
+	MaxFileSize ByteSize `yaml:"max_file_size"`
+	// APIURL replaces https://api.telegram.org or https://slack.com/api, e.g.
+	// for a local Telegram Bot API server
+	APIURL string `yaml:"api_url"`
+}
+
+// ChatChannelConfig routes the files matching one of its patterns to their
+// own channel, with their own caption if one is set.
+type ChatChannelConfig struct {
+	Match   []string `yaml:"match"`
+	Channel string   `yaml:"channel"`
+	Caption string   `yaml:"caption"`
+}
+
+// chatBackend posts each file as a message with an attachment. Slack's
+// files.upload method has been retired, so files go through
+// files.getUploadURLExternal and files.completeUploadExternal instead.
+type chatBackend struct {
+	conf   ChatConfig
+	client *http.Client
+}
+
+func newChatBackend(conf ChatConfig) (*chatBackend, error) {
+	conf.Token = firstNonEmpty(conf.Token, os.Getenv("CHAT_TOKEN"))
+	var maxFileSize ByteSize
+	switch conf.Kind {
+	case chatTelegram:
+		conf.APIURL = firstNonEmpty(conf.APIURL, "https://api.telegram.org")
+		maxFileSize = 50 << 20
+	case chatSlack:
+		conf.APIURL = firstNonEmpty(conf.APIURL, "https://slack.com/api")
+		maxFileSize = 1 << 30
+	case chatDiscord:
+		maxFileSize = 10 << 20
+	default:
+		return nil, fmt.Errorf("unknown chat service: %s (use telegram, slack or discord)", conf.Kind)
+	}
+	if conf.Token == "" && conf.Kind != chatDiscord {
+		return nil, fmt.Errorf("the %s chat backend needs a bot token", conf.Kind)
+	}
+	conf.APIURL = strings.TrimSuffix(conf.APIURL, "/")
+	if conf.MaxFileSize == 0 {
+		conf.MaxFileSize = maxFileSize
+	}
+
+	if conf.Channel == "" && len(conf.Channels) == 0 {
+		return nil, errors.New("chat backend needs a channel")
+	}
+	for _, rule := range conf.Channels {
+		if len(rule.Match) == 0 || rule.Channel == "" {
+			return nil, errors.New("chat channel rules need match patterns and a channel")
+		}
+	}
+
+	return &chatBackend{
+		conf:   conf,
+		client: &http.Client{Transport: userAgentTransport{newTransport()}, Timeout: cfg.HTTPClient.RequestTimeout},
+	}, nil
+}
+
+// channel returns the channel and caption template for the file at relPath,
+// or an empty channel if no rule matches it and there is no default.
+func (b *chatBackend) channel(relPath string) (string, string) {
+	for _, rule := range b.conf.Channels {
+		if matchAny(rule.Match, relPath) {
+			return rule.Channel, firstNonEmpty(rule.Caption, b.conf.Caption)
+		}
+	}
+	return b.conf.Channel, b.conf.Caption
+}
+
+func (b *chatBackend) upload(job *uploadJob) (*fileRecord, error) {
+	filePath := job.Path
+	file, info, err := openFile(job.context(), filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	channel, caption := b.channel(job.RelPath)
+	if channel == "" {
+		return nil, fmt.Errorf("no chat channel for %s", job.RelPath)
+	}
+	if b.conf.MaxFileSize > 0 && info.Size() > int64(b.conf.MaxFileSize) {
+		return nil, fmt.Errorf("the file has %d bytes, %s takes at most %d", info.Size(), b.conf.Kind, b.conf.MaxFileSize)
+	}
+	caption, err = renderTemplate(caption, newFileTemplateData(job, info))
+	if err != nil {
+		return nil, fmt.Errorf("rendering caption: %w", err)
+	}
+
+	hash := sha256.New()
+	content := io.TeeReader(file, hash)
+	var remoteURL string
+	switch b.conf.Kind {
+	case chatTelegram:
+		remoteURL, err = b.sendTelegram(job, channel, caption, content, info.Size())
+	case chatSlack:
+		remoteURL, err = b.sendSlack(job, channel, caption, content, info.Size())
+	case chatDiscord:
+		remoteURL, err = b.sendDiscord(job, channel, caption, content, info.Size())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rec := newFileRecord(filePath, info, hex.EncodeToString(hash.Sum(nil)))
+	rec.RemoteURL = remoteURL
+	return rec, nil
+}
+
+// sendTelegram sends the file as a document, which keeps photos in their
+// original quality.
+func (b *chatBackend) sendTelegram(job *uploadJob, chatID, caption string, content io.Reader, size int64) (string, error) {
+	form := newMultipartBody("", "", "", nil)
+	form.addLeadingField("chat_id", chatID)
+	if caption != "" {
+		form.addLeadingField("caption", caption)
+	}
+	form.addFile("document", job.uploadName(), job.contentType(), "")
+
+	var result struct {
+		OK          bool   `json:"ok"`
+		ErrorCode   int    `json:"error_code"`
+		Description string `json:"description"`
+		Parameters  struct {
+			RetryAfter int `json:"retry_after"`
+		} `json:"parameters"`
+		Result struct {
+			MessageID int64 `json:"message_id"`
+			Chat      struct {
+				Username string `json:"username"`
+			} `json:"chat"`
+		} `json:"result"`
+	}
+	// Telegram explains failures in the body, including how long to wait
+	// when sending too fast
+	status, err := b.postFile(job.context(), b.conf.APIURL+"/bot"+b.conf.Token+"/sendDocument", form, content, size, &result)
+	if err != nil {
+		return "", err
+	}
+	if !result.OK {
+		if result.ErrorCode == 0 {
+			result.ErrorCode = status
+		}
+		return "", &statusError{
+			StatusCode: result.ErrorCode,
+			Status:     result.Description,
+			RetryAfter: time.Duration(result.Parameters.RetryAfter) * time.Second,
+		}
+	}
+	if result.Result.Chat.Username == "" {
+		// Private chats and groups have no public links
+		return "", nil
+	}
+	return "https://t.me/" + result.Result.Chat.Username + "/" + strconv.FormatInt(result.Result.MessageID, 10), nil
+}
+
+// sendDiscord posts the file to a channel webhook.
+func (b *chatBackend) sendDiscord(job *uploadJob, webhookURL, caption string, content io.Reader, size int64) (string, error) {
+	payload, err := json.Marshal(map[string]string{"content": caption})
+	if err != nil {
+		return "", err
+	}
+	form := newMultipartBody("", "", "", nil)
+	form.addLeadingField("payload_json", string(payload))
+	form.addFile("files[0]", job.uploadName(), job.contentType(), "")
+
+	var result struct {
+		Message     string `json:"message"`
+		Attachments []struct {
+			URL string `json:"url"`
+		} `json:"attachments"`
+	}
+	// wait=true makes Discord answer with the message it created
+	target := webhookURL + "?wait=true"
+	if strings.Contains(webhookURL, "?") {
+		target = webhookURL + "&wait=true"
+	}
+	status, err := b.postFile(job.context(), target, form, content, size, &result)
+	if err != nil {
+		return "", err
+	}
+	if status < 200 || status > 299 {
+		return "", &statusError{StatusCode: status, Status: firstNonEmpty(result.Message, http.StatusText(status))}
+	}
+	if len(result.Attachments) == 0 {
+		return "", nil
+	}
+	return result.Attachments[0].URL, nil
+}
+
+// slackResponse is the envelope of every Slack API answer. Slack answers 200
+// to failed calls too, with ok false and an error code.
+type slackResponse struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error"`
+}
+
+func (r slackResponse) err(method string) error {
+	if r.OK {
+		return nil
+	}
+	return fmt.Errorf("slack %s: %s", method, r.Error)
+}
+
+// sendSlack uploads the file to the URL Slack hands out for it, then shares
+// it in the channel.
+func (b *chatBackend) sendSlack(job *uploadJob, channelID, caption string, content io.Reader, size int64) (string, error) {
+	header := http.Header{"Authorization": {"Bearer " + b.conf.Token}}
+
+	var ticket struct {
+		slackResponse
+		UploadURL string `json:"upload_url"`
+		FileID    string `json:"file_id"`
+	}
+	params := url.Values{"filename": {job.uploadName()}, "length": {strconv.FormatInt(size, 10)}}
+	header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if err := b.call(job.context(), b.conf.APIURL+"/files.getUploadURLExternal", header, strings.NewReader(params.Encode()), &ticket); err != nil {
+		return "", err
+	}
+	if err := ticket.err("files.getUploadURLExternal"); err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(job.context(), http.MethodPost, ticket.UploadURL, content)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", job.contentType())
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", newStatusError(resp)
+	}
+
+	complete, err := json.Marshal(map[string]interface{}{
+		"files":           []map[string]string{{"id": ticket.FileID, "title": job.uploadName()}},
+		"channel_id":      channelID,
+		"initial_comment": caption,
+	})
+	if err != nil {
+		return "", err
+	}
+	var shared struct {
+		slackResponse
+		Files []struct {
+			Permalink string `json:"permalink"`
+		} `json:"files"`
+	}
+	header.Set("Content-Type", "application/json; charset=utf-8")
+	if err := b.call(job.context(), b.conf.APIURL+"/files.completeUploadExternal", header, bytes.NewReader(complete), &shared); err != nil {
+		return "", err
+	}
+	if err := shared.err("files.completeUploadExternal"); err != nil {
+		return "", err
+	}
+	if len(shared.Files) == 0 {
+		return "", nil
+	}
+	return shared.Files[0].Permalink, nil
+}
+
+// call posts body to a Slack API method and decodes its answer into result.
+func (b *chatBackend) call(ctx context.Context, target string, header http.Header, body io.Reader, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, body)
+	if err != nil {
+		return err
+	}
+	req.Header = header.Clone()
+	status, err := b.do(req, result)
+	if err != nil {
+		return err
+	}
+	if status < 200 || status > 299 {
+		return &statusError{StatusCode: status, Status: http.StatusText(status)}
+	}
+	return nil
+}
+
+// postFile streams a multipart form with content as its file to target and
+// decodes the answer into result, returning the response's status code.
+func (b *chatBackend) postFile(ctx context.Context, target string, form *multipartBody, content io.Reader, size int64, result interface{}) (int, error) {
+	pr, pw := io.Pipe()
+	written := make(chan error, 1)
+	go func() {
+		err := form.writeTo(pw, []io.Reader{content})
+		pw.CloseWithError(err)
+		written <- err
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, pr)
+	if err != nil {
+		pr.Close()
+		return 0, err
+	}
+	req.ContentLength = form.overhead() + size
+	req.Header.Set("Content-Type", "multipart/form-data; boundary="+form.boundary)
+
+	status, err := b.do(req, result)
+	if err != nil {
+		return 0, err
+	}
+	// The whole file must have been sent for the upload to count
+	return status, <-written
+}
+
+// do sends req and decodes a JSON answer into result. Rate limiting and
+// server errors without a JSON body fail with a statusError so they are
+// retried; other answers are left to the caller. The URL is left out of
+// connection errors, as Telegram's carry the bot token and Discord's the
+// webhook's.
+func (b *chatBackend) do(req *http.Request, result interface{}) (int, error) {
+	resp, err := b.client.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			urlErr.URL = req.URL.Scheme + "://" + req.URL.Host
+		}
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	if err := json.Unmarshal(body, result); err != nil {
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return 0, newStatusError(resp)
+		}
+		return 0, fmt.Errorf("%s answered with something other than JSON: %w", b.conf.Kind, err)
+	}
+	if resp.StatusCode == http.StatusTooManyRequests && retryAfter(resp) > 0 {
+		return 0, newStatusError(resp)
+	}
+	return resp.StatusCode, nil
+}
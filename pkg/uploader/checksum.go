@@ -0,0 +1,164 @@
+package uploader
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	checksumMD5    = "md5"
+	checksumSHA256 = "sha256"
+)
+
+// ChecksumConfig sends a checksum of every file along with it, so the server
+// can check that the file arrived intact, and can check the checksum the
+// server reports back before the upload counts.
+type ChecksumConfig struct {
+	// Algorithm is md5 or sha256, empty sends no checksum
+	Algorithm string `yaml:"algorithm"`
+	// Header is the request header carrying the checksum, e.g. Content-MD5
+	// or X-Checksum-SHA256
+	Header string `yaml:"header"`
+	// Field is the form field carrying the checksum
+	Field string `yaml:"field"`
+	// Encoding is hex or base64, it defaults to base64 for Content-MD5 and
+	// to hex otherwise
+	Encoding string `yaml:"encoding"`
+	// Verify is the JSONPath of the checksum in the response, e.g.
+	// $.data.sha256, which has to match the one sent, in hex or base64
+	Verify string `yaml:"verify"`
+}
+
+func (c ChecksumConfig) validate() error {
+	switch c.Algorithm {
+	case "", checksumMD5, checksumSHA256:
+	default:
+		return fmt.Errorf("unknown checksum algorithm: %s (use md5 or sha256)", c.Algorithm)
+	}
+	switch c.Encoding {
+	case "", "hex", "base64":
+	default:
+		return fmt.Errorf("unknown checksum encoding: %s (use hex or base64)", c.Encoding)
+	}
+	if c.Algorithm == "" {
+		return nil
+	}
+	if c.Header == "" && c.Field == "" && c.Verify == "" {
+		return fmt.Errorf("checksum %s needs a header, field or verify path", c.Algorithm)
+	}
+	if c.Verify != "" {
+		if _, err := parseJSONPath(c.Verify); err != nil {
+			return fmt.Errorf("invalid checksum verify path %q: %w", c.Verify, err)
+		}
+	}
+	return nil
+}
+
+// addChecksum computes the checksum sent with the job's file and adds it to
+// the form fields. It runs before the upload is attempted, so the retries
+// and the copies of the job for other targets share it.
+func (j *uploadJob) addChecksum() error {
+	conf := cfg.Checksum
+	if conf.Algorithm == "" {
+		return nil
+	}
+
+	var sum []byte
+	if conf.Algorithm == checksumSHA256 {
+		// Reuse the SHA-256 the state is keyed by
+		checksum, err := j.checksum()
+		if err != nil {
+			return fmt.Errorf("hashing file: %w", err)
+		}
+		if sum, err = hex.DecodeString(checksum); err != nil {
+			return err
+		}
+	} else {
+		var err error
+		if sum, err = hashFileWith(j.Path, md5.New()); err != nil {
+			return fmt.Errorf("hashing file: %w", err)
+		}
+	}
+
+	encoding := conf.Encoding
+	if encoding == "" && http.CanonicalHeaderKey(conf.Header) == "Content-Md5" {
+		encoding = "base64"
+	}
+	if encoding == "base64" {
+		j.SentChecksum = base64.StdEncoding.EncodeToString(sum)
+	} else {
+		j.SentChecksum = hex.EncodeToString(sum)
+	}
+
+	if conf.Field != "" {
+		j.Fields[conf.Field] = j.SentChecksum
+	}
+	return nil
+}
+
+func hashFileWith(filePath string, h hash.Hash) ([]byte, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(h, file); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// setChecksumHeader adds the checksum header to a request that carries the
+// whole file.
+func (j *uploadJob) setChecksumHeader(req *http.Request) {
+	if j.SentChecksum != "" && cfg.Checksum.Header != "" {
+		req.Header.Set(cfg.Checksum.Header, j.SentChecksum)
+	}
+}
+
+// verifyChecksum checks the checksum the server reports in its response
+// against the one sent. Hex checksums are compared ignoring case, and either
+// encoding is accepted.
+func (j *uploadJob) verifyChecksum(body []byte) error {
+	path := cfg.Checksum.Verify
+	if j.SentChecksum == "" || path == "" {
+		return nil
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return fmt.Errorf("response is not JSON: %w", err)
+	}
+	value, found := lookupJSONPath(doc, path)
+	reported, ok := value.(string)
+	if !found || !ok || reported == "" {
+		return fmt.Errorf("response has no checksum at %s", path)
+	}
+
+	if sameChecksum(reported, j.SentChecksum) {
+		return nil
+	}
+	return retryable(fmt.Errorf("checksum mismatch: sent %s, server has %s", j.SentChecksum, reported))
+}
+
+func sameChecksum(a, b string) bool {
+	decode := func(s string) []byte {
+		if sum, err := hex.DecodeString(s); err == nil {
+			return sum
+		}
+		if sum, err := base64.StdEncoding.DecodeString(s); err == nil {
+			return sum
+		}
+		return []byte(strings.ToLower(s))
+	}
+	return string(decode(a)) == string(decode(b))
+}
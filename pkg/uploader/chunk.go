@@ -0,0 +1,223 @@
+package uploader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// chunkProgress is the persisted state of a chunked upload, so a retry or a
+// restart only sends the chunks the server has not accepted yet. Done
+// chunks were all accepted, Sent lists the ones after them that were, as
+// chunks sent in parallel finish out of order.
+type chunkProgress struct {
+	SHA256    string `json:"sha256"`
+	ChunkSize int64  `json:"chunk_size"`
+	Done      int    `json:"done"`
+	Sent      []int  `json:"sent,omitempty"`
+}
+
+// pending returns the indexes of the chunks still to send.
+func (p *chunkProgress) pending(totalChunks int) []int {
+	sent := make(map[int]bool, len(p.Sent))
+	for _, index := range p.Sent {
+		sent[index] = true
+	}
+	var pending []int
+	for index := p.Done; index < totalChunks; index++ {
+		if !sent[index] {
+			pending = append(pending, index)
+		}
+	}
+	return pending
+}
+
+// accept records that the chunk index was accepted. Accepting it again
+// changes nothing.
+func (p *chunkProgress) accept(index int) {
+	if index < p.Done || slices.Contains(p.Sent, index) {
+		return
+	}
+	p.Sent = append(p.Sent, index)
+	sort.Ints(p.Sent)
+	for len(p.Sent) > 0 && p.Sent[0] <= p.Done {
+		if p.Sent[0] == p.Done {
+			p.Done++
+		}
+		p.Sent = p.Sent[1:]
+	}
+	if len(p.Sent) == 0 {
+		p.Sent = nil
+	}
+}
+
+// sendFileChunked uploads a large file as numbered chunks, each in its own
+// multipart request, followed by a finalize request that tells the server to
+// assemble them. Every request carries the chunk index, the total number of
+// chunks and the SHA-256 of the whole file so the server can match them up.
+// With cfg.ChunkParallelism several chunks are sent at a time, so the server
+// has to take them in any order.
+func sendFileChunked(job *uploadJob, file *sourceFile, info os.FileInfo) (*fileRecord, error) {
+	filePath := job.Path
+	checksum, err := job.checksum()
+	if err != nil {
+		return nil, fmt.Errorf("hashing file: %w", err)
+	}
+
+	chunkSize := int64(cfg.ChunkSize)
+	totalChunks := int((info.Size() + chunkSize - 1) / chunkSize)
+	fileName := job.uploadName()
+
+	progress := &chunkProgress{}
+	found, err := state.getJSON(chunksBucket, job.stateKey(), progress)
+	if err != nil {
+		return nil, err
+	}
+	if !found || progress.SHA256 != checksum || progress.ChunkSize != chunkSize {
+		progress = &chunkProgress{SHA256: checksum, ChunkSize: chunkSize}
+	} else if sent := progress.Done + len(progress.Sent); sent > 0 {
+		logrus.Infof("Resuming chunked upload of %s with %d/%d chunks sent", filePath, sent, totalChunks)
+	}
+
+	var progressMu sync.Mutex
+	pending := progress.pending(totalChunks)
+	lengths := make([]int64, len(pending))
+	for i, index := range pending {
+		lengths[i] = min(chunkSize, info.Size()-int64(index)*chunkSize)
+	}
+	err = sendChunks(job, lengths, func(i int) error {
+		index := pending[i]
+		offset, length := int64(index)*chunkSize, lengths[i]
+
+		fields := chunkFields(job.Fields, checksum, totalChunks, info.Size())
+		fields["chunk_index"] = index
+
+		form := newMultipartBody(job.FieldName, fileName, "", fields)
+
+		// The checksum header describes the whole file, so only the
+		// finalize request carries it, and every chunk has an idempotency
+		// key of its own
+		chunkJob := *job
+		chunkJob.SentChecksum = ""
+		if job.IdempotencyKey != "" {
+			chunkJob.IdempotencyKey = fmt.Sprintf("%s-%d", job.IdempotencyKey, index)
+		}
+		if _, err := postForm(&chunkJob, job.URL, form, []io.Reader{io.NewSectionReader(file, offset, length)}, length); err != nil {
+			return fmt.Errorf("chunk %d/%d: %w", index+1, totalChunks, err)
+		}
+
+		progressMu.Lock()
+		defer progressMu.Unlock()
+		progress.accept(index)
+		if err := state.putJSON(chunksBucket, job.stateKey(), progress); err != nil {
+			logrus.Error("Error saving chunk progress:", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	finalizeURL := firstNonEmpty(cfg.ChunkFinalizeURL, job.URL)
+
+	fields := chunkFields(job.Fields, checksum, totalChunks, info.Size())
+	fields["filename"] = fileName
+	fields["finalize"] = true
+	body, err := postForm(job, finalizeURL, newMultipartBody("", "", "", fields), nil, 0)
+	job.Response = body
+	if err != nil {
+		return nil, fmt.Errorf("finalizing chunked upload: %w", err)
+	}
+	if err := job.verifyChecksum(body); err != nil {
+		return nil, err
+	}
+
+	if err := state.delete(chunksBucket, job.stateKey()); err != nil {
+		logrus.Error("Error clearing chunk progress:", err)
+	}
+
+	rec := newFileRecord(filePath, info, checksum)
+	rec.RemoteURL = job.rules().remoteURL(body)
+	return rec, nil
+}
+
+// chunkFields returns the form fields shared by all requests of a chunked
+// upload: the job fields plus the information to reassemble the file.
+func chunkFields(base map[string]interface{}, checksum string, totalChunks int, size int64) map[string]interface{} {
+	fields := make(map[string]interface{}, len(base)+3)
+	for key, value := range base {
+		fields[key] = value
+	}
+	fields["file_hash"] = checksum
+	fields["total_chunks"] = totalChunks
+	fields["file_size"] = size
+	return fields
+}
+
+// sendChunks calls send for the parts of the job's file, of the lengths,
+// up to cfg.ChunkParallelism of them at a time, or as many as the adaptive
+// concurrency of the server allows, in order. No part is started after one
+// failed, and the error of the first one to fail is returned once the
+// others are done.
+func sendChunks(job *uploadJob, lengths []int64, send func(i int) error) error {
+	var (
+		mu       sync.Mutex
+		next     int
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	name, limit := targetName(job), job.concurrencyLimit()
+	count := len(lengths)
+	for worker := 0; worker < min(max(cfg.ChunkParallelism, 1), count); worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				started := limit.acquire()
+				mu.Lock()
+				if firstErr != nil || next == count {
+					mu.Unlock()
+					limit.skip()
+					return
+				}
+				i := next
+				next++
+				mu.Unlock()
+
+				err := send(i)
+				limit.release(name, started, lengths[i], err)
+			retry:
+				for attempt := 1; limit != nil && congested(err) && attempt < cfg.Retry.MaxAttempts; attempt++ {
+					// The limit was lowered for the chunk the server turned
+					// away, it is sent again within the new one
+					select {
+					case <-time.After(max(retryAfterOf(err), cfg.Retry.backoff(attempt))):
+					case <-job.context().Done():
+						err = context.Cause(job.context())
+						break retry
+					}
+					started = limit.acquire()
+					err = send(i)
+					limit.release(name, started, lengths[i], err)
+				}
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
@@ -0,0 +1,56 @@
+package uploader
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestChunkProgressAccept(t *testing.T) {
+	tests := []struct {
+		name     string
+		accepted []int
+		wantDone int
+		wantSent []int
+	}{
+		{name: "none"},
+		{name: "in order", accepted: []int{0, 1, 2}, wantDone: 3},
+		{name: "gap", accepted: []int{0, 2, 3}, wantDone: 1, wantSent: []int{2, 3}},
+		{name: "gap filled", accepted: []int{2, 3, 0, 1}, wantDone: 4},
+		{name: "out of order", accepted: []int{3, 1, 0}, wantDone: 2, wantSent: []int{3}},
+		{name: "accepted twice", accepted: []int{0, 0, 2, 2}, wantDone: 1, wantSent: []int{2}},
+		{name: "accepted again after done", accepted: []int{0, 1, 0}, wantDone: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &chunkProgress{}
+			for _, index := range tt.accepted {
+				p.accept(index)
+			}
+			if p.Done != tt.wantDone || !reflect.DeepEqual(p.Sent, tt.wantSent) {
+				t.Errorf("after accepting %v: Done = %d, Sent = %v, want %d, %v", tt.accepted, p.Done, p.Sent, tt.wantDone, tt.wantSent)
+			}
+		})
+	}
+}
+
+func TestChunkProgressPending(t *testing.T) {
+	tests := []struct {
+		name        string
+		progress    chunkProgress
+		totalChunks int
+		want        []int
+	}{
+		{name: "new", totalChunks: 3, want: []int{0, 1, 2}},
+		{name: "resumed", progress: chunkProgress{Done: 2}, totalChunks: 4, want: []int{2, 3}},
+		{name: "sent out of order", progress: chunkProgress{Done: 1, Sent: []int{2, 4}}, totalChunks: 6, want: []int{1, 3, 5}},
+		{name: "all sent", progress: chunkProgress{Done: 1, Sent: []int{1, 2}}, totalChunks: 3},
+		{name: "done", progress: chunkProgress{Done: 3}, totalChunks: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.progress.pending(tt.totalChunks); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("pending(%d) = %v, want %v", tt.totalChunks, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package uploader
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// CircuitBreakerConfig stops uploading to a server that failed Failures
+// uploads in a row, for CoolDown, so a server that is down does not cost a
+// failed attempt and a log line per file. Files wait in the meantime, and
+// once CoolDown is over a single upload probes whether the server is back.
+// Every target has a breaker of its own.
+type CircuitBreakerConfig struct {
+	// Failures opens the circuit, 0 turns the breaker off
+	Failures int           `yaml:"failures"`
+	CoolDown time.Duration `yaml:"cool_down"`
+}
+
+// uploadBreaker is the circuit breaker of server_url, or of the backend.
+var uploadBreaker *circuitBreaker
+
+// circuitBreaker counts the failures of a server in a row. A nil
+// circuitBreaker lets every upload through.
+type circuitBreaker struct {
+	conf CircuitBreakerConfig
+
+	mu       sync.Mutex
+	failures int
+	// openUntil is when the cool-down ends
+	openUntil time.Time
+	// probing is set while the upload that probes the server runs
+	probing bool
+}
+
+// circuitOpenError is returned for uploads held back by an open circuit.
+type circuitOpenError struct {
+	name string
+	wait time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("uploads to %s are paused after repeated failures", e.name)
+}
+
+func newCircuitBreaker(conf CircuitBreakerConfig) *circuitBreaker {
+	if conf.Failures <= 0 {
+		return nil
+	}
+	return &circuitBreaker{conf: conf}
+}
+
+// allow returns a circuitOpenError while the circuit is open. Once the
+// cool-down is over it lets a single upload through as the probe.
+func (b *circuitBreaker) allow(name string) error {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.conf.Failures {
+		return nil
+	}
+	if wait := time.Until(b.openUntil); wait > 0 || b.probing {
+		return &circuitOpenError{name: name, wait: max(wait, time.Second)}
+	}
+	b.probing = true
+	return nil
+}
+
+// record counts the outcome of an upload. Only failures that say nothing
+// about the file, such as connection errors and retryable status codes,
+// count; a server that rejects a file is still up.
+func (b *circuitBreaker) record(name string, err error) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if err == nil || !isRetryable(err, cfg.Retry) || retryAfterOf(err) > 0 {
+		if b.failures >= b.conf.Failures {
+			logrus.Infof("%s is back, resuming uploads", name)
+		}
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.conf.Failures {
+		b.openUntil = time.Now().Add(b.conf.CoolDown)
+		logrus.Warnf("%s failed %d uploads in a row, pausing its uploads for %s", name, b.failures, b.conf.CoolDown)
+	}
+}
@@ -0,0 +1,442 @@
+package uploader
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+// ClaimConfig lets several uploaders watch the same shared directory, e.g.
+// an NFS or SMB share mounted on two hosts, with every file uploaded by only
+// one of them. A file is claimed before it is uploaded, and the claim is
+// renewed while the upload runs. Once the file is uploaded the claim stays
+// as a record that it is done, so the other uploaders skip it, until it
+// changes; after a failure it is given up, so another uploader can try.
+// The claim of an uploader that died expires after TTL. Files are told
+// apart by the name of their watched directory and their path below it, so
+// the share may be mounted at different paths. Only the files of the
+// watched directories are claimed, not archived subdirectories or the
+// upload command's. It only changes on restart.
+type ClaimConfig struct {
+	// Backend is where the claims are kept: "file" for claim files next to
+	// the files, "redis" for a Redis server, or empty for no claims
+	Backend string `yaml:"backend"`
+	// Dir is the directory of the claim files; empty keeps them in
+	// .auto-upload-claims in each watched directory, which is not uploaded
+	Dir string `yaml:"dir"`
+	// RedisURL is the Redis server, e.g. redis://:password@host:6379/0
+	RedisURL string `yaml:"redis_url"`
+	// RedisPrefix is put in front of the keys of the claims
+	RedisPrefix string `yaml:"redis_prefix"`
+	// TTL is how long a claim holds without being renewed
+	TTL time.Duration `yaml:"ttl"`
+	// Owner names this uploader in the claims; empty is the host name and
+	// process ID
+	Owner string `yaml:"owner"`
+}
+
+const (
+	claimFile  = "file"
+	claimRedis = "redis"
+
+	// claimDirName is the directory of the claim files in a watched
+	// directory
+	claimDirName = ".auto-upload-claims"
+)
+
+// claims claims the files before they are uploaded, nil without claims.
+var claims *claimer
+
+// claimRecord is the content of a claim.
+type claimRecord struct {
+	Owner string `json:"owner"`
+	// Token tells apart the claims of the same owner, e.g. before and
+	// after a restart
+	Token   string    `json:"token"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+
+	// Done is set once the file is uploaded, with what the owner recorded
+	Done       bool      `json:"done,omitempty"`
+	UploadedAt time.Time `json:"uploaded_at,omitempty"`
+	SHA256     string    `json:"sha256,omitempty"`
+	RemoteURL  string    `json:"remote_url,omitempty"`
+}
+
+// claimStore keeps the claims. The claims are compared by their encoded
+// content, so only the holder of a claim can renew, complete or release it.
+type claimStore interface {
+	// create stores rec under key unless there is a claim already, and
+	// reports whether it did
+	create(key string, rec []byte) (bool, error)
+	// get returns the claim under key, nil if there is none, and whether
+	// it expired
+	get(key string) ([]byte, bool, error)
+	// replace stores rec under key if old is still there, and reports
+	// whether it did; done claims do not expire
+	replace(key string, old, rec []byte, done bool) (bool, error)
+	// renew extends the claim rec under key
+	renew(key string, rec []byte) error
+	// release removes the claim rec under key
+	release(key string, rec []byte) error
+	close()
+}
+
+// claimer claims files for this uploader.
+type claimer struct {
+	conf  ClaimConfig
+	store claimStore
+	owner string
+}
+
+// fileClaim is a claim held on a file while it is uploaded.
+type fileClaim struct {
+	store claimStore
+	key   string
+	rec   []byte
+	done  chan struct{}
+	once  sync.Once
+}
+
+// newClaimer sets up the claims of conf, nil if they are off.
+func newClaimer(conf ClaimConfig) (*claimer, error) {
+	if conf.Backend == "" {
+		return nil, nil
+	}
+	if conf.TTL <= 0 {
+		return nil, errors.New("claim ttl must be positive")
+	}
+	c := &claimer{conf: conf, owner: conf.Owner}
+	if c.owner == "" {
+		hostname, _ := os.Hostname()
+		c.owner = fmt.Sprintf("%s:%d", hostname, os.Getpid())
+	}
+
+	switch conf.Backend {
+	case claimFile:
+		if conf.Dir != "" {
+			c.store = &fileClaimStore{dir: conf.Dir, ttl: conf.TTL}
+		}
+	case claimRedis:
+		if conf.RedisURL == "" {
+			return nil, errors.New("claim backend redis needs redis_url")
+		}
+		options, err := redis.ParseURL(conf.RedisURL)
+		if err != nil {
+			return nil, fmt.Errorf("parsing claim redis_url: %w", err)
+		}
+		c.store = &redisClaimStore{client: redis.NewClient(options), prefix: conf.RedisPrefix, ttl: conf.TTL}
+	default:
+		return nil, fmt.Errorf("unknown claim backend: %s", conf.Backend)
+	}
+	logrus.Infof("Claiming files as %s", c.owner)
+	return c, nil
+}
+
+// storeFor returns the store of the claims of the files in dir.
+func (c *claimer) storeFor(dir *watchDir) claimStore {
+	if c.store == nil {
+		return &fileClaimStore{dir: filepath.Join(dir.Path, claimDirName), ttl: c.conf.TTL}
+	}
+	return c.store
+}
+
+// isClaimPath reports whether relPath is in the directory of the claim
+// files of a watched directory.
+func isClaimPath(relPath string) bool {
+	first, _, _ := strings.Cut(filepath.ToSlash(relPath), "/")
+	return first == claimDirName
+}
+
+// claim claims the file of job for this uploader. It returns nil if the
+// file is claimed by another uploader, which is left to it and looked at
+// again after the TTL, or was uploaded by another uploader as it is now,
+// which is recorded as uploaded.
+func (c *claimer) claim(job *uploadJob, info os.FileInfo) (*fileClaim, error) {
+	store := c.storeFor(job.Dir)
+	key := filepath.Base(job.Dir.Path) + "/" + job.RelPath
+	token := make([]byte, 8)
+	rand.Read(token)
+	rec, err := json.Marshal(claimRecord{Owner: c.owner, Token: hex.EncodeToString(token), Size: info.Size(), ModTime: info.ModTime().UTC()})
+	if err != nil {
+		return nil, err
+	}
+
+	claimed, err := store.create(key, rec)
+	if err == nil && !claimed {
+		var current []byte
+		var expired bool
+		if current, expired, err = store.get(key); err != nil {
+			return nil, fmt.Errorf("claiming %s: %w", job.Path, err)
+		}
+		held := &claimRecord{}
+		json.Unmarshal(current, held)
+		switch {
+		case current == nil:
+			// Given up in the meantime
+			claimed, err = store.create(key, rec)
+		case held.Done && held.Size == info.Size() && held.ModTime.Equal(info.ModTime()):
+			c.uploadedElsewhere(job, info, held)
+			return nil, nil
+		case held.Done || expired:
+			// The file changed since it was uploaded, or its uploader is gone
+			claimed, err = store.replace(key, current, rec, false)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("claiming %s: %w", job.Path, err)
+	}
+	if !claimed {
+		logrus.Debugf("Deferring %s: claimed by another uploader", job.Path)
+		deferUpload(job.Path, c.conf.TTL)
+		return nil, nil
+	}
+
+	claim := &fileClaim{store: store, key: key, rec: rec, done: make(chan struct{})}
+	go claim.keepAlive(c.conf.TTL / 3)
+	return claim, nil
+}
+
+// uploadedElsewhere records a file another uploader uploaded.
+func (c *claimer) uploadedElsewhere(job *uploadJob, info os.FileInfo, held *claimRecord) {
+	logrus.Infof("Skipping %s: uploaded by %s", job.Path, held.Owner)
+	rec := newFileRecord(job.Path, info, held.SHA256)
+	rec.UploadedAt = held.UploadedAt
+	rec.RemoteURL = held.RemoteURL
+	rec.UploadedBy = held.Owner
+	if err := state.put(rec); err != nil {
+		logrus.Error("Error saving upload state:", err)
+	}
+}
+
+// keepAlive renews the claim every interval until it is finished.
+func (f *fileClaim) keepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := f.store.renew(f.key, f.rec); err != nil {
+				logrus.Warnf("Error renewing the claim of %s: %v", f.key, err)
+			}
+		case <-f.done:
+			return
+		}
+	}
+}
+
+// finish marks the claim done with the record of the upload, or gives it
+// up if rec is nil. Only the first call counts.
+func (f *fileClaim) finish(rec *fileRecord) {
+	if f == nil {
+		return
+	}
+	f.once.Do(func() {
+		close(f.done)
+		if rec == nil {
+			if err := f.store.release(f.key, f.rec); err != nil {
+				logrus.Warnf("Error giving up the claim of %s: %v", f.key, err)
+			}
+			return
+		}
+
+		done := claimRecord{}
+		json.Unmarshal(f.rec, &done)
+		done.Done, done.UploadedAt, done.SHA256, done.RemoteURL = true, rec.UploadedAt, rec.SHA256, rec.RemoteURL
+		data, err := json.Marshal(done)
+		if err == nil {
+			var replaced bool
+			if replaced, err = f.store.replace(f.key, f.rec, data, true); err == nil && !replaced {
+				err = errors.New("the claim was taken over by another uploader")
+			}
+		}
+		if err != nil {
+			logrus.Warnf("Error recording the upload of %s in its claim: %v", f.key, err)
+		}
+	})
+}
+
+// close stops the claims.
+func (c *claimer) close() {
+	if c != nil && c.store != nil {
+		c.store.close()
+	}
+}
+
+// fileClaimStore keeps claims as files in a shared directory, named after
+// the hash of their key. A claim is created exclusively, which NFS and SMB
+// do atomically, and renewed by touching its file. Replacing a claim that
+// expired or is done is not atomic: two uploaders taking over the same claim
+// at the same moment may both upload the file.
+type fileClaimStore struct {
+	dir string
+	ttl time.Duration
+}
+
+func (s *fileClaimStore) path(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(hash[:16])+".claim")
+}
+
+func (s *fileClaimStore) create(key string, rec []byte) (bool, error) {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return false, err
+	}
+	file, err := os.OpenFile(s.path(key), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	_, err = file.Write(rec)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err == nil, err
+}
+
+func (s *fileClaimStore) get(key string) ([]byte, bool, error) {
+	path := s.path(key)
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	return data, time.Since(info.ModTime()) > s.ttl, err
+}
+
+func (s *fileClaimStore) replace(key string, old, rec []byte, done bool) (bool, error) {
+	current, _, err := s.get(key)
+	if err != nil || string(current) != string(old) {
+		return false, err
+	}
+	if err := writeFileAtomic(s.path(key), rec, 0644); err != nil {
+		return false, err
+	}
+	// Another uploader may have replaced it at the same time
+	current, _, err = s.get(key)
+	return err == nil && string(current) == string(rec), err
+}
+
+func (s *fileClaimStore) renew(key string, rec []byte) error {
+	current, _, err := s.get(key)
+	if err != nil {
+		return err
+	}
+	if string(current) != string(rec) {
+		return errors.New("the claim was taken over by another uploader")
+	}
+	now := time.Now()
+	return os.Chtimes(s.path(key), now, now)
+}
+
+func (s *fileClaimStore) release(key string, rec []byte) error {
+	current, _, err := s.get(key)
+	if err != nil || string(current) != string(rec) {
+		return err
+	}
+	err = os.Remove(s.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *fileClaimStore) close() {}
+
+// redisClaimStore keeps claims in Redis, where they are created with SET NX
+// and changed by scripts that check the claim first, so a claim is only
+// ever held by one uploader. Claims that are not done expire by themselves.
+type redisClaimStore struct {
+	client *redis.Client
+	prefix string
+	ttl    time.Duration
+}
+
+var (
+	redisReplace = redis.NewScript(`
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then return 0 end
+if ARGV[3] == "0" then redis.call("SET", KEYS[1], ARGV[2]) else redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3]) end
+return 1`)
+	redisRenew = redis.NewScript(`
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then return 0 end
+return redis.call("PEXPIRE", KEYS[1], ARGV[2])`)
+	redisRelease = redis.NewScript(`
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then return 0 end
+return redis.call("DEL", KEYS[1])`)
+)
+
+func (s *redisClaimStore) key(key string) string {
+	return s.prefix + key
+}
+
+func redisContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), 10*time.Second)
+}
+
+func (s *redisClaimStore) create(key string, rec []byte) (bool, error) {
+	ctx, cancel := redisContext()
+	defer cancel()
+	return s.client.SetNX(ctx, s.key(key), rec, s.ttl).Result()
+}
+
+func (s *redisClaimStore) get(key string) ([]byte, bool, error) {
+	ctx, cancel := redisContext()
+	defer cancel()
+	data, err := s.client.Get(ctx, s.key(key)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+	// Redis removes expired claims
+	return data, false, err
+}
+
+func (s *redisClaimStore) replace(key string, old, rec []byte, done bool) (bool, error) {
+	ctx, cancel := redisContext()
+	defer cancel()
+	ttl := s.ttl.Milliseconds()
+	if done {
+		ttl = 0
+	}
+	replaced, err := redisReplace.Run(ctx, s.client, []string{s.key(key)}, old, rec, ttl).Int()
+	return replaced == 1, err
+}
+
+func (s *redisClaimStore) renew(key string, rec []byte) error {
+	ctx, cancel := redisContext()
+	defer cancel()
+	renewed, err := redisRenew.Run(ctx, s.client, []string{s.key(key)}, rec, s.ttl.Milliseconds()).Int()
+	if err == nil && renewed != 1 {
+		err = errors.New("the claim was taken over by another uploader")
+	}
+	return err
+}
+
+func (s *redisClaimStore) release(key string, rec []byte) error {
+	ctx, cancel := redisContext()
+	defer cancel()
+	return redisRelease.Run(ctx, s.client, []string{s.key(key)}, rec).Err()
+}
+
+func (s *redisClaimStore) close() {
+	s.client.Close()
+}
@@ -0,0 +1,127 @@
+package uploader
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	compressGzip = "gzip"
+	compressZstd = "zstd"
+)
+
+// compressionExt is appended to the name of a compressed file.
+var compressionExt = map[string]string{
+	compressGzip: ".gz",
+	compressZstd: ".zst",
+}
+
+func validateCompression(name string) error {
+	if _, ok := compressionExt[name]; name != "" && !ok {
+		return fmt.Errorf("unknown compression: %s (use gzip or zstd)", name)
+	}
+	return nil
+}
+
+// compressReader compresses src as it is read. It works without a goroutine,
+// so nothing is left behind when an upload stops reading early.
+type compressReader struct {
+	name  string
+	src   io.Reader
+	enc   io.WriteCloser
+	buf   bytes.Buffer
+	chunk [32 << 10]byte
+	done  bool
+
+	// n counts the compressed bytes read so far
+	n int64
+}
+
+func newCompressReader(src io.Reader, compression string) (*compressReader, error) {
+	r := &compressReader{name: compression, src: src}
+	switch compression {
+	case compressGzip:
+		r.enc = gzip.NewWriter(&r.buf)
+	case compressZstd:
+		enc, err := zstd.NewWriter(&r.buf, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		r.enc = enc
+	default:
+		return nil, fmt.Errorf("unknown compression: %s", compression)
+	}
+	return r, nil
+}
+
+func (r *compressReader) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 && !r.done {
+		n, err := r.src.Read(r.chunk[:])
+		if n > 0 {
+			if _, err := r.enc.Write(r.chunk[:n]); err != nil {
+				return 0, err
+			}
+		}
+		switch {
+		case err == io.EOF:
+			if err := r.enc.Close(); err != nil {
+				return 0, err
+			}
+			r.done = true
+		case err != nil:
+			return 0, err
+		}
+	}
+
+	n, _ := r.buf.Read(p)
+	r.n += int64(n)
+	if n == 0 && r.done {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// addFilePart adds the job's file to form as a part of fieldName, compressed
+// if its route asks for it. It returns the content to send for the part and
+// its size, which is -1 when compressed since that size is only known once
+// the part is sent, and the compressing reader or nil.
+func (j *uploadJob) addFilePart(form *multipartBody, fieldName string, content io.Reader, size int64) (io.Reader, int64, *compressReader, error) {
+	fileName := j.uploadName()
+	if j.Compress == "" {
+		form.addFile(fieldName, fileName, j.contentType(), "")
+		return content, size, nil, nil
+	}
+
+	compressed, err := newCompressReader(content, j.Compress)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	form.addFile(fieldName, fileName+compressionExt[j.Compress], j.contentType(), j.Compress)
+	return compressed, -1, compressed, nil
+}
+
+// annotate records the compression and compressed size in rec. It does
+// nothing for content that was not compressed.
+func (r *compressReader) annotate(rec *fileRecord) {
+	if r != nil {
+		rec.Compression, rec.CompressedSize = r.name, r.n
+	}
+}
+
+// usesCompression reports whether any route compresses files.
+func usesCompression(c *Config) bool {
+	routes := append([]RouteConfig(nil), c.Routes...)
+	for _, dir := range c.Directories {
+		routes = append(routes, dir.Routes...)
+	}
+	for _, route := range routes {
+		if route.Compress != "" {
+			return true
+		}
+	}
+	return false
+}
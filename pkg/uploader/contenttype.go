@@ -0,0 +1,39 @@
+package uploader
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// contentType returns the MIME type the file is sent with: the one forced by
+// the matching route, else the type registered for the file's extension, else
+// the type sniffed from its first bytes.
+func (j *uploadJob) contentType() string {
+	if j.ContentType == "" {
+		j.ContentType = detectContentType(j.Path)
+	}
+	return j.ContentType
+}
+
+func detectContentType(filePath string) string {
+	if contentType := mime.TypeByExtension(filepath.Ext(filePath)); contentType != "" {
+		return contentType
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer file.Close()
+
+	// DetectContentType looks at no more than the first 512 bytes
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "application/octet-stream"
+	}
+	return http.DetectContentType(head[:n])
+}
@@ -0,0 +1,232 @@
+package uploader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPIDFile = "auto-upload.pid"
+
+	// daemonEnv marks the background process started by -daemon
+	daemonEnv = "AUTO_UPLOAD_DAEMON"
+)
+
+// errLocked is returned when another process holds a lock.
+var errLocked = errors.New("locked by another process")
+
+var (
+	pidFile   *os.File
+	dirLocks  []*os.File
+	runDaemon bool
+)
+
+// startDaemon runs the uploader again with the same arguments as a
+// background process detached from the terminal and returns its PID. It
+// waits a moment so that a daemon failing right away is reported.
+func startDaemon() (int, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.SysProcAttr = detachedProcAttr()
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	select {
+	case err := <-exited:
+		return 0, fmt.Errorf("daemon exited right away (%v), see the log file", err)
+	case <-time.After(time.Second):
+	}
+	return cmd.Process.Pid, nil
+}
+
+// isDaemon reports whether this process is the one started by -daemon.
+func isDaemon() bool {
+	return os.Getenv(daemonEnv) != ""
+}
+
+// createPIDFile writes the PID of this process to path and keeps the file
+// locked while the process runs, so a second instance using the same PID
+// file refuses to start and stop/status can tell a stale file from a
+// running process.
+func createPIDFile(path string) error {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("opening pid file: %w", err)
+	}
+	if err := lockFile(file); err != nil {
+		file.Close()
+		if errors.Is(err, errLocked) {
+			pid, _ := readPIDFile(path)
+			return fmt.Errorf("already running with PID %d (%s)", pid, path)
+		}
+		return fmt.Errorf("locking pid file: %w", err)
+	}
+
+	if err := file.Truncate(0); err != nil {
+		file.Close()
+		return err
+	}
+	if _, err := file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		file.Close()
+		return err
+	}
+	pidFile = file
+	return nil
+}
+
+// removePIDFile removes the PID file of this process, if it has one.
+func removePIDFile() {
+	if pidFile != nil {
+		os.Remove(pidFile.Name())
+		pidFile.Close()
+		pidFile = nil
+	}
+}
+
+func readPIDFile(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid pid file %s", path)
+	}
+	return pid, nil
+}
+
+// lockDirs takes a lock for every watched directory, so two instances with
+// different state databases do not both upload the same files. The locks
+// are files in the temporary directory named after the directory's path,
+// which keeps them out of the watched directory itself. With claims the
+// instances share the directories instead, so none are locked.
+func lockDirs(dirs []*watchDir) error {
+	if cfg.Claim.Backend != "" {
+		return nil
+	}
+	for _, dir := range dirs {
+		abs, err := filepath.Abs(dir.Path)
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256([]byte(abs))
+		path := filepath.Join(os.TempDir(), "auto-upload-"+hex.EncodeToString(hash[:8])+".lock")
+
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return fmt.Errorf("creating lock for %s: %w", dir.Path, err)
+		}
+		if err := lockFile(file); err != nil {
+			file.Close()
+			if errors.Is(err, errLocked) {
+				return fmt.Errorf("%s is already watched by another instance", dir.Path)
+			}
+			return fmt.Errorf("locking %s: %w", dir.Path, err)
+		}
+		dirLocks = append(dirLocks, file)
+	}
+	return nil
+}
+
+// runStatus implements "auto-upload status": it tells whether the instance
+// with the given PID file is running.
+func runStatus(args []string) error {
+	path := parsePIDFileFlags("status", args)
+
+	pid, running, err := pidFileStatus(path)
+	switch {
+	case err != nil:
+		return err
+	case running:
+		fmt.Printf("auto-upload is running with PID %d\n", pid)
+	default:
+		fmt.Println("auto-upload is not running")
+		os.Exit(3)
+	}
+	return nil
+}
+
+// runStop implements "auto-upload stop": it asks the instance with the
+// given PID file to shut down and waits for it to exit.
+func runStop(args []string) error {
+	path := parsePIDFileFlags("stop", args)
+
+	pid, running, err := pidFileStatus(path)
+	if err != nil {
+		return err
+	}
+	if !running {
+		fmt.Println("auto-upload is not running")
+		return nil
+	}
+
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	if err := stopProcess(process); err != nil {
+		return fmt.Errorf("stopping PID %d: %w", pid, err)
+	}
+
+	deadline := time.Now().Add(cfg.ShutdownTimeout + 5*time.Second)
+	for time.Now().Before(deadline) {
+		if _, running, _ := pidFileStatus(path); !running {
+			fmt.Printf("Stopped auto-upload (PID %d)\n", pid)
+			return nil
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	return fmt.Errorf("PID %d is still running", pid)
+}
+
+func parsePIDFileFlags(name string, args []string) string {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.StringVar(&configFile, "config", "", "YAML file to load settings from")
+	fs.StringVar(&cfg.PIDFile, "pid-file", cfg.PIDFile, "PID file of the running instance")
+	fs.Parse(args)
+	return firstNonEmpty(cfg.PIDFile, defaultPIDFile)
+}
+
+// pidFileStatus reads a PID file and reports whether its process is still
+// running, that is whether it still holds the lock on the file.
+func pidFileStatus(path string) (int, bool, error) {
+	pid, err := readPIDFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	defer file.Close()
+
+	err = lockFile(file)
+	if errors.Is(err, errLocked) {
+		return pid, true, nil
+	}
+	return pid, false, err
+}
@@ -0,0 +1,30 @@
+//go:build !windows
+
+package uploader
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// detachedProcAttr starts the daemon in a new session, so it keeps running
+// when the terminal is closed.
+func detachedProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
+
+// lockFile takes an exclusive lock on file without waiting. The lock is held
+// until the file is closed or the process exits.
+func lockFile(file *os.File) error {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return errLocked
+	}
+	return err
+}
+
+// stopProcess asks a running instance to shut down gracefully.
+func stopProcess(process *os.Process) error {
+	return process.Signal(syscall.SIGTERM)
+}
@@ -0,0 +1,36 @@
+package uploader
+
+import (
+	"errors"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+// detachedProcAttr starts the daemon without a console, so it keeps running
+// when the console window is closed.
+func detachedProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{
+		CreationFlags: windows.CREATE_NEW_PROCESS_GROUP | windows.DETACHED_PROCESS,
+	}
+}
+
+// lockFile takes an exclusive lock on file without waiting. The lock is held
+// until the file is closed or the process exits. It covers a byte far past
+// the end of the file, as Windows locks also block reads and the PID must
+// stay readable.
+func lockFile(file *os.File) error {
+	overlapped := &windows.Overlapped{OffsetHigh: 1}
+	err := windows.LockFileEx(windows.Handle(file.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, overlapped)
+	if errors.Is(err, windows.ERROR_LOCK_VIOLATION) {
+		return errLocked
+	}
+	return err
+}
+
+// stopProcess ends a running instance. Windows has no SIGTERM to ask for a
+// graceful shutdown; interrupted uploads resume on the next start.
+func stopProcess(process *os.Process) error {
+	return process.Kill()
+}
@@ -0,0 +1,150 @@
+package uploader
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	deadLetterMove    = "move"
+	deadLetterSymlink = "symlink"
+	deadLetterRecord  = "record"
+
+	// deadLetterResponseLimit caps the response kept in a report
+	deadLetterResponseLimit = 64 << 10
+)
+
+// deadLetterReport is written next to a file in the dead-letter or
+// quarantine directory, as <name>.error.json, to tell why its upload failed.
+type deadLetterReport struct {
+	Path     string    `json:"path"`
+	Error    string    `json:"error"`
+	Response string    `json:"response,omitempty"`
+	Server   string    `json:"server,omitempty"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// validateDeadLetter checks the dead-letter and quarantine settings against
+// the watched directories, which must not contain either directory.
+func validateDeadLetter(c *Config, dirs []*watchDir) error {
+	switch c.DeadLetterMode {
+	case "", deadLetterMove, deadLetterSymlink, deadLetterRecord:
+	default:
+		return fmt.Errorf("unknown dead-letter mode: %s (use move, symlink or record)", c.DeadLetterMode)
+	}
+	for _, dir := range dirs {
+		if c.DeadLetterDir != "" && isInside(c.DeadLetterDir, dir.Path) {
+			return fmt.Errorf("dead-letter directory %s is inside the watched directory %s", c.DeadLetterDir, dir.Path)
+		}
+		if c.QuarantineDir != "" && isInside(c.QuarantineDir, dir.Path) {
+			return fmt.Errorf("quarantine directory %s is inside the watched directory %s", c.QuarantineDir, dir.Path)
+		}
+	}
+	return nil
+}
+
+// isRejection reports whether the server rejected the file itself with a
+// 4xx status that is not retried, as opposed to failing for a while.
+func isRejection(err error) bool {
+	var statusErr *statusError
+	return errors.As(err, &statusErr) && statusErr.StatusCode >= 400 && statusErr.StatusCode < 500 && !isRetryable(err, cfg.Retry)
+}
+
+// setAsideFailed moves a file whose upload failed for good to the quarantine
+// directory if the server rejected it, and otherwise hands it to the
+// dead-letter directory. It returns the file's path there, or "" if it
+// stayed where it was. An upload failed for good once its retries are used
+// up or the server rejected it; other failures, and uploads cut short by a
+// shutdown or canceled by an operator, are left alone to be tried again.
+func setAsideFailed(job *uploadJob, uploadErr error) string {
+	if shutdownStarted() || errors.Is(uploadErr, errCanceled) {
+		return ""
+	}
+	var exhausted *exhaustedError
+	if !errors.As(uploadErr, &exhausted) && !isRejection(uploadErr) {
+		return ""
+	}
+
+	dir, mode, name := cfg.DeadLetterDir, firstNonEmpty(cfg.DeadLetterMode, deadLetterMove), "dead-letter"
+	if cfg.QuarantineDir != "" && isRejection(uploadErr) {
+		dir, mode, name = cfg.QuarantineDir, deadLetterMove, "quarantine"
+	}
+	if dir == "" {
+		return ""
+	}
+
+	dst, err := setAside(job, uploadErr, dir, mode)
+	if err != nil {
+		logrus.Errorf("Failed to add %s to the %s directory: %v", firstNonEmpty(job.Original, job.Path), name, err)
+		return ""
+	}
+	logrus.Warnf("Added %s to the %s directory as %s", firstNonEmpty(job.Original, job.Path), name, dst)
+	if mode != deadLetterMove {
+		return ""
+	}
+	return dst
+}
+
+// setAside moves a file whose upload failed for good into dir, or links to
+// it from there or only reports it, depending on mode, and writes a report
+// of the failure next to it. It returns the file's path in dir. Files keep
+// their path relative to the upload directory.
+func setAside(job *uploadJob, uploadErr error, dir, mode string) (string, error) {
+	filePath := firstNonEmpty(job.Original, job.Path)
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return "", err
+	}
+
+	relPath, err := filepath.Rel(job.Dir.Path, filePath)
+	if err != nil || strings.HasPrefix(relPath, "..") {
+		relPath = filepath.Base(filePath)
+	}
+	dst := filepath.Join(dir, relPath)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", err
+	}
+
+	// Files that stay in place are retried and reported again, so their
+	// entry is replaced rather than added to
+	switch mode {
+	case deadLetterMove:
+		dst = uniquePath(dst)
+		if err := moveFile(filePath, dst); err != nil {
+			return "", err
+		}
+	case deadLetterSymlink:
+		target, err := filepath.Abs(filePath)
+		if err != nil {
+			return "", err
+		}
+		os.Remove(dst)
+		if err := os.Symlink(target, dst); err != nil {
+			return "", err
+		}
+	}
+
+	report := deadLetterReport{
+		Path:     filePath,
+		Error:    uploadErr.Error(),
+		Response: string(job.Response[:min(len(job.Response), deadLetterResponseLimit)]),
+		Server:   targetName(job),
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+		FailedAt: time.Now(),
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return dst, err
+	}
+	return dst, writeFileAtomic(dst+".error.json", append(data, '\n'), 0644)
+}
@@ -0,0 +1,54 @@
+package uploader
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSetAsideFailed(t *testing.T) {
+	saved := cfg
+	t.Cleanup(func() { cfg = saved })
+	cfg = DefaultConfig()
+
+	tests := []struct {
+		name       string
+		err        error
+		setAside   bool
+		quarantine bool
+	}{
+		{name: "first attempt, not retryable", err: errors.New("checksum mismatch")},
+		{name: "retryable, attempts left", err: retryable(errors.New("connection reset"))},
+		{name: "canceled", err: errCanceled},
+		{name: "retries used up", err: &exhaustedError{attempts: 3, err: retryable(errors.New("connection reset"))}, setAside: true},
+		{name: "rejected", err: &statusError{StatusCode: 413, Status: "413 Request Entity Too Large"}, setAside: true},
+		{name: "rejected, quarantined", err: &statusError{StatusCode: 415, Status: "415 Unsupported Media Type"}, setAside: true, quarantine: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := &watchDir{WatchDir: WatchDir{Path: t.TempDir()}}
+			file := filepath.Join(dir.Path, "scan.pdf")
+			if err := os.WriteFile(file, []byte("scan"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			cfg.DeadLetterDir, cfg.QuarantineDir = t.TempDir(), ""
+			want := filepath.Join(cfg.DeadLetterDir, "scan.pdf")
+			if tt.quarantine {
+				cfg.QuarantineDir = t.TempDir()
+				want = filepath.Join(cfg.QuarantineDir, "scan.pdf")
+			}
+
+			got := setAsideFailed(&uploadJob{Path: file, Dir: dir}, tt.err)
+			if !tt.setAside {
+				want = ""
+			}
+			if got != want {
+				t.Fatalf("setAsideFailed(%v) = %q, want %q", tt.err, got, want)
+			}
+			if _, err := os.Stat(file); (err == nil) == tt.setAside {
+				t.Errorf("file still in the watched directory: %v, want %v", err == nil, !tt.setAside)
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// DebugHTTPConfig records every request of the http backend with the
+// server's answer, to troubleshoot uploads the server rejects: the request
+// line and headers, the response status, headers and the start of the body.
+// Request bodies are left out, as they hold the files. Secrets in headers,
+// query parameters and JSON bodies are replaced with [REDACTED].
+type DebugHTTPConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// File is the debug log the exchanges are appended to, rotated once it
+	// grows past MaxSize, keeping MaxBackups old files
+	File       string   `yaml:"file"`
+	MaxSize    ByteSize `yaml:"max_size"`
+	MaxBackups int      `yaml:"max_backups"`
+	// Dir writes every exchange to a file of its own in it instead, named
+	// after the time and the uploaded file
+	Dir string `yaml:"dir"`
+	// MaxBody limits how much of a response body is recorded
+	MaxBody ByteSize `yaml:"max_body"`
+}
+
+const redacted = "[REDACTED]"
+
+var (
+	// secretName matches the names of headers, query parameters and JSON
+	// fields whose values are not recorded
+	secretName = regexp.MustCompile(`(?i)^(proxy-)?authorization$|token|secret|password|passwd|cookie|signature|credential|key$|^(auth|sig)$`)
+	// secretField matches the JSON fields with secretName names and their
+	// string values
+	secretField = regexp.MustCompile(`(?i)("[^"]*(?:token|secret|password|passwd|signature|credential|api_?key)[^"]*"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+
+	debugMu  sync.Mutex
+	debugLog *lumberjack.Logger
+	// debugSeq tells apart the capture files of the same millisecond
+	debugSeq atomic.Uint64
+)
+
+// uploadPathKey is the context key of the path of the file a request
+// uploads, set by trackUploads.
+type uploadPathKey struct{}
+
+// uploadPathOf returns the path of the file whose upload ctx belongs to, ""
+// if it is not the upload of a single file.
+func uploadPathOf(ctx context.Context) string {
+	path, _ := ctx.Value(uploadPathKey{}).(string)
+	return path
+}
+
+// debugTransport records the requests it sends with their responses.
+type debugTransport struct {
+	base http.RoundTripper
+	conf DebugHTTPConfig
+}
+
+// newDebugTransport wraps base in a debugTransport if conf enables it.
+func newDebugTransport(conf DebugHTTPConfig, base http.RoundTripper) http.RoundTripper {
+	if !conf.Enabled {
+		return base
+	}
+	return debugTransport{base: base, conf: conf}
+}
+
+func (t debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	var capture bytes.Buffer
+	filePath := uploadPathOf(req.Context())
+	fmt.Fprintf(&capture, "=== %s %s\n", start.Format(time.RFC3339Nano), firstNonEmpty(filePath, "-"))
+	fmt.Fprintf(&capture, "> %s %s %s\n", req.Method, redactURL(req.URL.String()), req.Proto)
+	fmt.Fprintf(&capture, "> Host: %s\n", req.Host)
+	writeHeaders(&capture, "> ", req.Header)
+	if req.ContentLength >= 0 {
+		fmt.Fprintf(&capture, "> (body of %d bytes not recorded)\n", req.ContentLength)
+	} else {
+		fmt.Fprintf(&capture, "> (streamed body not recorded)\n")
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	elapsed := time.Since(start).Round(time.Millisecond)
+	if err != nil {
+		fmt.Fprintf(&capture, "! %v (after %s)\n\n", err, elapsed)
+		t.write(filePath, start, capture.Bytes())
+		return nil, err
+	}
+
+	fmt.Fprintf(&capture, "< %s %s (after %s)\n", resp.Proto, resp.Status, elapsed)
+	writeHeaders(&capture, "< ", resp.Header)
+	// Read the start of the body and hand it back to the caller unchanged
+	body, readErr := io.ReadAll(io.LimitReader(resp.Body, int64(t.conf.MaxBody)))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+	capture.WriteString("<\n")
+	capture.Write(secretField.ReplaceAll(body, []byte(`$1"`+redacted+`"`)))
+	if t.conf.MaxBody > 0 && int64(len(body)) == int64(t.conf.MaxBody) {
+		capture.WriteString("\n< (body truncated)")
+	}
+	if readErr != nil {
+		fmt.Fprintf(&capture, "\n! reading body: %v", readErr)
+	}
+	capture.WriteString("\n\n")
+	t.write(filePath, start, capture.Bytes())
+	return resp, nil
+}
+
+// write appends an exchange to the debug log, or writes it to a file of its
+// own in the capture directory.
+func (t debugTransport) write(filePath string, start time.Time, capture []byte) {
+	if t.conf.Dir != "" {
+		base := "request"
+		if filePath != "" {
+			base = filepath.Base(filePath)
+		}
+		name := fmt.Sprintf("%s-%d-%s.log", start.Format("20060102-150405.000"), debugSeq.Add(1), base)
+		if err := os.MkdirAll(t.conf.Dir, 0700); err != nil {
+			logrus.Warn("Error writing HTTP debug capture: ", err)
+			return
+		}
+		if err := os.WriteFile(filepath.Join(t.conf.Dir, name), capture, 0600); err != nil {
+			logrus.Warn("Error writing HTTP debug capture: ", err)
+		}
+		return
+	}
+
+	debugMu.Lock()
+	defer debugMu.Unlock()
+	log := openDebugLog(t.conf)
+	if _, err := log.Write(capture); err != nil {
+		logrus.Warn("Error writing HTTP debug log: ", err)
+	}
+}
+
+// openDebugLog returns the debug log for conf, replacing the open one if a
+// reload changed its settings. debugMu must be held.
+func openDebugLog(conf DebugHTTPConfig) *lumberjack.Logger {
+	// lumberjack counts in whole megabytes
+	maxSize := int((conf.MaxSize + (1<<20 - 1)) >> 20)
+	if debugLog != nil && debugLog.Filename == conf.File && debugLog.MaxSize == maxSize && debugLog.MaxBackups == conf.MaxBackups {
+		return debugLog
+	}
+	if debugLog != nil {
+		debugLog.Close()
+	}
+	debugLog = &lumberjack.Logger{Filename: conf.File, MaxSize: maxSize, MaxBackups: conf.MaxBackups}
+	return debugLog
+}
+
+// writeHeaders writes headers sorted by name, with the values of secret
+// ones redacted.
+func writeHeaders(w io.Writer, prefix string, headers http.Header) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range headers[name] {
+			if secretName.MatchString(name) {
+				value = redacted
+			}
+			fmt.Fprintf(w, "%s%s: %s\n", prefix, name, value)
+		}
+	}
+}
+
+// redactURL hides the password and the secret query parameters of a URL,
+// such as the signature of a presigned one.
+func redactURL(raw string) string {
+	base, query, ok := strings.Cut(raw, "?")
+	if i := strings.Index(base, "://"); i >= 0 {
+		if at := strings.LastIndex(base[i+3:], "@"); at >= 0 {
+			userinfo := base[i+3 : i+3+at]
+			if user, _, hasPassword := strings.Cut(userinfo, ":"); hasPassword {
+				base = base[:i+3] + user + ":" + redacted + base[i+3+at:]
+			}
+		}
+	}
+	if !ok {
+		return base
+	}
+	params := strings.Split(query, "&")
+	for i, param := range params {
+		if name, _, hasValue := strings.Cut(param, "="); hasValue && secretName.MatchString(name) {
+			params[i] = name + "=" + redacted
+		}
+	}
+	return base + "?" + strings.Join(params, "&")
+}
@@ -0,0 +1,55 @@
+package uploader
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	dedupOff  = "off"
+	dedupSkip = "skip"
+	dedupFlag = "flag"
+)
+
+func validateDedup(mode string) error {
+	switch mode {
+	case dedupOff, dedupSkip, dedupFlag:
+		return nil
+	default:
+		return fmt.Errorf("unknown dedup mode: %s", mode)
+	}
+}
+
+// findDuplicate hashes the job's file and returns the path the same content
+// was uploaded from before, or "" if it is new.
+func findDuplicate(job *uploadJob) (string, error) {
+	checksum, err := job.checksum()
+	if err != nil {
+		return "", err
+	}
+
+	original, err := state.pathForChecksum(checksum)
+	if err != nil || original == job.Path {
+		return "", err
+	}
+	return original, nil
+}
+
+// skipDuplicate records a duplicate file as handled without uploading it, so
+// it is not hashed again on every scan.
+func skipDuplicate(job *uploadJob, original string) {
+	info, err := os.Stat(job.Path)
+	if err != nil {
+		logrus.Error("Error reading file info:", err)
+		return
+	}
+
+	rec := newFileRecord(job.Path, info, job.Checksum)
+	rec.DuplicateOf = original
+	if err := state.put(rec); err != nil {
+		logrus.Error("Error saving upload state:", err)
+	}
+	finishFile(job.Dir, job.Path)
+}
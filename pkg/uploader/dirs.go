@@ -0,0 +1,194 @@
+package uploader
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// WatchDir configures one watched directory. Settings left empty fall back to
+// the top-level ones, so several ingestion pipelines can share a daemon while
+// a plain upload_dir keeps working as before.
+type WatchDir struct {
+	Path        string                 `yaml:"path"`
+	ServerURL   string                 `yaml:"server_url"`
+	FieldName   string                 `yaml:"field_name"`
+	Filename    string                 `yaml:"filename"`
+	Body        map[string]interface{} `yaml:"body"`
+	Include     []string               `yaml:"include"`
+	Exclude     []string               `yaml:"exclude"`
+	AfterUpload string                 `yaml:"after_upload"`
+	ArchiveDir  string                 `yaml:"archive_dir"`
+	Routes      []RouteConfig          `yaml:"routes"`
+	// ArchiveSubdirs uploads every subdirectory as one tar.gz or zip
+	// archive instead of file by file
+	ArchiveSubdirs string `yaml:"archive_subdirs"`
+	// UploadOrder uploads the files of each directory strictly by mtime or
+	// name
+	UploadOrder string `yaml:"upload_order"`
+	// MaxDepth limits how many levels of the directory are watched, 1 being
+	// only the files directly in it; 0 is no limit
+	MaxDepth int `yaml:"max_depth"`
+}
+
+// watchDir is a watched directory with its settings resolved.
+type watchDir struct {
+	WatchDir
+	filter      *fileFilter
+	afterUpload afterUploadAction
+}
+
+// watchDirs resolves upload_dir and the directories list into the watched
+// directories. Directories may not overlap, and files may not be moved or
+// archived into any of them.
+func (c *Config) watchDirs() ([]*watchDir, error) {
+	var configured []WatchDir
+	if c.UploadDir != "" {
+		configured = append(configured, WatchDir{Path: c.UploadDir})
+	}
+	configured = append(configured, c.Directories...)
+	if len(configured) == 0 {
+		return nil, errors.New("no upload directory configured: set -upload-dir or directories")
+	}
+	if err := validateLimits(c); err != nil {
+		return nil, err
+	}
+	if err := validateBacklog(c); err != nil {
+		return nil, err
+	}
+	if err := validateSymlinks(c.Symlinks); err != nil {
+		return nil, err
+	}
+
+	var dirs []*watchDir
+	for _, d := range configured {
+		if d.Path == "" {
+			return nil, errors.New("watched directory without a path")
+		}
+
+		d.ServerURL = firstNonEmpty(d.ServerURL, c.ServerURL)
+		d.FieldName = firstNonEmpty(d.FieldName, c.FieldName)
+		d.Filename = firstNonEmpty(d.Filename, c.Filename)
+		d.AfterUpload = firstNonEmpty(d.AfterUpload, c.AfterUpload)
+		d.ArchiveDir = firstNonEmpty(d.ArchiveDir, c.ArchiveDir)
+		d.ArchiveSubdirs = firstNonEmpty(d.ArchiveSubdirs, c.ArchiveSubdirs)
+		d.UploadOrder = firstNonEmpty(d.UploadOrder, c.UploadOrder)
+		if d.MaxDepth == 0 {
+			d.MaxDepth = c.MaxDepth
+		}
+		if d.Include == nil {
+			d.Include = c.Include
+		}
+		if d.Exclude == nil {
+			d.Exclude = c.Exclude
+		}
+
+		body := make(map[string]interface{}, len(c.Body)+len(d.Body))
+		for key, value := range c.Body {
+			body[key] = value
+		}
+		for key, value := range d.Body {
+			body[key] = value
+		}
+		d.Body = body
+
+		afterUpload, err := parseAfterUpload(d.AfterUpload, d.ArchiveDir)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", d.Path, err)
+		}
+		if d.Routes, err = resolveRoutes(d.Routes, c.Routes); err != nil {
+			return nil, fmt.Errorf("%s: %w", d.Path, err)
+		}
+		if err := validateSubdirArchive(d.ArchiveSubdirs); err != nil {
+			return nil, fmt.Errorf("%s: %w", d.Path, err)
+		}
+		if err := validateUploadOrder(d.UploadOrder); err != nil {
+			return nil, fmt.Errorf("%s: %w", d.Path, err)
+		}
+		if d.MaxDepth < 0 {
+			return nil, fmt.Errorf("%s: max_depth %d is negative", d.Path, d.MaxDepth)
+		}
+		if d.ArchiveSubdirs != "" && afterUpload.kind == afterUploadArchive {
+			return nil, fmt.Errorf("%s: subdirectories uploaded as archives can be kept, deleted or moved, not archived", d.Path)
+		}
+
+		dirs = append(dirs, &watchDir{
+			WatchDir:    d,
+			filter:      newFileFilter(d.Include, d.Exclude),
+			afterUpload: afterUpload,
+		})
+	}
+
+	if err := validateDeadLetter(c, dirs); err != nil {
+		return nil, err
+	}
+	for i, dir := range dirs {
+		for j, other := range dirs {
+			if i != j && isInside(dir.Path, other.Path) {
+				return nil, fmt.Errorf("watched directory %s overlaps with %s", dir.Path, other.Path)
+			}
+			if dir.afterUpload.dir != "" && isInside(dir.afterUpload.dir, other.Path) {
+				return nil, fmt.Errorf("after-upload directory %s is inside the watched directory %s", dir.afterUpload.dir, other.Path)
+			}
+		}
+	}
+
+	return dirs, nil
+}
+
+// depth returns how many levels below the watched directory path is, 1 for
+// the entries directly in it.
+func (d *watchDir) depth(path string) int {
+	relPath, err := filepath.Rel(d.Path, path)
+	if err != nil || relPath == "." {
+		return 0
+	}
+	return strings.Count(filepath.ToSlash(relPath), "/") + 1
+}
+
+// isTooDeep reports whether a file at path lies below max_depth.
+func (d *watchDir) isTooDeep(path string) bool {
+	return d.MaxDepth > 0 && d.depth(path) > d.MaxDepth
+}
+
+// isBeyondDepth reports whether the directory at path is at max_depth or
+// below, so none of its files are watched.
+func (d *watchDir) isBeyondDepth(path string) bool {
+	return d.MaxDepth > 0 && d.depth(path) >= d.MaxDepth
+}
+
+// dirFor returns the watched directory that contains path, or nil.
+func dirFor(dirs []*watchDir, path string) *watchDir {
+	for _, dir := range dirs {
+		if isInside(path, dir.Path) {
+			return dir
+		}
+	}
+	return nil
+}
+
+// uploadDirFlag handles repeated -upload-dir flags: the first one replaces
+// upload_dir from the config file, every further one adds a directory with
+// the top-level settings.
+type uploadDirFlag struct {
+	c   *Config
+	set bool
+}
+
+func (f *uploadDirFlag) String() string {
+	if f.c == nil {
+		return ""
+	}
+	return f.c.UploadDir
+}
+
+func (f *uploadDirFlag) Set(value string) error {
+	if !f.set {
+		f.c.UploadDir = value
+		f.set = true
+		return nil
+	}
+	f.c.Directories = append(f.c.Directories, WatchDir{Path: value})
+	return nil
+}
@@ -0,0 +1,399 @@
+package uploader
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"golang.org/x/oauth2/microsoft"
+)
+
+const (
+	driveGoogle   = "gdrive"
+	driveDropbox  = "dropbox"
+	driveOneDrive = "onedrive"
+)
+
+var driveBucket = []byte("drive")
+
+// DriveConfig configures the drive backend, which mirrors the watched
+// directories into a Google Drive, Dropbox or OneDrive folder for home users.
+// auto-upload has to be registered as an app with the service, and
+// "auto-upload login" signs in to the account once.
+type DriveConfig struct {
+	// Kind is gdrive, dropbox or onedrive
+	Kind string `yaml:"kind"`
+	// ClientID identifies the registered app. Google also hands out a
+	// client secret for it, which can come from DRIVE_CLIENT_SECRET too.
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	// Tenant is the Microsoft tenant for OneDrive: common (the default),
+	// consumers, organizations or a tenant id
+	Tenant string `yaml:"tenant"`
+	// TokenFile is where the login is kept, auto-upload-<kind>-token.json by
+	// default; it grants access to the drive, so keep it private
+	TokenFile string `yaml:"token_file"`
+
+	// Folder is the drive folder files are mirrored into, keeping their
+	// paths below the watched directory
+	Folder string `yaml:"folder"`
+	// Folders maps watched directories to drive folders of their own
+	Folders map[string]string `yaml:"folders"`
+	// ChunkSize is the size of the pieces of a resumable upload, rounded
+	// down to what the service asks for
+	ChunkSize ByteSize `yaml:"chunk_size"`
+	// Endpoint replaces the service's API, for testing
+	Endpoint string `yaml:"endpoint"`
+}
+
+// driveUpload is the persisted upload session of a file, so an interrupted
+// upload continues where the service left off.
+type driveUpload struct {
+	Kind    string    `json:"kind"`
+	Path    string    `json:"path"`
+	Session string    `json:"session"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Offset  int64     `json:"offset"`
+}
+
+// errDriveSessionGone is returned by a driveService for an upload session
+// that has expired, so the upload starts over.
+var errDriveSessionGone = errors.New("upload session expired")
+
+// driveService is the API of one of the drives.
+type driveService interface {
+	// start opens an upload session for size bytes at remotePath, a
+	// slash-separated path below the root of the drive.
+	start(job *uploadJob, remotePath string, size int64) (string, error)
+	// resume returns how much of upload the service has.
+	resume(ctx context.Context, upload *driveUpload) (int64, error)
+	// put sends length bytes of the file at offset and returns the offset to
+	// continue at, or the file's URL once the service has all of it.
+	put(ctx context.Context, upload *driveUpload, chunk io.Reader, offset, length int64) (next int64, remoteURL string, done bool, err error)
+	// chunkAlign is the granularity of the pieces of an upload.
+	chunkAlign() int64
+}
+
+// driveBackend uploads files to a consumer drive with resumable upload
+// sessions, replacing files that are uploaded again.
+type driveBackend struct {
+	conf      DriveConfig
+	service   driveService
+	chunkSize int64
+}
+
+func newDriveBackend(conf DriveConfig) (*driveBackend, error) {
+	oauthConfig, err := newDriveOAuthConfig(&conf)
+	if err != nil {
+		return nil, err
+	}
+	token, err := readDriveToken(conf.TokenFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// Token refreshes and uploads both go through the configured proxy
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: newTransport()})
+	source := &savingTokenSource{file: conf.TokenFile, base: oauthConfig.TokenSource(ctx, token), saved: token.AccessToken}
+	client := oauth2.NewClient(ctx, source)
+	client.Timeout = cfg.HTTPClient.RequestTimeout
+	// Upload URLs handed out by the services carry their own authorization
+	plain := &http.Client{Transport: newTransport(), Timeout: cfg.HTTPClient.RequestTimeout}
+
+	b := &driveBackend{conf: conf}
+	switch conf.Kind {
+	case driveGoogle:
+		b.service = newGoogleDrive(firstNonEmpty(conf.Endpoint, "https://www.googleapis.com"), client)
+	case driveDropbox:
+		b.service = newDropbox(conf.Endpoint, client)
+	case driveOneDrive:
+		b.service = newOneDrive(firstNonEmpty(conf.Endpoint, "https://graph.microsoft.com"), client, plain)
+	}
+
+	align := b.service.chunkAlign()
+	b.chunkSize = int64(conf.ChunkSize) / align * align
+	if b.chunkSize < align {
+		b.chunkSize = align
+	}
+	return b, nil
+}
+
+// newDriveOAuthConfig checks conf and returns the OAuth settings of its
+// service.
+func newDriveOAuthConfig(conf *DriveConfig) (*oauth2.Config, error) {
+	if conf.ClientID == "" {
+		return nil, errors.New("the drive backend needs the client id of an app registered with the service")
+	}
+	oauthConfig := &oauth2.Config{
+		ClientID:     conf.ClientID,
+		ClientSecret: firstNonEmpty(conf.ClientSecret, os.Getenv("DRIVE_CLIENT_SECRET")),
+	}
+	switch conf.Kind {
+	case driveGoogle:
+		oauthConfig.Endpoint = google.Endpoint
+		// Only the files auto-upload creates are visible to it
+		oauthConfig.Scopes = []string{"https://www.googleapis.com/auth/drive.file"}
+	case driveDropbox:
+		oauthConfig.Endpoint = oauth2.Endpoint{
+			AuthURL:  "https://www.dropbox.com/oauth2/authorize",
+			TokenURL: "https://api.dropboxapi.com/oauth2/token",
+		}
+	case driveOneDrive:
+		oauthConfig.Endpoint = microsoft.AzureADEndpoint(conf.Tenant)
+		oauthConfig.Scopes = []string{"Files.ReadWrite", "offline_access"}
+	default:
+		return nil, fmt.Errorf("unknown drive: %s (use gdrive, dropbox or onedrive)", conf.Kind)
+	}
+	if conf.TokenFile == "" {
+		conf.TokenFile = "auto-upload-" + conf.Kind + "-token.json"
+	}
+	return oauthConfig, nil
+}
+
+// remotePath returns where the file of job goes in the drive: the folder of
+// its watched directory followed by its path below it.
+func (b *driveBackend) remotePath(job *uploadJob) string {
+	folder := b.conf.Folder
+	if job.Dir != nil {
+		dir, _ := filepath.Abs(job.Dir.Path)
+		for local, remote := range b.conf.Folders {
+			if abs, _ := filepath.Abs(local); abs == dir {
+				folder = remote
+				break
+			}
+		}
+	}
+	return strings.Trim(path.Join(folder, path.Dir(job.RelPath), job.uploadName()), "/")
+}
+
+func (b *driveBackend) upload(job *uploadJob) (*fileRecord, error) {
+	filePath := job.Path
+	file, info, err := openFile(job.context(), filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	checksum, err := job.checksum()
+	if err != nil {
+		return nil, fmt.Errorf("hashing file: %w", err)
+	}
+	remotePath := b.remotePath(job)
+
+	upload, err := b.resume(job, info, remotePath)
+	if err != nil {
+		return nil, driveError(err)
+	}
+	if upload == nil {
+		session, err := b.service.start(job, remotePath, info.Size())
+		if err != nil {
+			return nil, driveError(err)
+		}
+		upload = &driveUpload{
+			Kind:    b.conf.Kind,
+			Path:    remotePath,
+			Session: session,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		}
+	} else {
+		logrus.Infof("Resuming upload of %s at offset %d", filePath, upload.Offset)
+	}
+
+	for {
+		length := min(upload.Size-upload.Offset, b.chunkSize)
+		next, remoteURL, done, err := b.service.put(job.context(), upload, io.NewSectionReader(file, upload.Offset, length), upload.Offset, length)
+		if err != nil {
+			if errors.Is(err, errDriveSessionGone) {
+				// Start over with a new session on the next attempt
+				state.delete(driveBucket, job.stateKey())
+			}
+			return nil, driveError(err)
+		}
+		if done {
+			if err := state.delete(driveBucket, job.stateKey()); err != nil {
+				logrus.Error("Error clearing upload session:", err)
+			}
+			rec := newFileRecord(filePath, info, checksum)
+			rec.RemoteURL = remoteURL
+			return rec, nil
+		}
+		upload.Offset = next
+		if err := state.putJSON(driveBucket, job.stateKey(), upload); err != nil {
+			logrus.Error("Error saving upload session:", err)
+		}
+	}
+}
+
+// resume looks up a stored session for the file and asks the service how
+// much of it was received. It returns nil if there is nothing to resume.
+func (b *driveBackend) resume(job *uploadJob, info os.FileInfo, remotePath string) (*driveUpload, error) {
+	upload := &driveUpload{}
+	found, err := state.getJSON(driveBucket, job.stateKey(), upload)
+	if err != nil {
+		return nil, err
+	}
+
+	// A changed file, or one that goes elsewhere now, can not continue an
+	// upload of its old content
+	if !found || upload.Kind != b.conf.Kind || upload.Path != remotePath ||
+		upload.Size != info.Size() || !upload.ModTime.Equal(info.ModTime()) {
+		return nil, nil
+	}
+
+	offset, err := b.service.resume(job.context(), upload)
+	if errors.Is(err, errDriveSessionGone) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	upload.Offset = offset
+	return upload, nil
+}
+
+// driveError explains failures to refresh the login, which retrying does
+// not get past.
+func driveError(err error) error {
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) {
+		return fmt.Errorf("the drive login has expired or was revoked, sign in again with auto-upload login: %s", retrieveErr.Error())
+	}
+	if errors.Is(err, errDriveSessionGone) {
+		return retryable(err)
+	}
+	return err
+}
+
+// driveStatusError reads the explanation of a failed request from the
+// body, as the three services put it.
+func driveStatusError(resp *http.Response) error {
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+
+	message := strings.TrimSpace(string(data))
+	var body struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+		ErrorSummary string `json:"error_summary"`
+	}
+	if json.Unmarshal(data, &body) == nil {
+		message = firstNonEmpty(body.Error.Message, body.ErrorSummary, message)
+	}
+	return fmt.Errorf("%w: %s", newStatusError(resp), message)
+}
+
+// savingTokenSource writes the token to the token file whenever it is
+// refreshed, as Microsoft replaces the refresh token with every refresh.
+type savingTokenSource struct {
+	file string
+	base oauth2.TokenSource
+
+	mu    sync.Mutex
+	saved string
+}
+
+func (s *savingTokenSource) Token() (*oauth2.Token, error) {
+	token, err := s.base.Token()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if token.AccessToken != s.saved {
+		if err := writeDriveToken(s.file, token); err != nil {
+			logrus.Errorf("Saving the refreshed drive login failed: %v", err)
+		}
+		s.saved = token.AccessToken
+	}
+	return token, nil
+}
+
+func readDriveToken(file string) (*oauth2.Token, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("not signed in to the drive yet, run auto-upload login first (%s does not exist)", file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading the drive login: %w", err)
+	}
+	token := &oauth2.Token{}
+	if err := json.Unmarshal(data, token); err != nil {
+		return nil, fmt.Errorf("parsing the drive login %s: %w", file, err)
+	}
+	return token, nil
+}
+
+func writeDriveToken(file string, token *oauth2.Token) error {
+	data, err := json.MarshalIndent(token, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(file, data, 0o600)
+}
+
+// runLogin implements "auto-upload login": it signs in to the drive of the
+// drive backend and saves the login to its token file. Google and Microsoft
+// show a code to enter on another device; Dropbox has no such flow and shows
+// a code to paste back instead.
+func runLogin(args []string) error {
+	fs := flag.NewFlagSet("login", flag.ExitOnError)
+	fs.StringVar(&configFile, "config", "", "YAML file to load settings from; flags override its values")
+	registerFlags(fs, &cfg)
+	fs.Parse(args)
+	if err := resolveSecrets(&cfg); err != nil {
+		return err
+	}
+
+	conf := cfg.Drive
+	oauthConfig, err := newDriveOAuthConfig(&conf)
+	if err != nil {
+		return err
+	}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: newTransport()})
+
+	var token *oauth2.Token
+	if conf.Kind == driveDropbox {
+		verifier := oauth2.GenerateVerifier()
+		authURL := oauthConfig.AuthCodeURL("", oauth2.S256ChallengeOption(verifier), oauth2.SetAuthURLParam("token_access_type", "offline"))
+		fmt.Printf("Open this page, allow access and paste the code Dropbox shows:\n\n  %s\n\nCode: ", authURL)
+		code, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("reading the code: %w", err)
+		}
+		if token, err = oauthConfig.Exchange(ctx, strings.TrimSpace(code), oauth2.VerifierOption(verifier)); err != nil {
+			return err
+		}
+	} else {
+		device, err := oauthConfig.DeviceAuth(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Open %s on any device and enter the code %s\n", device.VerificationURI, device.UserCode)
+		fmt.Println("Waiting for the sign-in...")
+		if token, err = oauthConfig.DeviceAccessToken(ctx, device); err != nil {
+			return err
+		}
+	}
+
+	if err := writeDriveToken(conf.TokenFile, token); err != nil {
+		return fmt.Errorf("saving the login: %w", err)
+	}
+	fmt.Printf("Signed in, the login is saved in %s\n", conf.TokenFile)
+	return nil
+}
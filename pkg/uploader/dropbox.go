@@ -0,0 +1,179 @@
+package uploader
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"unicode/utf16"
+)
+
+// dropbox uploads to Dropbox with upload sessions. Dropbox cannot tell how
+// much of a session it has, so resuming continues at the stored offset and
+// corrects it when Dropbox answers with the offset it expected.
+type dropbox struct {
+	endpoint string
+	client   *http.Client
+}
+
+func newDropbox(endpoint string, client *http.Client) *dropbox {
+	return &dropbox{
+		endpoint: strings.TrimSuffix(firstNonEmpty(endpoint, "https://content.dropboxapi.com"), "/"),
+		client:   client,
+	}
+}
+
+// chunkAlign is 4 MiB, the size Dropbox recommends chunks be a multiple of.
+func (d *dropbox) chunkAlign() int64 {
+	return 4 << 20
+}
+
+type dropboxCursor struct {
+	SessionID string `json:"session_id"`
+	Offset    int64  `json:"offset"`
+}
+
+func (d *dropbox) start(job *uploadJob, _ string, _ int64) (string, error) {
+	var session struct {
+		SessionID string `json:"session_id"`
+	}
+	if err := d.call(job.context(), "/2/files/upload_session/start", map[string]bool{"close": false}, nil, 0, &session); err != nil {
+		return "", err
+	}
+	return session.SessionID, nil
+}
+
+func (d *dropbox) resume(_ context.Context, upload *driveUpload) (int64, error) {
+	return upload.Offset, nil
+}
+
+func (d *dropbox) put(ctx context.Context, upload *driveUpload, chunk io.Reader, offset, length int64) (int64, string, bool, error) {
+	cursor := dropboxCursor{SessionID: upload.Session, Offset: offset}
+	if offset+length < upload.Size {
+		err := d.call(ctx, "/2/files/upload_session/append_v2", map[string]interface{}{"cursor": cursor, "close": false}, chunk, length, nil)
+		if next, ok := correctOffset(err); ok {
+			return next, "", false, nil
+		}
+		if err != nil {
+			return 0, "", false, err
+		}
+		return offset + length, "", false, nil
+	}
+
+	// The last chunk goes with the request that saves the file
+	var file struct {
+		PathDisplay string `json:"path_display"`
+	}
+	arg := map[string]interface{}{
+		"cursor": cursor,
+		"commit": map[string]interface{}{"path": "/" + upload.Path, "mode": "overwrite", "mute": true},
+	}
+	err := d.call(ctx, "/2/files/upload_session/finish", arg, chunk, length, &file)
+	if next, ok := correctOffset(err); ok {
+		return next, "", false, nil
+	}
+	if err != nil {
+		return 0, "", false, err
+	}
+	return upload.Size, "https://www.dropbox.com/home" + path.Dir(file.PathDisplay) + "?preview=" + url.QueryEscape(path.Base(file.PathDisplay)), true, nil
+}
+
+// dropboxError is the answer to a session request Dropbox refused, as
+// {"error": {".tag": "incorrect_offset", "correct_offset": 123}} for append
+// and nested in lookup_failed for finish.
+type dropboxError struct {
+	Summary string `json:"error_summary"`
+	Error   struct {
+		dropboxLookupError
+		LookupFailed dropboxLookupError `json:"lookup_failed"`
+	} `json:"error"`
+}
+
+type dropboxLookupError struct {
+	Tag           string `json:".tag"`
+	CorrectOffset *int64 `json:"correct_offset"`
+}
+
+// dropboxOffsetError is returned for a chunk sent at another offset than
+// the one Dropbox expected.
+type dropboxOffsetError struct {
+	offset int64
+}
+
+func (e *dropboxOffsetError) Error() string {
+	return fmt.Sprintf("dropbox expected offset %d", e.offset)
+}
+
+func correctOffset(err error) (int64, bool) {
+	if offsetErr, ok := err.(*dropboxOffsetError); ok {
+		return offsetErr.offset, true
+	}
+	return 0, false
+}
+
+// call sends a request with its arguments in the Dropbox-API-Arg header and
+// length bytes of body, and decodes the answer into result.
+func (d *dropbox) call(ctx context.Context, method string, arg interface{}, body io.Reader, length int64, result interface{}) error {
+	argJSON, err := json.Marshal(arg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.endpoint+method, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = length
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Dropbox-API-Arg", asciiJSON(argJSON))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusConflict {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		var refused dropboxError
+		json.Unmarshal(data, &refused)
+		for _, lookup := range []dropboxLookupError{refused.Error.dropboxLookupError, refused.Error.LookupFailed} {
+			if lookup.CorrectOffset != nil {
+				return &dropboxOffsetError{offset: *lookup.CorrectOffset}
+			}
+			if lookup.Tag == "not_found" || lookup.Tag == "closed" {
+				return errDriveSessionGone
+			}
+		}
+		return fmt.Errorf("%w: %s", newStatusError(resp), firstNonEmpty(refused.Summary, string(data)))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return driveStatusError(resp)
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("reading dropbox response: %w", err)
+	}
+	return nil
+}
+
+// asciiJSON escapes the characters outside ASCII in a JSON document, as
+// HTTP headers such as Dropbox-API-Arg can only carry ASCII.
+func asciiJSON(data []byte) string {
+	var out strings.Builder
+	for _, r := range string(data) {
+		if r < 0x80 {
+			out.WriteRune(r)
+			continue
+		}
+		for _, unit := range utf16.Encode([]rune{r}) {
+			fmt.Fprintf(&out, `\u%04x`, unit)
+		}
+	}
+	return out.String()
+}
@@ -0,0 +1,327 @@
+package uploader
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// EmailConfig configures the email backend.
+type EmailConfig struct {
+	// Host is the SMTP server as host[:port]; the port defaults to 587, or
+	// 465 with implicit TLS
+	Host string `yaml:"host"`
+	User string `yaml:"user"`
+	// Password can also come from EMAIL_PASSWORD
+	Password string `yaml:"password"`
+	// TLS is starttls (the default), implicit or none
+	TLS                string `yaml:"tls"`
+	CAFile             string `yaml:"ca_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+
+	From string   `yaml:"from"`
+	To   []string `yaml:"to"`
+	// Subject and Body are templates with the same fields as remote
+	// directories
+	Subject string `yaml:"subject"`
+	Body    string `yaml:"body"`
+	// MaxFileSize is the largest file sent; mail servers commonly refuse
+	// messages over 10-25MB, and the attachment grows by a third on the way
+	MaxFileSize ByteSize      `yaml:"max_file_size"`
+	Timeout     time.Duration `yaml:"timeout"`
+}
+
+// emailBackend sends each file as the attachment of a message, for
+// receiving systems that are a mailbox. Every file gets its own connection,
+// as mail servers close idle ones quickly.
+type emailBackend struct {
+	conf      EmailConfig
+	from      *mail.Address
+	to        []string
+	tlsConfig *tls.Config
+}
+
+func newEmailBackend(conf EmailConfig) (*emailBackend, error) {
+	if conf.Host == "" {
+		return nil, errors.New("email backend needs an smtp host")
+	}
+	if conf.From == "" || len(conf.To) == 0 {
+		return nil, errors.New("email backend needs a sender and at least one recipient")
+	}
+	from, err := mail.ParseAddress(conf.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid email sender %q: %w", conf.From, err)
+	}
+	var to []string
+	for _, recipient := range conf.To {
+		address, err := mail.ParseAddress(recipient)
+		if err != nil {
+			return nil, fmt.Errorf("invalid email recipient %q: %w", recipient, err)
+		}
+		to = append(to, address.Address)
+	}
+
+	switch conf.TLS {
+	case "":
+		conf.TLS = "starttls"
+	case "starttls", "implicit", "none":
+	default:
+		return nil, fmt.Errorf("unknown email tls mode: %s (use starttls, implicit or none)", conf.TLS)
+	}
+	if _, _, err := net.SplitHostPort(conf.Host); err != nil {
+		port := "587"
+		if conf.TLS == "implicit" {
+			port = "465"
+		}
+		conf.Host = net.JoinHostPort(conf.Host, port)
+	}
+	if conf.Password == "" {
+		conf.Password = os.Getenv("EMAIL_PASSWORD")
+	}
+	if conf.Timeout <= 0 {
+		conf.Timeout = 2 * time.Minute
+	}
+
+	b := &emailBackend{conf: conf, from: from, to: to}
+	if conf.TLS != "none" {
+		if b.tlsConfig, err = tlsClientConfig(conf.CAFile, conf.InsecureSkipVerify); err != nil {
+			return nil, err
+		}
+		b.tlsConfig.ServerName, _, _ = net.SplitHostPort(conf.Host)
+		if conf.InsecureSkipVerify {
+			logrus.Warn("SMTP certificate verification is disabled, the connection can be intercepted")
+		}
+	}
+	return b, nil
+}
+
+func (b *emailBackend) upload(job *uploadJob) (*fileRecord, error) {
+	filePath := job.Path
+	file, info, err := openFile(job.context(), filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if b.conf.MaxFileSize > 0 && info.Size() > int64(b.conf.MaxFileSize) {
+		return nil, fmt.Errorf("the file has %d bytes, attachments are limited to %d by max_file_size", info.Size(), b.conf.MaxFileSize)
+	}
+	data := newFileTemplateData(job, info)
+	subject, err := renderTemplate(b.conf.Subject, data)
+	if err != nil {
+		return nil, fmt.Errorf("rendering subject: %w", err)
+	}
+	body, err := renderTemplate(b.conf.Body, data)
+	if err != nil {
+		return nil, fmt.Errorf("rendering body: %w", err)
+	}
+
+	messageID, err := b.newMessageID()
+	if err != nil {
+		return nil, err
+	}
+	checksum, err := b.send(messageID, subject, body, job, file)
+	if err != nil {
+		return nil, smtpRetryable(err)
+	}
+
+	rec := newFileRecord(filePath, info, checksum)
+	rec.RemoteURL = "mid:" + strings.Trim(messageID, "<>")
+	return rec, nil
+}
+
+// send delivers one message with content attached and returns the SHA-256 of
+// the attachment.
+func (b *emailBackend) send(messageID, subject, body string, job *uploadJob, content io.Reader) (string, error) {
+	conn, err := dialThroughProxy("smtp", b.conf.Host, cfg.HTTPClient.ConnectTimeout)
+	if err != nil {
+		return "", retryable(fmt.Errorf("connecting to %s: %w", b.conf.Host, err))
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(b.conf.Timeout))
+	if b.conf.TLS == "implicit" {
+		conn = tls.Client(conn, b.tlsConfig)
+	}
+
+	host, _, _ := net.SplitHostPort(b.conf.Host)
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+	if hostname, err := os.Hostname(); err == nil {
+		if err := client.Hello(hostname); err != nil {
+			return "", err
+		}
+	}
+	if b.conf.TLS == "starttls" {
+		if err := client.StartTLS(b.tlsConfig); err != nil {
+			return "", fmt.Errorf("starting tls: %w", err)
+		}
+	}
+	if b.conf.User != "" {
+		// PlainAuth refuses to send the password over a connection without
+		// TLS, unless the server is on this machine
+		if err := client.Auth(smtp.PlainAuth("", b.conf.User, b.conf.Password, host)); err != nil {
+			return "", fmt.Errorf("logging in: %w", err)
+		}
+	}
+
+	if err := client.Mail(b.from.Address); err != nil {
+		return "", err
+	}
+	for _, recipient := range b.to {
+		if err := client.Rcpt(recipient); err != nil {
+			return "", fmt.Errorf("recipient %s: %w", recipient, err)
+		}
+	}
+	message, err := client.Data()
+	if err != nil {
+		return "", err
+	}
+	checksum, err := b.writeMessage(message, messageID, subject, body, job, content)
+	if err != nil {
+		return "", err
+	}
+	// Closing the message waits for the server to accept it
+	if err := message.Close(); err != nil {
+		return "", err
+	}
+	client.Quit()
+	return checksum, nil
+}
+
+// writeMessage writes a multipart/mixed message with body as its text and
+// content as the attachment.
+func (b *emailBackend) writeMessage(w io.Writer, messageID, subject, body string, job *uploadJob, content io.Reader) (string, error) {
+	parts := multipart.NewWriter(w)
+
+	header := []string{
+		"From: " + b.from.String(),
+		"To: " + strings.Join(b.conf.To, ", "),
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"Message-ID: " + messageID,
+		"MIME-Version: 1.0",
+		"Content-Type: multipart/mixed; boundary=" + parts.Boundary(),
+	}
+	if _, err := io.WriteString(w, strings.Join(header, "\r\n")+"\r\n\r\n"); err != nil {
+		return "", err
+	}
+
+	text, err := parts.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := writeBase64(text, strings.NewReader(body)); err != nil {
+		return "", err
+	}
+
+	attachment, err := parts.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {job.contentType()},
+		"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": job.uploadName()})},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	if err := writeBase64(attachment, io.TeeReader(content, hash)); err != nil {
+		return "", err
+	}
+
+	if err := parts.Close(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// writeBase64 writes content base64 encoded in lines of 76 characters, as
+// MIME asks for.
+func writeBase64(w io.Writer, content io.Reader) error {
+	encoder := base64.NewEncoder(base64.StdEncoding, &lineBreaker{w: w})
+	if _, err := io.Copy(encoder, content); err != nil {
+		return err
+	}
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
+
+// lineBreaker inserts a line break after every 76 bytes written through it.
+type lineBreaker struct {
+	w    io.Writer
+	used int
+}
+
+const mimeLineLength = 76
+
+func (l *lineBreaker) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if l.used == mimeLineLength {
+			if _, err := io.WriteString(l.w, "\r\n"); err != nil {
+				return written, err
+			}
+			l.used = 0
+		}
+		n := min(len(p), mimeLineLength-l.used)
+		if _, err := l.w.Write(p[:n]); err != nil {
+			return written, err
+		}
+		l.used += n
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// newMessageID returns a unique Message-ID in the sender's domain.
+func (b *emailBackend) newMessageID() (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	domain := b.from.Address[strings.LastIndex(b.from.Address, "@")+1:]
+	return "<" + hex.EncodeToString(random) + "@" + domain + ">", nil
+}
+
+// smtpRetryable marks the errors worth sending the message again for: the
+// server's temporary 4xx replies and failures of the connection. Permanent
+// 5xx replies, such as a refused recipient or a message that is too large,
+// are not.
+func smtpRetryable(err error) error {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		if protoErr.Code >= 400 && protoErr.Code < 500 {
+			return retryable(err)
+		}
+		return err
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return retryable(err)
+	}
+	return err
+}
@@ -0,0 +1,371 @@
+package uploader
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	encryptAES256GCM = "aes-256-gcm"
+
+	// Encrypted files start with encryptionMagic and a random nonce prefix,
+	// followed by the content in segments of encryptionSegment bytes, each
+	// sealed on its own so files are encrypted and decrypted as streams.
+	encryptionMagic   = "AUE1"
+	encryptionSegment = 64 << 10
+	noncePrefixSize   = 7
+)
+
+// EncryptionConfig encrypts files with AES-256-GCM before they are uploaded,
+// so sensitive files can be stored on servers that must not read them. The
+// 256-bit key is read from KeyFile, from a data key encrypted with AWS KMS,
+// or from the KeyEnv environment variable, as raw, hex or base64 bytes.
+type EncryptionConfig struct {
+	// Algorithm turns encryption on, the only one is aes-256-gcm
+	Algorithm string `yaml:"algorithm"`
+	KeyFile   string `yaml:"key_file"`
+	KeyEnv    string `yaml:"key_env"`
+	// KeyID is recorded with every upload to tell which key encrypted it,
+	// it defaults to the KMS key or a fingerprint of the key
+	KeyID string `yaml:"key_id"`
+
+	// KMSEncryptedKey is a base64 data key encrypted with AWS KMS, which is
+	// decrypted with the credentials from AWS_ACCESS_KEY_ID and
+	// AWS_SECRET_ACCESS_KEY on start
+	KMSEncryptedKey string `yaml:"kms_encrypted_key"`
+	KMSRegion       string `yaml:"kms_region"`
+	KMSEndpoint     string `yaml:"kms_endpoint"`
+}
+
+// encryptor encrypts files with the configured key.
+type encryptor struct {
+	aead  cipher.AEAD
+	keyID string
+}
+
+// encryption is nil unless files are encrypted.
+var encryption *encryptor
+
+func newEncryptor(conf EncryptionConfig) (*encryptor, error) {
+	switch conf.Algorithm {
+	case "":
+		return nil, nil
+	case encryptAES256GCM:
+	default:
+		return nil, fmt.Errorf("unknown encryption algorithm: %s", conf.Algorithm)
+	}
+
+	key, keyID, err := loadEncryptionKey(conf)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if keyID == "" {
+		fingerprint := sha256.Sum256(key)
+		keyID = "sha256:" + hex.EncodeToString(fingerprint[:8])
+	}
+	return &encryptor{aead: aead, keyID: firstNonEmpty(conf.KeyID, keyID)}, nil
+}
+
+// loadEncryptionKey returns the key and, for KMS, the ID of the KMS key.
+func loadEncryptionKey(conf EncryptionConfig) ([]byte, string, error) {
+	switch {
+	case conf.KeyFile != "":
+		data, err := os.ReadFile(conf.KeyFile)
+		if err != nil {
+			return nil, "", fmt.Errorf("reading encryption key: %w", err)
+		}
+		key, err := parseEncryptionKey(data)
+		return key, "", err
+	case conf.KMSEncryptedKey != "":
+		return decryptKMSKey(conf)
+	}
+
+	name := firstNonEmpty(conf.KeyEnv, "AUTO_UPLOAD_ENCRYPTION_KEY")
+	value := os.Getenv(name)
+	if value == "" {
+		return nil, "", fmt.Errorf("encryption needs a key: set key_file, kms_encrypted_key or %s", name)
+	}
+	key, err := parseEncryptionKey([]byte(value))
+	return key, "", err
+}
+
+// parseEncryptionKey accepts a 256-bit key as 32 raw bytes or written in hex
+// or base64.
+func parseEncryptionKey(data []byte) ([]byte, error) {
+	if len(data) == 32 {
+		return data, nil
+	}
+	text := strings.TrimSpace(string(data))
+	if key, err := hex.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, errors.New("encryption key must be 32 bytes, raw or in hex or base64")
+}
+
+// decryptKMSKey decrypts the data key with the AWS KMS Decrypt API.
+func decryptKMSKey(conf EncryptionConfig) ([]byte, string, error) {
+	transport, err := newSigV4Transport(AuthConfig{Service: "kms", Region: conf.KMSRegion}, http.DefaultTransport)
+	if err != nil {
+		return nil, "", fmt.Errorf("kms: %w", err)
+	}
+	endpoint := firstNonEmpty(conf.KMSEndpoint, "https://kms."+transport.region+".amazonaws.com/")
+
+	payload, _ := json.Marshal(map[string]string{"CiphertextBlob": conf.KMSEncryptedKey})
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService.Decrypt")
+
+	resp, err := (&http.Client{Transport: transport, Timeout: cfg.HTTPClient.ConnectTimeout}).Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("kms: %w", err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("kms: %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	var result struct {
+		KeyID     string `json:"KeyId"`
+		Plaintext []byte `json:"Plaintext"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, "", fmt.Errorf("kms: %w", err)
+	}
+	if len(result.Plaintext) != 32 {
+		return nil, "", errors.New("kms: the data key is not 256 bits")
+	}
+	return result.Plaintext, result.KeyID, nil
+}
+
+// encryptedFile describes the encrypted copy uploaded in place of a job's
+// file.
+type encryptedFile struct {
+	keyID string
+	nonce string
+}
+
+// encryptJob replaces the job's file with an encrypted copy named after it
+// with an .enc suffix, in a temporary directory that is removed once the
+// upload is done with.
+func encryptJob(job *uploadJob) error {
+	dir, err := os.MkdirTemp("", "auto-upload-")
+	if err != nil {
+		return err
+	}
+	copyPath := filepath.Join(dir, filepath.Base(job.Path)+".enc")
+
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	if err := encryption.encryptFile(copyPath, job.Path, prefix); err != nil {
+		os.RemoveAll(dir)
+		return fmt.Errorf("encrypting: %w", err)
+	}
+
+	job.Original = firstNonEmpty(job.Original, job.Path)
+	if job.FileName != "" {
+		job.FileName += ".enc"
+	}
+	job.Path, job.Checksum, job.ContentType = copyPath, "", ""
+	job.Encrypted = &encryptedFile{keyID: encryption.keyID, nonce: hex.EncodeToString(prefix)}
+	job.tempDirs = append(job.tempDirs, dir)
+	return nil
+}
+
+// annotate records the key and nonce of the encrypted copy in rec.
+func (f *encryptedFile) annotate(rec *fileRecord) {
+	if f != nil {
+		rec.Encryption, rec.KeyID, rec.Nonce = encryptAES256GCM, f.keyID, f.nonce
+	}
+}
+
+func (e *encryptor) encryptFile(dst, src string, prefix []byte) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if err := e.encrypt(out, in, prefix); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// encrypt writes the header and the sealed segments of src to dst. The
+// nonce of a segment is the prefix, the segment's number and a flag for the
+// last segment, so segments cannot be reordered or cut off unnoticed.
+func (e *encryptor) encrypt(dst io.Writer, src io.Reader, prefix []byte) error {
+	if _, err := io.WriteString(dst, encryptionMagic); err != nil {
+		return err
+	}
+	if _, err := dst.Write(prefix); err != nil {
+		return err
+	}
+
+	buf, next := make([]byte, encryptionSegment), make([]byte, encryptionSegment)
+	sealed := make([]byte, 0, encryptionSegment+e.aead.Overhead())
+	n, err := io.ReadFull(src, buf)
+	for counter := uint32(0); ; counter++ {
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		// A full segment is only known to be the last one once nothing
+		// follows it
+		last := err != nil
+		var m int
+		var nextErr error
+		if !last {
+			m, nextErr = io.ReadFull(src, next)
+			last = m == 0 && nextErr == io.EOF
+		}
+
+		sealed = e.aead.Seal(sealed[:0], segmentNonce(prefix, counter, last), buf[:n], nil)
+		if _, err := dst.Write(sealed); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+		buf, next = next, buf
+		n, err = m, nextErr
+	}
+}
+
+// decrypt reverses encrypt.
+func (e *encryptor) decrypt(dst io.Writer, src io.Reader) error {
+	header := make([]byte, len(encryptionMagic)+noncePrefixSize)
+	if _, err := io.ReadFull(src, header); err != nil || string(header[:len(encryptionMagic)]) != encryptionMagic {
+		return errors.New("not an encrypted file")
+	}
+	prefix := header[len(encryptionMagic):]
+
+	size := encryptionSegment + e.aead.Overhead()
+	buf, next := make([]byte, size), make([]byte, size)
+	plain := make([]byte, 0, encryptionSegment)
+	n, err := io.ReadFull(src, buf)
+	for counter := uint32(0); ; counter++ {
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		last := err != nil
+		var m int
+		var nextErr error
+		if !last {
+			m, nextErr = io.ReadFull(src, next)
+			last = m == 0 && nextErr == io.EOF
+		}
+
+		var openErr error
+		plain, openErr = e.aead.Open(plain[:0], segmentNonce(prefix, counter, last), buf[:n], nil)
+		if openErr != nil {
+			return errors.New("the file is damaged, truncated or encrypted with another key")
+		}
+		if _, err := dst.Write(plain); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+		buf, next = next, buf
+		n, err = m, nextErr
+	}
+}
+
+func segmentNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 0, noncePrefixSize+5)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, counter)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// runDecrypt implements "auto-upload decrypt": it decrypts a file that was
+// uploaded encrypted, with the key from the same settings.
+func runDecrypt(args []string) error {
+	fs := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	fs.StringVar(&configFile, "config", "", "YAML file to load settings from; flags override its values")
+	output := fs.String("output", "", "File to write the decrypted content to (default stdout)")
+	registerFlags(fs, &cfg)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: auto-upload decrypt [flags] <file>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("decrypt needs exactly one file")
+	}
+	if err := resolveSecrets(&cfg); err != nil {
+		return err
+	}
+
+	conf := cfg.Encryption
+	conf.Algorithm = encryptAES256GCM
+	e, err := newEncryptor(conf)
+	if err != nil {
+		return err
+	}
+
+	in, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if *output == "" {
+		return e.decrypt(os.Stdout, in)
+	}
+	out, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	if err := e.decrypt(out, in); err != nil {
+		out.Close()
+		os.Remove(*output)
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,210 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// FailoverConfig switches the targets from mirror mode to an ordered
+// failover list: files go to server_url while it works, and to the first
+// working target otherwise.
+type FailoverConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Status lists the status codes that make the upload move on to the next
+	// target, in addition to connection failures
+	Status []int `yaml:"status"`
+	// HealthURL is checked to find out whether server_url is back, it
+	// defaults to server_url
+	HealthURL string `yaml:"health_url"`
+	// HealthCheckInterval is how often failed targets are checked
+	HealthCheckInterval time.Duration `yaml:"health_check_interval"`
+}
+
+// failoverBackend uploads to the first of server_url and the targets that
+// is not known to be down. A target that fails is marked down and checked
+// in the background, and used again as soon as it is healthy, so uploads
+// return to server_url once it recovers.
+type failoverBackend struct {
+	backend
+	conf FailoverConfig
+
+	// targets holds nil for server_url, followed by the targets
+	targets []*uploadTarget
+
+	mu   sync.Mutex
+	down map[int]bool
+
+	// stop ends the health checks
+	stop chan struct{}
+}
+
+func newFailoverBackend(base backend, targets []*uploadTarget, conf FailoverConfig) *failoverBackend {
+	b := &failoverBackend{
+		backend: base,
+		conf:    conf,
+		targets: append([]*uploadTarget{nil}, targets...),
+		down:    make(map[int]bool),
+		stop:    make(chan struct{}),
+	}
+	go b.checkHealth()
+	return b
+}
+
+func (b *failoverBackend) upload(job *uploadJob) (*fileRecord, error) {
+	info, err := os.Stat(job.Path)
+	if err != nil {
+		return nil, fmt.Errorf("reading file info: %w", err)
+	}
+
+	var lastErr error
+	for _, i := range b.order() {
+		targetJob := job
+		if target := b.targets[i]; target != nil {
+			if targetJob, err = job.forTarget(target, info); err != nil {
+				return nil, err
+			}
+		}
+
+		rec, err := b.backend.upload(targetJob)
+		job.Response = targetJob.Response
+		if err == nil {
+			if i > 0 {
+				logrus.Infof("Uploaded %s to %s", job.Path, targetName(targetJob))
+			}
+			return rec, nil
+		}
+		if !b.failsOver(err) {
+			return nil, err
+		}
+
+		b.mu.Lock()
+		if !b.down[i] {
+			b.down[i] = true
+			logrus.Warnf("Upload to %s failed, failing over: %v", targetName(targetJob), err)
+		}
+		b.mu.Unlock()
+		lastErr = fmt.Errorf("%s: %w", targetName(targetJob), err)
+	}
+
+	return nil, lastErr
+}
+
+func (b *failoverBackend) close() {
+	close(b.stop)
+}
+
+// order returns the indexes of the targets to try: the ones that are up,
+// in the configured order. When all are down they are all tried anyway.
+func (b *failoverBackend) order() []int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var up, all []int
+	for i := range b.targets {
+		all = append(all, i)
+		if !b.down[i] {
+			up = append(up, i)
+		}
+	}
+	if len(up) == 0 {
+		return all
+	}
+	return up
+}
+
+// failsOver reports whether err means the target is unavailable, as opposed
+// to a problem with the file that the next target would have as well.
+func (b *failoverBackend) failsOver(err error) bool {
+	var circuitErr *circuitOpenError
+	if errors.As(err, &circuitErr) {
+		return true
+	}
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		return slices.Contains(b.conf.Status, statusErr.StatusCode)
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
+
+// checkHealth periodically checks the targets that are down and brings
+// back the ones that answer again.
+func (b *failoverBackend) checkHealth() {
+	interval := b.conf.HealthCheckInterval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.stop:
+			return
+		}
+
+		b.mu.Lock()
+		var down []int
+		for i := range b.down {
+			down = append(down, i)
+		}
+		b.mu.Unlock()
+
+		configMu.RLock()
+		for _, i := range down {
+			name, healthURL := cfg.ServerURL, firstNonEmpty(b.conf.HealthURL, cfg.ServerURL)
+			if target := b.targets[i]; target != nil {
+				name, healthURL = target.name, target.healthURL
+			}
+			if err := checkEndpoint(healthURL); err != nil {
+				logrus.Debugf("%s is still down: %v", name, err)
+				continue
+			}
+
+			b.mu.Lock()
+			delete(b.down, i)
+			b.mu.Unlock()
+			logrus.Infof("%s is healthy again", name)
+		}
+		configMu.RUnlock()
+	}
+}
+
+// checkEndpoint sends a GET request to a health check URL and fails on
+// connection errors and server errors. A URL with templates can not be
+// checked, so the endpoint is simply tried again.
+func checkEndpoint(healthURL string) error {
+	if strings.Contains(healthURL, "{{") {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, healthURL, nil)
+	if err != nil {
+		return err
+	}
+	setProbeHeaders(req)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return &statusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package uploader
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// fileFilter decides which files in the upload directory are uploaded, from
+// glob patterns matched against their path relative to that directory. A
+// pattern without a slash matches the file name at any depth, "**" matches
+// any number of directories, and a leading "!" turns an include pattern into
+// an exclude pattern and the other way round.
+type fileFilter struct {
+	include []string
+	exclude []string
+}
+
+func newFileFilter(include, exclude []string) *fileFilter {
+	f := &fileFilter{}
+	for _, pattern := range include {
+		if negated, ok := strings.CutPrefix(pattern, "!"); ok {
+			f.exclude = append(f.exclude, negated)
+		} else {
+			f.include = append(f.include, pattern)
+		}
+	}
+	for _, pattern := range exclude {
+		if negated, ok := strings.CutPrefix(pattern, "!"); ok {
+			f.include = append(f.include, negated)
+		} else {
+			f.exclude = append(f.exclude, pattern)
+		}
+	}
+	return f
+}
+
+// allows reports whether the file at relPath should be uploaded: it has to
+// match an include pattern, if there are any, and no exclude pattern.
+func (f *fileFilter) allows(relPath string) bool {
+	relPath = filepath.ToSlash(relPath)
+
+	if len(f.include) > 0 && !matchAny(f.include, relPath) {
+		return false
+	}
+	return !matchAny(f.exclude, relPath)
+}
+
+func matchAny(patterns []string, relPath string) bool {
+	for _, pattern := range patterns {
+		if matchGlob(pattern, relPath) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchGlob(pattern, relPath string) bool {
+	pattern = strings.TrimPrefix(filepath.ToSlash(pattern), "/")
+	if !strings.Contains(pattern, "/") {
+		matched, _ := path.Match(pattern, path.Base(relPath))
+		return matched
+	}
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(relPath, "/"))
+}
+
+// matchSegments matches path segments one by one, letting "**" consume zero
+// or more of them.
+func matchSegments(pattern, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(segments); i++ {
+				if matchSegments(pattern[1:], segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(segments) == 0 {
+			return false
+		}
+		if matched, _ := path.Match(pattern[0], segments[0]); !matched {
+			return false
+		}
+		pattern, segments = pattern[1:], segments[1:]
+	}
+	return len(segments) == 0
+}
+
+// deferredFiles holds the files that are waiting to be looked at again, so
+// each one is only scheduled once.
+var deferredFiles sync.Map
+
+// admitFile applies the size and age limits to a file. Files that are too
+// small or too new are deferred, as they may be placeholders or still be
+// written: they are looked at again on the next event or scan, or once they
+// reach min_age. Files that are too large or too old are skipped. It reports
+// whether the file can be uploaded now.
+func admitFile(filePath string, info os.FileInfo) bool {
+	size, age := info.Size(), time.Since(info.ModTime())
+
+	switch {
+	case cfg.MaxSize > 0 && size > int64(cfg.MaxSize):
+		logrus.Debugf("Skipping %s: larger than %s", filePath, &cfg.MaxSize)
+		return false
+	case cfg.MaxAge > 0 && age > cfg.MaxAge:
+		logrus.Debugf("Skipping %s: older than %s", filePath, cfg.MaxAge)
+		return false
+	case size < int64(cfg.MinSize):
+		logrus.Debugf("Deferring %s: smaller than %s", filePath, &cfg.MinSize)
+		return false
+	case age < cfg.MinAge:
+		logrus.Debugf("Deferring %s: newer than %s", filePath, cfg.MinAge)
+		deferUpload(filePath, cfg.MinAge-age)
+		return false
+	}
+	return true
+}
+
+// defaultTempPatterns match the files that office suites, browsers and
+// download tools write before renaming them to their final name, and the
+// metadata files of desktops.
+var defaultTempPatterns = []string{"~$*", "*.part", "*.partial", "*.crdownload", "*.download", "*.tmp", "*.swp", ".DS_Store", "Thumbs.db"}
+
+// admitName applies the rules for hidden and temporary files. Dotfiles and
+// files in dot-directories are skipped with skip_hidden, and files matching
+// temp_patterns with skip_temp. With temp_max_wait a temporary file is only
+// deferred until it has kept its name unchanged for that long, and is then
+// uploaded after all; it is usually renamed and uploaded under its new name
+// before. It reports whether the file can be uploaded now.
+func admitName(filePath, relPath string, info os.FileInfo) bool {
+	relPath = filepath.ToSlash(relPath)
+	if cfg.SkipHidden && isHidden(relPath) {
+		logrus.Debugf("Skipping %s: hidden", filePath)
+		return false
+	}
+	if !cfg.SkipTemp || !matchAny(cfg.TempPatterns, relPath) {
+		return true
+	}
+
+	age := time.Since(info.ModTime())
+	switch {
+	case cfg.TempMaxWait <= 0:
+		logrus.Debugf("Skipping %s: temporary file", filePath)
+		return false
+	case age < cfg.TempMaxWait:
+		logrus.Debugf("Deferring %s: temporary file, waiting for it to be renamed", filePath)
+		deferUpload(filePath, cfg.TempMaxWait-age)
+		return false
+	}
+	logrus.Infof("Uploading %s: it kept its temporary name for %s", filePath, cfg.TempMaxWait)
+	return true
+}
+
+// isSkippedName reports whether admitName skips the file at relPath for good.
+func isSkippedName(relPath string) bool {
+	relPath = filepath.ToSlash(relPath)
+	return cfg.SkipHidden && isHidden(relPath) || cfg.SkipTemp && cfg.TempMaxWait <= 0 && matchAny(cfg.TempPatterns, relPath)
+}
+
+// isHidden reports whether a slash-separated relative path is a dotfile or
+// lies in a dot-directory.
+func isHidden(relPath string) bool {
+	for _, segment := range strings.Split(relPath, "/") {
+		if strings.HasPrefix(segment, ".") && segment != "." && segment != ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// deferUpload looks at a file again after wait, unless it is already
+// scheduled.
+func deferUpload(filePath string, wait time.Duration) {
+	if _, scheduled := deferredFiles.LoadOrStore(filePath, true); !scheduled {
+		time.AfterFunc(wait, func() {
+			deferredFiles.Delete(filePath)
+			requestControl([]string{filePath}, false)
+		})
+	}
+}
+
+// validateLimits checks that the size and age limits leave room for files.
+func validateLimits(c *Config) error {
+	if c.MaxSize > 0 && c.MinSize > c.MaxSize {
+		return fmt.Errorf("min_size %s is larger than max_size %s", &c.MinSize, &c.MaxSize)
+	}
+	if c.MaxAge > 0 && c.MinAge > c.MaxAge {
+		return fmt.Errorf("min_age %s is longer than max_age %s", c.MinAge, c.MaxAge)
+	}
+	return nil
+}
+
+// stringListFlag parses a comma-separated list such as glob patterns.
+type stringListFlag []string
+
+func (l *stringListFlag) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringListFlag) Set(value string) error {
+	var values []string
+	for _, field := range strings.Split(value, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			values = append(values, field)
+		}
+	}
+	*l = values
+	return nil
+}
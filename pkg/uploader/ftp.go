@@ -0,0 +1,459 @@
+package uploader
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// FTPConfig configures the FTP/FTPS backend.
+type FTPConfig struct {
+	Host               string        `yaml:"host"`
+	User               string        `yaml:"user"`
+	Password           string        `yaml:"password"`
+	TLS                string        `yaml:"tls"`
+	CAFile             string        `yaml:"ca_file"`
+	InsecureSkipVerify bool          `yaml:"insecure_skip_verify"`
+	Mode               string        `yaml:"mode"`
+	ActiveIP           string        `yaml:"active_ip"`
+	RemoteDir          string        `yaml:"remote_dir"`
+	Timeout            time.Duration `yaml:"timeout"`
+}
+
+// ftpBackend stores files on an FTP server, optionally secured with TLS
+// (explicit AUTH TLS or implicit FTPS). Like the SFTP backend it uploads to a
+// temporary name and renames the file when the transfer is complete.
+type ftpBackend struct {
+	conf      FTPConfig
+	tlsConfig *tls.Config
+
+	mu   sync.Mutex
+	conn *ftpConn
+}
+
+func newFTPBackend(conf FTPConfig) (*ftpBackend, error) {
+	if conf.Host == "" {
+		return nil, errors.New("ftp backend needs a host")
+	}
+	if _, _, err := net.SplitHostPort(conf.Host); err != nil {
+		port := "21"
+		if conf.TLS == "implicit" {
+			port = "990"
+		}
+		conf.Host = net.JoinHostPort(conf.Host, port)
+	}
+	if conf.User == "" {
+		conf.User = "anonymous"
+	}
+	if conf.Password == "" {
+		conf.Password = os.Getenv("FTP_PASSWORD")
+	}
+	if conf.Timeout <= 0 {
+		conf.Timeout = 30 * time.Second
+	}
+
+	switch conf.Mode {
+	case "":
+		conf.Mode = "passive"
+	case "passive", "active":
+	default:
+		return nil, fmt.Errorf("unknown ftp mode: %s", conf.Mode)
+	}
+
+	b := &ftpBackend{conf: conf}
+
+	switch conf.TLS {
+	case "", "none":
+	case "explicit", "implicit":
+		tlsConfig, err := tlsClientConfig(conf.CAFile, conf.InsecureSkipVerify)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ServerName, _, _ = net.SplitHostPort(conf.Host)
+		// Servers commonly require the data connection to resume the TLS
+		// session of the control connection
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(4)
+		b.tlsConfig = tlsConfig
+
+		if conf.InsecureSkipVerify {
+			logrus.Warn("FTPS certificate verification is disabled, the connection can be intercepted")
+		}
+	default:
+		return nil, fmt.Errorf("unknown ftp tls mode: %s", conf.TLS)
+	}
+
+	return b, nil
+}
+
+func (b *ftpBackend) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn != nil {
+		b.conn.close()
+		b.conn = nil
+	}
+}
+
+func (b *ftpBackend) upload(job *uploadJob) (*fileRecord, error) {
+	filePath := job.Path
+	file, info, err := openFile(job.context(), filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	remoteDir, err := renderTemplate(b.conf.RemoteDir, newFileTemplateData(job, info))
+	if err != nil {
+		return nil, fmt.Errorf("rendering remote directory: %w", err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.conn == nil {
+		conn, err := dialFTP(b.conf, b.tlsConfig)
+		if err != nil {
+			return nil, retryable(err)
+		}
+		b.conn = conn
+	}
+
+	checksum, err := b.put(file, remoteDir, job.uploadName())
+	if err != nil {
+		// The control connection may be in an unknown state, start over
+		b.conn.close()
+		b.conn = nil
+		return nil, retryable(err)
+	}
+
+	rec := newFileRecord(filePath, info, checksum)
+	rec.RemoteURL = "ftp://" + b.conf.Host + "/" + strings.TrimPrefix(path.Join(remoteDir, job.uploadName()), "/")
+	return rec, nil
+}
+
+// stat looks up the file at remoteURL with the SIZE command (RFC 3659). As
+// for SFTP, the remote directory setting tells whether its path is absolute.
+func (b *ftpBackend) stat(_ context.Context, remoteURL string) (int64, error) {
+	remotePath, ok := strings.CutPrefix(remoteURL, "ftp://"+b.conf.Host+"/")
+	if !ok {
+		return 0, ErrUnknownRemote
+	}
+	if strings.HasPrefix(b.conf.RemoteDir, "/") {
+		remotePath = "/" + remotePath
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.conn == nil {
+		conn, err := dialFTP(b.conf, b.tlsConfig)
+		if err != nil {
+			return 0, err
+		}
+		b.conn = conn
+	}
+
+	code, message, err := b.conn.request("SIZE " + remotePath)
+	if err != nil {
+		b.conn.close()
+		b.conn = nil
+		return 0, err
+	}
+	switch code {
+	case 213:
+		return strconv.ParseInt(strings.TrimSpace(message), 10, 64)
+	case 550:
+		return 0, ErrRemoteMissing
+	}
+	return 0, fmt.Errorf("SIZE refused: %d %s", code, message)
+}
+
+func (b *ftpBackend) put(content io.Reader, remoteDir, name string) (string, error) {
+	if remoteDir != "" {
+		b.conn.mkdirAll(remoteDir)
+	}
+
+	target := path.Join(remoteDir, name)
+	temp := path.Join(remoteDir, "."+name+".part")
+
+	hash := sha256.New()
+	if err := b.conn.store(temp, io.TeeReader(content, hash)); err != nil {
+		b.conn.cmd(0, "DELE %s", temp)
+		return "", fmt.Errorf("storing %s: %w", temp, err)
+	}
+
+	if _, err := b.conn.cmd(350, "RNFR %s", temp); err != nil {
+		return "", fmt.Errorf("renaming %s: %w", temp, err)
+	}
+	if _, err := b.conn.cmd(250, "RNTO %s", target); err != nil {
+		return "", fmt.Errorf("renaming %s to %s: %w", temp, target, err)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// ftpConn is a minimal FTP client: just enough of RFC 959, RFC 2428 and
+// RFC 4217 to log in, create directories and store files.
+type ftpConn struct {
+	conf      FTPConfig
+	tlsConfig *tls.Config
+	netConn   net.Conn
+	text      *textproto.Conn
+	protected bool
+}
+
+func dialFTP(conf FTPConfig, tlsConfig *tls.Config) (*ftpConn, error) {
+	netConn, err := dialThroughProxy("ftp", conf.Host, conf.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %s: %w", conf.Host, err)
+	}
+	if conf.TLS == "implicit" {
+		tlsConn := tls.Client(netConn, tlsConfig)
+		tlsConn.SetDeadline(time.Now().Add(conf.Timeout))
+		if err := tlsConn.Handshake(); err != nil {
+			netConn.Close()
+			return nil, fmt.Errorf("connecting to %s: %w", conf.Host, err)
+		}
+		tlsConn.SetDeadline(time.Time{})
+		netConn = tlsConn
+	}
+
+	c := &ftpConn{conf: conf, tlsConfig: tlsConfig, netConn: netConn, text: textproto.NewConn(netConn)}
+	if err := c.login(); err != nil {
+		c.netConn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *ftpConn) login() error {
+	c.netConn.SetDeadline(time.Now().Add(c.conf.Timeout))
+	defer c.netConn.SetDeadline(time.Time{})
+
+	if _, _, err := c.text.ReadResponse(220); err != nil {
+		return fmt.Errorf("ftp greeting: %w", err)
+	}
+
+	if c.conf.TLS == "explicit" {
+		if _, err := c.cmd(234, "AUTH TLS"); err != nil {
+			return fmt.Errorf("starting tls: %w", err)
+		}
+		c.netConn = tls.Client(c.netConn, c.tlsConfig)
+		c.text = textproto.NewConn(c.netConn)
+	}
+
+	code, err := c.cmd(0, "USER %s", c.conf.User)
+	if err != nil {
+		return fmt.Errorf("ftp login: %w", err)
+	}
+	if code == 331 {
+		if _, err := c.cmd(230, "PASS %s", c.conf.Password); err != nil {
+			return fmt.Errorf("ftp login: %w", err)
+		}
+	} else if code != 230 {
+		return fmt.Errorf("ftp login: unexpected reply %d", code)
+	}
+
+	if c.conf.TLS == "explicit" || c.conf.TLS == "implicit" {
+		if _, err := c.cmd(200, "PBSZ 0"); err != nil {
+			return err
+		}
+		if _, err := c.cmd(200, "PROT P"); err != nil {
+			return err
+		}
+		c.protected = true
+	}
+
+	_, err = c.cmd(200, "TYPE I")
+	return err
+}
+
+// cmd sends a command and reads the reply. With expect 0 any reply is
+// accepted and only its code is returned.
+func (c *ftpConn) cmd(expect int, format string, args ...interface{}) (int, error) {
+	if err := c.text.PrintfLine(format, args...); err != nil {
+		return 0, err
+	}
+	code, _, err := c.text.ReadResponse(expect)
+	return code, err
+}
+
+func (c *ftpConn) request(command string) (int, string, error) {
+	if err := c.text.PrintfLine("%s", command); err != nil {
+		return 0, "", err
+	}
+	return c.text.ReadResponse(0)
+}
+
+// startTransfer sends a transfer command such as STOR and checks that the
+// server is about to use the data connection.
+func (c *ftpConn) startTransfer(command string) error {
+	code, message, err := c.request(command)
+	if err != nil {
+		return err
+	}
+	if code != 125 && code != 150 {
+		return fmt.Errorf("%s refused: %d %s", strings.Fields(command)[0], code, message)
+	}
+	return nil
+}
+
+// mkdirAll creates every component of dir. Errors are ignored because most
+// servers do not distinguish "already exists" from other failures; a real
+// problem shows up when the file is stored.
+func (c *ftpConn) mkdirAll(dir string) {
+	current := ""
+	if strings.HasPrefix(dir, "/") {
+		current = "/"
+	}
+	for _, part := range strings.Split(strings.Trim(dir, "/"), "/") {
+		current = path.Join(current, part)
+		c.cmd(0, "MKD %s", current)
+	}
+}
+
+func (c *ftpConn) store(name string, content io.Reader) error {
+	data, err := c.openDataConn("STOR " + name)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(data, content)
+	if closeErr := data.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	_, _, err = c.text.ReadResponse(226)
+	return err
+}
+
+// openDataConn sets up a data connection in the configured mode and sends
+// command over the control connection.
+func (c *ftpConn) openDataConn(command string) (net.Conn, error) {
+	var data net.Conn
+	var err error
+
+	if c.conf.Mode == "active" {
+		data, err = c.activeDataConn(command)
+	} else {
+		data, err = c.passiveDataConn(command)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if c.protected {
+		data = tls.Client(data, c.tlsConfig)
+	}
+	return data, nil
+}
+
+func (c *ftpConn) passiveDataConn(command string) (net.Conn, error) {
+	host, _, _ := net.SplitHostPort(c.conf.Host)
+
+	var port int
+	code, message, err := c.request("EPSV")
+	if err == nil && code == 229 {
+		// 229 Entering Extended Passive Mode (|||port|)
+		start := strings.Index(message, "(")
+		end := strings.LastIndex(message, ")")
+		if start < 0 || end < start {
+			return nil, fmt.Errorf("invalid EPSV reply: %s", message)
+		}
+		fields := strings.Split(message[start+1:end], "|")
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("invalid EPSV reply: %s", message)
+		}
+		if port, err = strconv.Atoi(fields[3]); err != nil {
+			return nil, fmt.Errorf("invalid EPSV reply: %s", message)
+		}
+	} else {
+		if _, message, err = c.request("PASV"); err != nil {
+			return nil, err
+		}
+		// 227 Entering Passive Mode (h1,h2,h3,h4,p1,p2). The address is
+		// ignored in favour of the control host, it is often wrong behind NAT.
+		start := strings.Index(message, "(")
+		end := strings.LastIndex(message, ")")
+		if start < 0 || end < start {
+			return nil, fmt.Errorf("invalid PASV reply: %s", message)
+		}
+		fields := strings.Split(message[start+1:end], ",")
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("invalid PASV reply: %s", message)
+		}
+		high, _ := strconv.Atoi(fields[4])
+		low, _ := strconv.Atoi(fields[5])
+		port = high<<8 | low
+	}
+
+	data, err := dialThroughProxy("ftp", net.JoinHostPort(host, strconv.Itoa(port)), c.conf.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("opening data connection: %w", err)
+	}
+
+	if err := c.startTransfer(command); err != nil {
+		data.Close()
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (c *ftpConn) activeDataConn(command string) (net.Conn, error) {
+	localIP := c.conf.ActiveIP
+	if localIP == "" {
+		localIP, _, _ = net.SplitHostPort(c.netConn.LocalAddr().String())
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort(localIP, "0"))
+	if err != nil {
+		return nil, fmt.Errorf("listening for data connection: %w", err)
+	}
+	defer listener.Close()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	ip := net.ParseIP(localIP)
+	if ip4 := ip.To4(); ip4 != nil {
+		_, err = c.cmd(200, "PORT %d,%d,%d,%d,%d,%d", ip4[0], ip4[1], ip4[2], ip4[3], port>>8, port&0xff)
+	} else {
+		_, err = c.cmd(200, "EPRT |2|%s|%d|", localIP, port)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.startTransfer(command); err != nil {
+		return nil, err
+	}
+
+	listener.(*net.TCPListener).SetDeadline(time.Now().Add(c.conf.Timeout))
+	data, err := listener.Accept()
+	if err != nil {
+		return nil, fmt.Errorf("waiting for data connection: %w", err)
+	}
+	return data, nil
+}
+
+func (c *ftpConn) close() {
+	c.text.PrintfLine("QUIT")
+	c.netConn.Close()
+}
@@ -0,0 +1,329 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// GCSConfig configures the Google Cloud Storage backend.
+type GCSConfig struct {
+	Bucket          string   `yaml:"bucket"`
+	Prefix          string   `yaml:"prefix"`
+	StorageClass    string   `yaml:"storage_class"`
+	CredentialsFile string   `yaml:"credentials_file"`
+	Endpoint        string   `yaml:"endpoint"`
+	ChunkSize       ByteSize `yaml:"chunk_size"`
+}
+
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// gcsChunkAlign is the granularity of resumable upload chunks: every chunk
+// but the last must be a multiple of 256 KiB.
+const gcsChunkAlign = 256 << 10
+
+// gcsUpload is the persisted resumable upload session of a file. Sessions
+// stay valid for a week, so an interrupted upload continues where the server
+// left off.
+type gcsUpload struct {
+	SessionURL string    `json:"session_url"`
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"mod_time"`
+}
+
+// gcsBackend uploads files as objects with the Cloud Storage JSON API, always
+// using resumable uploads. Credentials are discovered like the Google Cloud
+// SDKs do: GOOGLE_APPLICATION_CREDENTIALS, the gcloud application default
+// credentials or the metadata server on Google Cloud.
+type gcsBackend struct {
+	conf      GCSConfig
+	chunkSize int64
+	client    *http.Client
+}
+
+func newGCSBackend(conf GCSConfig) (*gcsBackend, error) {
+	if conf.Bucket == "" {
+		return nil, errors.New("gcs backend needs a bucket")
+	}
+	if conf.Endpoint == "" {
+		conf.Endpoint = "https://storage.googleapis.com"
+	}
+	conf.Endpoint = strings.TrimSuffix(conf.Endpoint, "/")
+
+	chunkSize := int64(conf.ChunkSize) / gcsChunkAlign * gcsChunkAlign
+	if chunkSize < gcsChunkAlign {
+		chunkSize = gcsChunkAlign
+	}
+
+	// Token requests and uploads both go through the configured proxy
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: newTransport()})
+	creds, err := gcsCredentials(ctx, conf.CredentialsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &gcsBackend{
+		conf:      conf,
+		chunkSize: chunkSize,
+		client:    oauth2.NewClient(ctx, creds.TokenSource),
+	}, nil
+}
+
+func gcsCredentials(ctx context.Context, file string) (*google.Credentials, error) {
+	if file == "" {
+		creds, err := google.FindDefaultCredentials(ctx, gcsScope)
+		if err != nil {
+			return nil, fmt.Errorf("finding google credentials: %w", err)
+		}
+		return creds, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading google credentials: %w", err)
+	}
+	creds, err := google.CredentialsFromJSON(ctx, data, gcsScope)
+	if err != nil {
+		return nil, fmt.Errorf("parsing google credentials %s: %w", file, err)
+	}
+	return creds, nil
+}
+
+func (b *gcsBackend) upload(job *uploadJob) (*fileRecord, error) {
+	filePath := job.Path
+	file, info, err := openFile(job.context(), filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	prefix, err := renderTemplate(b.conf.Prefix, newFileTemplateData(job, info))
+	if err != nil {
+		return nil, fmt.Errorf("rendering gcs prefix: %w", err)
+	}
+	name := strings.TrimPrefix(prefix+job.uploadName(), "/")
+
+	checksum, err := job.checksum()
+	if err != nil {
+		return nil, fmt.Errorf("hashing file: %w", err)
+	}
+
+	upload, offset, done, err := b.resume(job.context(), filePath, info)
+	if err != nil {
+		return nil, err
+	}
+	if upload == nil {
+		if upload, err = b.startSession(job, info, name); err != nil {
+			return nil, err
+		}
+	} else if !done {
+		logrus.Infof("Resuming upload of %s at offset %d", filePath, offset)
+	}
+
+	for !done {
+		if offset, done, err = b.putChunk(job.context(), file, upload, offset); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := state.delete(gcsBucket, filePath); err != nil {
+		logrus.Error("Error clearing upload session:", err)
+	}
+
+	rec := newFileRecord(filePath, info, checksum)
+	rec.RemoteURL = "gs://" + b.conf.Bucket + "/" + name
+	return rec, nil
+}
+
+// resume looks up a stored session for the file and asks the server how much
+// of it was received. It returns a nil upload if there is nothing to resume.
+func (b *gcsBackend) resume(ctx context.Context, filePath string, info os.FileInfo) (*gcsUpload, int64, bool, error) {
+	upload := &gcsUpload{}
+	found, err := state.getJSON(gcsBucket, filePath, upload)
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	// A changed file can not continue an upload of its old content
+	if !found || upload.Size != info.Size() || !upload.ModTime.Equal(info.ModTime()) {
+		return nil, 0, false, nil
+	}
+
+	offset, done, err := b.send(ctx, upload, nil, 0, "bytes */"+strconv.FormatInt(upload.Size, 10))
+	var statusErr *statusError
+	if errors.As(err, &statusErr) && (statusErr.StatusCode == http.StatusNotFound || statusErr.StatusCode == http.StatusGone) {
+		// The session has expired, start over
+		return nil, 0, false, nil
+	}
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	return upload, offset, done, nil
+}
+
+// stat reads the size from the metadata of the object at remoteURL.
+func (b *gcsBackend) stat(ctx context.Context, remoteURL string) (int64, error) {
+	name, ok := strings.CutPrefix(remoteURL, "gs://"+b.conf.Bucket+"/")
+	if !ok {
+		return 0, ErrUnknownRemote
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.conf.Endpoint+"/storage/v1/b/"+url.PathEscape(b.conf.Bucket)+"/o/"+url.PathEscape(name), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, missingIfNotFound(gcsStatusError(resp))
+	}
+
+	var object struct {
+		Size int64 `json:"size,string"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&object); err != nil {
+		return 0, fmt.Errorf("reading object metadata: %w", err)
+	}
+	return object.Size, nil
+}
+
+// startSession creates a resumable upload session for the object and stores
+// its URL.
+func (b *gcsBackend) startSession(job *uploadJob, info os.FileInfo, name string) (*gcsUpload, error) {
+	filePath := job.Path
+	contentType := job.contentType()
+
+	metadata := make(map[string]string, len(job.Fields))
+	for key, value := range job.Fields {
+		metadata[key] = fmt.Sprintf("%v", value)
+	}
+
+	body, err := json.Marshal(struct {
+		Name         string            `json:"name"`
+		ContentType  string            `json:"contentType"`
+		StorageClass string            `json:"storageClass,omitempty"`
+		Metadata     map[string]string `json:"metadata,omitempty"`
+	}{name, contentType, b.conf.StorageClass, metadata})
+	if err != nil {
+		return nil, err
+	}
+
+	target := b.conf.Endpoint + "/upload/storage/v1/b/" + url.PathEscape(b.conf.Bucket) + "/o?uploadType=resumable"
+	req, err := http.NewRequestWithContext(job.context(), http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Type", contentType)
+	req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(info.Size(), 10))
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, gcsStatusError(resp)
+	}
+
+	location, err := resp.Location()
+	if err != nil {
+		return nil, fmt.Errorf("upload session created without a location: %w", err)
+	}
+
+	upload := &gcsUpload{
+		SessionURL: location.String(),
+		Size:       info.Size(),
+		ModTime:    info.ModTime(),
+	}
+	if err := state.putJSON(gcsBucket, filePath, upload); err != nil {
+		logrus.Error("Error saving upload session:", err)
+	}
+
+	return upload, nil
+}
+
+// putChunk sends the next chunk of the file starting at offset.
+func (b *gcsBackend) putChunk(ctx context.Context, file *sourceFile, upload *gcsUpload, offset int64) (int64, bool, error) {
+	if upload.Size == 0 {
+		return b.send(ctx, upload, nil, 0, "bytes */0")
+	}
+
+	length := upload.Size - offset
+	if length > b.chunkSize {
+		length = b.chunkSize
+	}
+
+	contentRange := fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, upload.Size)
+	return b.send(ctx, upload, io.NewSectionReader(file, offset, length), length, contentRange)
+}
+
+// send makes a request to the upload session and returns the offset the
+// server has persisted and whether the object is complete.
+func (b *gcsBackend) send(ctx context.Context, upload *gcsUpload, body io.Reader, length int64, contentRange string) (int64, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, upload.SessionURL, body)
+	if err != nil {
+		return 0, false, fmt.Errorf("creating request: %w", err)
+	}
+	req.ContentLength = length
+	req.Header.Set("Content-Range", contentRange)
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return 0, false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return upload.Size, true, nil
+	case http.StatusPermanentRedirect:
+		// 308 Resume Incomplete, with the persisted range as "bytes=0-N"
+		received := resp.Header.Get("Range")
+		if received == "" {
+			return 0, false, nil
+		}
+		_, last, _ := strings.Cut(received, "-")
+		end, err := strconv.ParseInt(last, 10, 64)
+		if err != nil {
+			return 0, false, fmt.Errorf("invalid Range in response: %s", received)
+		}
+		return end + 1, false, nil
+	default:
+		return 0, false, gcsStatusError(resp)
+	}
+}
+
+func gcsStatusError(resp *http.Response) error {
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+
+	message := strings.TrimSpace(string(data))
+	var gcsErr struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(data, &gcsErr) == nil && gcsErr.Error.Message != "" {
+		message = gcsErr.Error.Message
+	}
+
+	return fmt.Errorf("%w: %s", newStatusError(resp), message)
+}
@@ -0,0 +1,257 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const googleFolderType = "application/vnd.google-apps.folder"
+
+// googleDrive uploads to Google Drive. Drive finds files by id rather than
+// path, so the folders of a path are looked up or created one by one and
+// remembered.
+type googleDrive struct {
+	endpoint string
+	client   *http.Client
+
+	// mu serializes folder lookups, so two uploads do not create the same
+	// folder twice
+	mu      sync.Mutex
+	folders map[string]string
+}
+
+func newGoogleDrive(endpoint string, client *http.Client) *googleDrive {
+	return &googleDrive{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		client:   client,
+		folders:  map[string]string{"": "root"},
+	}
+}
+
+// chunkAlign is 256 KiB: every chunk but the last must be a multiple of it.
+func (d *googleDrive) chunkAlign() int64 {
+	return 256 << 10
+}
+
+func (d *googleDrive) start(job *uploadJob, remotePath string, size int64) (string, error) {
+	dir, name := "", remotePath
+	if i := strings.LastIndex(remotePath, "/"); i >= 0 {
+		dir, name = remotePath[:i], remotePath[i+1:]
+	}
+	parent, err := d.folder(job.context(), dir)
+	if err != nil {
+		return "", err
+	}
+	existing, err := d.find(job.context(), parent, name, false)
+	if err != nil {
+		return "", err
+	}
+
+	// A file uploaded again replaces the content of the one in the drive
+	method, target := http.MethodPost, d.endpoint+"/upload/drive/v3/files?uploadType=resumable&fields=id,webViewLink"
+	metadata := map[string]interface{}{"name": name, "parents": []string{parent}}
+	if existing != "" {
+		method, target = http.MethodPatch, d.endpoint+"/upload/drive/v3/files/"+url.PathEscape(existing)+"?uploadType=resumable&fields=id,webViewLink"
+		metadata = map[string]interface{}{}
+	}
+	body, err := json.Marshal(metadata)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(job.context(), method, target, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Type", job.contentType())
+	req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(size, 10))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		// A remembered folder was deleted, look them up again next time
+		d.mu.Lock()
+		d.folders = map[string]string{"": "root"}
+		d.mu.Unlock()
+		return "", retryable(driveStatusError(resp))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", driveStatusError(resp)
+	}
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return "", fmt.Errorf("upload session created without a location")
+	}
+	return location, nil
+}
+
+func (d *googleDrive) resume(ctx context.Context, upload *driveUpload) (int64, error) {
+	next, _, _, err := d.send(ctx, upload, nil, 0, "bytes */"+strconv.FormatInt(upload.Size, 10))
+	return next, err
+}
+
+func (d *googleDrive) put(ctx context.Context, upload *driveUpload, chunk io.Reader, offset, length int64) (int64, string, bool, error) {
+	if offset >= upload.Size {
+		// Nothing left to send, e.g. for an empty file: ask for the result
+		return d.send(ctx, upload, nil, 0, "bytes */"+strconv.FormatInt(upload.Size, 10))
+	}
+	return d.send(ctx, upload, chunk, length, fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, upload.Size))
+}
+
+// send makes a request to the upload session and returns the offset Drive
+// has persisted, or the file's link once it is complete.
+func (d *googleDrive) send(ctx context.Context, upload *driveUpload, body io.Reader, length int64, contentRange string) (int64, string, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, upload.Session, body)
+	if err != nil {
+		return 0, "", false, err
+	}
+	req.ContentLength = length
+	req.Header.Set("Content-Range", contentRange)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, "", false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		var file struct {
+			WebViewLink string `json:"webViewLink"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&file); err != nil {
+			return 0, "", false, fmt.Errorf("reading file metadata: %w", err)
+		}
+		return upload.Size, file.WebViewLink, true, nil
+	case http.StatusPermanentRedirect:
+		// 308 Resume Incomplete, with the persisted range as "bytes=0-N"
+		received := resp.Header.Get("Range")
+		if received == "" {
+			return 0, "", false, nil
+		}
+		_, last, _ := strings.Cut(received, "-")
+		end, err := strconv.ParseInt(last, 10, 64)
+		if err != nil {
+			return 0, "", false, fmt.Errorf("invalid Range in response: %s", received)
+		}
+		return end + 1, "", false, nil
+	case http.StatusNotFound, http.StatusGone:
+		return 0, "", false, errDriveSessionGone
+	default:
+		return 0, "", false, driveStatusError(resp)
+	}
+}
+
+// folder returns the id of the folder at dir, creating the folders of the
+// path that do not exist yet.
+func (d *googleDrive) folder(ctx context.Context, dir string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if id, ok := d.folders[dir]; ok {
+		return id, nil
+	}
+	parent, current := "root", ""
+	for _, name := range strings.Split(dir, "/") {
+		current = strings.TrimPrefix(current+"/"+name, "/")
+		if id, ok := d.folders[current]; ok {
+			parent = id
+			continue
+		}
+		id, err := d.find(ctx, parent, name, true)
+		if err != nil {
+			return "", err
+		}
+		if id == "" {
+			if id, err = d.createFolder(ctx, parent, name); err != nil {
+				return "", fmt.Errorf("creating folder %s: %w", current, err)
+			}
+		}
+		d.folders[current] = id
+		parent = id
+	}
+	return parent, nil
+}
+
+// find returns the id of the file or folder called name in parent, or ""
+// if there is none.
+func (d *googleDrive) find(ctx context.Context, parent, name string, folder bool) (string, error) {
+	typeCondition := "mimeType != '" + googleFolderType + "'"
+	if folder {
+		typeCondition = "mimeType = '" + googleFolderType + "'"
+	}
+	escaped := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(name)
+	query := url.Values{
+		"q":      {fmt.Sprintf("name = '%s' and '%s' in parents and %s and trashed = false", escaped, parent, typeCondition)},
+		"fields": {"files(id)"},
+		"spaces": {"drive"},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.endpoint+"/drive/v3/files?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", driveStatusError(resp)
+	}
+
+	var list struct {
+		Files []struct {
+			ID string `json:"id"`
+		} `json:"files"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return "", fmt.Errorf("reading file list: %w", err)
+	}
+	if len(list.Files) == 0 {
+		return "", nil
+	}
+	return list.Files[0].ID, nil
+}
+
+func (d *googleDrive) createFolder(ctx context.Context, parent, name string) (string, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"name":     name,
+		"mimeType": googleFolderType,
+		"parents":  []string{parent},
+	})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.endpoint+"/drive/v3/files?fields=id", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", driveStatusError(resp)
+	}
+
+	var folder struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&folder); err != nil {
+		return "", fmt.Errorf("reading folder metadata: %w", err)
+	}
+	return folder.ID, nil
+}
@@ -0,0 +1,105 @@
+package uploader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// GraphQLConfig configures the graphql protocol of the http backend, which
+// sends files as a GraphQL multipart request
+// (https://github.com/jaydenseric/graphql-multipart-request-spec): the
+// operation, a map of the variables the file goes into and then the file.
+// The body fields are the operation's variables.
+type GraphQLConfig struct {
+	// Query is the mutation, e.g.
+	// mutation ($file: Upload!) { upload(file: $file) { url } }
+	Query         string `yaml:"query"`
+	OperationName string `yaml:"operation_name"`
+	// FileVariable is the variable of the query that takes the file
+	FileVariable string `yaml:"file_variable"`
+}
+
+func (c *GraphQLConfig) validate() error {
+	if strings.TrimSpace(c.Query) == "" {
+		return errors.New("the graphql protocol needs a query")
+	}
+	if c.FileVariable == "" {
+		return errors.New("the graphql protocol needs the variable that takes the file")
+	}
+	if !strings.Contains(c.Query, "$"+c.FileVariable) {
+		return fmt.Errorf("the graphql query does not use $%s", c.FileVariable)
+	}
+	return nil
+}
+
+// graphQLResponse is the part of a GraphQL response that tells whether the
+// operation failed. GraphQL servers usually answer 200 even then.
+type graphQLResponse struct {
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// sendFileGraphQL uploads a file with a GraphQL multipart request.
+func sendFileGraphQL(job *uploadJob) (*fileRecord, error) {
+	filePath := job.Path
+	file, info, err := openFile(job.context(), filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	conf := cfg.GraphQL
+	variables := make(map[string]interface{}, len(job.Fields)+1)
+	for key, value := range job.Fields {
+		variables[key] = value
+	}
+	// The file's variable is null in the operation, the map says which part
+	// fills it in
+	variables[conf.FileVariable] = nil
+	operation := map[string]interface{}{"query": conf.Query, "variables": variables}
+	if conf.OperationName != "" {
+		operation["operationName"] = conf.OperationName
+	}
+	operations, err := json.Marshal(operation)
+	if err != nil {
+		return nil, err
+	}
+	fileMap, err := json.Marshal(map[string][]string{"0": {"variables." + conf.FileVariable}})
+	if err != nil {
+		return nil, err
+	}
+
+	// The spec wants operations and map ahead of the files
+	form := newMultipartBody("", "", "", nil)
+	form.addLeadingField("operations", string(operations))
+	form.addLeadingField("map", string(fileMap))
+	form.addFile("0", job.uploadName(), job.contentType(), "")
+
+	hash := sha256.New()
+	body, err := postForm(job, job.URL, form, []io.Reader{io.TeeReader(file, hash)}, info.Size())
+	job.Response = body
+	if err != nil {
+		return nil, err
+	}
+
+	var resp graphQLResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("graphql response is not JSON: %w", err)
+	}
+	if len(resp.Errors) > 0 {
+		return nil, fmt.Errorf("graphql error: %s", resp.Errors[0].Message)
+	}
+	if err := job.verifyChecksum(body); err != nil {
+		return nil, err
+	}
+
+	rec := newFileRecord(filePath, info, hex.EncodeToString(hash.Sum(nil)))
+	rec.RemoteURL = job.rules().remoteURL(body)
+	return rec, nil
+}
@@ -0,0 +1,203 @@
+package uploader
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"auto-upload/pkg/uploadpb"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// GRPCConfig configures the gRPC backend.
+type GRPCConfig struct {
+	Address string `yaml:"address"`
+	// Plaintext connects without TLS, for services on a private network
+	Plaintext          bool   `yaml:"plaintext"`
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	// Token is sent as a bearer token in the authorization metadata
+	Token string `yaml:"token"`
+	// Metadata is sent with every call, like the headers of HTTP uploads
+	Metadata  map[string]string `yaml:"metadata"`
+	ChunkSize ByteSize          `yaml:"chunk_size"`
+	// Timeout limits a whole upload; 0 waits forever
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// grpcBackend streams files to the Upload RPC of an ingestion service, as
+// defined in pkg/uploadpb/upload.proto. The connection is shared by all
+// uploads and reconnects by itself.
+type grpcBackend struct {
+	conf   GRPCConfig
+	token  string
+	conn   *grpc.ClientConn
+	client uploadpb.UploaderClient
+}
+
+func newGRPCBackend(conf GRPCConfig) (*grpcBackend, error) {
+	if conf.Address == "" {
+		return nil, errors.New("grpc backend needs an address")
+	}
+	if conf.ChunkSize <= 0 {
+		conf.ChunkSize = 1 << 20
+	}
+
+	creds := insecure.NewCredentials()
+	if !conf.Plaintext {
+		tlsConfig, err := tlsClientConfig(conf.CAFile, conf.InsecureSkipVerify)
+		if err != nil {
+			return nil, err
+		}
+		if conf.CertFile != "" || conf.KeyFile != "" {
+			cert, err := tls.LoadX509KeyPair(conf.CertFile, firstNonEmpty(conf.KeyFile, conf.CertFile))
+			if err != nil {
+				return nil, fmt.Errorf("loading client certificate: %w", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		if conf.InsecureSkipVerify {
+			logrus.Warn("gRPC certificate verification is disabled, the connection can be intercepted")
+		}
+		creds = credentials.NewTLS(tlsConfig)
+	}
+
+	conn, err := grpc.NewClient(conf.Address,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithContextDialer(func(_ context.Context, addr string) (net.Conn, error) {
+			return dialThroughProxy("grpc", addr, cfg.HTTPClient.ConnectTimeout)
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %s: %w", conf.Address, err)
+	}
+
+	return &grpcBackend{
+		conf:   conf,
+		token:  firstNonEmpty(conf.Token, os.Getenv("GRPC_TOKEN")),
+		conn:   conn,
+		client: uploadpb.NewUploaderClient(conn),
+	}, nil
+}
+
+func (b *grpcBackend) close() {
+	b.conn.Close()
+}
+
+func (b *grpcBackend) upload(job *uploadJob) (*fileRecord, error) {
+	filePath := job.Path
+	file, info, err := openFile(job.context(), filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	checksum, err := job.checksum()
+	if err != nil {
+		return nil, fmt.Errorf("hashing file: %w", err)
+	}
+
+	fields := make(map[string]string, len(job.Fields))
+	for key, value := range job.Fields {
+		fields[key] = fmt.Sprintf("%v", value)
+	}
+
+	ctx, cancel := context.WithCancel(job.context())
+	if b.conf.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(job.context(), b.conf.Timeout)
+	}
+	defer cancel()
+	md := metadata.New(b.conf.Metadata)
+	if b.token != "" {
+		md.Set("authorization", "Bearer "+b.token)
+	}
+	ctx = metadata.NewOutgoingContext(ctx, md)
+
+	stream, err := b.client.Upload(ctx)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	err = stream.Send(&uploadpb.UploadRequest{Data: &uploadpb.UploadRequest_Info{Info: &uploadpb.FileInfo{
+		Filename:    job.uploadName(),
+		RelPath:     job.RelPath,
+		Size:        info.Size(),
+		ContentType: job.contentType(),
+		Sha256:      checksum,
+		Fields:      fields,
+	}}})
+	for err == nil {
+		// Every chunk gets its own buffer, as gRPC may still hold on to a
+		// message after sending it
+		chunk := make([]byte, b.conf.ChunkSize)
+		n, readErr := file.Read(chunk)
+		if n > 0 {
+			err = stream.Send(&uploadpb.UploadRequest{Data: &uploadpb.UploadRequest_Chunk{Chunk: chunk[:n]}})
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return nil, readErr
+		}
+	}
+	// A failed Send returns io.EOF, the reason comes with the response
+	resp, recvErr := stream.CloseAndRecv()
+	if recvErr != nil {
+		return nil, grpcError(recvErr)
+	}
+	if err != nil && err != io.EOF {
+		return nil, grpcError(err)
+	}
+
+	rec := newFileRecord(filePath, info, checksum)
+	rec.RemoteURL = resp.GetUrl()
+	return rec, nil
+}
+
+// grpcStatus maps gRPC status codes to the HTTP status codes they stand for,
+// so the retry policy, the circuit breaker and the quarantine treat gRPC
+// errors like those of HTTP uploads.
+var grpcStatus = map[codes.Code]int{
+	codes.InvalidArgument:    http.StatusBadRequest,
+	codes.FailedPrecondition: http.StatusBadRequest,
+	codes.OutOfRange:         http.StatusBadRequest,
+	codes.Unauthenticated:    http.StatusUnauthorized,
+	codes.PermissionDenied:   http.StatusForbidden,
+	codes.NotFound:           http.StatusNotFound,
+	codes.AlreadyExists:      http.StatusConflict,
+	codes.Aborted:            http.StatusConflict,
+	codes.ResourceExhausted:  http.StatusTooManyRequests,
+	codes.Unknown:            http.StatusInternalServerError,
+	codes.Internal:           http.StatusInternalServerError,
+	codes.DataLoss:           http.StatusInternalServerError,
+	codes.Unimplemented:      http.StatusNotImplemented,
+	codes.Unavailable:        http.StatusServiceUnavailable,
+	codes.DeadlineExceeded:   http.StatusGatewayTimeout,
+}
+
+func grpcError(err error) error {
+	st, ok := status.FromError(err)
+	if !ok {
+		return retryable(err)
+	}
+	code, ok := grpcStatus[st.Code()]
+	if !ok {
+		return retryable(err)
+	}
+	return &statusError{StatusCode: code, Status: st.Code().String() + ": " + st.Message()}
+}
@@ -0,0 +1,344 @@
+package uploader
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// HealthConfig configures the health endpoints for container probes:
+//
+//	GET /healthz  200 while the watcher is running, 503 once it is stuck
+//	GET /readyz   200 once the first scan is done and a server is reachable,
+//	              503 before, while shutting down or with every server down
+//
+// Both answer with the same report on the watcher, queue, recent errors and
+// servers, and need no token.
+type HealthConfig struct {
+	// Listen is the address to serve the endpoints on, e.g. :8091. The
+	// admin API serves them too.
+	Listen string `yaml:"listen"`
+	// ProbeInterval is how often the server URLs are sent a HEAD request,
+	// 0 turns the probes off
+	ProbeInterval time.Duration `yaml:"probe_interval"`
+	// StaleAfter is how long the watcher may be overdue before /healthz
+	// fails, unless an upload keeps it busy
+	StaleAfter time.Duration `yaml:"stale_after"`
+}
+
+// errorWindow is how far back /healthz counts uploads and failures.
+const errorWindow = 15 * time.Minute
+
+var (
+	// watchStarted is set once the first scan of the watched directories is
+	// done
+	watchStarted atomic.Bool
+	// lastScan and nextBeat are Unix nanoseconds: when a scan of the
+	// watched directories last finished, and by when the watch loop is
+	// expected to come round again
+	lastScan atomic.Int64
+	nextBeat atomic.Int64
+
+	outcomesMu sync.Mutex
+	// outcomes counts the finished uploads by minute over errorWindow
+	outcomes []outcomeCount
+	// uploadsSucceeded counts the successful uploads since the start
+	uploadsSucceeded atomic.Int64
+
+	probesMu sync.Mutex
+	probes   = map[string]*probeResult{}
+	probing  sync.Once
+)
+
+type outcomeCount struct {
+	minute   int64
+	uploads  int
+	failures int
+}
+
+// probeResult is the outcome of the last HEAD request to a server.
+type probeResult struct {
+	URL       string    `json:"url"`
+	Reachable bool      `json:"reachable"`
+	Status    string    `json:"status,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+type healthReport struct {
+	Status   string         `json:"status"`
+	Problems []string       `json:"problems,omitempty"`
+	Watcher  watcherHealth  `json:"watcher"`
+	Queue    queueHealth    `json:"queue"`
+	Errors   errorHealth    `json:"errors"`
+	Servers  []*probeResult `json:"servers,omitempty"`
+}
+
+type watcherHealth struct {
+	Mode     string     `json:"mode"`
+	Started  bool       `json:"started"`
+	Paused   bool       `json:"paused"`
+	LastScan *time.Time `json:"last_scan,omitempty"`
+}
+
+type queueHealth struct {
+	Queued    int `json:"queued"`
+	Uploading int `json:"uploading"`
+}
+
+type errorHealth struct {
+	Window   string  `json:"window"`
+	Uploads  int     `json:"uploads"`
+	Failures int     `json:"failures"`
+	Rate     float64 `json:"rate"`
+}
+
+// recordScan notes that a scan of the watched directories finished.
+func recordScan() {
+	lastScan.Store(time.Now().UnixNano())
+}
+
+// watcherBeat tells the health check that the watch loop is running and
+// comes round again within d.
+func watcherBeat(d time.Duration) {
+	nextBeat.Store(time.Now().Add(d).UnixNano())
+}
+
+// recordOutcome counts a finished upload for the error rate.
+func recordOutcome(err error) {
+	outcomesMu.Lock()
+	defer outcomesMu.Unlock()
+
+	minute := time.Now().Unix() / 60
+	if n := len(outcomes); n == 0 || outcomes[n-1].minute != minute {
+		outcomes = append(outcomes, outcomeCount{minute: minute})
+	}
+	last := &outcomes[len(outcomes)-1]
+	last.uploads++
+	if err != nil {
+		last.failures++
+	} else {
+		uploadsSucceeded.Add(1)
+	}
+}
+
+// recentOutcomes returns the uploads and failures within errorWindow.
+func recentOutcomes() errorHealth {
+	outcomesMu.Lock()
+	defer outcomesMu.Unlock()
+
+	oldest := time.Now().Add(-errorWindow).Unix() / 60
+	for len(outcomes) > 0 && outcomes[0].minute < oldest {
+		outcomes = outcomes[1:]
+	}
+	report := errorHealth{Window: errorWindow.String()}
+	for _, count := range outcomes {
+		report.Uploads += count.uploads
+		report.Failures += count.failures
+	}
+	if report.Uploads > 0 {
+		report.Rate = float64(report.Failures) / float64(report.Uploads)
+	}
+	return report
+}
+
+// startHealth serves /healthz and /readyz on conf.Listen.
+func startHealth(conf HealthConfig) error {
+	listener, err := net.Listen("tcp", conf.Listen)
+	if err != nil {
+		return fmt.Errorf("starting health endpoints: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	registerHealth(mux)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			logrus.Error("Health endpoints stopped:", err)
+		}
+	}()
+	logrus.Infof("Health endpoints listening on %s", listener.Addr())
+	return nil
+}
+
+// registerHealth adds the health endpoints to mux and starts probing the
+// servers.
+func registerHealth(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", healthHandler(false))
+	mux.HandleFunc("/readyz", healthHandler(true))
+	probing.Do(func() { go probeServers() })
+}
+
+func healthHandler(ready bool) http.HandlerFunc {
+	return adminHandler(http.MethodGet, func(r *http.Request) (interface{}, int, error) {
+		report := checkHealth(ready)
+		if len(report.Problems) > 0 {
+			return report, http.StatusServiceUnavailable, nil
+		}
+		return report, http.StatusOK, nil
+	})
+}
+
+// checkHealth reports on the uploader, with the liveness problems, or the
+// readiness ones too if ready is set.
+func checkHealth(ready bool) healthReport {
+	configMu.RLock()
+	conf := cfg.Health
+	mode := cfg.WatchMode
+	configMu.RUnlock()
+
+	report := healthReport{
+		Watcher: watcherHealth{Mode: mode, Started: watchStarted.Load(), Paused: paused.Load()},
+		Queue:   queueHealth{Queued: queue.len(), Uploading: len(currentUploads())},
+		Errors:  recentOutcomes(),
+		Servers: probedServers(),
+	}
+	if scanned := lastScan.Load(); scanned != 0 {
+		at := time.Unix(0, scanned)
+		report.Watcher.LastScan = &at
+	}
+
+	// A long upload holds up the watch loop, but it is busy, not stuck
+	if beat := nextBeat.Load(); beat != 0 && conf.StaleAfter > 0 && report.Queue.Uploading == 0 {
+		if overdue := time.Since(time.Unix(0, beat)); overdue > conf.StaleAfter {
+			report.Problems = append(report.Problems, fmt.Sprintf("watcher has not run for %s", overdue.Round(time.Second)))
+		}
+	}
+
+	if ready {
+		switch {
+		case shutdownStarted():
+			report.Problems = append(report.Problems, "shutting down")
+		case !report.Watcher.Started:
+			report.Problems = append(report.Problems, "first scan not done yet")
+		}
+		if len(report.Servers) > 0 {
+			reachable := false
+			for _, server := range report.Servers {
+				reachable = reachable || server.Reachable
+			}
+			if !reachable {
+				report.Problems = append(report.Problems, "no server is reachable")
+			}
+		}
+	}
+
+	report.Status = "ok"
+	if len(report.Problems) > 0 {
+		report.Status = "unavailable"
+	}
+	return report
+}
+
+// probedServers returns the last probe of every server that had one.
+func probedServers() []*probeResult {
+	urls := serverURLs()
+	probesMu.Lock()
+	defer probesMu.Unlock()
+
+	var results []*probeResult
+	for _, url := range urls {
+		if result, ok := probes[url]; ok {
+			copied := *result
+			results = append(results, &copied)
+		}
+	}
+	return results
+}
+
+// serverURLs returns the URLs the http backend uploads to, without those
+// that depend on the file.
+func serverURLs() []string {
+	configMu.RLock()
+	defer configMu.RUnlock()
+
+	if cfg.Backend != "http" {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var urls []string
+	add := func(url string) {
+		if url != "" && !strings.Contains(url, "{{") && !seen[url] {
+			seen[url] = true
+			urls = append(urls, url)
+		}
+	}
+	for _, dir := range dirs {
+		add(dir.ServerURL)
+	}
+	for _, target := range cfg.Targets {
+		add(firstNonEmpty(target.HealthURL, target.URL))
+	}
+	return urls
+}
+
+// probeServers sends a HEAD request to every server URL every
+// cfg.Health.ProbeInterval. Probes that are off at the start stay off until
+// a restart.
+func probeServers() {
+	for {
+		configMu.RLock()
+		interval := cfg.Health.ProbeInterval
+		configMu.RUnlock()
+		if interval <= 0 {
+			return
+		}
+
+		for _, url := range serverURLs() {
+			result := probeServer(url)
+			probesMu.Lock()
+			if previous, ok := probes[url]; ok && previous.Reachable != result.Reachable {
+				if result.Reachable {
+					logrus.Infof("%s is reachable again", url)
+				} else {
+					logrus.Warnf("%s is not reachable: %s", url, firstNonEmpty(result.Error, result.Status))
+				}
+			}
+			probes[url] = result
+			probesMu.Unlock()
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-stopping:
+			return
+		}
+	}
+}
+
+// probeServer sends a HEAD request to url. Any answer but a 502, 503 or 504,
+// which come from a proxy in front of a server that is down or from a server
+// that says it is unavailable, counts as reachable, as upload endpoints
+// rarely support HEAD.
+func probeServer(url string) *probeResult {
+	result := &probeResult{URL: url, CheckedAt: time.Now()}
+	ctx, cancel := context.WithTimeout(uploadsCtx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	setProbeHeaders(req)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	resp.Body.Close()
+	result.Status = resp.Status
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+	default:
+		result.Reachable = true
+	}
+	return result
+}
@@ -0,0 +1,95 @@
+package uploader
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// runHistory implements "auto-upload history": it lists the recorded
+// uploads with their remote URLs as a table, or exports them as a CSV or
+// JSON manifest.
+func runHistory(args []string) error {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	fs.StringVar(&configFile, "config", "", "YAML file to load settings from")
+	registerStateFlags(fs, &cfg)
+	format := fs.String("format", "table", "Output format: 'table', 'csv' or 'json'")
+	output := fs.String("output", "", "File to write to instead of stdout")
+	fs.Parse(args)
+	if err := resolveSecrets(&cfg); err != nil {
+		return err
+	}
+
+	var write func(io.Writer, []*fileRecord) error
+	switch *format {
+	case "table":
+		write = writeHistoryTable
+	case "csv":
+		write = writeHistoryCSV
+	case "json":
+		write = writeHistoryJSON
+	default:
+		return fmt.Errorf("unknown history format: %s", *format)
+	}
+
+	store, err := openState()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	var records []*fileRecord
+	err = store.history(func(rec *fileRecord) error {
+		records = append(records, rec)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	return write(out, records)
+}
+
+func writeHistoryTable(w io.Writer, records []*fileRecord) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "UPLOADED AT\tPATH\tSIZE\tREMOTE URL")
+	for _, rec := range records {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", rec.UploadedAt.Format(time.RFC3339), rec.Path, rec.Size, rec.RemoteURL)
+	}
+	return tw.Flush()
+}
+
+func writeHistoryCSV(w io.Writer, records []*fileRecord) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"uploaded_at", "path", "size", "sha256", "remote_url"})
+	for _, rec := range records {
+		cw.Write([]string{rec.UploadedAt.Format(time.RFC3339), rec.Path, strconv.FormatInt(rec.Size, 10), rec.SHA256, rec.RemoteURL})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeHistoryJSON(w io.Writer, records []*fileRecord) error {
+	if records == nil {
+		records = []*fileRecord{}
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(records)
+}
@@ -0,0 +1,182 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxHookResponse caps the response body passed to the post-upload hooks, as
+// environment variables are limited in size.
+const maxHookResponse = 64 << 10
+
+// HooksConfig holds shell commands run around every upload, for virus
+// scanning, transcoding or notifications. They get the file and the outcome
+// in UPLOAD_HOOK_* environment variables.
+type HooksConfig struct {
+	// PreUpload runs before a file is uploaded. A non-zero exit code vetoes
+	// the upload. If the last line it prints is the path of a file, that
+	// file is uploaded in place of the watched one, e.g. a transcoded copy.
+	PreUpload   string        `yaml:"pre_upload"`
+	PostSuccess string        `yaml:"post_success"`
+	PostFailure string        `yaml:"post_failure"`
+	Timeout     time.Duration `yaml:"timeout"`
+}
+
+// shellCommand returns a command that runs command with the system shell.
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+	return exec.CommandContext(ctx, "sh", "-c", command)
+}
+
+// runHook runs a hook command with the job's environment and returns what it
+// printed on stdout.
+func runHook(command string, env []string) (string, error) {
+	ctx := uploadsCtx
+	if cfg.Hooks.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Hooks.Timeout)
+		defer cancel()
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := shellCommand(ctx, command)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", fmt.Errorf("timed out after %s", cfg.Hooks.Timeout)
+	}
+	if err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return "", fmt.Errorf("%w: %s", err, message)
+		}
+		return "", err
+	}
+	return stdout.String(), nil
+}
+
+// hookEnvPrefix starts the names of the variables that describe a job to
+// the hooks.
+const hookEnvPrefix = "UPLOAD_HOOK_"
+
+// hookEnv describes a job to the hooks.
+func hookEnv(job *uploadJob, status string) []string {
+	return []string{
+		hookEnvPrefix + "FILE=" + firstNonEmpty(job.Original, job.Path),
+		hookEnvPrefix + "UPLOAD_FILE=" + job.Path,
+		hookEnvPrefix + "REL_PATH=" + job.RelPath,
+		hookEnvPrefix + "DIR=" + job.Dir.Path,
+		hookEnvPrefix + "SERVER_URL=" + job.URL,
+		hookEnvPrefix + "STATUS=" + status,
+	}
+}
+
+// runPreUploadHook runs the pre-upload hook for a job and reports whether
+// the upload should go ahead. A file printed by the hook replaces the job's
+// file. A vetoed file is recorded as handled so the hook does not run for it
+// again until it changes.
+func runPreUploadHook(job *uploadJob) bool {
+	output, err := runHook(cfg.Hooks.PreUpload, hookEnv(job, "pending"))
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		filePath := firstNonEmpty(job.Original, job.Path)
+		logrus.Infof("Skipping %s: pre-upload hook vetoed it (%v)", filePath, err)
+		info, err := os.Stat(filePath)
+		if err != nil {
+			logrus.Error("Error reading file info:", err)
+			return false
+		}
+		checksum, _ := hashFile(filePath)
+		rec := newFileRecord(filePath, info, checksum)
+		rec.Vetoed = true
+		if err := state.put(rec); err != nil {
+			logrus.Error("Error saving upload state:", err)
+		}
+		return false
+	}
+	if err != nil {
+		logrus.Errorf("Pre-upload hook failed for %s: %v", job.Path, err)
+		return false
+	}
+
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	replacement := strings.TrimSpace(lines[len(lines)-1])
+	if replacement == "" || replacement == job.Path {
+		return true
+	}
+	if info, err := os.Stat(replacement); err != nil || info.IsDir() {
+		logrus.Errorf("Pre-upload hook for %s printed %q, which is not a file", job.Path, replacement)
+		return false
+	}
+	logrus.Infof("Uploading %s in place of %s", replacement, job.Path)
+	job.Original, job.Path, job.Checksum = firstNonEmpty(job.Original, job.Path), replacement, ""
+	return true
+}
+
+// runPostUploadHook runs the post-success or post-failure hook for a job,
+// depending on uploadErr.
+func runPostUploadHook(job *uploadJob, rec *fileRecord, uploadErr error) {
+	command, status := cfg.Hooks.PostSuccess, "success"
+	if uploadErr != nil {
+		command, status = cfg.Hooks.PostFailure, "failure"
+	}
+	if command == "" {
+		return
+	}
+
+	env := hookEnv(job, status)
+	response := job.Response
+	if len(response) > maxHookResponse {
+		response = response[:maxHookResponse]
+	}
+	env = append(env, hookEnvPrefix+"RESPONSE="+string(response))
+	if rec != nil {
+		env = append(env, hookEnvPrefix+"REMOTE_URL="+rec.RemoteURL)
+	}
+	if uploadErr != nil {
+		env = append(env, hookEnvPrefix+"ERROR="+uploadErr.Error())
+	}
+
+	if _, err := runHook(command, env); err != nil {
+		logrus.Errorf("Post-%s hook failed for %s: %v", status, job.Path, err)
+	}
+}
+
+// originalRecord turns the record of an upload of a file made by the
+// pre-upload hook into one for the watched file, so that file counts as
+// uploaded.
+func originalRecord(job *uploadJob, rec *fileRecord) (*fileRecord, error) {
+	info, err := os.Stat(job.Original)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		// A directory uploaded as an archive keeps the archive's size and
+		// checksum
+		rec.Path, rec.ModTime = job.Original, info.ModTime()
+		return rec, nil
+	}
+	checksum, err := hashFile(job.Original)
+	if err != nil {
+		return nil, err
+	}
+
+	original := newFileRecord(job.Original, info, checksum)
+	original.RemoteURL = rec.RemoteURL
+	original.Compression, original.CompressedSize = rec.Compression, rec.CompressedSize
+	return original, nil
+}
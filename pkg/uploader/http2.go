@@ -0,0 +1,56 @@
+package uploader
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// http2Transport sends every request with HTTP/2, for -force-http2. Over
+// TLS HTTP/2 is negotiated as usual, but a server that answers with HTTP/1
+// fails the request. Plain http:// URLs get cleartext HTTP/2 (h2c) with
+// prior knowledge, which does not go through a proxy.
+type http2Transport struct {
+	tls *http.Transport
+	h2c *http2.Transport
+}
+
+func newHTTP2Transport(transport *http.Transport) *http2Transport {
+	transport.ForceAttemptHTTP2 = true
+	dialer := &net.Dialer{Timeout: cfg.HTTPClient.ConnectTimeout, KeepAlive: 30 * time.Second}
+	return &http2Transport{
+		tls: transport,
+		h2c: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+			IdleConnTimeout: cfg.HTTPClient.KeepAlive,
+		},
+	}
+}
+
+func (t *http2Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "http" {
+		return t.h2c.RoundTrip(req)
+	}
+	resp, err := t.tls.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.ProtoMajor != 2 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s answered with %s rather than HTTP/2", req.URL.Host, resp.Proto)
+	}
+	return resp, nil
+}
+
+func (t *http2Transport) CloseIdleConnections() {
+	t.tls.CloseIdleConnections()
+	t.h2c.CloseIdleConnections()
+}
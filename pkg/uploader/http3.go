@@ -0,0 +1,43 @@
+package uploader
+
+import (
+	"net/http"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// http3Transport sends the requests to https:// URLs with HTTP/3 over QUIC,
+// for -http3, which copes with lossy mobile and satellite links better than
+// TCP. Requests to http:// URLs still go over TCP, since QUIC is always
+// encrypted. QUIC runs on UDP and so does not go through a proxy.
+type http3Transport struct {
+	tcp  *http.Transport
+	quic *http3.Transport
+}
+
+func newHTTP3Transport(transport *http.Transport) *http3Transport {
+	conf := cfg.HTTPClient
+	return &http3Transport{
+		tcp: transport,
+		quic: &http3.Transport{
+			TLSClientConfig: transport.TLSClientConfig.Clone(),
+			QUICConfig: &quic.Config{
+				HandshakeIdleTimeout: conf.TLSHandshakeTimeout,
+				MaxIdleTimeout:       conf.KeepAlive,
+			},
+		},
+	}
+}
+
+func (t *http3Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "https" {
+		return t.quic.RoundTrip(req)
+	}
+	return t.tcp.RoundTrip(req)
+}
+
+func (t *http3Transport) CloseIdleConnections() {
+	t.tcp.CloseIdleConnections()
+	t.quic.CloseIdleConnections()
+}
@@ -0,0 +1,56 @@
+package uploader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// setIdempotencyKey derives the job's idempotency key from the path, size and
+// modification time of the watched file. The key only depends on the file, so
+// a file that is sent again after the state database was lost carries the
+// same key and the server can recognise it.
+func (j *uploadJob) setIdempotencyKey() error {
+	if cfg.IdempotencyHeader == "" {
+		return nil
+	}
+
+	filePath := firstNonEmpty(j.Original, j.Path)
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	if abs, err := filepath.Abs(filePath); err == nil {
+		filePath = abs
+	}
+	j.IdempotencyKey = idempotencyKey(fmt.Sprintf("%s\n%d\n%d", filePath, info.Size(), info.ModTime().UnixNano()))
+	return nil
+}
+
+func idempotencyKey(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:16])
+}
+
+// batchIdempotencyKey combines the keys of the files sent in one request.
+func batchIdempotencyKey(jobs []*uploadJob) string {
+	if cfg.IdempotencyHeader == "" || len(jobs) == 1 {
+		return jobs[0].IdempotencyKey
+	}
+	keys := make([]string, len(jobs))
+	for i, job := range jobs {
+		keys[i] = job.IdempotencyKey
+	}
+	return idempotencyKey(strings.Join(keys, "\n"))
+}
+
+// setIdempotencyHeader adds the job's idempotency key to a request.
+func (j *uploadJob) setIdempotencyHeader(req *http.Request) {
+	if j.IdempotencyKey != "" && cfg.IdempotencyHeader != "" {
+		req.Header.Set(cfg.IdempotencyHeader, j.IdempotencyKey)
+	}
+}
@@ -0,0 +1,168 @@
+package uploader
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	symlinksFollow     = "follow"
+	symlinksSkip       = "skip"
+	symlinksTargetOnce = "target-once"
+)
+
+var inodesBucket = []byte("inodes")
+
+// inodeRecord is the file uploaded for an inode, to find hard links and
+// symbolic links to content that was uploaded already.
+type inodeRecord struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+func validateSymlinks(policy string) error {
+	switch policy {
+	case "", symlinksFollow, symlinksSkip, symlinksTargetOnce:
+		return nil
+	}
+	return fmt.Errorf("unknown symlink policy: %s (use follow, skip or target-once)", policy)
+}
+
+// usesInodes reports whether uploads are recorded by inode.
+func usesInodes() bool {
+	return cfg.DedupHardlinks || cfg.Symlinks == symlinksTargetOnce
+}
+
+// isSymlink reports whether the file at path is a symbolic link.
+func isSymlink(path string) bool {
+	info, err := os.Lstat(path)
+	return err == nil && info.Mode()&os.ModeSymlink != 0
+}
+
+// skipsLink reports whether the file at path is a symbolic link that is not
+// uploaded: with the skip policy none are, and with target-once links to a
+// file in a watched directory are not, as the file is uploaded itself.
+func skipsLink(path string) bool {
+	if cfg.Symlinks != symlinksSkip && cfg.Symlinks != symlinksTargetOnce || !isSymlink(path) {
+		return false
+	}
+	if cfg.Symlinks == symlinksSkip {
+		logrus.Debugf("Skipping symbolic link %s", path)
+		return true
+	}
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false
+	}
+	if dir := dirFor(dirs, target); dir != nil {
+		logrus.Debugf("Skipping symbolic link %s: its target %s is uploaded from %s", path, target, dir.Path)
+		return true
+	}
+	return false
+}
+
+// linkedOriginal returns the path the content of filePath was uploaded from
+// under another name, through a hard link with -dedup-hardlinks or a symbolic
+// link with -symlinks=target-once, or "" if there is none. The size and
+// modification time have to match, in case the inode was reused since.
+func linkedOriginal(filePath string, info os.FileInfo) string {
+	key, links, ok := inodeOf(info)
+	if !ok {
+		return ""
+	}
+	if !(cfg.DedupHardlinks && links > 1) && !(cfg.Symlinks == symlinksTargetOnce && isSymlink(filePath)) {
+		return ""
+	}
+
+	rec := &inodeRecord{}
+	found, err := state.getJSON(inodesBucket, key, rec)
+	if err != nil {
+		logrus.Error("Error reading upload state:", err)
+		return ""
+	}
+	if !found || rec.Path == filePath || rec.Size != info.Size() || !rec.ModTime.Equal(info.ModTime()) {
+		return ""
+	}
+	return rec.Path
+}
+
+// recordInode remembers the inode of an uploaded file for linkedOriginal.
+func recordInode(filePath string) {
+	if !usesInodes() {
+		return
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return
+	}
+	key, _, ok := inodeOf(info)
+	if !ok {
+		return
+	}
+	rec := inodeRecord{Path: filePath, Size: info.Size(), ModTime: info.ModTime()}
+	if err := state.putJSON(inodesBucket, key, rec); err != nil {
+		logrus.Error("Error saving upload state:", err)
+	}
+}
+
+// followLink returns the directory a symbolic link found while walking points
+// to, when links are followed. Directories already on the way to the link, or
+// containing it, are not returned, as following them would loop.
+func followLink(path string, info os.FileInfo, chain []string) (string, bool) {
+	if info.Mode()&os.ModeSymlink == 0 || firstNonEmpty(cfg.Symlinks, symlinksFollow) != symlinksFollow {
+		return "", false
+	}
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", false
+	}
+	if targetInfo, err := os.Stat(target); err != nil || !targetInfo.IsDir() {
+		return "", false
+	}
+	for _, visited := range chain {
+		if target == visited || isInside(path, target) {
+			logrus.Debugf("Not following %s to %s, it leads back to a directory that is scanned already", path, target)
+			return "", false
+		}
+	}
+	return target, true
+}
+
+// walkLinked walks the tree at root, which is reached as path, following the
+// symbolic links to directories in it. chain are the real paths of the
+// directories on the way to root.
+func walkLinked(dir *watchDir, root, path string, chain []string, found func(path string, info os.FileInfo)) error {
+	return filepath.Walk(root, func(realPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// A scan that is still running makes no difference once shutting down
+		if shutdownStarted() {
+			return filepath.SkipAll
+		}
+		linkPath := path + strings.TrimPrefix(realPath, root)
+
+		if target, ok := followLink(realPath, info, chain); ok {
+			if dir.isBeyondDepth(linkPath) {
+				return nil
+			}
+			return walkLinked(dir, target, linkPath, append(chain, target), found)
+		}
+		if !info.IsDir() {
+			found(linkPath, info)
+		} else if dir.unitFor(linkPath) == linkPath {
+			found(linkPath, info)
+			return filepath.SkipDir
+		} else if dir.isBeyondDepth(linkPath) {
+			return filepath.SkipDir
+		}
+
+		return nil
+	})
+}
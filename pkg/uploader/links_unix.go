@@ -0,0 +1,19 @@
+//go:build !windows
+
+package uploader
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// inodeOf returns the device and inode of a file, which hard links share,
+// and its number of links.
+func inodeOf(info os.FileInfo) (string, uint64, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", 0, false
+	}
+	return fmt.Sprintf("%d:%d", stat.Dev, stat.Ino), uint64(stat.Nlink), true
+}
@@ -0,0 +1,250 @@
+package uploader
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// logFile is where log entries are written besides stdout, nil without a
+// log file or if it could not be opened.
+var (
+	logFile io.Writer
+	logMu   sync.Mutex
+
+	// historyFile is where the uploads are recorded, one JSON object per
+	// line, nil without a history file
+	historyFile *os.File
+
+	// console receives the log entries along with the log file; a Windows
+	// service has no console to write to
+	console io.Writer = os.Stdout
+)
+
+// LogSampling keeps a flood of the same warning or error, e.g. one for every
+// file while the server is down, from filling the disk. Of the entries that
+// differ only in paths and numbers, the first First in every Window are
+// logged, then every Thereafter-th; the next one logged carries the number
+// left out in a "suppressed" field. Info and debug entries are not sampled.
+type LogSampling struct {
+	Window time.Duration `yaml:"window"`
+	// First is the number of similar entries logged per window, 0 logs
+	// every entry
+	First int `yaml:"first"`
+	// Thereafter logs one in this many after the first; 0 logs none
+	Thereafter int `yaml:"thereafter"`
+}
+
+// setupLogging configures the log level, format and sampling, the log file
+// and the history file. With a maximum size set the log file is rotated,
+// keeping at most LogMaxBackups old files that are no older than LogMaxAge;
+// the history file never is.
+func setupLogging(c *Config) error {
+	logMu.Lock()
+	defer logMu.Unlock()
+
+	historyFile = nil
+	if c.HistoryFile != "" {
+		file, err := openHistoryFile(c.HistoryFile)
+		if err != nil {
+			return fmt.Errorf("opening history file: %w", err)
+		}
+		historyFile = file
+	}
+
+	level, err := logrus.ParseLevel(c.LogLevel)
+	if err != nil {
+		return fmt.Errorf("unknown log level: %s", c.LogLevel)
+	}
+
+	var formatter logrus.Formatter
+	switch c.LogFormat {
+	case "text":
+		formatter = &logrus.TextFormatter{}
+	case "json":
+		formatter = &logrus.JSONFormatter{}
+	default:
+		return fmt.Errorf("unknown log format: %s", c.LogFormat)
+	}
+	if c.LogSampling.First > 0 && c.LogSampling.Window > 0 {
+		formatter = &samplingFormatter{base: formatter, conf: c.LogSampling, seen: map[string]*sampleCount{}}
+	}
+	logrus.SetLevel(level)
+	logrus.SetFormatter(formatter)
+
+	if c.LogFile == "" || c.LogFile == "-" {
+		logFile = nil
+		logrus.SetOutput(console)
+		return nil
+	}
+	if c.LogMaxSize > 0 {
+		// lumberjack counts in whole megabytes and days
+		logFile = &lumberjack.Logger{
+			Filename:   c.LogFile,
+			MaxSize:    int((c.LogMaxSize + (1<<20 - 1)) >> 20),
+			MaxAge:     int((c.LogMaxAge + 24*time.Hour - 1) / (24 * time.Hour)),
+			MaxBackups: c.LogMaxBackups,
+			Compress:   c.LogCompress,
+		}
+	} else {
+		file, err := os.OpenFile(c.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+		if err != nil {
+			logrus.Info("Failed to log to file, using default stderr")
+			logFile = nil
+			logrus.SetOutput(os.Stderr)
+			return nil
+		}
+		logFile = file
+	}
+
+	logrus.SetOutput(io.MultiWriter(console, logFile))
+	return nil
+}
+
+// reopenLogFile opens the log and history files again with the current
+// settings and closes the previous ones, e.g. after logrotate moved the log
+// file away.
+func reopenLogFile() error {
+	logMu.Lock()
+	previous, previousHistory := logFile, historyFile
+	logMu.Unlock()
+
+	if err := setupLogging(&cfg); err != nil {
+		return err
+	}
+	if closer, ok := previous.(io.Closer); ok {
+		closer.Close()
+	}
+	if previousHistory != nil {
+		previousHistory.Close()
+	}
+	return nil
+}
+
+// openHistoryFile opens the history file for appending. A record cut off by
+// a crash is ended with a line break, so the records after it are intact;
+// -import-log skips it.
+func openHistoryFile(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err = file.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			logrus.Warnf("The last record of %s is incomplete", path)
+			_, err = file.Write([]byte{'\n'})
+		}
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// recordHistory appends an upload to the history file, as the JSON of its
+// state record on a line of its own. Unlike the log file, it holds nothing
+// else and is not rotated, so it can be read back with -import-log. Every
+// record is written in one go and synced to disk.
+func recordHistory(rec *fileRecord) {
+	logMu.Lock()
+	defer logMu.Unlock()
+
+	if historyFile == nil {
+		return
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		logrus.Error("Error writing to history file:", err)
+		return
+	}
+	if _, err := historyFile.Write(append(line, '\n')); err != nil {
+		logrus.Error("Error writing to history file:", err)
+		return
+	}
+	if err := historyFile.Sync(); err != nil {
+		logrus.Error("Error writing to history file:", err)
+	}
+}
+
+// similarText matches the parts of a log message that tell apart entries of
+// the same kind: paths, URLs and numbers.
+var similarText = regexp.MustCompile(`\S*[/\\]\S*|\d+`)
+
+// samplingFormatter leaves out the warnings and errors that LogSampling
+// rules out. logrus writes nothing for an entry formatted to nothing.
+type samplingFormatter struct {
+	base logrus.Formatter
+	conf LogSampling
+
+	mu   sync.Mutex
+	seen map[string]*sampleCount
+}
+
+// sampleCount counts the similar entries in the current window.
+type sampleCount struct {
+	window     time.Time
+	count      int
+	suppressed int
+}
+
+func (f *samplingFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	if entry.Level > logrus.WarnLevel {
+		return f.base.Format(entry)
+	}
+
+	key := entry.Level.String() + " " + similarText.ReplaceAllString(entry.Message, "*")
+	window := entry.Time.Truncate(f.conf.Window)
+	f.mu.Lock()
+	sample, ok := f.seen[key]
+	if !ok || !sample.window.Equal(window) {
+		if len(f.seen) >= 1000 {
+			f.forget(window)
+		}
+		if !ok {
+			sample = &sampleCount{}
+			f.seen[key] = sample
+		}
+		sample.window, sample.count = window, 0
+	}
+	sample.count++
+	n := sample.count - f.conf.First
+	if n > 0 && (f.conf.Thereafter <= 0 || n%f.conf.Thereafter != 0) {
+		sample.suppressed++
+		f.mu.Unlock()
+		return nil, nil
+	}
+	suppressed := sample.suppressed
+	sample.suppressed = 0
+	f.mu.Unlock()
+
+	if suppressed > 0 {
+		copied := *entry
+		copied.Data = make(logrus.Fields, len(entry.Data)+1)
+		for name, value := range entry.Data {
+			copied.Data[name] = value
+		}
+		copied.Data["suppressed"] = suppressed
+		entry = &copied
+	}
+	return f.base.Format(entry)
+}
+
+// forget drops the counts of the entries not seen since before window, so
+// messages that are never repeated do not pile up. f.mu must be held.
+func (f *samplingFormatter) forget(window time.Time) {
+	for key, sample := range f.seen {
+		if sample.window.Before(window) {
+			delete(f.seen, key)
+		}
+	}
+}
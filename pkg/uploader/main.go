@@ -0,0 +1,900 @@
+package uploader
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	cfg        = DefaultConfig()
+	configFile string
+	importLog  string
+	// oneShot uploads the files in the watched directories once and exits,
+	// see uploadOnce
+	oneShot bool
+
+	state    *stateStore
+	uploader backend
+	dirs     []*watchDir
+)
+
+// Main runs the auto-upload command line with os.Args.
+func Main() {
+	if path := configFileFromArgs(os.Args[1:]); path != "" {
+		if err := LoadConfigFile(path, &cfg); err != nil {
+			logrus.Fatal(err)
+		}
+	}
+
+	if len(os.Args) > 1 {
+		var run func([]string) error
+		switch os.Args[1] {
+		case "history":
+			run = runHistory
+		case "state":
+			run = runState
+		case "status":
+			run = runStatus
+		case "stop":
+			run = runStop
+		case "service":
+			run = runService
+		case "upload":
+			run = runUpload
+		case "verify":
+			run = runVerify
+		case "decrypt":
+			run = runDecrypt
+		case "login":
+			run = runLogin
+		case "watch":
+			// The default command, given explicitly
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+		}
+		if run != nil {
+			if err := run(os.Args[2:]); err != nil {
+				logrus.Fatal(err)
+			}
+			return
+		}
+	}
+
+	registerFlags(flag.CommandLine, &cfg)
+	registerCommandFlags(flag.CommandLine)
+	flag.Usage = usage
+	if err := setFlagsFromEnv(flag.CommandLine); err != nil {
+		logrus.Fatal(err)
+	}
+	flag.Parse()
+	if err := resolveSecrets(&cfg); err != nil {
+		logrus.Fatal(err)
+	}
+
+	if runDaemon && !isDaemon() {
+		pid, err := startDaemon()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		fmt.Printf("Started auto-upload in the background with PID %d\n", pid)
+		return
+	}
+
+	run()
+}
+
+// run starts the uploader with the parsed configuration and watches the
+// directories until the process is shut down.
+func run() {
+	// Setup logrus
+	if err := setupLogging(&cfg); err != nil {
+		logrus.Fatal(err)
+	}
+
+	if runDaemon || cfg.PIDFile != "" {
+		if err := createPIDFile(firstNonEmpty(cfg.PIDFile, defaultPIDFile)); err != nil {
+			logrus.Fatal(err)
+		}
+		defer removePIDFile()
+	}
+
+	var err error
+	state, err = openState()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer state.Close()
+	go handleShutdown()
+
+	if importLog != "" {
+		imported, err := importLogFile(state, importLog)
+		if err != nil {
+			logrus.Fatal("Error importing log file:", err)
+		}
+		logrus.Infof("Imported %d uploaded files from %s", imported, importLog)
+		return
+	}
+
+	dirs, err = cfg.watchDirs()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	if err := lockDirs(dirs); err != nil {
+		logrus.Fatal(err)
+	}
+	if err := startUploader(); err != nil {
+		logrus.Fatal(err)
+	}
+
+	if cfg.Admin.Listen != "" {
+		if err := startAdmin(cfg.Admin); err != nil {
+			logrus.Fatal(err)
+		}
+	}
+	if err := startTracing(cfg.Tracing); err != nil {
+		logrus.Fatal(err)
+	}
+	if cfg.Health.Listen != "" {
+		if err := startHealth(cfg.Health); err != nil {
+			logrus.Fatal(err)
+		}
+	}
+
+	go handleReload()
+	go pruneStatePeriodically()
+	startWatchdog()
+	sdNotify("READY=1")
+
+	if oneShot {
+		finished <- uploadOnce()
+	} else if err := watch(); err != nil {
+		logrus.Fatal(err)
+	}
+	// handleShutdown ends the process once the running uploads are done
+	select {}
+}
+
+// watch uploads the files in the watched directories as they appear, until
+// a shutdown starts.
+func watch() error {
+	if cfg.WatchMode == "notify" {
+		err := watchWithNotify(dirs)
+		if err == nil {
+			return nil
+		}
+		logrus.Error("File watcher failed, falling back to polling:", err)
+	} else if cfg.WatchMode != "poll" {
+		return fmt.Errorf("unknown watch mode: %s", cfg.WatchMode)
+	}
+
+	// The poll interval only changes on a restart
+	interval := cfg.PollInterval
+	scanBacklog(dirs)
+	for {
+		watcherBeat(interval)
+		uploadQueued(nil)
+		select {
+		case <-time.After(interval):
+		case <-controlRequests:
+			runControlRequests()
+		case <-stopping:
+			return nil
+		}
+		pollForNewFiles(dirs)
+	}
+}
+
+// Exit codes of -once besides 0 for success, apart from those of fatal
+// errors (1) and bad flags (2).
+const (
+	exitSomeFailed = 3
+	exitAllFailed  = 4
+)
+
+// uploadOnce uploads the files in the watched directories once, for -once,
+// and returns the exit code. Files that are deferred, e.g. for being too
+// young or claimed by another uploader, are left for the next run, as are
+// uploads cut off by a shutdown, which are not failures.
+func uploadOnce() int {
+	// The counter runs since the start, only this run's uploads count
+	succeededBefore := uploadsSucceeded.Load()
+	var mu sync.Mutex
+	seen, failed, interrupted := 0, 0, 0
+	count := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case errors.Is(err, errShutdown):
+			interrupted++
+		case err != nil:
+			failed++
+		}
+	}
+
+	scanBacklog(dirs)
+	errs := uploadQueued(func(err error) {
+		mu.Lock()
+		seen++
+		mu.Unlock()
+		count(err)
+	})
+	for _, err := range errs {
+		count(err)
+	}
+
+	uploaded := int(uploadsSucceeded.Load() - succeededBefore)
+	left := queue.len() + interrupted
+	deferredFiles.Range(func(_, _ interface{}) bool {
+		left++
+		return true
+	})
+	// Files of a batch count once each, as do the archives of directories
+	skipped := max(seen-uploaded-failed-interrupted, 0)
+	entry := logrus.WithFields(logrus.Fields{"uploaded": uploaded, "failed": failed, "skipped": skipped, "left": left})
+	switch {
+	case failed > 0 && uploaded == 0:
+		entry.Errorf("All %d uploads failed", failed)
+		return exitAllFailed
+	case failed > 0:
+		entry.Errorf("%d of %d uploads failed", failed, failed+uploaded)
+		return exitSomeFailed
+	}
+	entry.Infof("Uploaded %d files, skipped %d, left %d for the next run", uploaded, skipped, left)
+	return 0
+}
+
+func usage() {
+	fmt.Fprint(flag.CommandLine.Output(), `Usage:
+  auto-upload [watch] [flags]              watch the directories and upload new files
+  auto-upload upload [flags] <paths...>    upload files and directories once
+  auto-upload verify [flags]               check that the server still has the uploaded files
+  auto-upload history [flags]              list or export the upload history
+  auto-upload state export|import [flags]  move the state database to another machine as JSON
+  auto-upload state prune [flags]          forget deleted files and compact the state database
+  auto-upload decrypt [flags] <file>       decrypt a file that was uploaded encrypted
+  auto-upload login [flags]                sign in to the drive of the drive backend
+  auto-upload status|stop [flags]          check on or stop a running instance
+  auto-upload service install|uninstall    run as a Windows service
+
+Flags:
+`)
+	flag.PrintDefaults()
+}
+
+// startUploader sets up what uploads need besides the state database: the
+// backend, and the rules, limits and event publishers applied to every
+// upload.
+func startUploader() error {
+	if err := validateDedup(cfg.Dedup); err != nil {
+		return err
+	}
+
+	bandwidthLimiter = newBandwidthLimiter(cfg.MaxBandwidth)
+	uploadRate = newRateLimiter(cfg.RateLimit)
+	uploadBreaker = newCircuitBreaker(cfg.CircuitBreaker)
+	uploadConcurrency = newConcurrencyLimit(cfg.AdaptiveChunkConcurrency)
+	var err error
+	if responseCheck, err = newResponseRules(cfg.Response); err != nil {
+		return err
+	}
+	if webhooks, err = newWebhooks(cfg.Webhooks); err != nil {
+		return err
+	}
+	if busEvents, err = newEventBus(cfg.Bus); err != nil {
+		return err
+	}
+	if mqttEvents, err = newMQTTPublisher(cfg.MQTT); err != nil {
+		return err
+	}
+	mqttEvents.start()
+	if encryption, err = newEncryptor(cfg.Encryption); err != nil {
+		return err
+	}
+	if plugins, err = newPluginSet(cfg.Plugins); err != nil {
+		return err
+	}
+	if routeScript, err = loadScript(cfg.Script); err != nil {
+		return err
+	}
+	if claims, err = newClaimer(cfg.Claim); err != nil {
+		return err
+	}
+	uploader, err = newBackend(cfg.Backend)
+	return err
+}
+
+// stopServices closes the event publishers, plugins and claims that
+// startUploader set up and exports the last traces. The backend is left
+// open, as an upload that did not stop in time may still hold it.
+func stopServices() {
+	busEvents.close()
+	mqttEvents.close()
+	plugins.close()
+	claims.close()
+	stopTracing()
+}
+
+// registerCommandFlags binds the flags that are not settings of the config
+// file.
+func registerCommandFlags(fs *flag.FlagSet) {
+	fs.StringVar(&configFile, "config", "", "YAML file to load settings from; flags override its values")
+	fs.StringVar(&importLog, "import-log", "", "Import uploaded files recorded in a log file of an older version or a history file into the state database, then exit")
+	fs.BoolVar(&runDaemon, "daemon", false, "Run in the background with a PID file; stop it with 'auto-upload stop'")
+	fs.BoolVar(&oneShot, "once", false, "Upload the files in the watched directories once and exit, e.g. from cron; the exit code is 3 if some uploads failed, 4 if all did")
+	fs.BoolVar(&oneShot, "one-shot", false, "Same as -once")
+}
+
+// watchForNewFiles queues the files in dir for upload, except for the
+// backlog left for the next start. Files that were uploaded before are
+// skipped once their turn comes.
+func watchForNewFiles(dir *watchDir) {
+	walkDir(dir, func(path string, info os.FileInfo) {
+		queueNew(dir, path, info)
+	})
+}
+
+// queueNew queues a file found in dir unless it is backlog left for the next
+// start.
+func queueNew(dir *watchDir, path string, info os.FileInfo) {
+	if !isLeftBacklog(path, info) {
+		queue.add(dir, path)
+	}
+}
+
+// walkDir calls found for every file in dir, and for the subdirectories that
+// are uploaded as archives instead of the files in them. Symbolic links to
+// directories are followed unless the symlink policy says otherwise.
+func walkDir(dir *watchDir, found func(path string, info os.FileInfo)) {
+	_, span := tracer.Start(uploadsCtx, "scan", trace.WithAttributes(attribute.String("file.dir", dir.Path)))
+	defer span.End()
+
+	root, err := filepath.EvalSymlinks(dir.Path)
+	if err == nil {
+		err = walkLinked(dir, root, dir.Path, []string{root}, found)
+	}
+
+	if err != nil {
+		logrus.Error("Error walking through the directory:", err)
+	}
+	recordScan()
+}
+
+// uploadFile uploads a file found in dir unless it is skipped, e.g. for
+// having been uploaded before, and returns the error if the upload failed.
+// queued is when the file was queued, zero if it was not.
+func uploadFile(dir *watchDir, filePath string, queued time.Time) error {
+	// Leave the file for the rescan on resume while paused
+	if paused.Load() {
+		return nil
+	}
+
+	// Leave the file for the next run once shutting down
+	if !beginUpload() {
+		return nil
+	}
+	defer endUpload()
+	configMu.RLock()
+	defer configMu.RUnlock()
+
+	// Files in subdirectories uploaded as archives go with their directory
+	if unit := dir.unitFor(filePath); unit != "" {
+		return uploadUnit(dir, unit)
+	}
+
+	// Skip files ruled out by the include/exclude patterns or max_depth
+	relPath, err := filepath.Rel(dir.Path, filePath)
+	if err == nil && !dir.filter.allows(relPath) || dir.isTooDeep(filePath) {
+		return nil
+	}
+	if err == nil && isClaimPath(relPath) {
+		return nil
+	}
+
+	// Skip or defer hidden and temporary files and files outside the size
+	// and age limits; directories reached through links are scanned rather
+	// than uploaded
+	info, err := os.Stat(filePath)
+	if err != nil || info.IsDir() || skipsLink(filePath) || !admitName(filePath, relPath, info) || !admitFile(filePath, info) {
+		return nil
+	}
+
+	// Check if the file has already been uploaded
+	if !needsUpload(filePath) {
+		return nil
+	}
+
+	// Ask the filter plugins last, as they are the slowest to ask
+	if !plugins.allows(dir, filePath, relPath, info) {
+		return nil
+	}
+
+	job := newUploadJob(dir, filePath)
+	job.queued, job.started = queued, time.Now()
+	if err := job.expand(); err != nil {
+		logrus.Errorf("Failed to upload file: %s, %v", filePath, err)
+		return err
+	}
+
+	// Let the routing script redirect, rename or skip the file
+	upload, err := routeScript.apply(job, info)
+	if err != nil {
+		logrus.Errorf("Failed to upload file: %s, %v", filePath, err)
+		return err
+	}
+	if !upload {
+		return nil
+	}
+
+	if original := linkedOriginal(filePath, info); original != "" {
+		logrus.Infof("Skipping linked file: %s is the same file as %s", filePath, original)
+		skipDuplicate(job, original)
+		return nil
+	}
+
+	if cfg.Dedup != dedupOff {
+		original, err := findDuplicate(job)
+		switch {
+		case err != nil:
+			logrus.Errorf("Error checking %s for duplicates: %v", filePath, err)
+		case original == "":
+		case cfg.Dedup == dedupSkip:
+			logrus.Infof("Skipping duplicate file: %s has the same content as %s", filePath, original)
+			skipDuplicate(job, original)
+			return nil
+		default:
+			// Upload anyway, but tell the server which file this one repeats
+			job.Fields[cfg.DedupField] = original
+		}
+	}
+
+	// Leave the file to the uploader on the other host that has it
+	if claims != nil {
+		if job.claim, err = claims.claim(job, info); err != nil || job.claim == nil {
+			if err != nil {
+				logrus.Errorf("Failed to upload file: %s, %v", filePath, err)
+			}
+			return err
+		}
+	}
+
+	return sendJob(job, info.Size())
+}
+
+// sendJob runs the pre-upload hook and encryption for a prepared job and
+// uploads it, or adds it to the batch. size is the size of the file, to
+// decide on batching.
+func sendJob(job *uploadJob, size int64) error {
+	if cfg.Hooks.PreUpload != "" && !runPreUploadHook(job) {
+		job.removeTemp()
+		return nil
+	}
+
+	if err := plugins.transform(job); err != nil {
+		logrus.Errorf("Failed to upload file: %s, %v", firstNonEmpty(job.Original, job.Path), err)
+		job.removeTemp()
+		return err
+	}
+
+	if encryption != nil {
+		if err := encryptJob(job); err != nil {
+			logrus.Errorf("Failed to upload file: %s, %v", firstNonEmpty(job.Original, job.Path), err)
+			job.removeTemp()
+			return err
+		}
+	}
+
+	if err := job.setIdempotencyKey(); err != nil {
+		logrus.Errorf("Failed to upload file: %s, %v", firstNonEmpty(job.Original, job.Path), err)
+		job.removeTemp()
+		return err
+	}
+	if err := job.addChecksum(); err != nil {
+		logrus.Errorf("Failed to upload file: %s, %v", firstNonEmpty(job.Original, job.Path), err)
+		job.removeTemp()
+		return err
+	}
+
+	startTrace(job)
+
+	// Collect the file into a batch unless it is large enough to be chunked
+	if cfg.Batch.MaxFiles > 1 && (cfg.ChunkSize <= 0 || size <= cfg.chunkThreshold()) {
+		addToBatch(job, size)
+		return nil
+	}
+
+	var rec *fileRecord
+	ctx, span := tracer.Start(job.context(), "upload", trace.WithAttributes(attribute.Int64("file.size", size)))
+	done := trackUploads(ctx, job)
+	err := withRetry(job.context(), firstNonEmpty(job.Original, job.Path), func() error {
+		var err error
+		rec, err = uploader.upload(job)
+		return err
+	})
+	done()
+	endSpan(span, err)
+	return completeUpload(job, rec, err)
+}
+
+// completeUpload handles the outcome of a file's upload: a failure is
+// recorded, a success stored in the state and history and followed by the
+// after-upload action. The hooks and webhooks are told either way.
+func completeUpload(job *uploadJob, rec *fileRecord, err error) (result error) {
+	defer job.removeTemp()
+	defer func() { job.endTrace(result) }()
+	filePath := firstNonEmpty(job.Original, job.Path)
+	if errors.Is(err, errShutdown) {
+		// Not a failure, the file is uploaded again on the next start
+		logrus.Warnf("Upload of %s interrupted by shutdown", filePath)
+		return err
+	}
+	recordOutcome(err)
+	if err != nil {
+		logrus.Errorf("Failed to upload file: %s, %v", filePath, err)
+		recordFailure(filePath, err, setAsideFailed(job, err))
+		runPostUploadHook(job, nil, err)
+		notifyWebhooks(job, nil, err)
+		notifyBus(job, nil, err)
+		notifyMQTT(job, nil, err)
+		return err
+	}
+
+	logrus.Infof("File uploaded successfully: %s", filePath)
+
+	if job.Original != "" {
+		if rec, err = originalRecord(job, rec); err != nil {
+			logrus.Error("Error reading file info:", err)
+			return err
+		}
+	}
+	job.Encrypted.annotate(rec)
+
+	// Record the upload so the file is not uploaded again
+	_, span := tracer.Start(job.traceContext(), "state")
+	if err := state.put(rec); err != nil {
+		logrus.Error("Error saving upload state:", err)
+	}
+	if err := state.addHistory(rec); err != nil {
+		logrus.Error("Error saving upload history:", err)
+	}
+	if err := state.delete(failedBucket, filePath); err != nil {
+		logrus.Error("Error saving upload state:", err)
+	}
+	span.End()
+	recordInode(filePath)
+	recordHistory(rec)
+	runPostUploadHook(job, rec, nil)
+	notifyWebhooks(job, rec, nil)
+	notifyBus(job, rec, nil)
+	notifyMQTT(job, rec, nil)
+	job.claim.finish(rec)
+	finishFile(job.Dir, filePath)
+	return nil
+}
+
+// finishFile applies the after-upload action to a file that is done with.
+func finishFile(dir *watchDir, filePath string) {
+	if dir.afterUpload.kind == afterUploadKeep {
+		return
+	}
+	if err := dir.afterUpload.apply(filePath, dir.Path); err != nil {
+		logrus.Errorf("After-upload %s failed for %s: %v", dir.afterUpload.kind, filePath, err)
+		return
+	}
+	// The path is free again, a new file with the same name has to be uploaded
+	if err := state.delete(filesBucket, filePath); err != nil {
+		logrus.Error("Error saving upload state:", err)
+	}
+}
+
+// sendFile performs a single upload attempt and returns the state record for
+// the file on success.
+func sendFile(job *uploadJob) (*fileRecord, error) {
+	filePath := job.Path
+	file, info, err := openFile(job.context(), filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if cfg.ChunkSize > 0 && info.Size() > cfg.chunkThreshold() {
+		return sendFileChunked(job, file, info)
+	}
+
+	// Additional form fields come from the body setting
+	form := newMultipartBody("", "", "", job.Fields)
+
+	hash := sha256.New()
+	content, size, compressed, err := job.addFilePart(form, job.FieldName, io.TeeReader(file, hash), info.Size())
+	if err != nil {
+		return nil, err
+	}
+	body, err := postForm(job, job.URL, form, []io.Reader{content}, size)
+	job.Response = body
+	if err != nil {
+		return nil, err
+	}
+	if err := job.verifyChecksum(body); err != nil {
+		return nil, err
+	}
+
+	rec := newFileRecord(filePath, info, hex.EncodeToString(hash.Sum(nil)))
+	rec.RemoteURL = job.rules().remoteURL(body)
+	compressed.annotate(rec)
+	return rec, nil
+}
+
+// postForm streams a multipart form with contents as its file parts to target
+// and returns the response body, with an error unless the server accepted it.
+// contentSize is the combined size of the contents, or -1 if it is unknown.
+func postForm(job *uploadJob, target string, form *multipartBody, contents []io.Reader, contentSize int64) ([]byte, error) {
+	// Stream the multipart body to the request as the file is read, so memory
+	// use does not grow with the file size
+	pr, pw := io.Pipe()
+	written := make(chan error, 1)
+	go func() {
+		err := form.writeTo(pw, contents)
+		pw.CloseWithError(err)
+		written <- err
+	}()
+
+	// Perform the upload
+	req, err := http.NewRequestWithContext(job.context(), cfg.Method, target, pr)
+	if err != nil {
+		pr.Close()
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+	req.ContentLength = -1
+	if contentSize >= 0 {
+		req.ContentLength = form.overhead() + contentSize
+	}
+
+	// Set Content-Type header for multipart/form-data
+	req.Header.Set("Content-Type", "multipart/form-data; boundary="+form.boundary)
+	gzipped := job.gzipBody(req.URL.Host, form, contentSize)
+	if gzipped {
+		if err := gzipRequest(req, pr); err != nil {
+			pr.Close()
+			return nil, err
+		}
+	}
+
+	// Add headers to the request
+	if err := job.setHeaders(req); err != nil {
+		pr.Close()
+		return nil, err
+	}
+	job.setChecksumHeader(req)
+	job.setIdempotencyHeader(req)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// The response body only goes into the debug log, stdout holds nothing
+	// but log entries
+	buf := new(bytes.Buffer)
+	buf.ReadFrom(resp.Body)
+	logrus.WithField("response", buf.String()).Debugf("Response to the upload of %s", job.Path)
+
+	if gzipped && resp.StatusCode == http.StatusUnsupportedMediaType {
+		return buf.Bytes(), refuseGzip(req.URL.Host, resp.Status)
+	}
+
+	// Check if the upload was successful by the configured response rules
+	if err := job.rules().check(resp.StatusCode, resp.Status, buf.Bytes()); err != nil {
+		var statusErr *statusError
+		if errors.As(err, &statusErr) {
+			statusErr.RetryAfter = retryAfter(resp)
+		}
+		return buf.Bytes(), err
+	}
+
+	// The whole file must have been sent for the upload to count
+	return buf.Bytes(), <-written
+}
+
+// multipartBody describes a multipart/form-data body so it can be measured
+// up front and then streamed without buffering the files. A body without
+// files only carries the form fields.
+type multipartBody struct {
+	boundary string
+	// leading are fields written ahead of the files, in order, for servers
+	// that need to read them first
+	leading []formField
+	files   []formFile
+	fields  map[string]interface{}
+}
+
+// formField is a plain field of a multipart body.
+type formField struct {
+	name  string
+	value string
+}
+
+// formFile is a file part of a multipart body. A part without a content type
+// is sent as application/octet-stream; contentEncoding names the compression
+// of a compressed part.
+type formFile struct {
+	fieldName       string
+	fileName        string
+	contentType     string
+	contentEncoding string
+}
+
+func newMultipartBody(fieldName, fileName, contentType string, fields map[string]interface{}) *multipartBody {
+	form := &multipartBody{
+		boundary: multipart.NewWriter(io.Discard).Boundary(),
+		fields:   fields,
+	}
+	if fileName != "" {
+		form.addFile(fieldName, fileName, contentType, "")
+	}
+	return form
+}
+
+// addLeadingField adds a field that is written before the file parts.
+func (m *multipartBody) addLeadingField(name, value string) {
+	m.leading = append(m.leading, formField{name: name, value: value})
+}
+
+// addFile adds a file part; its content is passed to writeTo in the same
+// order.
+func (m *multipartBody) addFile(fieldName, fileName, contentType, contentEncoding string) {
+	m.files = append(m.files, formFile{
+		fieldName:       fieldName,
+		fileName:        fileName,
+		contentType:     firstNonEmpty(contentType, "application/octet-stream"),
+		contentEncoding: contentEncoding,
+	})
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+func (m *multipartBody) writeTo(w io.Writer, contents []io.Reader) error {
+	writer := multipart.NewWriter(w)
+	if err := writer.SetBoundary(m.boundary); err != nil {
+		return err
+	}
+
+	for _, field := range m.leading {
+		if err := writer.WriteField(field.name, field.value); err != nil {
+			return err
+		}
+	}
+
+	for i, file := range m.files {
+		// Create form field for file upload
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`,
+			quoteEscaper.Replace(file.fieldName), quoteEscaper.Replace(file.fileName)))
+		header.Set("Content-Type", file.contentType)
+		if file.contentEncoding != "" {
+			header.Set("Content-Encoding", file.contentEncoding)
+		}
+		part, err := writer.CreatePart(header)
+		if err != nil {
+			return fmt.Errorf("creating form file: %w", err)
+		}
+
+		// Copy file content to form field
+		if _, err := io.Copy(part, contents[i]); err != nil {
+			return fmt.Errorf("copying file content: %w", err)
+		}
+	}
+
+	for key, value := range m.fields {
+		if err := writer.WriteField(key, fmt.Sprintf("%v", value)); err != nil {
+			return err
+		}
+	}
+
+	return writer.Close()
+}
+
+// overhead returns the size of everything in the body except the file
+// contents, so the request can carry a Content-Length instead of being sent
+// with chunked encoding.
+func (m *multipartBody) overhead() int64 {
+	contents := make([]io.Reader, len(m.files))
+	for i := range contents {
+		contents[i] = strings.NewReader("")
+	}
+	counter := &countingWriter{}
+	m.writeTo(counter, contents)
+	return counter.n
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// needsUpload reports whether the file has to be uploaded: it never was, or
+// -reupload-on-change is set and its content differs from the last upload.
+func needsUpload(filePath string) bool {
+	rec, err := state.get(filePath)
+	if err != nil {
+		logrus.Error("Error reading upload state:", err)
+		return true
+	}
+
+	if rec == nil {
+		return true
+	}
+	return cfg.ReuploadOnChange && contentChanged(rec)
+}
+
+// contentChanged compares a file with its state record. Size and
+// modification time are checked first; only if they differ is the file
+// hashed, so touching a file does not cause a new upload.
+func contentChanged(rec *fileRecord) bool {
+	info, err := os.Stat(rec.Path)
+	if err != nil {
+		return false
+	}
+	if info.Size() == rec.Size && info.ModTime().Equal(rec.ModTime) {
+		return false
+	}
+
+	checksum, err := hashFile(rec.Path)
+	if err != nil {
+		logrus.Warnf("Could not checksum %s: %v", rec.Path, err)
+		return false
+	}
+
+	if checksum == rec.SHA256 {
+		// Remember the new modification time so the file is not hashed again
+		rec.Size, rec.ModTime = info.Size(), info.ModTime()
+		if err := state.put(rec); err != nil {
+			logrus.Error("Error saving upload state:", err)
+		}
+		return false
+	}
+
+	logrus.Infof("File changed since it was uploaded: %s", rec.Path)
+	return true
+}
+
+func readLogFile(logFilePath string) ([]string, error) {
+	var logEntries []string
+
+	file, err := os.Open(logFilePath)
+	if err != nil {
+		return logEntries, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		logEntries = append(logEntries, strings.TrimSpace(scanner.Text()))
+	}
+
+	if err := scanner.Err(); err != nil {
+		return logEntries, err
+	}
+
+	return logEntries, nil
+}
@@ -0,0 +1,228 @@
+package uploader
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/sirupsen/logrus"
+)
+
+// MQTTConfig publishes upload events to an MQTT broker, for edge and IoT
+// devices whose fleet dashboards follow the uploaders over MQTT. The status
+// topic tells whether the device's uploader is running: it holds a retained
+// "online" while connected and "offline" once it stops or drops off.
+type MQTTConfig struct {
+	// Broker is the broker's address, tcp://host:1883 or ssl://host:8883
+	Broker   string `yaml:"broker"`
+	ClientID string `yaml:"client_id"`
+	User     string `yaml:"user"`
+	// Password can also come from MQTT_PASSWORD
+	Password           string `yaml:"password"`
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+
+	// Device names this uploader in the topics and events, the host name
+	// by default
+	Device string `yaml:"device"`
+	// Topic is a Go template for the topic of an event, with the fields of
+	// the webhook event and .Device
+	Topic string `yaml:"topic"`
+	// StatusTopic is a Go template with .Device for the status topic; empty
+	// publishes no status
+	StatusTopic string `yaml:"status_topic"`
+	// Events limits the events published like for webhooks; empty means
+	// all of them
+	Events  []string      `yaml:"events"`
+	QoS     int           `yaml:"qos"`
+	Retain  bool          `yaml:"retain"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// mqttEvents publishes the upload events, if a broker is configured.
+var mqttEvents *mqttPublisher
+
+type mqttPublisher struct {
+	conf        MQTTConfig
+	events      map[string]bool
+	topic       *template.Template
+	statusTopic string
+	client      mqtt.Client
+}
+
+// mqttEvent is an upload event as published to MQTT.
+type mqttEvent struct {
+	webhookEvent
+	Device string `json:"device"`
+}
+
+// newMQTTPublisher sets up the publisher for conf, or returns nil if no
+// broker is configured. It does not connect yet, see start.
+func newMQTTPublisher(conf MQTTConfig) (*mqttPublisher, error) {
+	if conf.Broker == "" {
+		return nil, nil
+	}
+	broker, err := url.Parse(conf.Broker)
+	if err != nil || broker.Host == "" {
+		return nil, fmt.Errorf("invalid mqtt broker: %s", conf.Broker)
+	}
+	secure := false
+	switch broker.Scheme {
+	case "tcp", "mqtt":
+	case "ssl", "tls", "mqtts":
+		secure = true
+	default:
+		return nil, fmt.Errorf("unsupported mqtt broker scheme: %s (use tcp or ssl)", broker.Scheme)
+	}
+	if conf.QoS < 0 || conf.QoS > 2 {
+		return nil, fmt.Errorf("mqtt qos %d is not 0, 1 or 2", conf.QoS)
+	}
+	if conf.Timeout <= 0 {
+		conf.Timeout = 30 * time.Second
+	}
+	if conf.Device == "" {
+		if conf.Device, err = os.Hostname(); err != nil {
+			return nil, fmt.Errorf("mqtt needs a device name: %w", err)
+		}
+	}
+
+	p := &mqttPublisher{conf: conf}
+	for _, event := range conf.Events {
+		switch event {
+		case eventSuccess, eventFailure, eventRetryExhausted, eventRejected:
+		default:
+			return nil, fmt.Errorf("unknown mqtt event: %s", event)
+		}
+		if p.events == nil {
+			p.events = make(map[string]bool)
+		}
+		p.events[event] = true
+	}
+	if p.topic, err = template.New("").Option("missingkey=error").Parse(conf.Topic); err != nil {
+		return nil, fmt.Errorf("parsing mqtt topic: %w", err)
+	}
+	if conf.StatusTopic != "" {
+		tmpl, err := template.New("").Option("missingkey=error").Parse(conf.StatusTopic)
+		if err != nil {
+			return nil, fmt.Errorf("parsing mqtt status topic: %w", err)
+		}
+		var topic strings.Builder
+		if err := tmpl.Execute(&topic, mqttEvent{Device: conf.Device}); err != nil {
+			return nil, fmt.Errorf("rendering mqtt status topic: %w", err)
+		}
+		p.statusTopic = topic.String()
+	}
+
+	var tlsConfig *tls.Config
+	if secure {
+		if tlsConfig, err = tlsClientConfig(conf.CAFile, conf.InsecureSkipVerify); err != nil {
+			return nil, err
+		}
+		if conf.CertFile != "" || conf.KeyFile != "" {
+			cert, err := tls.LoadX509KeyPair(conf.CertFile, firstNonEmpty(conf.KeyFile, conf.CertFile))
+			if err != nil {
+				return nil, fmt.Errorf("loading client certificate: %w", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		if conf.InsecureSkipVerify {
+			logrus.Warn("MQTT certificate verification is disabled, the connection can be intercepted")
+		}
+	}
+
+	options := mqtt.NewClientOptions().
+		AddBroker(conf.Broker).
+		SetClientID(firstNonEmpty(conf.ClientID, "auto-upload-"+conf.Device)).
+		SetUsername(conf.User).
+		SetPassword(firstNonEmpty(conf.Password, os.Getenv("MQTT_PASSWORD"))).
+		SetConnectTimeout(cfg.HTTPClient.ConnectTimeout).
+		SetWriteTimeout(conf.Timeout).
+		SetAutoReconnect(true).
+		// A broker that is down at the start is waited for, like one that
+		// goes away later
+		SetConnectRetry(true).
+		SetCustomOpenConnectionFn(func(uri *url.URL, _ mqtt.ClientOptions) (net.Conn, error) {
+			conn, err := dialThroughProxy("mqtt", uri.Host, cfg.HTTPClient.ConnectTimeout)
+			if err != nil || tlsConfig == nil {
+				return conn, err
+			}
+			config := tlsConfig.Clone()
+			config.ServerName = uri.Hostname()
+			return tls.Client(conn, config), nil
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			logrus.Warnf("Lost the connection to the MQTT broker %s: %v", conf.Broker, err)
+		}).
+		SetOnConnectHandler(func(client mqtt.Client) {
+			if p.statusTopic != "" {
+				client.Publish(p.statusTopic, byte(conf.QoS), true, "online")
+			}
+		})
+	if p.statusTopic != "" {
+		options.SetWill(p.statusTopic, "offline", byte(conf.QoS), true)
+	}
+	p.client = mqtt.NewClient(options)
+	return p, nil
+}
+
+// start connects to the broker in the background.
+func (p *mqttPublisher) start() {
+	if p != nil {
+		p.client.Connect()
+	}
+}
+
+// close marks the device offline and disconnects. The will is only sent by
+// the broker for connections that drop without disconnecting.
+func (p *mqttPublisher) close() {
+	if p == nil {
+		return
+	}
+	if p.statusTopic != "" && p.client.IsConnectionOpen() {
+		p.client.Publish(p.statusTopic, byte(p.conf.QoS), true, "offline").WaitTimeout(p.conf.Timeout)
+	}
+	p.client.Disconnect(250)
+}
+
+// notifyMQTT publishes the outcome of an upload to its topic. Failures to
+// publish are logged and otherwise ignored.
+func notifyMQTT(job *uploadJob, rec *fileRecord, uploadErr error) {
+	p := mqttEvents
+	if p == nil {
+		return
+	}
+	event := mqttEvent{webhookEvent: newUploadEvent(job, rec, uploadErr), Device: p.conf.Device}
+	if p.events != nil && !p.events[event.Event] {
+		return
+	}
+	if err := p.publish(event); err != nil {
+		logrus.Errorf("Publishing the %s event of %s to MQTT failed: %v", event.Event, event.File, err)
+	}
+}
+
+func (p *mqttPublisher) publish(event mqttEvent) error {
+	var topic strings.Builder
+	if err := p.topic.Execute(&topic, event); err != nil {
+		return fmt.Errorf("rendering topic: %w", err)
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	token := p.client.Publish(topic.String(), byte(p.conf.QoS), p.conf.Retain, payload)
+	if !token.WaitTimeout(p.conf.Timeout) {
+		return errors.New("timed out")
+	}
+	return token.Error()
+}
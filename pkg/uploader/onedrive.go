@@ -0,0 +1,159 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// oneDrive uploads to OneDrive through Microsoft Graph. Upload sessions
+// address files by path, and Graph creates the missing folders on the way.
+// Empty files cannot go through a session and are uploaded in one request.
+type oneDrive struct {
+	endpoint string
+	client   *http.Client
+	// plain sends to the session URLs, which must not carry the token
+	plain *http.Client
+}
+
+func newOneDrive(endpoint string, client, plain *http.Client) *oneDrive {
+	return &oneDrive{endpoint: strings.TrimSuffix(endpoint, "/"), client: client, plain: plain}
+}
+
+// chunkAlign is 320 KiB: every chunk but the last must be a multiple of it.
+func (d *oneDrive) chunkAlign() int64 {
+	return 320 << 10
+}
+
+// itemURL returns the Graph URL of the item at remotePath followed by
+// action.
+func (d *oneDrive) itemURL(remotePath, action string) string {
+	segments := strings.Split(remotePath, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return d.endpoint + "/v1.0/me/drive/root:/" + strings.Join(segments, "/") + ":/" + action
+}
+
+func (d *oneDrive) start(job *uploadJob, remotePath string, size int64) (string, error) {
+	if size == 0 {
+		return "", nil
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"item": map[string]string{"@microsoft.graph.conflictBehavior": "replace"},
+	})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(job.context(), http.MethodPost, d.itemURL(remotePath, "createUploadSession"), bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", driveStatusError(resp)
+	}
+
+	var session struct {
+		UploadURL string `json:"uploadUrl"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&session); err != nil {
+		return "", fmt.Errorf("reading upload session: %w", err)
+	}
+	return session.UploadURL, nil
+}
+
+func (d *oneDrive) resume(ctx context.Context, upload *driveUpload) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, upload.Session, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := d.plain.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return 0, errDriveSessionGone
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, driveStatusError(resp)
+	}
+	return nextExpected(resp.Body)
+}
+
+func (d *oneDrive) put(ctx context.Context, upload *driveUpload, chunk io.Reader, offset, length int64) (int64, string, bool, error) {
+	var req *http.Request
+	var err error
+	if upload.Size == 0 {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPut, d.itemURL(upload.Path, "content"), http.NoBody)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPut, upload.Session, chunk)
+		if err == nil {
+			req.ContentLength = length
+			req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, upload.Size))
+		}
+	}
+	if err != nil {
+		return 0, "", false, err
+	}
+
+	client := d.plain
+	if upload.Size == 0 {
+		client = d.client
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, "", false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		var item struct {
+			WebURL string `json:"webUrl"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&item); err != nil {
+			return 0, "", false, fmt.Errorf("reading item: %w", err)
+		}
+		return upload.Size, item.WebURL, true, nil
+	case http.StatusAccepted:
+		next, err := nextExpected(resp.Body)
+		return next, "", false, err
+	case http.StatusNotFound:
+		return 0, "", false, errDriveSessionGone
+	default:
+		return 0, "", false, driveStatusError(resp)
+	}
+}
+
+// nextExpected reads the offset a session continues at from its status,
+// {"nextExpectedRanges": ["12345-"]}.
+func nextExpected(body io.Reader) (int64, error) {
+	var status struct {
+		NextExpectedRanges []string `json:"nextExpectedRanges"`
+	}
+	if err := json.NewDecoder(body).Decode(&status); err != nil {
+		return 0, fmt.Errorf("reading upload session: %w", err)
+	}
+	if len(status.NextExpectedRanges) == 0 {
+		return 0, fmt.Errorf("upload session without expected ranges")
+	}
+	start, _, _ := strings.Cut(status.NextExpectedRanges[0], "-")
+	offset, err := strconv.ParseInt(start, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid expected range %q", status.NextExpectedRanges[0])
+	}
+	return offset, nil
+}
@@ -0,0 +1,103 @@
+package uploader
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// A watched directory with an upload order has the files of each of its
+// directories uploaded strictly one after the other, oldest or first by name
+// first, e.g. for numbered log segments. Priority rules do not reorder them,
+// and a file that failed holds back the rest of its directory until it is
+// uploaded, ignored or gone. Each directory is a lane of the queue, so up to
+// cfg.DirParallelism of them upload in parallel, next to the other files.
+const (
+	uploadOrderMtime = "mtime"
+	uploadOrderName  = "name"
+)
+
+func validateUploadOrder(order string) error {
+	switch order {
+	case "", uploadOrderMtime, uploadOrderName:
+		return nil
+	}
+	return fmt.Errorf("unknown upload order: %s (use mtime or name)", order)
+}
+
+// addOrdered registers a queued file of a directory with an upload order.
+// q.mu must be held.
+func (q *uploadQueue) addOrdered(file *queuedFile) {
+	parent := filepath.Dir(file.path)
+	if q.groups[parent] == nil {
+		q.groups[parent] = make(map[*queuedFile]bool)
+	}
+	q.groups[parent][file] = true
+	if q.held[parent] == file.path {
+		// The failed file is back in the queue, ahead of the others
+		delete(q.held, parent)
+	}
+}
+
+// removeOrdered forgets a file that left the queue. q.mu must be held.
+func (q *uploadQueue) removeOrdered(file *queuedFile) {
+	parent := filepath.Dir(file.path)
+	delete(q.groups[parent], file)
+	if len(q.groups[parent]) == 0 {
+		delete(q.groups, parent)
+	}
+}
+
+// firstInOrder returns the file that goes first of those queued in the
+// directory of file. q.mu must be held.
+func (q *uploadQueue) firstInOrder(file *queuedFile) *queuedFile {
+	first := file
+	for other := range q.groups[filepath.Dir(file.path)] {
+		if other.before(first) {
+			first = other
+		}
+	}
+	return first
+}
+
+// before reports whether f goes before other in their directory's order.
+func (f *queuedFile) before(other *queuedFile) bool {
+	if f.order == uploadOrderMtime && !f.modTime.Equal(other.modTime) {
+		return f.modTime.Before(other.modTime)
+	}
+	return filepath.Base(f.path) < filepath.Base(other.path)
+}
+
+// lane returns the lane the file is uploaded in: its directory if that is
+// uploaded in order, and "" for all other files.
+func (f *queuedFile) lane() string {
+	if f.order == "" {
+		return ""
+	}
+	return filepath.Dir(f.path)
+}
+
+// orderedBusy returns how many directories uploaded in order have an upload
+// running. q.mu must be held.
+func (q *uploadQueue) orderedBusy() int {
+	if q.busy[""] {
+		return len(q.busy) - 1
+	}
+	return len(q.busy)
+}
+
+// isHeld reports whether file waits for a file before it that failed. The
+// hold ends once that file was uploaded or ignored, or is gone, e.g. to the
+// dead-letter directory. q.mu must be held.
+func (q *uploadQueue) isHeld(file *queuedFile) bool {
+	parent := filepath.Dir(file.path)
+	failed, ok := q.held[parent]
+	if !ok {
+		return false
+	}
+	if _, err := os.Stat(failed); err != nil || !needsUpload(failed) {
+		delete(q.held, parent)
+		return false
+	}
+	return true
+}
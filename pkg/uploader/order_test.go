@@ -0,0 +1,75 @@
+package uploader
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestQueueLanes(t *testing.T) {
+	saved := cfg
+	t.Cleanup(func() { cfg = saved })
+	cfg = DefaultConfig()
+
+	root := t.TempDir()
+	ordered := &watchDir{WatchDir: WatchDir{Path: filepath.Join(root, "logs"), UploadOrder: uploadOrderName}}
+	plain := &watchDir{WatchDir: WatchDir{Path: filepath.Join(root, "inbox")}}
+	add := func(t *testing.T, q *uploadQueue, dir *watchDir, relPath string) {
+		path := filepath.Join(dir.Path, relPath)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(relPath), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		q.add(dir, path)
+	}
+	next := func(q *uploadQueue) string {
+		file := q.next()
+		if file == nil {
+			return ""
+		}
+		relPath, _ := filepath.Rel(root, file.path)
+		return filepath.ToSlash(relPath)
+	}
+
+	tests := []struct {
+		name  string
+		lanes int
+		want  []string
+	}{
+		{name: "a lane per directory", lanes: 4, want: []string{"logs/a/1.log", "logs/b/1.log", "inbox/scan.pdf", ""}},
+		{name: "one directory at a time", lanes: 1, want: []string{"logs/a/1.log", "inbox/scan.pdf", ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.DirParallelism = tt.lanes
+			q := newUploadQueue()
+			add(t, q, ordered, "a/2.log")
+			add(t, q, ordered, "a/1.log")
+			add(t, q, ordered, "b/1.log")
+			add(t, q, plain, "scan.pdf")
+			add(t, q, plain, "photo.jpg")
+
+			for i, want := range tt.want {
+				if got := next(q); got != want {
+					t.Fatalf("next() #%d = %q, want %q", i+1, got, want)
+				}
+			}
+		})
+	}
+
+	// The next file of a directory goes once the one before is done
+	cfg.DirParallelism = 4
+	q := newUploadQueue()
+	add(t, q, ordered, "a/2.log")
+	add(t, q, ordered, "a/1.log")
+	first := q.next()
+	if got := q.next(); got != nil {
+		t.Fatalf("next() = %s while %s is uploaded", got.path, first.path)
+	}
+	q.done(first, nil)
+	if got := next(q); got != "logs/a/2.log" {
+		t.Errorf("next() = %q after the first file, want %q", got, "logs/a/2.log")
+	}
+}
@@ -0,0 +1,547 @@
+package uploader
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// pluginProtocol is the version of the plugin protocol, sent to plugins with
+// the init request.
+const pluginProtocol = 1
+
+// PluginConfig configures an external plugin: a program that is started
+// once and answers requests sent as JSON lines on its stdin with JSON lines
+// on its stdout. A plugin can decide which files are uploaded, prepare files
+// before upload, or be the backend with "backend: <name>". Messages it writes
+// to stderr are logged.
+type PluginConfig struct {
+	// Name identifies the plugin in the logs and as a backend
+	Name    string   `yaml:"name"`
+	Command string   `yaml:"command"`
+	Args    []string `yaml:"args"`
+	// Env holds KEY=value pairs added to the plugin's environment
+	Env []string `yaml:"env"`
+	// Options are sent to the plugin with the init request
+	Options map[string]interface{} `yaml:"options"`
+
+	// Filter has the plugin decide for every new file whether it is
+	// uploaded, after the include and exclude patterns
+	Filter bool `yaml:"filter"`
+	// Transform has the plugin prepare every file before upload: it can
+	// name another file to upload in its place, rename it, set its content
+	// type and add fields
+	Transform bool `yaml:"transform"`
+
+	// Timeout limits every request to the plugin, 0 waits forever
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// pluginFile describes a file to a plugin.
+type pluginFile struct {
+	Path        string                 `json:"path"`
+	RelPath     string                 `json:"rel_path"`
+	Dir         string                 `json:"dir,omitempty"`
+	Name        string                 `json:"name,omitempty"`
+	Size        int64                  `json:"size"`
+	ModTime     time.Time              `json:"mod_time"`
+	ContentType string                 `json:"content_type,omitempty"`
+	Fields      map[string]interface{} `json:"fields,omitempty"`
+}
+
+type pluginRequest struct {
+	ID     int64       `json:"id"`
+	Method string      `json:"method"`
+	Params interface{} `json:"params"`
+}
+
+type pluginResponse struct {
+	ID     int64           `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *pluginError    `json:"error"`
+}
+
+// pluginError is a failure reported by a plugin. Retryable ones are tried
+// again like network errors.
+type pluginError struct {
+	Message   string `json:"message"`
+	Retryable bool   `json:"retryable"`
+}
+
+func (e *pluginError) Error() string {
+	return e.Message
+}
+
+// plugin is a running plugin. The program is started on the first request
+// and again after it exits. Requests can overlap; plugins that answer one at
+// a time work too, as answers are matched to requests by their id.
+type plugin struct {
+	conf PluginConfig
+	// uses is what the plugin is used for, sent with the init request
+	uses []string
+
+	nextID atomic.Int64
+
+	// mu guards conn and closed, and is held while a program starts
+	mu     sync.Mutex
+	conn   *pluginConn
+	closed bool
+}
+
+// pluginConn is one run of a plugin's program.
+type pluginConn struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	// done is closed once the program has exited
+	done chan struct{}
+
+	// mu guards pending and err and serializes writes to stdin
+	mu      sync.Mutex
+	pending map[int64]chan *pluginResponse
+	err     error
+}
+
+func newPlugin(conf PluginConfig, uses ...string) (*plugin, error) {
+	if conf.Command == "" {
+		return nil, fmt.Errorf("plugin %s has no command", conf.Name)
+	}
+	if _, err := exec.LookPath(conf.Command); err != nil {
+		return nil, fmt.Errorf("plugin %s: %w", conf.Name, err)
+	}
+	return &plugin{conf: conf, uses: uses}, nil
+}
+
+// call sends a request to the plugin and decodes its result into result.
+func (p *plugin) call(ctx context.Context, method string, params, result interface{}) error {
+	conn, err := p.connect(ctx)
+	if err != nil {
+		return err
+	}
+	return p.roundTrip(ctx, conn, method, params, result)
+}
+
+// connect returns the running program, starting it if it is not running.
+func (p *plugin) connect(ctx context.Context) (*pluginConn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil, fmt.Errorf("plugin %s is stopped", p.conf.Name)
+	}
+	if p.conn != nil && p.conn.exited() == nil {
+		return p.conn, nil
+	}
+
+	conn, err := p.start()
+	if err != nil {
+		return nil, retryable(fmt.Errorf("starting plugin %s: %w", p.conf.Name, err))
+	}
+	init := map[string]interface{}{"protocol": pluginProtocol, "uses": p.uses, "options": p.conf.Options}
+	if err := p.roundTrip(ctx, conn, "init", init, nil); err != nil {
+		conn.stop()
+		return nil, fmt.Errorf("starting plugin %s: %w", p.conf.Name, err)
+	}
+	p.conn = conn
+	return conn, nil
+}
+
+func (p *plugin) start() (*pluginConn, error) {
+	cmd := exec.Command(p.conf.Command, p.conf.Args...)
+	cmd.Env = append(os.Environ(), p.conf.Env...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	conn := &pluginConn{cmd: cmd, stdin: stdin, done: make(chan struct{}), pending: make(map[int64]chan *pluginResponse)}
+	logged := make(chan struct{})
+	go func() {
+		defer close(logged)
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			logrus.Infof("Plugin %s: %s", p.conf.Name, scanner.Text())
+		}
+	}()
+	go func() {
+		err := conn.read(stdout)
+		<-logged
+		if waitErr := cmd.Wait(); waitErr != nil {
+			err = waitErr
+		}
+		conn.fail(fmt.Errorf("plugin %s exited: %v", p.conf.Name, err))
+		close(conn.done)
+	}()
+	return conn, nil
+}
+
+// roundTrip sends a request over conn and waits for its answer.
+func (p *plugin) roundTrip(ctx context.Context, conn *pluginConn, method string, params, result interface{}) error {
+	id := p.nextID.Add(1)
+	answer, err := conn.send(&pluginRequest{ID: id, Method: method, Params: params})
+	if err != nil {
+		return retryable(err)
+	}
+	defer conn.forget(id)
+
+	var timeout <-chan time.Time
+	if p.conf.Timeout > 0 {
+		timer := time.NewTimer(p.conf.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var resp *pluginResponse
+	select {
+	case resp = <-answer:
+	case <-timeout:
+		return retryable(fmt.Errorf("plugin %s did not answer %s within %s", p.conf.Name, method, p.conf.Timeout))
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if resp == nil {
+		return retryable(conn.exited())
+	}
+	if resp.Error != nil {
+		if resp.Error.Retryable {
+			return retryable(resp.Error)
+		}
+		return resp.Error
+	}
+	if result == nil || len(resp.Result) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(resp.Result, result); err != nil {
+		return fmt.Errorf("reading %s answer of plugin %s: %w", method, p.conf.Name, err)
+	}
+	return nil
+}
+
+// close stops the plugin: its stdin is closed, which it should take as the
+// sign to exit, and it is killed if it has not after a few seconds.
+func (p *plugin) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	if p.conn != nil {
+		p.conn.stop()
+	}
+}
+
+func (c *pluginConn) send(req *pluginRequest) (<-chan *pluginResponse, error) {
+	line, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return nil, c.err
+	}
+	answer := make(chan *pluginResponse, 1)
+	c.pending[req.ID] = answer
+	if _, err := c.stdin.Write(append(line, '\n')); err != nil {
+		delete(c.pending, req.ID)
+		return nil, err
+	}
+	return answer, nil
+}
+
+func (c *pluginConn) forget(id int64) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.mu.Unlock()
+}
+
+// read delivers the answers the program writes to stdout until it closes.
+func (c *pluginConn) read(stdout io.Reader) error {
+	reader := bufio.NewReader(stdout)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(strings.TrimSpace(string(line))) > 0 {
+			var resp pluginResponse
+			if jsonErr := json.Unmarshal(line, &resp); jsonErr != nil {
+				logrus.Warnf("Ignoring invalid output of plugin %s: %s", c.cmd.Path, strings.TrimSpace(string(line)))
+			} else {
+				c.mu.Lock()
+				if answer, ok := c.pending[resp.ID]; ok {
+					answer <- &resp
+					delete(c.pending, resp.ID)
+				}
+				c.mu.Unlock()
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				return errors.New("closed its output")
+			}
+			return err
+		}
+	}
+}
+
+// fail answers the waiting requests with nil once the program has exited.
+func (c *pluginConn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.err = err
+	for id, answer := range c.pending {
+		close(answer)
+		delete(c.pending, id)
+	}
+}
+
+// exited returns why the program exited, or nil while it runs.
+func (c *pluginConn) exited() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *pluginConn) stop() {
+	c.stdin.Close()
+	select {
+	case <-c.done:
+	case <-time.After(5 * time.Second):
+		c.cmd.Process.Kill()
+		<-c.done
+	}
+}
+
+// plugins runs the filter and transform plugins.
+var plugins *pluginSet
+
+type pluginSet struct {
+	filters    []*plugin
+	transforms []*plugin
+	all        []*plugin
+}
+
+// newPluginSet sets up the filter and transform plugins of confs. Their
+// programs are only started once they are needed.
+func newPluginSet(confs []PluginConfig) (*pluginSet, error) {
+	names := make(map[string]bool, len(confs))
+	set := &pluginSet{}
+	for _, conf := range confs {
+		if conf.Name == "" {
+			return nil, errors.New("every plugin needs a name")
+		}
+		if names[conf.Name] {
+			return nil, fmt.Errorf("plugin %s is configured twice", conf.Name)
+		}
+		names[conf.Name] = true
+
+		var uses []string
+		if conf.Filter {
+			uses = append(uses, "filter")
+		}
+		if conf.Transform {
+			uses = append(uses, "transform")
+		}
+		if len(uses) == 0 {
+			continue
+		}
+		p, err := newPlugin(conf, uses...)
+		if err != nil {
+			return nil, err
+		}
+		if conf.Filter {
+			set.filters = append(set.filters, p)
+		}
+		if conf.Transform {
+			set.transforms = append(set.transforms, p)
+		}
+		set.all = append(set.all, p)
+	}
+	if len(set.all) == 0 {
+		return nil, nil
+	}
+	return set, nil
+}
+
+func (s *pluginSet) close() {
+	if s != nil {
+		for _, p := range s.all {
+			p.close()
+		}
+	}
+}
+
+// allows asks the filter plugins whether the file at filePath in dir should
+// be uploaded. A plugin that fails keeps the file back for the next scan.
+func (s *pluginSet) allows(dir *watchDir, filePath, relPath string, info os.FileInfo) bool {
+	if s == nil {
+		return true
+	}
+	file := &pluginFile{Path: filePath, RelPath: filepath.ToSlash(relPath), Dir: dir.Path, Size: info.Size(), ModTime: info.ModTime()}
+	for _, p := range s.filters {
+		var decision struct {
+			Upload bool   `json:"upload"`
+			Reason string `json:"reason"`
+		}
+		if err := p.call(uploadsCtx, "filter", file, &decision); err != nil {
+			logrus.Errorf("Filter plugin %s failed for %s: %v", p.conf.Name, filePath, err)
+			return false
+		}
+		if !decision.Upload {
+			logrus.Debugf("Skipping %s: plugin %s ruled it out %s", filePath, p.conf.Name, decision.Reason)
+			return false
+		}
+	}
+	return true
+}
+
+// transform lets the transform plugins prepare a job, in the order they are
+// configured.
+func (s *pluginSet) transform(job *uploadJob) error {
+	if s == nil {
+		return nil
+	}
+	for _, p := range s.transforms {
+		info, err := os.Stat(job.Path)
+		if err != nil {
+			return err
+		}
+		file := &pluginFile{
+			Path:        job.Path,
+			RelPath:     job.RelPath,
+			Dir:         job.Dir.Path,
+			Name:        job.uploadName(),
+			Size:        info.Size(),
+			ModTime:     info.ModTime(),
+			ContentType: job.contentType(),
+			Fields:      job.Fields,
+		}
+		var changes struct {
+			Path        string                 `json:"path"`
+			Name        string                 `json:"name"`
+			ContentType string                 `json:"content_type"`
+			Fields      map[string]interface{} `json:"fields"`
+		}
+		if err := p.call(uploadsCtx, "transform", file, &changes); err != nil {
+			return fmt.Errorf("transform plugin %s: %w", p.conf.Name, err)
+		}
+
+		if changes.Path != "" && changes.Path != job.Path {
+			if info, err := os.Stat(changes.Path); err != nil || info.IsDir() {
+				return fmt.Errorf("transform plugin %s returned %q, which is not a file", p.conf.Name, changes.Path)
+			}
+			logrus.Infof("Uploading %s in place of %s", changes.Path, job.Path)
+			job.Original, job.Path, job.Checksum = firstNonEmpty(job.Original, job.Path), changes.Path, ""
+			if changes.ContentType == "" {
+				job.ContentType = ""
+			}
+		}
+		if changes.Name != "" {
+			job.FileName = changes.Name
+		}
+		if changes.ContentType != "" {
+			job.ContentType = changes.ContentType
+		}
+		for key, value := range changes.Fields {
+			job.Fields[key] = value
+		}
+	}
+	return nil
+}
+
+// plugin returns the plugin configured as name, or nil if there is none.
+func (c *Config) plugin(name string) *PluginConfig {
+	for i := range c.Plugins {
+		if c.Plugins[i].Name == name {
+			return &c.Plugins[i]
+		}
+	}
+	return nil
+}
+
+// pluginBackend uploads files through a plugin's upload requests and looks
+// them up with its verify requests.
+type pluginBackend struct {
+	plugin *plugin
+}
+
+func newPluginBackend(conf PluginConfig) (*registeredBackend, error) {
+	p, err := newPlugin(conf, "backend")
+	if err != nil {
+		return nil, err
+	}
+	return &registeredBackend{name: conf.Name, backend: pluginBackend{plugin: p}}, nil
+}
+
+func (b pluginBackend) Init(func(v interface{}) error) error {
+	return nil
+}
+
+func (b pluginBackend) Upload(ctx context.Context, file *File) (*Result, error) {
+	info, err := os.Stat(file.Path)
+	if err != nil {
+		return nil, fmt.Errorf("reading file info: %w", err)
+	}
+	params := &pluginFile{
+		Path:        file.Path,
+		RelPath:     file.RelPath,
+		Name:        file.Name,
+		Size:        info.Size(),
+		ModTime:     info.ModTime(),
+		ContentType: file.ContentType,
+		Fields:      file.Fields,
+	}
+	var result struct {
+		RemoteURL string `json:"remote_url"`
+		Checksum  string `json:"checksum"`
+		Response  string `json:"response"`
+	}
+	if err := b.plugin.call(ctx, "upload", params, &result); err != nil {
+		return nil, err
+	}
+	return &Result{RemoteURL: result.RemoteURL, Checksum: result.Checksum, Response: []byte(result.Response)}, nil
+}
+
+func (b pluginBackend) Verify(ctx context.Context, remoteURL string) (int64, error) {
+	var result struct {
+		Size    *int64 `json:"size"`
+		Missing bool   `json:"missing"`
+		Unknown bool   `json:"unknown"`
+	}
+	if err := b.plugin.call(ctx, "verify", map[string]string{"remote_url": remoteURL}, &result); err != nil {
+		return 0, err
+	}
+	switch {
+	case result.Unknown:
+		return 0, ErrUnknownRemote
+	case result.Missing:
+		return 0, ErrRemoteMissing
+	case result.Size == nil:
+		return -1, nil
+	}
+	return *result.Size, nil
+}
+
+func (b pluginBackend) Close() error {
+	b.plugin.close()
+	return nil
+}
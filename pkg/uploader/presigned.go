@@ -0,0 +1,208 @@
+package uploader
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// PresignedConfig configures the presigned protocol of the http backend,
+// for APIs that hand out a temporary upload URL: the file's metadata is
+// posted to the server URL, the file is sent to the URL found in the
+// response, and a complete endpoint is told once it is there.
+type PresignedConfig struct {
+	// UploadURL is the JSONPath of the upload URL in the response, e.g.
+	// $.upload.url
+	UploadURL string `yaml:"upload_url"`
+	// UploadHeaders is the JSONPath of an object of headers the file has to
+	// be sent with, for URLs signed with headers
+	UploadHeaders string `yaml:"upload_headers"`
+	Method        string `yaml:"method"`
+	// CompleteURL is the endpoint told about the finished upload, or the
+	// JSONPath of it in the response when it starts with $. The response of
+	// the first request is posted to it, so it can carry the upload's ID.
+	CompleteURL string `yaml:"complete_url"`
+}
+
+// presignedClient sends files to the upload URLs. It does not add the auth
+// of the server URL, as the URL is signed and other credentials are refused.
+var presignedClient = &http.Client{}
+
+func (c *PresignedConfig) validate() error {
+	if c.UploadURL == "" {
+		return errors.New("the presigned protocol needs the JSONPath of the upload url")
+	}
+	for _, path := range []string{c.UploadURL, c.UploadHeaders, c.CompleteURL} {
+		if path == "" || path[0] != '$' {
+			continue
+		}
+		if _, err := parseJSONPath(path); err != nil {
+			return fmt.Errorf("invalid presigned path %q: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// sendFilePresigned uploads a file in two phases: it asks the server for an
+// upload URL, sends the file there and then completes the upload.
+func sendFilePresigned(job *uploadJob) (*fileRecord, error) {
+	filePath := job.Path
+	file, info, err := openFile(job.context(), filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	checksum, err := job.checksum()
+	if err != nil {
+		return nil, fmt.Errorf("hashing file: %w", err)
+	}
+
+	metadata := make(map[string]interface{}, len(job.Fields)+4)
+	for key, value := range job.Fields {
+		metadata[key] = value
+	}
+	metadata["filename"] = job.uploadName()
+	metadata["size"] = info.Size()
+	metadata["content_type"] = job.contentType()
+	metadata["sha256"] = checksum
+
+	initiate, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+	body, err := postPresigned(job, job.URL, initiate, nil)
+	if err != nil {
+		return nil, fmt.Errorf("starting upload: %w", err)
+	}
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, fmt.Errorf("reading upload url: %w", err)
+	}
+
+	target, err := presignedURL(job.URL, doc, cfg.Presigned.UploadURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := putPresigned(job, file, info.Size(), target, doc); err != nil {
+		return nil, err
+	}
+
+	final := body
+	if cfg.Presigned.CompleteURL != "" {
+		complete, err := presignedURL(job.URL, doc, cfg.Presigned.CompleteURL)
+		if err != nil {
+			return nil, err
+		}
+		final, err = postPresigned(job, complete.String(), body, job.rules())
+		job.Response = final
+		if err != nil {
+			return nil, fmt.Errorf("completing upload: %w", err)
+		}
+	}
+
+	rec := newFileRecord(filePath, info, checksum)
+	rec.RemoteURL = job.rules().remoteURL(final)
+	if rec.RemoteURL == "" {
+		// The upload URL without its signature
+		target.RawQuery = ""
+		rec.RemoteURL = target.String()
+	}
+	return rec, nil
+}
+
+// presignedURL returns the URL at path in the response doc, or path itself
+// if it is not a JSONPath, resolved against the server URL.
+func presignedURL(serverURL string, doc interface{}, path string) (*url.URL, error) {
+	raw := path
+	if path[0] == '$' {
+		value, found := lookupJSONPath(doc, path)
+		if s, ok := value.(string); found && ok && s != "" {
+			raw = s
+		} else {
+			return nil, fmt.Errorf("no url at %s in the response", path)
+		}
+	}
+	base, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, err
+	}
+	return base.Parse(raw)
+}
+
+// postPresigned posts a JSON body with the configured headers and returns
+// the response body, with an error unless the response passes rules, or has
+// a 2xx status without rules. Only the first request carries the checksum
+// and idempotency key, which the server may remember it by.
+func postPresigned(job *uploadJob, target string, body []byte, rules *responseRules) ([]byte, error) {
+	req, err := http.NewRequestWithContext(job.context(), http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := job.setHeaders(req); err != nil {
+		return nil, err
+	}
+	if rules == nil {
+		job.setChecksumHeader(req)
+		job.setIdempotencyHeader(req)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case rules != nil:
+		if err := rules.check(resp.StatusCode, resp.Status, data); err != nil {
+			var statusErr *statusError
+			if errors.As(err, &statusErr) {
+				statusErr.RetryAfter = retryAfter(resp)
+			}
+			return data, err
+		}
+	case resp.StatusCode/100 != 2:
+		return data, newStatusError(resp)
+	}
+	return data, nil
+}
+
+// putPresigned sends the file to the upload URL, with the headers the
+// response asked for.
+func putPresigned(job *uploadJob, file *sourceFile, size int64, target *url.URL, doc interface{}) error {
+	req, err := http.NewRequestWithContext(job.context(), cfg.Presigned.Method, target.String(), io.NewSectionReader(file, 0, size))
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", job.contentType())
+	if cfg.Presigned.UploadHeaders != "" {
+		value, _ := lookupJSONPath(doc, cfg.Presigned.UploadHeaders)
+		headers, _ := value.(map[string]interface{})
+		for key, value := range headers {
+			req.Header.Set(key, fmt.Sprintf("%v", value))
+		}
+	}
+
+	resp, err := presignedClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("uploading to %s: %w", target.Host, newStatusError(resp))
+	}
+	return nil
+}
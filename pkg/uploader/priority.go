@@ -0,0 +1,313 @@
+package uploader
+
+import (
+	"container/heap"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PriorityRule gives the files it matches a priority. Files with a higher
+// priority are uploaded first, so small or urgent files do not wait behind a
+// backlog of large ones. A rule matches a file when every condition it sets
+// holds, the first matching rule counts, and files no rule matches have
+// priority 0.
+type PriorityRule struct {
+	// Match are glob patterns matched against the path relative to the
+	// watched directory, like include and exclude
+	Match []string `yaml:"match"`
+	// Dir is a directory the file has to be in
+	Dir     string   `yaml:"dir"`
+	MinSize ByteSize `yaml:"min_size"`
+	MaxSize ByteSize `yaml:"max_size"`
+
+	Priority int `yaml:"priority"`
+}
+
+// queueStatusLimit caps the queued files listed by the status API.
+const queueStatusLimit = 100
+
+// queue holds the files found by scans and watch events until the watch loop
+// uploads them.
+var queue = newUploadQueue()
+
+// queuedFile is a file waiting for its upload.
+type queuedFile struct {
+	dir      *watchDir
+	path     string
+	priority int
+	// order is the upload order of the directory when the file was queued
+	order   string
+	modTime time.Time
+	// queued is when the file was queued
+	queued time.Time
+	// seq keeps files of the same priority in the order they were found
+	seq uint64
+}
+
+// queuedStatus is a queued file as reported by the status API.
+type queuedStatus struct {
+	Path     string `json:"path"`
+	Priority int    `json:"priority"`
+}
+
+// uploadQueue hands out the queued files by priority, highest first, and in
+// their directory's order where there is one. A file is queued once however
+// often it is seen before its upload. Each directory uploaded in order is a
+// lane of its own, and all other files share one; a lane uploads a file at a
+// time, and different lanes upload in parallel.
+type uploadQueue struct {
+	mu    sync.Mutex
+	files queuedFiles
+	paths map[string]*queuedFile
+	seq   uint64
+
+	// groups are the queued files of the directories uploaded in order, by
+	// directory
+	groups map[string]map[*queuedFile]bool
+	// held maps directories uploaded in order to the file that failed there
+	held map[string]string
+	// busy are the lanes with an upload running
+	busy map[string]bool
+}
+
+// laneFreed is signaled whenever an upload handed out by the queue is over,
+// so the files that waited for its lane can go.
+var laneFreed = make(chan struct{}, 1)
+
+func newUploadQueue() *uploadQueue {
+	return &uploadQueue{
+		paths:  make(map[string]*queuedFile),
+		groups: make(map[string]map[*queuedFile]bool),
+		held:   make(map[string]string),
+		busy:   make(map[string]bool),
+	}
+}
+
+// add queues a file found in dir with the priority its rules give it.
+func (q *uploadQueue) add(dir *watchDir, filePath string) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		// The file is already gone again
+		return
+	}
+	configMu.RLock()
+	priority := priorityOf(cfg.Priority, dir, filePath, info)
+	order := dir.UploadOrder
+	configMu.RUnlock()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.paths[filePath]; ok {
+		return
+	}
+	q.seq++
+	file := &queuedFile{dir: dir, path: filePath, priority: priority, order: order, modTime: info.ModTime(), queued: time.Now(), seq: q.seq}
+	q.paths[filePath] = file
+	heap.Push(&q.files, file)
+	if order != "" {
+		q.addOrdered(file)
+	}
+}
+
+// remove drops a file that went away before its upload.
+func (q *uploadQueue) remove(filePath string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if file, ok := q.paths[filePath]; ok {
+		q.take(file)
+	}
+}
+
+// next takes the file to upload next off the queue and marks its lane busy
+// until done is called for it. It returns nil if no file can go, because the
+// queue is empty or its files are held back or wait for their lane.
+func (q *uploadQueue) next() *queuedFile {
+	configMu.RLock()
+	lanes := max(cfg.DirParallelism, 1)
+	configMu.RUnlock()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var waiting []*queuedFile
+	defer func() {
+		for _, file := range waiting {
+			heap.Push(&q.files, file)
+		}
+	}()
+	for q.files.Len() > 0 {
+		file := heap.Pop(&q.files).(*queuedFile)
+		// Files that left the queue are skipped here rather than searched for
+		if q.paths[file.path] != file {
+			continue
+		}
+		if q.busy[file.lane()] || file.order != "" && (q.orderedBusy() >= lanes || q.isHeld(file)) {
+			waiting = append(waiting, file)
+			continue
+		}
+		// The first file of the directory goes in this file's place
+		if file.order != "" {
+			if first := q.firstInOrder(file); first != file {
+				waiting = append(waiting, file)
+				file = first
+			}
+		}
+		q.take(file)
+		q.busy[file.lane()] = true
+		return file
+	}
+	return nil
+}
+
+// done frees the lane of a file handed out by next once its upload is over.
+// A file that failed holds back the rest of its directory if that is
+// uploaded in order.
+func (q *uploadQueue) done(file *queuedFile, err error) {
+	q.mu.Lock()
+	if err != nil && file.order != "" {
+		q.held[filepath.Dir(file.path)] = file.path
+	}
+	delete(q.busy, file.lane())
+	q.mu.Unlock()
+
+	select {
+	case laneFreed <- struct{}{}:
+	default:
+	}
+}
+
+// running returns how many lanes have an upload running.
+func (q *uploadQueue) running() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.busy)
+}
+
+// take removes a file from the queue, leaving its entry in the heap to be
+// skipped. q.mu must be held.
+func (q *uploadQueue) take(file *queuedFile) {
+	delete(q.paths, file.path)
+	if file.order != "" {
+		q.removeOrdered(file)
+	}
+}
+
+func (q *uploadQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.paths)
+}
+
+// status returns the queued file at filePath, if it is queued.
+func (q *uploadQueue) status(filePath string) *queuedStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if file, ok := q.paths[filePath]; ok {
+		return &queuedStatus{Path: file.path, Priority: file.priority}
+	}
+	return nil
+}
+
+// list returns up to limit queued files by priority.
+func (q *uploadQueue) list(limit int) []queuedStatus {
+	q.mu.Lock()
+	files := make(queuedFiles, 0, len(q.paths))
+	for _, file := range q.paths {
+		files = append(files, file)
+	}
+	q.mu.Unlock()
+
+	sort.Sort(files)
+	statuses := make([]queuedStatus, 0, min(len(files), limit))
+	for _, file := range files[:min(len(files), limit)] {
+		statuses = append(statuses, queuedStatus{Path: file.path, Priority: file.priority})
+	}
+	return statuses
+}
+
+// queuedFiles orders files by priority and then by the order they were found
+// in, and is the heap of an uploadQueue.
+type queuedFiles []*queuedFile
+
+func (f queuedFiles) Len() int      { return len(f) }
+func (f queuedFiles) Swap(i, j int) { f[i], f[j] = f[j], f[i] }
+
+func (f queuedFiles) Less(i, j int) bool {
+	if f[i].priority != f[j].priority {
+		return f[i].priority > f[j].priority
+	}
+	return f[i].seq < f[j].seq
+}
+
+func (f *queuedFiles) Push(x interface{}) { *f = append(*f, x.(*queuedFile)) }
+
+func (f *queuedFiles) Pop() interface{} {
+	old := *f
+	file := old[len(old)-1]
+	*f = old[:len(old)-1]
+	return file
+}
+
+// priorityOf returns the priority of the first rule matching the file at
+// filePath in dir, or 0. The size conditions only match files, not the
+// directories uploaded as archives.
+func priorityOf(rules []PriorityRule, dir *watchDir, filePath string, info os.FileInfo) int {
+	relPath, err := filepath.Rel(dir.Path, filePath)
+	if err != nil {
+		relPath = filepath.Base(filePath)
+	}
+
+	for _, rule := range rules {
+		if len(rule.Match) > 0 && !matchAny(rule.Match, filepath.ToSlash(relPath)) {
+			continue
+		}
+		if rule.Dir != "" && !isInside(filePath, rule.Dir) {
+			continue
+		}
+		if rule.MinSize > 0 && (info.IsDir() || info.Size() < int64(rule.MinSize)) {
+			continue
+		}
+		if rule.MaxSize > 0 && (info.IsDir() || info.Size() > int64(rule.MaxSize)) {
+			continue
+		}
+		return rule.Priority
+	}
+	return 0
+}
+
+// uploadNext starts the upload of the file that is next in the queue in its
+// lane and calls finished, if not nil, with the outcome. It returns false if
+// no file could go.
+func uploadNext(finished func(error)) bool {
+	file := queue.next()
+	if file == nil {
+		return false
+	}
+	go func() {
+		err := uploadFile(file.dir, file.path, file.queued)
+		if finished != nil {
+			finished(err)
+		}
+		queue.done(file, err)
+	}()
+	return true
+}
+
+// uploadQueued uploads the queued files, highest priority first, until no
+// file can go or the uploads are paused, and waits for the running ones. It
+// sends the batch collected on the way and returns the errors of flushBatch.
+func uploadQueued(finished func(error)) []error {
+	for {
+		if !paused.Load() && !shutdownStarted() && uploadNext(finished) {
+			continue
+		}
+		if queue.running() == 0 {
+			break
+		}
+		<-laneFreed
+	}
+	return flushBatch()
+}
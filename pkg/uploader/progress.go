@@ -0,0 +1,188 @@
+package uploader
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// uploadProgress tracks how much of a file the backend has read so far. The
+// data read is a close estimate of the data sent, the difference being what
+// sits in buffers.
+type uploadProgress struct {
+	path    string
+	size    int64
+	started time.Time
+	read    atomic.Int64
+	done    chan struct{}
+}
+
+// progressReport is a snapshot of an upload in progress.
+type progressReport struct {
+	Path        string        `json:"path"`
+	Size        int64         `json:"size"`
+	Sent        int64         `json:"sent"`
+	Percent     float64       `json:"percent"`
+	BytesPerSec float64       `json:"bytes_per_sec"`
+	ETA         time.Duration `json:"eta"`
+	Started     time.Time     `json:"started"`
+}
+
+var (
+	progressMu sync.Mutex
+	inProgress = make(map[*uploadProgress]struct{})
+
+	// bytesRead counts the data read by all uploads, for the throughput
+	bytesRead atomic.Int64
+)
+
+const (
+	throughputStep    = 10 * time.Second
+	throughputSamples = 360
+)
+
+// throughputSample is the average upload rate over one throughputStep.
+type throughputSample struct {
+	Time        time.Time `json:"time"`
+	BytesPerSec float64   `json:"bytes_per_sec"`
+}
+
+var (
+	throughputMu sync.Mutex
+	throughput   []throughputSample
+)
+
+// startProgress registers an upload of size bytes. Uploads of at least
+// cfg.ProgressThreshold are also logged every cfg.ProgressInterval until
+// stop is called.
+func startProgress(path string, size int64) *uploadProgress {
+	p := &uploadProgress{path: path, size: size, started: time.Now(), done: make(chan struct{})}
+
+	progressMu.Lock()
+	inProgress[p] = struct{}{}
+	progressMu.Unlock()
+
+	if cfg.ProgressThreshold > 0 && size >= int64(cfg.ProgressThreshold) && cfg.ProgressInterval > 0 {
+		go p.logEvery(cfg.ProgressInterval)
+	}
+	return p
+}
+
+func (p *uploadProgress) add(n int) {
+	p.read.Add(int64(n))
+	bytesRead.Add(int64(n))
+}
+
+func (p *uploadProgress) stop() {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	if _, ok := inProgress[p]; ok {
+		delete(inProgress, p)
+		close(p.done)
+	}
+}
+
+func (p *uploadProgress) report() progressReport {
+	// Retries and multipart uploads may read parts of the file twice
+	sent := min(p.read.Load(), p.size)
+	elapsed := time.Since(p.started).Seconds()
+
+	r := progressReport{Path: p.path, Size: p.size, Sent: sent, Percent: 100, Started: p.started}
+	if p.size > 0 {
+		r.Percent = float64(sent) * 100 / float64(p.size)
+	}
+	if elapsed > 0 {
+		r.BytesPerSec = float64(sent) / elapsed
+	}
+	if r.BytesPerSec > 0 {
+		r.ETA = time.Duration(float64(p.size-sent) / r.BytesPerSec * float64(time.Second)).Round(time.Second)
+	}
+	return r
+}
+
+func (p *uploadProgress) logEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			r := p.report()
+			entry := logrus.NewEntry(logrus.StandardLogger())
+			if cfg.LogFormat == "json" {
+				entry = entry.WithFields(logrus.Fields{
+					"file":          r.Path,
+					"percent":       r.Percent,
+					"bytes_sent":    r.Sent,
+					"bytes_per_sec": int64(r.BytesPerSec),
+					"eta_seconds":   r.ETA.Seconds(),
+				})
+			}
+			entry.Infof("Uploading %s: %.1f%% (%s of %s) at %s/s, ETA %s",
+				r.Path, r.Percent, formatBytes(r.Sent), formatBytes(r.Size), formatBytes(int64(r.BytesPerSec)), r.ETA)
+		}
+	}
+}
+
+// currentUploads returns the progress of all running uploads, oldest first.
+func currentUploads() []progressReport {
+	progressMu.Lock()
+	reports := make([]progressReport, 0, len(inProgress))
+	for p := range inProgress {
+		reports = append(reports, p.report())
+	}
+	progressMu.Unlock()
+
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].Started.Before(reports[j].Started)
+	})
+	return reports
+}
+
+// recordThroughput samples the upload rate every throughputStep, keeping the
+// last hour for the dashboard.
+func recordThroughput() {
+	ticker := time.NewTicker(throughputStep)
+	defer ticker.Stop()
+
+	last := bytesRead.Load()
+	for now := range ticker.C {
+		read := bytesRead.Load()
+		sample := throughputSample{Time: now, BytesPerSec: float64(read-last) / throughputStep.Seconds()}
+		last = read
+
+		throughputMu.Lock()
+		throughput = append(throughput, sample)
+		if len(throughput) > throughputSamples {
+			throughput = throughput[len(throughput)-throughputSamples:]
+		}
+		throughputMu.Unlock()
+	}
+}
+
+// throughputHistory returns the recorded upload rates, oldest first.
+func throughputHistory() []throughputSample {
+	throughputMu.Lock()
+	defer throughputMu.Unlock()
+	return append([]throughputSample{}, throughput...)
+}
+
+// formatBytes formats a size with a binary unit, e.g. 1.5MB.
+func formatBytes(n int64) string {
+	const unit = 1 << 10
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	value, suffix := float64(n)/unit, 0
+	for value >= unit && suffix < 3 {
+		value /= unit
+		suffix++
+	}
+	return fmt.Sprintf("%.1f%cB", value, "KMGT"[suffix])
+}
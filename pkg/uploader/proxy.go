@@ -0,0 +1,152 @@
+package uploader
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// ProxyOverride routes the connections to some hosts through a different
+// proxy than the default one, or directly with "direct".
+type ProxyOverride struct {
+	Hosts []string `yaml:"hosts"`
+	Proxy string   `yaml:"proxy"`
+}
+
+// proxyFor returns the proxy for connections to target, or nil to connect
+// directly. The first override whose host pattern matches wins, then the
+// proxy setting, then HTTP_PROXY, HTTPS_PROXY and NO_PROXY for HTTP targets.
+func proxyFor(target *url.URL) (*url.URL, error) {
+	host := target.Hostname()
+	for _, override := range cfg.ProxyOverrides {
+		for _, pattern := range override.Hosts {
+			if matched, _ := path.Match(pattern, host); matched {
+				return parseProxy(override.Proxy)
+			}
+		}
+	}
+
+	if cfg.Proxy != "" {
+		return parseProxy(cfg.Proxy)
+	}
+	if target.Scheme == "http" || target.Scheme == "https" {
+		return http.ProxyFromEnvironment(&http.Request{URL: target})
+	}
+	return nil, nil
+}
+
+func parseProxy(value string) (*url.URL, error) {
+	if value == "" || value == "direct" {
+		return nil, nil
+	}
+
+	proxyURL, err := url.Parse(value)
+	if err != nil || proxyURL.Host == "" {
+		return nil, fmt.Errorf("invalid proxy: %s", value)
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5", "socks5h":
+		return proxyURL, nil
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme: %s", proxyURL.Scheme)
+	}
+}
+
+// dialThroughProxy opens a TCP connection to addr for the SFTP, scp, FTP, SMB,
+// gRPC, WebSocket and email backends and for NATS and MQTT, through a SOCKS5
+// proxy or an HTTP proxy that allows CONNECT if one is configured for the
+// host.
+func dialThroughProxy(scheme, addr string, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+
+	proxyURL, err := proxyFor(&url.URL{Scheme: scheme, Host: addr})
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL == nil {
+		return dialer.Dial("tcp", addr)
+	}
+
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if proxyURL.User != nil {
+			password, _ := proxyURL.User.Password()
+			auth = &proxy.Auth{User: proxyURL.User.Username(), Password: password}
+		}
+		socks, err := proxy.SOCKS5("tcp", proxyURL.Host, auth, dialer)
+		if err != nil {
+			return nil, err
+		}
+		return socks.Dial("tcp", addr)
+	case "http":
+		return dialConnect(dialer, proxyURL, addr)
+	default:
+		return nil, fmt.Errorf("%s proxies are not supported for %s connections", proxyURL.Scheme, scheme)
+	}
+}
+
+// dialConnect opens a tunnel to addr with an HTTP CONNECT request.
+func dialConnect(dialer *net.Dialer, proxyURL *url.URL, addr string) (net.Conn, error) {
+	conn, err := dialer.Dial("tcp", proxyURL.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		req.SetBasicAuth(proxyURL.User.Username(), password)
+		req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+		req.Header.Del("Authorization")
+	}
+	if dialer.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(dialer.Timeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// Read the response byte by byte, the tunnelled data starts right after
+	// it and must not end up in a buffer
+	var header []byte
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(header, []byte("\r\n\r\n")) {
+		if _, err := conn.Read(b); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("reading proxy response: %w", err)
+		}
+		if header = append(header, b[0]); len(header) > 16<<10 {
+			conn.Close()
+			return nil, errors.New("proxy response too long")
+		}
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(header)), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, errors.New("proxy refused tunnel: " + strings.TrimSpace(resp.Status))
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,362 @@
+package uploader
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// RetentionConfig keeps the state database from growing forever. Once a
+// day, and with "auto-upload state prune", the records of files that are
+// gone from the watched directories for DeletedAfter are removed, and the
+// uploads older than HistoryMaxAge are removed from the history. A file is
+// noted as gone the first time a prune does not find it, so it is removed
+// by a later one. Files in a watched directory that is missing altogether,
+// e.g. a share that is not mounted, are left alone.
+type RetentionConfig struct {
+	// DeletedAfter is how long the records of deleted files are kept, 0
+	// keeps them
+	DeletedAfter time.Duration `yaml:"deleted_after"`
+	// HistoryMaxAge is how long uploads are kept in the history, 0 keeps
+	// them
+	HistoryMaxAge time.Duration `yaml:"history_max_age"`
+	// Interval is how often the uploader prunes the state while it runs
+	Interval time.Duration `yaml:"interval"`
+}
+
+// sessionBuckets hold the state of uploads in progress, keyed by the path
+// of the file, after the name of the target for mirrored uploads.
+var sessionBuckets = [][]byte{tusBucket, chunksBucket, gcsBucket, driveBucket, targetsBucket}
+
+// pruneStats counts what a prune did.
+type pruneStats struct {
+	Missing int
+	Removed int
+	History int
+}
+
+// pruneState applies conf to the state in store. watched are the watched
+// directories.
+func pruneState(store *stateStore, conf RetentionConfig, watched []string) (pruneStats, error) {
+	var stats pruneStats
+	now := time.Now()
+
+	if conf.DeletedAfter > 0 {
+		var marked []*fileRecord
+		var gone []string
+		err := store.files(func(rec *fileRecord) error {
+			if !rootExists(rec.Path, watched) {
+				return nil
+			}
+			_, err := os.Lstat(rec.Path)
+			switch {
+			case err == nil && rec.MissingSince != nil:
+				// The file is back
+				rec.MissingSince = nil
+				marked = append(marked, rec)
+			case !os.IsNotExist(err):
+			case rec.MissingSince == nil:
+				rec.MissingSince = &now
+				marked = append(marked, rec)
+				stats.Missing++
+			case now.Sub(*rec.MissingSince) >= conf.DeletedAfter:
+				gone = append(gone, rec.Path)
+			}
+			return nil
+		})
+		if err != nil {
+			return stats, err
+		}
+		if err := store.markMissing(marked); err != nil {
+			return stats, err
+		}
+		if stats.Removed, err = store.removeFiles(gone, watched, conf.DeletedAfter); err != nil {
+			return stats, err
+		}
+	}
+
+	if conf.HistoryMaxAge > 0 {
+		var err error
+		if stats.History, err = store.pruneHistory(now.Add(-conf.HistoryMaxAge)); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// rootExists reports whether the watched directory that path is in exists,
+// or true if path is in none of them.
+func rootExists(path string, watched []string) bool {
+	path = filepath.Clean(path)
+	for _, dir := range watched {
+		prefix := filepath.Clean(dir)
+		if !strings.HasSuffix(prefix, string(filepath.Separator)) {
+			prefix += string(filepath.Separator)
+		}
+		if strings.HasPrefix(path, prefix) {
+			_, err := os.Stat(dir)
+			return err == nil
+		}
+	}
+	return true
+}
+
+// markMissing saves when the files of records were found gone, or that they
+// are back. The records are read again, in case an upload changed them.
+func (s *stateStore) markMissing(records []*fileRecord) error {
+	return s.db.update(func(tx stateTx) error {
+		for _, rec := range records {
+			current := &fileRecord{}
+			data := tx.get(filesBucket, []byte(rec.Path))
+			if data == nil || json.Unmarshal(data, current) != nil {
+				continue
+			}
+			current.MissingSince = rec.MissingSince
+			data, err := json.Marshal(current)
+			if err != nil {
+				return err
+			}
+			if err := tx.put(filesBucket, []byte(rec.Path), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// removeFiles forgets the files at paths: their records, the checksums
+// pointing to them and the state of unfinished uploads. Failed uploads of
+// files that are gone and inodes recorded for them are dropped too, the
+// failures once they are older than failedAfter.
+func (s *stateStore) removeFiles(paths []string, watched []string, failedAfter time.Duration) (int, error) {
+	gone := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		gone[path] = true
+	}
+	missing := func(path string) bool {
+		if gone[path] {
+			return true
+		}
+		if !rootExists(path, watched) {
+			return false
+		}
+		_, err := os.Lstat(path)
+		return os.IsNotExist(err)
+	}
+
+	removed := 0
+	err := s.db.update(func(tx stateTx) error {
+		for _, path := range paths {
+			// A file uploaded again since is kept
+			current := &fileRecord{}
+			data := tx.get(filesBucket, []byte(path))
+			if data == nil || json.Unmarshal(data, current) != nil || current.MissingSince == nil {
+				delete(gone, path)
+				continue
+			}
+			if err := tx.delete(filesBucket, []byte(path)); err != nil {
+				return err
+			}
+			removed++
+		}
+		cutoff := time.Now().Add(-failedAfter)
+		return deleteWhere(tx, func(bucket, key, value []byte) bool {
+			switch {
+			case bytes.Equal(bucket, checksumsBucket):
+				return gone[string(value)]
+			case bytes.Equal(bucket, failedBucket):
+				failed := &failedUpload{}
+				return json.Unmarshal(value, failed) == nil && failed.FailedAt.Before(cutoff) && missing(failed.Path)
+			case bytes.Equal(bucket, inodesBucket):
+				rec := &inodeRecord{}
+				return json.Unmarshal(value, rec) == nil && missing(rec.Path)
+			}
+			// A session bucket
+			path := string(key)
+			if _, file, ok := strings.Cut(path, " "); ok && !gone[path] {
+				path = file
+			}
+			return gone[path]
+		}, append([][]byte{checksumsBucket, failedBucket, inodesBucket}, sessionBuckets...)...)
+	})
+	return removed, err
+}
+
+// deleteWhere deletes the records of the buckets that match.
+func deleteWhere(tx stateTx, match func(bucket, key, value []byte) bool, buckets ...[]byte) error {
+	for _, name := range buckets {
+		var keys [][]byte
+		err := tx.forEach(name, false, func(key, value []byte) error {
+			if match(name, key, value) {
+				keys = append(keys, append([]byte(nil), key...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := tx.delete(name, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// pruneHistory removes the uploads before cutoff from the history.
+func (s *stateStore) pruneHistory(cutoff time.Time) (int, error) {
+	// The keys start with the upload time, oldest first
+	last := []byte(cutoff.UTC().Format("20060102T150405.000000000Z"))
+	removed := 0
+	err := s.db.update(func(tx stateTx) error {
+		var keys [][]byte
+		err := tx.forEach(historyBucket, false, func(key, _ []byte) error {
+			if bytes.Compare(key, last) >= 0 {
+				return errStopIteration
+			}
+			keys = append(keys, append([]byte(nil), key...))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := tx.delete(historyBucket, key); err != nil {
+				return err
+			}
+		}
+		removed = len(keys)
+		return nil
+	})
+	return removed, err
+}
+
+// watchedPaths returns the watched directories of c.
+func watchedPaths(c *Config) []string {
+	var paths []string
+	if c.UploadDir != "" {
+		paths = append(paths, c.UploadDir)
+	}
+	for _, dir := range c.Directories {
+		paths = append(paths, dir.Path)
+	}
+	return paths
+}
+
+// pruneStatePeriodically prunes the state every cfg.Retention.Interval while
+// the uploader runs.
+func pruneStatePeriodically() {
+	for {
+		configMu.RLock()
+		conf := cfg.Retention
+		watched := watchedPaths(&cfg)
+		configMu.RUnlock()
+		if conf.Interval <= 0 {
+			return
+		}
+
+		if conf.DeletedAfter > 0 || conf.HistoryMaxAge > 0 {
+			stats, err := pruneState(state, conf, watched)
+			if err != nil {
+				logrus.Error("Error pruning upload state:", err)
+			} else if stats.Removed > 0 || stats.History > 0 {
+				logrus.Infof("Pruned the state of %d deleted files and %d uploads from the history", stats.Removed, stats.History)
+			}
+		}
+
+		select {
+		case <-time.After(conf.Interval):
+		case <-stopping:
+			return
+		}
+	}
+}
+
+// runStatePrune implements "auto-upload state prune": it applies the
+// retention policy once and compacts the database, which bbolt never
+// shrinks by itself.
+func runStatePrune(args []string) error {
+	fs := flag.NewFlagSet("state prune", flag.ExitOnError)
+	fs.StringVar(&configFile, "config", "", "YAML file to load settings from")
+	registerStateFlags(fs, &cfg)
+	fs.Var(&uploadDirFlag{c: &cfg}, "upload-dir", "Watched directory; files in one that is missing altogether are not counted as deleted")
+	fs.DurationVar(&cfg.Retention.DeletedAfter, "deleted-after", cfg.Retention.DeletedAfter, "Remove the records of files deleted at least this long ago, e.g. 720h (0 keeps them)")
+	fs.DurationVar(&cfg.Retention.HistoryMaxAge, "history-max-age", cfg.Retention.HistoryMaxAge, "Remove uploads older than this from the history, e.g. 8760h (0 keeps them)")
+	compact := fs.Bool("compact", true, "Compact the database afterwards, to give the space of the removed records back")
+	fs.Parse(args)
+	if err := resolveSecrets(&cfg); err != nil {
+		return err
+	}
+
+	store, err := openState()
+	if err != nil {
+		return err
+	}
+	stats, err := pruneState(store, cfg.Retention, watchedPaths(&cfg))
+	store.Close()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d files found deleted, %d deleted files forgotten, %d uploads removed from the history\n", stats.Missing, stats.Removed, stats.History)
+
+	// Redis gives the space back by itself
+	if !*compact || cfg.StateBackend == stateRedis {
+		return nil
+	}
+	before, after, err := compactStateDB(cfg.StateDB)
+	if err != nil {
+		return fmt.Errorf("compacting %s: %w", cfg.StateDB, err)
+	}
+	sizeBefore, sizeAfter := ByteSize(before), ByteSize(after)
+	fmt.Printf("Compacted %s from %s to %s\n", cfg.StateDB, &sizeBefore, &sizeAfter)
+	return nil
+}
+
+// compactStateDB rewrites the database at path without its free pages,
+// through a copy renamed over it. It returns the sizes before and after.
+func compactStateDB(path string) (int64, int64, error) {
+	src, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second, ReadOnly: true})
+	if err != nil {
+		return 0, 0, err
+	}
+	defer src.Close()
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	temp := path + ".compact"
+	os.Remove(temp)
+	dst, err := bolt.Open(temp, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := bolt.Compact(dst, src, 64<<20); err != nil {
+		dst.Close()
+		os.Remove(temp)
+		return 0, 0, err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(temp)
+		return 0, 0, err
+	}
+	compacted, err := os.Stat(temp)
+	if err != nil {
+		return 0, 0, err
+	}
+	src.Close()
+	if err := os.Rename(temp, path); err != nil {
+		os.Remove(temp)
+		return 0, 0, err
+	}
+	return info.Size(), compacted.Size(), nil
+}
@@ -0,0 +1,174 @@
+package uploader
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RateLimitConfig caps how many uploads start per minute and per hour, for
+// APIs that enforce request quotas, so a large backlog is spread out instead
+// of running into 429 responses. 0 is no limit.
+type RateLimitConfig struct {
+	PerMinute int `yaml:"per_minute"`
+	PerHour   int `yaml:"per_hour"`
+}
+
+// uploadRate limits the uploads to server_url, or to the backend. Targets
+// have limiters of their own.
+var uploadRate *rateLimiter
+
+// rateLimiter holds uploads back until the last minute and the last hour
+// have room for another one, and while the server asked to wait with
+// Retry-After. A nil rateLimiter does not limit.
+type rateLimiter struct {
+	mu      sync.Mutex
+	windows []*rateWindow
+	// pausedUntil is when the server is willing to take uploads again
+	pausedUntil time.Time
+}
+
+// rateWindow remembers the start times of the uploads in the last period.
+type rateWindow struct {
+	limit  int
+	period time.Duration
+	starts []time.Time
+}
+
+func newRateLimiter(conf RateLimitConfig) *rateLimiter {
+	l := &rateLimiter{}
+	if conf.PerMinute > 0 {
+		l.windows = append(l.windows, &rateWindow{limit: conf.PerMinute, period: time.Minute})
+	}
+	if conf.PerHour > 0 {
+		l.windows = append(l.windows, &rateWindow{limit: conf.PerHour, period: time.Hour})
+	}
+	return l
+}
+
+// pause holds uploads back for the delay a server asked for.
+func (l *rateLimiter) pause(delay time.Duration) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until := time.Now().Add(delay); until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+}
+
+// wait blocks until an upload may start and counts it, or fails once ctx,
+// the upload's, ends or the uploader shuts down. The limiter is not locked
+// while it waits, so other uploads and the status can look at it.
+func (l *rateLimiter) wait(ctx context.Context, name string) error {
+	if l == nil {
+		return nil
+	}
+
+	for {
+		delay := l.reserve()
+		if delay <= 0 {
+			return nil
+		}
+
+		logrus.Debugf("Rate limit reached for %s, waiting %s", name, delay.Round(time.Second))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case <-stopping:
+			return fmt.Errorf("%w while rate limited", errShutdown)
+		}
+	}
+}
+
+// reserve counts an upload that may start now and returns 0, or returns how
+// long it has to wait before trying again.
+func (l *rateLimiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	delay := l.pausedUntil.Sub(now)
+	for _, w := range l.windows {
+		delay = max(delay, w.delay(now))
+	}
+	if delay > 0 {
+		return delay
+	}
+	for _, w := range l.windows {
+		w.starts = append(w.starts, now)
+	}
+	return 0
+}
+
+// delay drops the uploads that left the window and returns how long it takes
+// until the window has room, if it is full.
+func (w *rateWindow) delay(now time.Time) time.Duration {
+	expired := 0
+	for expired < len(w.starts) && now.Sub(w.starts[expired]) >= w.period {
+		expired++
+	}
+	w.starts = w.starts[expired:]
+
+	if len(w.starts) < w.limit {
+		return 0
+	}
+	return w.starts[len(w.starts)-w.limit].Add(w.period).Sub(now)
+}
+
+// guardedBackend holds every upload back until the rate limit and the
+// circuit breaker of the server it goes to allow it.
+type guardedBackend struct {
+	backend
+}
+
+func guarded(b backend, err error) (backend, error) {
+	if err != nil {
+		return nil, err
+	}
+	return guardedBackend{b}, nil
+}
+
+func (b guardedBackend) upload(job *uploadJob) (*fileRecord, error) {
+	name := targetName(job)
+	limiter, breaker := job.rateLimiter(), job.circuitBreaker()
+	if err := limiter.wait(job.context(), name); err != nil {
+		return nil, err
+	}
+	if err := breaker.allow(name); err != nil {
+		return nil, err
+	}
+
+	rec, err := b.backend.upload(job)
+	limiter.pause(retryAfterOf(err))
+	breaker.record(name, err)
+	return rec, err
+}
+
+func (b guardedBackend) close() {
+	if closer, ok := b.backend.(closer); ok {
+		closer.close()
+	}
+}
+
+// rateLimiter returns the rate limiter of the server the job uploads to.
+func (j *uploadJob) rateLimiter() *rateLimiter {
+	if j.Target != nil {
+		return j.Target.limiter
+	}
+	return uploadRate
+}
+
+// circuitBreaker returns the circuit breaker of the server the job uploads
+// to.
+func (j *uploadJob) circuitBreaker() *circuitBreaker {
+	if j.Target != nil {
+		return j.Target.breaker
+	}
+	return uploadBreaker
+}
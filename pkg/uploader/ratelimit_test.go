@@ -0,0 +1,42 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterWait(t *testing.T) {
+	l := newRateLimiter(RateLimitConfig{PerMinute: 1})
+	if err := l.wait(context.Background(), "test"); err != nil {
+		t.Fatalf("first wait: %v", err)
+	}
+
+	errStop := errors.New("stop waiting")
+	ctx, cancel := context.WithCancelCause(context.Background())
+	result := make(chan error, 1)
+	go func() { result <- l.wait(ctx, "test") }()
+
+	// The waiting upload must not keep the limiter locked.
+	paused := make(chan struct{})
+	go func() {
+		l.pause(time.Second)
+		close(paused)
+	}()
+	select {
+	case <-paused:
+	case <-time.After(5 * time.Second):
+		t.Fatal("pause blocked while another upload waits")
+	}
+
+	cancel(errStop)
+	select {
+	case err := <-result:
+		if !errors.Is(err, errStop) {
+			t.Errorf("wait = %v, want %v", err, errStop)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait did not return after its context ended")
+	}
+}
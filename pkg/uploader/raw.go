@@ -0,0 +1,69 @@
+package uploader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// sendFileRaw sends the file itself as the request body, for servers that
+// take a plain PUT or POST instead of a multipart form. The name goes in the
+// server URL template or in the raw_filename_header; the body fields have no
+// place in such a request and are not sent.
+func sendFileRaw(job *uploadJob) (*fileRecord, error) {
+	filePath := job.Path
+	file, info, err := openFile(job.context(), filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	req, err := http.NewRequestWithContext(job.context(), cfg.Method, job.URL, io.TeeReader(io.NewSectionReader(file, 0, info.Size()), hash))
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+	req.ContentLength = info.Size()
+	req.Header.Set("Content-Type", job.contentType())
+	if cfg.RawFilenameHeader != "" {
+		req.Header.Set(cfg.RawFilenameHeader, job.uploadName())
+	}
+	if err := job.setHeaders(req); err != nil {
+		return nil, err
+	}
+	job.setChecksumHeader(req)
+	job.setIdempotencyHeader(req)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	job.Response = body
+	if err != nil {
+		return nil, err
+	}
+	if err := job.rules().check(resp.StatusCode, resp.Status, body); err != nil {
+		var statusErr *statusError
+		if errors.As(err, &statusErr) {
+			statusErr.RetryAfter = retryAfter(resp)
+		}
+		return nil, err
+	}
+	if err := job.verifyChecksum(body); err != nil {
+		return nil, err
+	}
+
+	rec := newFileRecord(filePath, info, hex.EncodeToString(hash.Sum(nil)))
+	rec.RemoteURL = job.rules().remoteURL(body)
+	if rec.RemoteURL == "" && cfg.Method == http.MethodPut {
+		// A PUT stores the file at the URL it was sent to
+		rec.RemoteURL = job.URL
+	}
+	return rec, nil
+}
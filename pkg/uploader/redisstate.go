@@ -0,0 +1,209 @@
+package uploader
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// StateRedisConfig keeps the state on a Redis server instead of in the state
+// database, so a fleet of uploaders watching shared storage, e.g. pods in
+// Kubernetes, share which files were uploaded, the checksums for dedup and
+// the history. Every bucket of the state is a hash. The uploaders have to
+// see the files at the same paths. It only changes on restart.
+type StateRedisConfig struct {
+	// URL is the Redis server, e.g. redis://:password@host:6379/0
+	URL string `yaml:"url"`
+	// Prefix is put in front of the keys of the hashes, so several fleets
+	// can keep their state on the same server
+	Prefix string `yaml:"prefix"`
+}
+
+const (
+	stateBolt  = "bolt"
+	stateRedis = "redis"
+)
+
+// redisState is the state on a Redis server.
+type redisState struct {
+	client *redis.Client
+	prefix string
+}
+
+// openRedisState connects to the Redis server of conf.
+func openRedisState(conf StateRedisConfig) (*stateStore, error) {
+	if conf.URL == "" {
+		return nil, errors.New("state backend redis needs state_redis.url")
+	}
+	options, err := redis.ParseURL(conf.URL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing state_redis.url: %w", err)
+	}
+	client := redis.NewClient(options)
+	ctx, cancel := redisContext()
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("connecting to the state on %s: %w", redactURL(conf.URL), err)
+	}
+	return &stateStore{db: &redisState{client: client, prefix: conf.Prefix}}, nil
+}
+
+func (s *redisState) view(fn func(tx stateTx) error) error {
+	tx := &redisTx{state: s}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.err
+}
+
+// update runs fn with the writes held back until it returns, then sends
+// them in one MULTI/EXEC, so the other uploaders see all of them or none.
+// Unlike with bbolt, what fn reads may change while it runs.
+func (s *redisState) update(fn func(tx stateTx) error) error {
+	tx := &redisTx{state: s, writes: map[string]*[]byte{}, cleared: map[string]bool{}}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if tx.err != nil || len(tx.ops) == 0 {
+		return tx.err
+	}
+
+	ctx, cancel := redisContext()
+	defer cancel()
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, op := range tx.ops {
+			switch {
+			case op.key == nil:
+				pipe.Del(ctx, s.hash(op.bucket))
+			case op.value == nil:
+				pipe.HDel(ctx, s.hash(op.bucket), string(op.key))
+			default:
+				pipe.HSet(ctx, s.hash(op.bucket), string(op.key), op.value)
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+func (s *redisState) Close() error {
+	return s.client.Close()
+}
+
+// hash returns the key of the hash of bucket.
+func (s *redisState) hash(bucket []byte) string {
+	return s.prefix + string(bucket)
+}
+
+// redisOp is a write of an update: a record put, or deleted if value is
+// nil, or the bucket cleared if key is nil too.
+type redisOp struct {
+	bucket, key, value []byte
+}
+
+// redisTx is a transaction on the state in Redis. Reads see the writes of
+// the transaction through get, but not through forEach. The first error of
+// a read fails the transaction.
+type redisTx struct {
+	state   *redisState
+	ops     []redisOp
+	writes  map[string]*[]byte
+	cleared map[string]bool
+	err     error
+}
+
+func (t *redisTx) get(bucket, key []byte) []byte {
+	if value, ok := t.writes[string(bucket)+"\x00"+string(key)]; ok {
+		return *value
+	}
+	if t.cleared[string(bucket)] || t.err != nil {
+		return nil
+	}
+	ctx, cancel := redisContext()
+	defer cancel()
+	value, err := t.state.client.HGet(ctx, t.state.hash(bucket), string(key)).Bytes()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		t.err = err
+	}
+	return value
+}
+
+func (t *redisTx) put(bucket, key, value []byte) error {
+	return t.write(redisOp{bucket: bucket, key: key, value: append([]byte{}, value...)})
+}
+
+func (t *redisTx) delete(bucket, key []byte) error {
+	return t.write(redisOp{bucket: bucket, key: key})
+}
+
+func (t *redisTx) clear(bucket []byte) error {
+	return t.write(redisOp{bucket: bucket})
+}
+
+func (t *redisTx) write(op redisOp) error {
+	if t.writes == nil {
+		return errors.New("write in a read-only transaction")
+	}
+	t.ops = append(t.ops, op)
+	if op.key == nil {
+		for key := range t.writes {
+			if strings.HasPrefix(key, string(op.bucket)+"\x00") {
+				delete(t.writes, key)
+			}
+		}
+		t.cleared[string(op.bucket)] = true
+		return nil
+	}
+	t.writes[string(op.bucket)+"\x00"+string(op.key)] = &op.value
+	return nil
+}
+
+func (t *redisTx) forEach(bucket []byte, backward bool, fn func(key, value []byte) error) error {
+	if t.err != nil {
+		return t.err
+	}
+	hash := t.state.hash(bucket)
+	ctx, cancel := redisContext()
+	keys, err := t.state.client.HKeys(ctx, hash).Result()
+	cancel()
+	if err != nil {
+		return err
+	}
+	sort.Strings(keys)
+	if backward {
+		for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+			keys[i], keys[j] = keys[j], keys[i]
+		}
+	}
+
+	// The values are read in pages, a bucket does not have to fit into
+	// memory
+	const page = 500
+	for start := 0; start < len(keys); start += page {
+		end := min(start+page, len(keys))
+		ctx, cancel := redisContext()
+		values, err := t.state.client.HMGet(ctx, hash, keys[start:end]...).Result()
+		cancel()
+		if err != nil {
+			return err
+		}
+		for i, value := range values {
+			value, ok := value.(string)
+			if !ok {
+				// Deleted since
+				continue
+			}
+			if err := fn([]byte(keys[start+i]), []byte(value)); err != nil {
+				if err == errStopIteration {
+					return nil
+				}
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package uploader
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Backend is implemented by upload destinations that are added to the
+// uploader from outside, with RegisterBackend. Everything around the upload
+// itself stays with the uploader: watching, filtering, retries with backoff,
+// rate limits, the state store, hooks and notifications.
+//
+// The built-in http backend is a Backend too. Its Init sets up the HTTP
+// client from the tls, proxy, auth and http_client settings and checks the
+// protocol, Upload sends the file with the configured protocol (multipart,
+// raw, tus, presigned or graphql), Verify asks the server for the response
+// URL recorded with the upload with a HEAD request, and Close has nothing
+// to release. Targets and failover are wrapped around it by the uploader.
+type Backend interface {
+	// Init prepares the backend before its first upload. decode fills v, a
+	// pointer to the backend's own settings struct, from the section named
+	// after the backend in backend_options of the config file; v is left
+	// untouched if there is none.
+	Init(decode func(v interface{}) error) error
+
+	// Upload makes a single attempt at uploading file. Errors are not
+	// retried unless they are marked with Retryable, are network errors
+	// of an HTTP request or carry one of the retryable status codes.
+	Upload(ctx context.Context, file *File) (*Result, error)
+
+	// Verify returns the size of the file at remoteURL, the RemoteURL of an
+	// earlier Result, for "auto-upload verify": -1 if the destination does
+	// not tell, ErrRemoteMissing if the file is gone or ErrUnknownRemote if
+	// remoteURL was not uploaded by the backend.
+	Verify(ctx context.Context, remoteURL string) (int64, error)
+
+	// Close releases connections and stops work in the background, when
+	// the uploader shuts down or a config reload replaces the backend.
+	Close() error
+}
+
+// File is a file handed to a Backend for upload.
+type File struct {
+	// Path is the file to read. It is a copy of the watched file when the
+	// file is encrypted or the pre-upload hook replaced it.
+	Path string
+	// RelPath is the slash-separated path of the watched file below its
+	// watched directory
+	RelPath string
+	// Name is the name the file is uploaded as
+	Name string
+	// ContentType is the MIME type of the file
+	ContentType string
+	// Fields are the form fields or metadata configured for the file
+	Fields map[string]interface{}
+
+	// job is the upload of the file, for the built-in backends
+	job *uploadJob
+}
+
+// Result is the outcome of a successful upload.
+type Result struct {
+	// RemoteURL is where the destination keeps the file, if it tells. It is
+	// recorded with the upload and passed to Verify later.
+	RemoteURL string
+	// Checksum is the SHA-256 of the uploaded content as a hex string, if
+	// the backend computed it; the uploader hashes the file otherwise.
+	Checksum string
+	// Response is the destination's answer, passed on to the hooks
+	Response []byte
+
+	// record is the state record of a built-in backend
+	record *fileRecord
+}
+
+// Retryable marks err as transient, so the upload is tried again.
+func Retryable(err error) error {
+	return retryable(err)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = map[string]func() Backend{}
+)
+
+// RegisterBackend makes a backend available as "backend: name" in the
+// config file and -backend=name on the command line. newBackend is called
+// for a fresh instance every time the backend is set up, at start and on
+// every config reload. It is meant to be called from an init function
+// before Main, and panics if name is taken.
+func RegisterBackend(name string, newBackend func() Backend) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, ok := registry[name]; ok {
+		panic("backend registered twice: " + name)
+	}
+	registry[name] = newBackend
+}
+
+// registeredBackends returns the names of the registered backends.
+func registeredBackends() []string {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newRegisteredBackend sets up the backend registered as name with its
+// options from the config file.
+func newRegisteredBackend(name string) (*registeredBackend, error) {
+	registryMu.Lock()
+	newBackend, ok := registry[name]
+	registryMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown backend: %s", name)
+	}
+
+	b := newBackend()
+	decode := func(v interface{}) error {
+		node, ok := cfg.BackendOptions[name]
+		if !ok {
+			return nil
+		}
+		return node.Decode(v)
+	}
+	if err := b.Init(decode); err != nil {
+		return nil, fmt.Errorf("setting up %s backend: %w", name, err)
+	}
+	return &registeredBackend{name: name, backend: b}, nil
+}
+
+// registeredBackend adapts a Backend to the uploader.
+type registeredBackend struct {
+	name    string
+	backend Backend
+}
+
+func (b *registeredBackend) upload(job *uploadJob) (*fileRecord, error) {
+	file := &File{
+		Path:        job.Path,
+		RelPath:     job.RelPath,
+		Name:        job.uploadName(),
+		ContentType: job.contentType(),
+		Fields:      job.Fields,
+		job:         job,
+	}
+	result, err := b.backend.Upload(job.context(), file)
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		result = &Result{}
+	}
+	if result.record != nil {
+		return result.record, nil
+	}
+
+	info, err := os.Stat(job.Path)
+	if err != nil {
+		return nil, fmt.Errorf("reading file info: %w", err)
+	}
+	checksum := result.Checksum
+	if checksum == "" {
+		if checksum, err = job.checksum(); err != nil {
+			return nil, err
+		}
+	}
+	if result.Response != nil {
+		job.Response = result.Response
+	}
+	rec := newFileRecord(job.Path, info, checksum)
+	rec.RemoteURL = result.RemoteURL
+	return rec, nil
+}
+
+func (b *registeredBackend) stat(ctx context.Context, remoteURL string) (int64, error) {
+	return b.backend.Verify(ctx, remoteURL)
+}
+
+func (b *registeredBackend) close() {
+	if err := b.backend.Close(); err != nil {
+		logrus.Errorf("Error closing %s backend: %v", b.name, err)
+	}
+}
@@ -0,0 +1,242 @@
+package uploader
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+// configMu is held for reading by every upload and for writing by a reload,
+// so the config changes between uploads: the running uploads finish with
+// the old settings and the ones waiting start with the new ones.
+var configMu sync.RWMutex
+
+// handleReload reloads the configuration on SIGHUP, which is also what
+// "systemctl reload" sends with ExecReload=kill -HUP $MAINPID, and with
+// -watch-config whenever the config file changes. The log file is reopened
+// with the new logging settings, so it can be rotated by logrotate as well.
+func handleReload() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	if cfg.WatchConfig && configFile != "" {
+		go watchConfigFile(configFile, signals)
+	}
+
+	for range signals {
+		sdNotify("RELOADING=1")
+		if err := reload(); err != nil {
+			logrus.Error("Error reloading config, keeping the current one:", err)
+		} else {
+			logrus.Info("Reloaded config")
+		}
+		sdNotify("READY=1")
+	}
+}
+
+// reload reads the config again and applies it: the watched directories'
+// settings such as filters and form fields, the upload backend with its
+// targets and credentials, response rules, webhooks and logging. Nothing is
+// changed if any part of the new config is invalid.
+func reload() error {
+	next, err := loadConfig(os.Args[1:])
+	if err != nil {
+		return err
+	}
+
+	if !configMu.TryLock() {
+		logrus.Info("Reloading config once the running uploads are done")
+		configMu.Lock()
+	}
+	defer configMu.Unlock()
+
+	// These are only read at startup
+	if next.StateDB != cfg.StateDB || next.StateBackend != cfg.StateBackend || next.StateRedis != cfg.StateRedis ||
+		next.PIDFile != cfg.PIDFile || next.WatchMode != cfg.WatchMode ||
+		next.PollInterval != cfg.PollInterval || next.WatchConfig != cfg.WatchConfig {
+		logrus.Warn("Changes to state_db, state_backend, state_redis, pid_file, watch_mode, poll_interval and watch_config take effect on restart")
+	}
+	next.StateDB, next.PIDFile, next.WatchMode = cfg.StateDB, cfg.PIDFile, cfg.WatchMode
+	next.StateBackend, next.StateRedis = cfg.StateBackend, cfg.StateRedis
+	next.PollInterval, next.WatchConfig = cfg.PollInterval, cfg.WatchConfig
+
+	previous, previousRules, previousClient := cfg, responseCheck, httpClient
+	cfg = next
+	if err := applyConfig(); err != nil {
+		cfg, responseCheck, httpClient = previous, previousRules, previousClient
+		return err
+	}
+	return nil
+}
+
+// applyConfig rebuilds everything that is derived from cfg. It must be
+// called with configMu held.
+func applyConfig() error {
+	nextDirs, err := cfg.watchDirs()
+	if err != nil {
+		return err
+	}
+	if len(nextDirs) != len(dirs) {
+		return errors.New("the watched directories can only change on restart")
+	}
+	byPath := make(map[string]*watchDir, len(nextDirs))
+	for _, dir := range nextDirs {
+		byPath[dir.Path] = dir
+	}
+	for _, dir := range dirs {
+		if byPath[dir.Path] == nil {
+			return fmt.Errorf("the watched directories can only change on restart, %s is no longer configured", dir.Path)
+		}
+	}
+	if err := validateDedup(cfg.Dedup); err != nil {
+		return err
+	}
+
+	// Targets fall back to the top-level response rules
+	if responseCheck, err = newResponseRules(cfg.Response); err != nil {
+		return err
+	}
+	nextWebhooks, err := newWebhooks(cfg.Webhooks)
+	if err != nil {
+		return err
+	}
+	nextEncryption, err := newEncryptor(cfg.Encryption)
+	if err != nil {
+		return err
+	}
+	nextBusEvents, err := newEventBus(cfg.Bus)
+	if err != nil {
+		return err
+	}
+	// The MQTT client only connects once it takes over, as the broker would
+	// drop the old one for a second client with its ID
+	nextMQTTEvents, err := newMQTTPublisher(cfg.MQTT)
+	if err != nil {
+		nextBusEvents.close()
+		return err
+	}
+	nextScript, err := loadScript(cfg.Script)
+	if err != nil {
+		nextBusEvents.close()
+		return err
+	}
+	nextPlugins, err := newPluginSet(cfg.Plugins)
+	if err != nil {
+		nextBusEvents.close()
+		return err
+	}
+	nextUploader, err := newBackend(cfg.Backend)
+	if err != nil {
+		nextBusEvents.close()
+		return err
+	}
+	if err := reopenLogFile(); err != nil {
+		if closer, ok := nextUploader.(closer); ok {
+			closer.close()
+		}
+		nextBusEvents.close()
+		return err
+	}
+
+	// The directories are updated in place, as the file watcher refers to
+	// them
+	for _, dir := range dirs {
+		*dir = *byPath[dir.Path]
+	}
+	if closer, ok := uploader.(closer); ok {
+		closer.close()
+	}
+	uploader = nextUploader
+	webhooks = nextWebhooks
+	busEvents.close()
+	busEvents = nextBusEvents
+	mqttEvents.close()
+	mqttEvents = nextMQTTEvents
+	mqttEvents.start()
+	encryption = nextEncryption
+	plugins.close()
+	plugins = nextPlugins
+	routeScript = nextScript
+	bandwidthLimiter = newBandwidthLimiter(cfg.MaxBandwidth)
+	uploadRate = newRateLimiter(cfg.RateLimit)
+	uploadBreaker = newCircuitBreaker(cfg.CircuitBreaker)
+	uploadConcurrency = newConcurrencyLimit(cfg.AdaptiveChunkConcurrency)
+	return nil
+}
+
+// watchConfigFile sends a reload request to requests whenever the config
+// file changes, once it has not been written to for a moment. The directory
+// is watched rather than the file, since editors often save by replacing the
+// file.
+func watchConfigFile(path string, requests chan<- os.Signal) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logrus.Error("Error watching config file:", err)
+		return
+	}
+	defer watcher.Close()
+
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		logrus.Error("Error watching config file:", err)
+		return
+	}
+
+	var settle *time.Timer
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Base(event.Name) != filepath.Base(path) || !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) {
+				continue
+			}
+			if settle == nil {
+				settle = time.AfterFunc(notifySettleDelay, func() {
+					select {
+					case requests <- syscall.SIGHUP:
+					default:
+						// A reload is already pending
+					}
+				})
+			} else {
+				settle.Reset(notifySettleDelay)
+			}
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logrus.Error("Error watching config file:", err)
+		}
+	}
+}
+
+// loadConfig reads the config file and the flags in args into a new config,
+// the same way they are read at startup.
+func loadConfig(args []string) (Config, error) {
+	c := DefaultConfig()
+	if path := configFileFromArgs(args); path != "" {
+		if err := LoadConfigFile(path, &c); err != nil {
+			return c, err
+		}
+	}
+
+	fs := flag.NewFlagSet("auto-upload", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	registerFlags(fs, &c)
+	registerCommandFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return c, err
+	}
+	return c, resolveSecrets(&c)
+}
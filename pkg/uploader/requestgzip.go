@@ -0,0 +1,98 @@
+package uploader
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RequestCompressionConfig gzips the bodies of multipart uploads, sent with
+// Content-Encoding: gzip, which shrinks logs, CSVs and other text a lot.
+// Files whose content type matches Skip are already compressed and are sent
+// as they are. A server that does not take gzipped bodies answers 415, and
+// from then on gets them uncompressed.
+type RequestCompressionConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// MinSize is the smallest body worth compressing
+	MinSize ByteSize `yaml:"min_size"`
+	// Skip are content type patterns such as image/* of files that are not
+	// compressed
+	Skip []string `yaml:"skip"`
+}
+
+// defaultGzipSkip are the content types of formats that are compressed
+// already.
+var defaultGzipSkip = []string{
+	"image/jpeg", "image/png", "image/gif", "image/webp", "image/avif", "image/heic",
+	"video/*", "audio/mpeg", "audio/aac", "audio/mp4", "audio/ogg", "audio/flac", "audio/webm",
+	"application/zip", "application/gzip", "application/x-gzip", "application/zstd",
+	"application/x-7z-compressed", "application/x-rar-compressed", "application/vnd.rar",
+	"application/x-xz", "application/x-bzip2", "application/pdf", "application/java-archive",
+	"application/vnd.openxmlformats-officedocument.*", "application/vnd.oasis.opendocument.*",
+	"font/woff", "font/woff2",
+}
+
+// gzipRefused holds the hosts that answered 415 to a gzipped body.
+var gzipRefused sync.Map
+
+// gzipBody reports whether the body of the job's request to host, with
+// form's file parts of contentSize bytes, is sent gzipped. Files the route
+// compresses and encrypted files do not shrink any further.
+func (j *uploadJob) gzipBody(host string, form *multipartBody, contentSize int64) bool {
+	conf := cfg.RequestCompression
+	if !conf.Enabled || contentSize < int64(conf.MinSize) || j.Compress != "" || j.Encrypted != nil {
+		return false
+	}
+	if _, refused := gzipRefused.Load(host); refused {
+		return false
+	}
+	if len(form.files) > 0 && skipsGzip(conf.Skip, j.contentType()) {
+		return false
+	}
+	for _, file := range form.files {
+		if file.contentEncoding != "" || skipsGzip(conf.Skip, file.contentType) {
+			return false
+		}
+	}
+	return true
+}
+
+// skipsGzip reports whether contentType matches one of the patterns.
+func skipsGzip(patterns []string, contentType string) bool {
+	contentType, _, _ = strings.Cut(contentType, ";")
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), contentType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipRequest compresses the body of req as it is sent.
+func gzipRequest(req *http.Request, body io.ReadCloser) error {
+	compressed, err := newCompressReader(body, compressGzip)
+	if err != nil {
+		return err
+	}
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{compressed, body}
+	req.ContentLength = -1
+	req.Header.Set("Content-Encoding", "gzip")
+	return nil
+}
+
+// refuseGzip remembers that host does not take gzipped bodies and returns
+// the error that has the upload tried again without.
+func refuseGzip(host, status string) error {
+	gzipRefused.Store(host, true)
+	logrus.Warnf("%s does not take gzipped request bodies, sending them uncompressed", host)
+	return retryable(fmt.Errorf("gzipped request body refused: %s", status))
+}
@@ -0,0 +1,73 @@
+package uploader
+
+import "testing"
+
+func TestSkipsGzip(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"text/plain", false},
+		{"text/csv; charset=utf-8", false},
+		{"application/json", false},
+		{"image/jpeg", true},
+		{"IMAGE/PNG", true},
+		{"image/svg+xml", false},
+		{"video/mp4", true},
+		{"application/zip", true},
+		{"application/gzip; foo=bar", true},
+		{"application/vnd.openxmlformats-officedocument.wordprocessingml.document", true},
+		{"application/vnd.ms-excel", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := skipsGzip(defaultGzipSkip, tt.contentType); got != tt.want {
+			t.Errorf("skipsGzip(%q) = %v, want %v", tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestGzipBody(t *testing.T) {
+	saved := cfg
+	t.Cleanup(func() { cfg = saved })
+	cfg = DefaultConfig()
+	gzipRefused.Store("refused.example.com", true)
+	t.Cleanup(func() { gzipRefused.Delete("refused.example.com") })
+
+	fileForm := func(contentType, contentEncoding string) *multipartBody {
+		form := newMultipartBody("", "", "", nil)
+		form.addFile("file", "upload", contentType, contentEncoding)
+		return form
+	}
+	tests := []struct {
+		name     string
+		job      uploadJob
+		host     string
+		form     *multipartBody
+		size     int64
+		disabled bool
+		want     bool
+	}{
+		{name: "text", job: uploadJob{ContentType: "text/plain"}, form: fileForm("text/plain", ""), size: 1 << 20, want: true},
+		{name: "disabled", job: uploadJob{ContentType: "text/plain"}, form: fileForm("text/plain", ""), size: 1 << 20, disabled: true},
+		{name: "too small", job: uploadJob{ContentType: "text/plain"}, form: fileForm("text/plain", ""), size: 100},
+		{name: "already compressed type", job: uploadJob{ContentType: "image/jpeg"}, form: fileForm("image/jpeg", ""), size: 1 << 20},
+		{name: "compressed by the route", job: uploadJob{ContentType: "text/plain", Compress: compressGzip}, form: fileForm("text/plain", compressGzip), size: 1 << 20},
+		{name: "encrypted", job: uploadJob{ContentType: "text/plain", Encrypted: &encryptedFile{}}, form: fileForm("application/octet-stream", ""), size: 1 << 20},
+		{name: "host refused before", job: uploadJob{ContentType: "text/plain"}, host: "refused.example.com", form: fileForm("text/plain", ""), size: 1 << 20},
+		{name: "batch with an archive", job: uploadJob{ContentType: "text/plain"}, form: func() *multipartBody {
+			form := fileForm("text/plain", "")
+			form.addFile("file", "logs.zip", "application/zip", "")
+			return form
+		}(), size: 1 << 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.RequestCompression.Enabled = !tt.disabled
+			host := firstNonEmpty(tt.host, "server.example.com")
+			if got := tt.job.gzipBody(host, tt.form, tt.size); got != tt.want {
+				t.Errorf("gzipBody() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package uploader
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ResponseConfig decides which server responses count as a successful
+// upload, for APIs that answer 201 or report errors in a 200 response.
+type ResponseConfig struct {
+	// SuccessStatus lists accepted status codes and ranges like "200-299"
+	SuccessStatus []string `yaml:"success_status"`
+	// BodyMatch is a regular expression the response body has to match
+	BodyMatch string `yaml:"body_match"`
+	// Assert holds conditions on the JSON response body, such as
+	// `$.status == "ok"`, `$.data.id != null` or just `$.data.url`
+	Assert []string `yaml:"assert"`
+	// RemoteURL is the JSONPath of the uploaded file's URL in the response,
+	// e.g. $.data.url, which is kept in the upload history
+	RemoteURL string `yaml:"remote_url"`
+}
+
+// responseRules is the parsed form of ResponseConfig.
+type responseRules struct {
+	status  [][2]int
+	match   *regexp.Regexp
+	asserts []jsonAssertion
+	urlPath string
+}
+
+var responseCheck = &responseRules{status: [][2]int{{200, 200}}}
+
+func newResponseRules(c ResponseConfig) (*responseRules, error) {
+	rules := &responseRules{}
+
+	for _, value := range c.SuccessStatus {
+		low, high, isRange := strings.Cut(strings.TrimSpace(value), "-")
+		if !isRange {
+			high = low
+		}
+		from, err1 := strconv.Atoi(strings.TrimSpace(low))
+		to, err2 := strconv.Atoi(strings.TrimSpace(high))
+		if err1 != nil || err2 != nil || from > to {
+			return nil, fmt.Errorf("invalid success status %q", value)
+		}
+		rules.status = append(rules.status, [2]int{from, to})
+	}
+	if len(rules.status) == 0 {
+		rules.status = [][2]int{{200, 200}}
+	}
+
+	if c.BodyMatch != "" {
+		match, err := regexp.Compile(c.BodyMatch)
+		if err != nil {
+			return nil, fmt.Errorf("invalid response body match: %w", err)
+		}
+		rules.match = match
+	}
+
+	for _, expr := range c.Assert {
+		assertion, err := parseJSONAssertion(expr)
+		if err != nil {
+			return nil, err
+		}
+		rules.asserts = append(rules.asserts, assertion)
+	}
+
+	if c.RemoteURL != "" {
+		if _, err := parseJSONPath(c.RemoteURL); err != nil {
+			return nil, fmt.Errorf("invalid response remote url path %q: %w", c.RemoteURL, err)
+		}
+		rules.urlPath = c.RemoteURL
+	}
+
+	return rules, nil
+}
+
+// remoteURL returns the URL of the uploaded file from a successful response,
+// or "" if it is not configured or not found.
+func (r *responseRules) remoteURL(body []byte) string {
+	if r.urlPath == "" {
+		return ""
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return ""
+	}
+	if value, found := lookupJSONPath(doc, r.urlPath); found && value != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return ""
+}
+
+// check returns a statusError for a status code that is not accepted, so
+// the retry policy applies to it, and a plain error if the body does not
+// satisfy the rules.
+func (r *responseRules) check(statusCode int, status string, body []byte) error {
+	accepted := false
+	for _, codes := range r.status {
+		if statusCode >= codes[0] && statusCode <= codes[1] {
+			accepted = true
+			break
+		}
+	}
+	if !accepted {
+		return &statusError{StatusCode: statusCode, Status: status}
+	}
+
+	if r.match != nil && !r.match.Match(body) {
+		return fmt.Errorf("response body does not match %q", r.match)
+	}
+
+	if len(r.asserts) == 0 {
+		return nil
+	}
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return fmt.Errorf("response is not JSON: %w", err)
+	}
+	for _, assertion := range r.asserts {
+		if !assertion.holds(doc) {
+			return fmt.Errorf("response assertion failed: %s", assertion.expr)
+		}
+	}
+
+	return nil
+}
+
+// jsonAssertion is a condition of the form "<path> == <value>",
+// "<path> != <value>" or "<path>", the last one meaning the value is
+// present and neither null nor false. Values are JSON literals; anything
+// that is not valid JSON is taken as a plain string.
+type jsonAssertion struct {
+	expr  string
+	path  string
+	op    string
+	value interface{}
+}
+
+func parseJSONAssertion(expr string) (jsonAssertion, error) {
+	assertion := jsonAssertion{expr: expr, path: strings.TrimSpace(expr)}
+	for _, op := range []string{"==", "!="} {
+		if path, literal, found := strings.Cut(expr, op); found {
+			assertion.path, assertion.op = strings.TrimSpace(path), op
+			literal = strings.TrimSpace(literal)
+			if err := json.Unmarshal([]byte(literal), &assertion.value); err != nil {
+				assertion.value = literal
+			}
+			break
+		}
+	}
+
+	if _, err := parseJSONPath(assertion.path); err != nil {
+		return jsonAssertion{}, fmt.Errorf("invalid response assertion %q: %w", expr, err)
+	}
+	return assertion, nil
+}
+
+func (a jsonAssertion) holds(doc interface{}) bool {
+	value, found := lookupJSONPath(doc, a.path)
+	switch a.op {
+	case "==":
+		return found && reflect.DeepEqual(value, a.value)
+	case "!=":
+		return !found || !reflect.DeepEqual(value, a.value)
+	default:
+		return found && value != nil && value != false
+	}
+}
+
+// lookupJSONPath returns the value at a simple JSONPath such as
+// "$.data.files[0].url" in a decoded JSON document.
+func lookupJSONPath(doc interface{}, path string) (interface{}, bool) {
+	steps, err := parseJSONPath(path)
+	if err != nil {
+		return nil, false
+	}
+
+	value := doc
+	for _, step := range steps {
+		switch node := value.(type) {
+		case map[string]interface{}:
+			child, ok := node[step]
+			if !ok {
+				return nil, false
+			}
+			value = child
+		case []interface{}:
+			index, err := strconv.Atoi(step)
+			if err != nil || index < 0 || index >= len(node) {
+				return nil, false
+			}
+			value = node[index]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// parseJSONPath splits "$.a.b[0]" into the steps "a", "b" and "0".
+func parseJSONPath(path string) ([]string, error) {
+	rest, ok := strings.CutPrefix(strings.TrimSpace(path), "$")
+	if !ok {
+		return nil, errors.New("path must start with $")
+	}
+
+	var steps []string
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			if end == 0 {
+				return nil, errors.New("empty path segment")
+			}
+			steps = append(steps, rest[1:end+1])
+			rest = rest[end+1:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, errors.New("missing ]")
+			}
+			steps = append(steps, strings.Trim(rest[1:end], `"'`))
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("unexpected %q", rest[0])
+		}
+	}
+	return steps, nil
+}
@@ -0,0 +1,245 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RetryConfig controls how failed uploads are retried.
+type RetryConfig struct {
+	MaxAttempts     int           `yaml:"max_attempts"`
+	InitialBackoff  time.Duration `yaml:"initial_backoff"`
+	MaxBackoff      time.Duration `yaml:"max_backoff"`
+	Multiplier      float64       `yaml:"multiplier"`
+	Jitter          float64       `yaml:"jitter"`
+	RetryableStatus []int         `yaml:"retryable_status"`
+}
+
+// statusError is returned when the server answers with a status code that is
+// not considered a successful upload.
+type statusError struct {
+	StatusCode int
+	Status     string
+	// RetryAfter is the delay a 429 or 503 response asked for with its
+	// Retry-After header, 0 if it did not
+	RetryAfter time.Duration
+}
+
+func newStatusError(resp *http.Response) *statusError {
+	return &statusError{StatusCode: resp.StatusCode, Status: resp.Status, RetryAfter: retryAfter(resp)}
+}
+
+func (e *statusError) Error() string {
+	return "Status: " + e.Status
+}
+
+// retryAfter returns the delay asked for by the Retry-After header of a 429
+// or 503 response, given in seconds or as a date.
+func retryAfter(resp *http.Response) time.Duration {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0
+	}
+	value := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0)
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0)
+	}
+	return 0
+}
+
+// retryAfterOf returns the delay the server asked for with a failed upload,
+// or until its open circuit lets an upload through again, 0 if neither.
+func retryAfterOf(err error) time.Duration {
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		return statusErr.RetryAfter
+	}
+	var circuitErr *circuitOpenError
+	if errors.As(err, &circuitErr) {
+		return circuitErr.wait
+	}
+	return 0
+}
+
+// retryableError marks a failure as transient, for backends whose errors are
+// not HTTP status codes, such as a dropped SSH connection.
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryableError) Unwrap() error {
+	return e.err
+}
+
+// exhaustedError is returned by withRetry when every attempt failed with an
+// error worth retrying.
+type exhaustedError struct {
+	attempts int
+	err      error
+}
+
+func (e *exhaustedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exhaustedError) Unwrap() error {
+	return e.err
+}
+
+func retryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &retryableError{err: err}
+}
+
+// withRetry runs attempt until it succeeds, fails with an error that is not
+// worth retrying, or the configured number of attempts is used up. A server
+// that answers with Retry-After is waited for as long as it asks, and this
+// does not use up an attempt, and so is a server whose circuit is open. It
+// stops with the reason once ctx ends, and with errShutdown when the uploader
+// shuts down while it waits for the next attempt.
+func withRetry(ctx context.Context, filePath string, attempt func() error) error {
+	policy := cfg.Retry
+	maxAttempts := policy.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	var err error
+	for n := 1; n <= maxAttempts; n++ {
+		if err = attempt(); err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return uploadErr(ctx, err)
+		}
+
+		if !isRetryable(err, policy) {
+			break
+		}
+
+		trace.SpanFromContext(ctx).AddEvent("attempt failed", trace.WithAttributes(
+			attribute.Int("attempt", n),
+			attribute.String("error", err.Error()),
+		))
+
+		delay := retryAfterOf(err)
+		if delay > 0 {
+			logrus.Warnf("Holding back %s: %v, retrying in %s", filePath, err, delay.Round(time.Second))
+			n--
+		} else if n == maxAttempts {
+			if n > 1 {
+				err = &exhaustedError{attempts: n, err: err}
+			}
+			break
+		} else {
+			delay = policy.backoff(n)
+			logrus.Warnf("Upload attempt %d/%d failed for %s: %v, retrying in %s", n, maxAttempts, filePath, err, delay.Round(time.Millisecond))
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return uploadErr(ctx, err)
+		case <-stopping:
+			return fmt.Errorf("%w, giving up after: %v", errShutdown, err)
+		}
+	}
+
+	return err
+}
+
+// backoff returns the delay before the attempt following the given one:
+// exponential growth capped at MaxBackoff, randomized by +/- Jitter.
+func (p RetryConfig) backoff(attempt int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	delay := float64(p.InitialBackoff) * math.Pow(multiplier, float64(attempt-1))
+	if p.MaxBackoff > 0 && delay > float64(p.MaxBackoff) {
+		delay = float64(p.MaxBackoff)
+	}
+
+	if p.Jitter > 0 {
+		delay *= 1 + p.Jitter*(rand.Float64()*2-1)
+	}
+
+	return time.Duration(delay)
+}
+
+// isRetryable reports whether err is transient: a network failure, an error
+// marked as retryable or one of the configured retryable status codes.
+func isRetryable(err error, policy RetryConfig) bool {
+	if retryAfterOf(err) > 0 {
+		return true
+	}
+	var retryableErr *retryableError
+	if errors.As(err, &retryableErr) {
+		return true
+	}
+
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		for _, code := range policy.RetryableStatus {
+			if code == statusErr.StatusCode {
+				return true
+			}
+		}
+		return false
+	}
+
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
+
+// intListFlag parses a comma-separated list of integers such as status codes.
+type intListFlag []int
+
+func (l *intListFlag) String() string {
+	if l == nil {
+		return ""
+	}
+
+	values := make([]string, len(*l))
+	for i, v := range *l {
+		values[i] = strconv.Itoa(v)
+	}
+	return strings.Join(values, ",")
+}
+
+func (l *intListFlag) Set(value string) error {
+	var values []int
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		v, err := strconv.Atoi(field)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", field)
+		}
+		values = append(values, v)
+	}
+	*l = values
+	return nil
+}
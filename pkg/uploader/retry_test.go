@@ -0,0 +1,57 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestShutdownWhileWaiting(t *testing.T) {
+	saved, savedStopping := cfg, stopping
+	t.Cleanup(func() { cfg, stopping = saved, savedStopping })
+	cfg = DefaultConfig()
+	cfg.Retry.MaxAttempts = 3
+	cfg.Retry.InitialBackoff = time.Hour
+
+	tests := []struct {
+		name string
+		wait func() error
+	}{
+		{
+			name: "retry backoff",
+			wait: func() error {
+				return withRetry(context.Background(), "report.pdf", func() error {
+					close(stopping)
+					return retryable(errors.New("connection reset"))
+				})
+			},
+		},
+		{
+			name: "rate limit",
+			wait: func() error {
+				l := newRateLimiter(RateLimitConfig{PerMinute: 1})
+				if err := l.wait(context.Background(), "test"); err != nil {
+					return err
+				}
+				close(stopping)
+				return l.wait(context.Background(), "test")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stopping = make(chan struct{})
+			result := make(chan error, 1)
+			go func() { result <- tt.wait() }()
+			select {
+			case err := <-result:
+				if !errors.Is(err, errShutdown) {
+					t.Errorf("got %v, want errShutdown", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("still waiting after the shutdown")
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package uploader
+
+import "errors"
+
+// RouteConfig sends the files matching one of its patterns to their own
+// server URL and form field, e.g. images to one API and CSV files to another.
+// Body is merged into the fields of the watched directory, and settings left
+// empty use the directory's. ContentType forces the MIME type of the files
+// instead of detecting it, and Compress (gzip or zstd) compresses them on the
+// way out.
+type RouteConfig struct {
+	Match       []string               `yaml:"match"`
+	ServerURL   string                 `yaml:"server_url"`
+	FieldName   string                 `yaml:"field_name"`
+	Filename    string                 `yaml:"filename"`
+	Body        map[string]interface{} `yaml:"body"`
+	ContentType string                 `yaml:"content_type"`
+	Compress    string                 `yaml:"compress"`
+}
+
+// resolveRoutes returns a directory's routes followed by the top-level ones,
+// so the directory's take precedence.
+func resolveRoutes(dirRoutes, routes []RouteConfig) ([]RouteConfig, error) {
+	resolved := append(append([]RouteConfig(nil), dirRoutes...), routes...)
+	for _, route := range resolved {
+		if len(route.Match) == 0 {
+			return nil, errors.New("route without match patterns")
+		}
+		if err := validateCompression(route.Compress); err != nil {
+			return nil, err
+		}
+	}
+	return resolved, nil
+}
+
+// route returns the first route whose patterns match the file at relPath, or
+// nil to upload it with the directory's settings.
+func (d *watchDir) route(relPath string) *RouteConfig {
+	for i := range d.Routes {
+		if matchAny(d.Routes[i].Match, relPath) {
+			return &d.Routes[i]
+		}
+	}
+	return nil
+}
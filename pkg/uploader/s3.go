@@ -0,0 +1,309 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// S3Config configures the S3 backend. It works with AWS and other services
+// that speak the S3 API, such as MinIO, by setting the endpoint.
+type S3Config struct {
+	Bucket             string   `yaml:"bucket"`
+	Region             string   `yaml:"region"`
+	Endpoint           string   `yaml:"endpoint"`
+	PathStyle          bool     `yaml:"path_style"`
+	Prefix             string   `yaml:"prefix"`
+	StorageClass       string   `yaml:"storage_class"`
+	AccessKey          string   `yaml:"access_key"`
+	SecretKey          string   `yaml:"secret_key"`
+	SessionToken       string   `yaml:"session_token"`
+	PartSize           ByteSize `yaml:"part_size"`
+	MultipartThreshold ByteSize `yaml:"multipart_threshold"`
+}
+
+// s3MaxParts is the largest number of parts S3 accepts in a multipart upload.
+const s3MaxParts = 10000
+
+// s3Backend uploads files as objects with the plain S3 REST API, signed with
+// Signature Version 4. Large files use multipart uploads.
+type s3Backend struct {
+	conf     S3Config
+	creds    awsCredentials
+	endpoint *url.URL
+	client   *http.Client
+}
+
+func newS3Backend(conf S3Config) (*s3Backend, error) {
+	if conf.Bucket == "" {
+		return nil, errors.New("s3 backend needs a bucket")
+	}
+
+	if conf.Region == "" {
+		conf.Region = firstNonEmpty(os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), "us-east-1")
+	}
+	if conf.Endpoint == "" {
+		conf.Endpoint = "https://s3." + conf.Region + ".amazonaws.com"
+	}
+
+	endpoint, err := url.Parse(conf.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint: %s", conf.Endpoint)
+	}
+
+	creds := awsCredentials{
+		AccessKey:    firstNonEmpty(conf.AccessKey, os.Getenv("AWS_ACCESS_KEY_ID")),
+		SecretKey:    firstNonEmpty(conf.SecretKey, os.Getenv("AWS_SECRET_ACCESS_KEY")),
+		SessionToken: firstNonEmpty(conf.SessionToken, os.Getenv("AWS_SESSION_TOKEN")),
+	}
+	if creds.AccessKey == "" || creds.SecretKey == "" {
+		return nil, errors.New("s3 backend needs credentials: set access_key/secret_key or AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY")
+	}
+
+	return &s3Backend{
+		conf:     conf,
+		creds:    creds,
+		endpoint: endpoint,
+		client:   &http.Client{Transport: userAgentTransport{newTransport()}, Timeout: cfg.HTTPClient.RequestTimeout},
+	}, nil
+}
+
+func (b *s3Backend) upload(job *uploadJob) (*fileRecord, error) {
+	filePath := job.Path
+	file, info, err := openFile(job.context(), filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	prefix, err := renderTemplate(b.conf.Prefix, newFileTemplateData(job, info))
+	if err != nil {
+		return nil, fmt.Errorf("rendering s3 prefix: %w", err)
+	}
+	key := strings.TrimPrefix(prefix+job.uploadName(), "/")
+
+	checksum, err := job.checksum()
+	if err != nil {
+		return nil, fmt.Errorf("hashing file: %w", err)
+	}
+
+	header := b.objectHeader(job)
+	if b.conf.MultipartThreshold > 0 && info.Size() > int64(b.conf.MultipartThreshold) {
+		err = b.putMultipart(job, file, info.Size(), key, header)
+	} else {
+		// Signing the real checksum lets S3 reject corrupted uploads
+		err = b.putObject(job.context(), file, info.Size(), key, header, checksum)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rec := newFileRecord(filePath, info, checksum)
+	rec.RemoteURL = b.objectURL(key, nil).String()
+	return rec, nil
+}
+
+// stat looks up the object at remoteURL with a signed HEAD request.
+func (b *s3Backend) stat(ctx context.Context, remoteURL string) (int64, error) {
+	remote, err := url.Parse(remoteURL)
+	bucket := b.objectURL("", nil)
+	if err != nil || remote.Host != bucket.Host || !strings.HasPrefix(remote.Path, bucket.Path) {
+		return 0, ErrUnknownRemote
+	}
+
+	resp, err := b.do(ctx, http.MethodHead, strings.TrimPrefix(remote.Path, bucket.Path), nil, nil, 0, emptyPayload, nil)
+	if err != nil {
+		return 0, missingIfNotFound(err)
+	}
+	resp.Body.Close()
+	return resp.ContentLength, nil
+}
+
+// objectHeader returns the headers stored with the object: its content type,
+// storage class and the job fields as user metadata.
+func (b *s3Backend) objectHeader(job *uploadJob) http.Header {
+	header := http.Header{}
+
+	contentType := job.contentType()
+	header.Set("Content-Type", contentType)
+
+	if b.conf.StorageClass != "" {
+		header.Set("X-Amz-Storage-Class", b.conf.StorageClass)
+	}
+
+	for key, value := range job.Fields {
+		header.Set("X-Amz-Meta-"+key, fmt.Sprintf("%v", value))
+	}
+
+	return header
+}
+
+func (b *s3Backend) putObject(ctx context.Context, file *sourceFile, size int64, key string, header http.Header, checksum string) error {
+	resp, err := b.do(ctx, http.MethodPut, key, nil, io.NewSectionReader(file, 0, size), size, checksum, header)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (b *s3Backend) putMultipart(job *uploadJob, file *sourceFile, size int64, key string, header http.Header) error {
+	ctx := job.context()
+	resp, err := b.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, 0, emptyPayload, header)
+	if err != nil {
+		return fmt.Errorf("starting multipart upload: %w", err)
+	}
+
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("reading multipart upload id: %w", err)
+	}
+
+	uploadQuery := url.Values{"uploadId": {initiated.UploadID}}
+
+	partSize := int64(b.conf.PartSize)
+	if minimum := (size + s3MaxParts - 1) / s3MaxParts; partSize < minimum {
+		partSize = minimum
+	}
+
+	parts := make([]s3CompletedPart, (size+partSize-1)/partSize)
+	lengths := make([]int64, len(parts))
+	for i := range lengths {
+		lengths[i] = min(partSize, size-int64(i)*partSize)
+	}
+	err = sendChunks(job, lengths, func(i int) error {
+		number := i + 1
+		offset, length := int64(i)*partSize, lengths[i]
+
+		query := url.Values{"partNumber": {fmt.Sprint(number)}, "uploadId": {initiated.UploadID}}
+		resp, err := b.do(ctx, http.MethodPut, key, query, io.NewSectionReader(file, offset, length), length, unsignedPayload, nil)
+		if err != nil {
+			return fmt.Errorf("uploading part %d: %w", number, err)
+		}
+		resp.Body.Close()
+
+		parts[i] = s3CompletedPart{PartNumber: number, ETag: resp.Header.Get("ETag")}
+		return nil
+	})
+	if err != nil {
+		b.abortMultipart(ctx, key, uploadQuery)
+		return err
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+
+	resp, err = b.do(ctx, http.MethodPost, key, uploadQuery, bytes.NewReader(body), int64(len(body)), hashHex(body),
+		http.Header{"Content-Type": {"application/xml"}})
+	if err != nil {
+		b.abortMultipart(ctx, key, uploadQuery)
+		return fmt.Errorf("completing multipart upload: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Completion can fail after S3 already answered 200, the error is in the body
+	result, _ := io.ReadAll(resp.Body)
+	if bytes.Contains(result, []byte("<Error>")) {
+		b.abortMultipart(ctx, key, uploadQuery)
+		return fmt.Errorf("completing multipart upload: %s", parseS3Error(result))
+	}
+
+	return nil
+}
+
+// abortMultipart discards the parts sent so far. It also runs after the
+// upload was cancelled, so it only keeps the values of ctx and gives up after
+// a while.
+func (b *s3Backend) abortMultipart(ctx context.Context, key string, query url.Values) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+	defer cancel()
+	resp, err := b.do(ctx, http.MethodDelete, key, query, nil, 0, emptyPayload, nil)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+// do sends a signed request for the object key and returns the response if
+// S3 answered with a 2xx status.
+func (b *s3Backend) do(ctx context.Context, method, key string, query url.Values, body io.Reader, length int64, payloadHash string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, b.endpoint.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+	req.URL = b.objectURL(key, query)
+	req.Host = req.URL.Host
+	req.ContentLength = length
+
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	signV4(req, b.creds, b.conf.Region, "s3", payloadHash, time.Now())
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("%w: %s", newStatusError(resp), parseS3Error(data))
+	}
+
+	return resp, nil
+}
+
+func (b *s3Backend) objectURL(key string, query url.Values) *url.URL {
+	u := *b.endpoint
+	if b.conf.PathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + b.conf.Bucket + "/" + key
+	} else {
+		u.Host = b.conf.Bucket + "." + u.Host
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	}
+	u.RawPath = awsURIEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+	return &u
+}
+
+func parseS3Error(data []byte) string {
+	var s3Err struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if err := xml.Unmarshal(data, &s3Err); err != nil || s3Err.Code == "" {
+		return strings.TrimSpace(string(data))
+	}
+	return s3Err.Code + ": " + s3Err.Message
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,144 @@
+package uploader
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// scanIndexSettle is how long ago a directory must have changed before the
+// index trusts its mtime, as file systems with coarse timestamps could hide a
+// change made right after a scan.
+const scanIndexSettle = 2 * time.Second
+
+// pollIndex remembers the directories seen by the poll scans, by path. It is
+// kept in memory, so the first scan after a start reads everything.
+var pollIndex = make(map[string]*indexedDir)
+
+// indexedDir is a directory as the last poll scan found it. A directory's
+// mtime changes when entries are added to it, removed or renamed, but not
+// when a file in it or a subdirectory changes.
+type indexedDir struct {
+	modTime time.Time
+	subdirs []indexedSubdir
+	// settled is set when none of the directory's files were left to upload
+	settled bool
+}
+
+// indexedSubdir is a subdirectory, with the real path of the directory it
+// links to if it is a symbolic link that is followed.
+type indexedSubdir struct {
+	path   string
+	target string
+}
+
+// pollForNewFiles queues the new files in the watched directories for the
+// poll loop. With -scan-index, directories whose mtime did not change since
+// a scan that found nothing left to upload in them are not read again, only
+// their subdirectories are visited. The index cannot see files change in
+// place, so it is not used with -reupload-on-change.
+func pollForNewFiles(dirs []*watchDir) {
+	for _, dir := range dirs {
+		if !cfg.ScanIndex || cfg.ReuploadOnChange {
+			watchForNewFiles(dir)
+			continue
+		}
+
+		root, err := filepath.EvalSymlinks(dir.Path)
+		if err != nil {
+			logrus.Error("Error walking through the directory:", err)
+			continue
+		}
+		_, span := tracer.Start(uploadsCtx, "scan", trace.WithAttributes(attribute.String("file.dir", dir.Path), attribute.Bool("scan.indexed", true)))
+		seen := make(map[string]bool)
+		scanIndexed(dir, dir.Path, []string{root}, seen)
+		span.End()
+		for path := range pollIndex {
+			if !seen[path] && isInside(path, dir.Path) {
+				delete(pollIndex, path)
+			}
+		}
+	}
+	recordScan()
+}
+
+// scanIndexed queues the new files in path and below, reading only the
+// directories that changed or still have files to upload. chain are the real
+// paths of the directories on the way to path, as for walkLinked.
+func scanIndexed(dir *watchDir, path string, chain []string, seen map[string]bool) {
+	info, err := os.Stat(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logrus.Error("Error walking through the directory:", err)
+		}
+		return
+	}
+	seen[path] = true
+
+	if entry := pollIndex[path]; entry != nil && entry.settled && entry.modTime.Equal(info.ModTime()) {
+		for _, subdir := range entry.subdirs {
+			scanIndexed(dir, subdir.path, appendTarget(chain, subdir.target), seen)
+		}
+		return
+	}
+
+	// The mtime is taken before reading, so files added in between show up
+	// as a change on the next scan
+	entry := &indexedDir{modTime: info.ModTime(), settled: time.Since(info.ModTime()) >= scanIndexSettle}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		logrus.Error("Error walking through the directory:", err)
+		return
+	}
+	for _, e := range entries {
+		entryPath := filepath.Join(path, e.Name())
+		info, err := e.Info()
+		if err != nil {
+			// The file is already gone again
+			continue
+		}
+
+		target, linked := followLink(entryPath, info, chain)
+		if (linked || info.IsDir()) && dir.isBeyondDepth(entryPath) && dir.unitFor(entryPath) != entryPath {
+			continue
+		}
+		if linked || info.IsDir() && dir.unitFor(entryPath) != entryPath {
+			entry.subdirs = append(entry.subdirs, indexedSubdir{path: entryPath, target: target})
+			scanIndexed(dir, entryPath, appendTarget(chain, target), seen)
+			continue
+		}
+		queueNew(dir, entryPath, info)
+		if isLeftToUpload(dir, entryPath, info) {
+			entry.settled = false
+		}
+	}
+	pollIndex[path] = entry
+}
+
+// isLeftToUpload reports whether a file, or a subdirectory uploaded as an
+// archive, still needs to be looked at by later scans.
+func isLeftToUpload(dir *watchDir, path string, info os.FileInfo) bool {
+	if info.IsDir() {
+		return true
+	}
+	// Links to directories that are not followed, and skipped links
+	if stat, err := os.Stat(path); err != nil || stat.IsDir() || skipsLink(path) {
+		return false
+	}
+	if relPath, err := filepath.Rel(dir.Path, path); err == nil && (!dir.filter.allows(relPath) || isSkippedName(relPath)) {
+		return false
+	}
+	return !isLeftBacklog(path, info) && needsUpload(path)
+}
+
+// appendTarget adds the target of a followed link to chain.
+func appendTarget(chain []string, target string) []string {
+	if target == "" {
+		return chain
+	}
+	return append(chain, target)
+}
@@ -0,0 +1,242 @@
+package uploader
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// scpBackend copies files to a remote directory with scp, for servers that
+// offer SSH logins but no SFTP subsystem. It uses the sftp settings. Like
+// with SFTP, each file is written under a temporary name and moved into
+// place once complete, which needs a POSIX shell on the server. The
+// connection is kept open between uploads and re-established after a
+// failure.
+type scpBackend struct {
+	conf      SFTPConfig
+	sshConfig *ssh.ClientConfig
+
+	mu   sync.Mutex
+	conn *ssh.Client
+}
+
+func newSCPBackend(conf SFTPConfig) (*scpBackend, error) {
+	sshConfig, err := newSSHConfig(&conf, "scp")
+	if err != nil {
+		return nil, err
+	}
+	return &scpBackend{conf: conf, sshConfig: sshConfig}, nil
+}
+
+func (b *scpBackend) upload(job *uploadJob) (*fileRecord, error) {
+	filePath := job.Path
+	file, info, err := openFile(job.context(), filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	remoteDir, err := renderTemplate(b.conf.RemoteDir, newFileTemplateData(job, info))
+	if err != nil {
+		return nil, fmt.Errorf("rendering remote directory: %w", err)
+	}
+	name := job.uploadName()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	conn, err := b.connect()
+	if err != nil {
+		return nil, retryable(err)
+	}
+
+	checksum, err := b.put(conn, file, info.Size(), remoteDir, name)
+	var remoteErr *scpError
+	if errors.As(err, &remoteErr) {
+		// The server refused the file, the connection is fine
+		return nil, err
+	}
+	if err != nil {
+		// The connection may be broken, start with a fresh one next time
+		b.disconnect()
+		return nil, retryable(err)
+	}
+
+	rec := newFileRecord(filePath, info, checksum)
+	rec.RemoteURL = "scp://" + b.conf.Host + "/" + strings.TrimPrefix(path.Join(remoteDir, name), "/")
+	return rec, nil
+}
+
+// scpError is an error the remote scp reported, such as a permission
+// problem, as opposed to a failure of the connection.
+type scpError struct {
+	message string
+}
+
+func (e *scpError) Error() string {
+	return "scp: " + e.message
+}
+
+// put sends size bytes of content to remoteDir/name through a temporary file
+// and returns the SHA-256 of what was sent.
+func (b *scpBackend) put(conn *ssh.Client, content io.Reader, size int64, remoteDir, name string) (string, error) {
+	session, err := conn.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return "", err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+
+	target := path.Join(remoteDir, name)
+	temp := path.Join(remoteDir, "."+name+".part")
+	command := fmt.Sprintf("scp -t %s && mv -f %s %s", shellQuote(temp), shellQuote(temp), shellQuote(target))
+	if remoteDir != "" {
+		command = fmt.Sprintf("mkdir -p %s && %s", shellQuote(remoteDir), command)
+	}
+	if err := session.Start(command); err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	replies := bufio.NewReader(stdout)
+	err = scpAck(replies)
+	if err == nil {
+		_, err = fmt.Fprintf(stdin, "C0644 %d %s\n", size, name)
+	}
+	if err == nil {
+		err = scpAck(replies)
+	}
+	if err == nil {
+		_, err = io.CopyN(stdin, io.TeeReader(content, hash), size)
+	}
+	if err == nil {
+		_, err = stdin.Write([]byte{0})
+	}
+	if err == nil {
+		err = scpAck(replies)
+	}
+	stdin.Close()
+
+	waitErr := session.Wait()
+	if err == nil && waitErr != nil {
+		var exitErr *ssh.ExitError
+		if errors.As(waitErr, &exitErr) {
+			// scp went through but the file could not be moved into place
+			waitErr = &scpError{message: firstNonEmpty(strings.TrimSpace(stderr.String()), exitErr.Error())}
+		}
+		err = waitErr
+	}
+	if err == io.EOF && stderr.Len() > 0 {
+		// The command failed before scp started, e.g. mkdir
+		err = &scpError{message: strings.TrimSpace(stderr.String())}
+	}
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// scpAck reads the remote scp's answer to a step: a zero byte, or 1 or 2
+// followed by an error message.
+func scpAck(replies *bufio.Reader) error {
+	code, err := replies.ReadByte()
+	if err != nil {
+		return err
+	}
+	if code == 0 {
+		return nil
+	}
+	message, _ := replies.ReadString('\n')
+	return &scpError{message: strings.TrimSpace(message)}
+}
+
+// stat looks up the size of the file at remoteURL with a shell command, as
+// scp has no way to ask for it.
+func (b *scpBackend) stat(_ context.Context, remoteURL string) (int64, error) {
+	remotePath, ok := strings.CutPrefix(remoteURL, "scp://"+b.conf.Host+"/")
+	if !ok {
+		return 0, ErrUnknownRemote
+	}
+	if strings.HasPrefix(b.conf.RemoteDir, "/") {
+		remotePath = "/" + remotePath
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	conn, err := b.connect()
+	if err != nil {
+		return 0, err
+	}
+	session, err := conn.NewSession()
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+
+	quoted := shellQuote(remotePath)
+	out, err := session.Output(fmt.Sprintf("if [ -f %s ]; then wc -c < %s; else echo missing; fi", quoted, quoted))
+	if err != nil {
+		return 0, err
+	}
+	answer := strings.TrimSpace(string(out))
+	if answer == "missing" {
+		return 0, ErrRemoteMissing
+	}
+	size, err := strconv.ParseInt(answer, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected size %q", answer)
+	}
+	return size, nil
+}
+
+func (b *scpBackend) connect() (*ssh.Client, error) {
+	if b.conn != nil {
+		return b.conn, nil
+	}
+	conn, err := dialSSH("scp", b.conf.Host, b.sshConfig)
+	if err != nil {
+		return nil, err
+	}
+	b.conn = conn
+	return conn, nil
+}
+
+func (b *scpBackend) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.disconnect()
+}
+
+func (b *scpBackend) disconnect() {
+	if b.conn != nil {
+		b.conn.Close()
+		b.conn = nil
+	}
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,275 @@
+package uploader
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.starlark.net/lib/json"
+	starlarktime "go.starlark.net/lib/time"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
+)
+
+// ScriptConfig configures the routing script, a Starlark file that defines
+// route(file). It is called for every file about to be uploaded, with the
+// file's details, and returns None to upload it as configured or a dict
+// with any of:
+//
+//	skip      True leaves the file out until it changes or the next scan
+//	url       the server URL to upload it to
+//	fields    form fields or metadata added to the configured ones
+//	name      the name it is uploaded as
+//	rel_path  the path below the watched directory it is uploaded as,
+//	          for the remote paths of the backends
+type ScriptConfig struct {
+	File string `yaml:"file"`
+	// MaxSteps limits the work of one call, so a script stuck in a loop
+	// fails the upload instead of stalling the uploader
+	MaxSteps uint64 `yaml:"max_steps"`
+}
+
+// routeScript is the loaded routing script, nil without one.
+var routeScript *script
+
+type script struct {
+	file     string
+	route    starlark.Callable
+	maxSteps uint64
+}
+
+// loadScript runs the script file of conf, which defines route(file).
+func loadScript(conf ScriptConfig) (*script, error) {
+	if conf.File == "" {
+		return nil, nil
+	}
+	src, err := os.ReadFile(conf.File)
+	if err != nil {
+		return nil, fmt.Errorf("reading script: %w", err)
+	}
+
+	thread := newScriptThread(conf.File, conf.MaxSteps)
+	predeclared := starlark.StringDict{
+		"json":   json.Module,
+		"time":   starlarktime.Module,
+		"struct": starlark.NewBuiltin("struct", starlarkstruct.Make),
+	}
+	options := &syntax.FileOptions{Set: true, While: true, TopLevelControl: true, GlobalReassign: true}
+	globals, err := starlark.ExecFileOptions(options, thread, conf.File, src, predeclared)
+	if err != nil {
+		return nil, scriptError(err)
+	}
+	route, ok := globals["route"].(starlark.Callable)
+	if !ok {
+		return nil, fmt.Errorf("script %s does not define route(file)", conf.File)
+	}
+	return &script{file: conf.File, route: route, maxSteps: conf.MaxSteps}, nil
+}
+
+func newScriptThread(file string, maxSteps uint64) *starlark.Thread {
+	thread := &starlark.Thread{
+		Name: file,
+		Print: func(_ *starlark.Thread, msg string) {
+			logrus.Infof("Script %s: %s", file, msg)
+		},
+	}
+	if maxSteps > 0 {
+		thread.SetMaxExecutionSteps(maxSteps)
+	}
+	return thread
+}
+
+// scriptError adds the script's backtrace to errors raised in it.
+func scriptError(err error) error {
+	var evalErr *starlark.EvalError
+	if errors.As(err, &evalErr) {
+		return errors.New(evalErr.Backtrace())
+	}
+	return err
+}
+
+// apply calls the script's route for job and applies its decision. It
+// reports whether the file is to be uploaded.
+func (s *script) apply(job *uploadJob, info os.FileInfo) (bool, error) {
+	if s == nil {
+		return true, nil
+	}
+
+	fields, err := toStarlark(job.Fields)
+	if err != nil {
+		return false, err
+	}
+	file := starlarkstruct.FromStringDict(starlark.String("file"), starlark.StringDict{
+		"path":         starlark.String(job.Path),
+		"rel_path":     starlark.String(job.RelPath),
+		"dir":          starlark.String(job.Dir.Path),
+		"name":         starlark.String(job.uploadName()),
+		"ext":          starlark.String(strings.ToLower(filepath.Ext(job.Path))),
+		"size":         starlark.MakeInt64(info.Size()),
+		"mod_time":     starlarktime.Time(info.ModTime()),
+		"content_type": starlark.String(job.contentType()),
+		"url":          starlark.String(job.URL),
+		"fields":       fields,
+	})
+
+	result, err := starlark.Call(newScriptThread(s.file, s.maxSteps), s.route, starlark.Tuple{file}, nil)
+	if err != nil {
+		return false, fmt.Errorf("script: %w", scriptError(err))
+	}
+	if result == starlark.None {
+		return true, nil
+	}
+	decision, ok := result.(*starlark.Dict)
+	if !ok {
+		return false, fmt.Errorf("script: route returned %s, not a dict or None", result.Type())
+	}
+
+	for _, item := range decision.Items() {
+		key, ok := starlark.AsString(item[0])
+		if !ok {
+			return false, fmt.Errorf("script: route returned a dict with the key %s", item[0])
+		}
+		value := item[1]
+		switch key {
+		case "skip":
+			if value.Truth() {
+				logrus.Debugf("Skipping %s: the script ruled it out", job.Path)
+				return false, nil
+			}
+		case "url":
+			if job.URL, ok = starlark.AsString(value); !ok {
+				return false, fmt.Errorf("script: url is a %s, not a string", value.Type())
+			}
+		case "name":
+			name, ok := starlark.AsString(value)
+			if !ok || name == "" || strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+				return false, fmt.Errorf("script: invalid name %s", value)
+			}
+			job.FileName = name
+		case "rel_path":
+			relPath, ok := starlark.AsString(value)
+			relPath = path.Clean(strings.ReplaceAll(relPath, `\`, "/"))
+			if !ok || relPath == "." || path.IsAbs(relPath) || relPath == ".." || strings.HasPrefix(relPath, "../") {
+				return false, fmt.Errorf("script: invalid rel_path %s", value)
+			}
+			job.RelPath = relPath
+			if cfg.RelPathField != "" {
+				job.Fields[cfg.RelPathField] = relPath
+			}
+		case "fields":
+			added, ok := value.(starlark.IterableMapping)
+			if !ok {
+				return false, fmt.Errorf("script: fields is a %s, not a dict", value.Type())
+			}
+			for _, field := range added.Items() {
+				name, ok := starlark.AsString(field[0])
+				if !ok {
+					return false, fmt.Errorf("script: field name %s is not a string", field[0])
+				}
+				if job.Fields[name], err = fromStarlark(field[1]); err != nil {
+					return false, fmt.Errorf("script: field %s: %w", name, err)
+				}
+			}
+		default:
+			return false, fmt.Errorf("script: route returned the unknown key %q", key)
+		}
+	}
+	return true, nil
+}
+
+// toStarlark converts a field value read from the config to Starlark.
+func toStarlark(v interface{}) (starlark.Value, error) {
+	switch v := v.(type) {
+	case nil:
+		return starlark.None, nil
+	case string:
+		return starlark.String(v), nil
+	case bool:
+		return starlark.Bool(v), nil
+	case int:
+		return starlark.MakeInt(v), nil
+	case int64:
+		return starlark.MakeInt64(v), nil
+	case float64:
+		return starlark.Float(v), nil
+	case time.Time:
+		return starlarktime.Time(v), nil
+	case []interface{}:
+		list := make([]starlark.Value, len(v))
+		for i, item := range v {
+			value, err := toStarlark(item)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = value
+		}
+		return starlark.NewList(list), nil
+	case map[string]interface{}:
+		dict := starlark.NewDict(len(v))
+		for key, item := range v {
+			value, err := toStarlark(item)
+			if err != nil {
+				return nil, err
+			}
+			dict.SetKey(starlark.String(key), value)
+		}
+		return dict, nil
+	}
+	return starlark.String(fmt.Sprint(v)), nil
+}
+
+// fromStarlark converts a field value returned by the script.
+func fromStarlark(v starlark.Value) (interface{}, error) {
+	switch v := v.(type) {
+	case starlark.NoneType:
+		return nil, nil
+	case starlark.String:
+		return string(v), nil
+	case starlark.Bool:
+		return bool(v), nil
+	case starlark.Int:
+		n, ok := v.Int64()
+		if !ok {
+			return nil, fmt.Errorf("%s is too large", v)
+		}
+		return n, nil
+	case starlark.Float:
+		return float64(v), nil
+	case starlarktime.Time:
+		return time.Time(v), nil
+	case *starlark.List, starlark.Tuple:
+		var list []interface{}
+		iter := v.(starlark.Iterable).Iterate()
+		defer iter.Done()
+		var item starlark.Value
+		for iter.Next(&item) {
+			value, err := fromStarlark(item)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		return list, nil
+	case *starlark.Dict:
+		dict := make(map[string]interface{}, v.Len())
+		for _, item := range v.Items() {
+			key, ok := starlark.AsString(item[0])
+			if !ok {
+				return nil, fmt.Errorf("key %s is not a string", item[0])
+			}
+			value, err := fromStarlark(item[1])
+			if err != nil {
+				return nil, err
+			}
+			dict[key] = value
+		}
+		return dict, nil
+	}
+	return nil, fmt.Errorf("cannot send a %s", v.Type())
+}
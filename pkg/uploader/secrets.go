@@ -0,0 +1,130 @@
+package uploader
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// envReference matches ${NAME} in a setting, and $${NAME} for a literal
+// ${NAME}.
+var envReference = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// secretSetting matches the names of the settings that hold credentials or
+// headers, the only ones references are resolved in. Others, such as hook
+// commands, may use ${NAME} for variables of their own.
+var secretSetting = regexp.MustCompile(`^(headers|password|key_passphrase|token|session_token|sas_token|client_secret|secret_key|access_key|account_key|kms_encrypted_key|connection_string|proxy)$`)
+
+// secretSettingPaths are settings that hold credentials under a name that
+// says nothing about it.
+var secretSettingPaths = map[string]bool{
+	"state_redis.url": true,
+}
+
+// resolveSecrets replaces the references to secrets in the credential and
+// header settings of c, from the config file as well as the flags, so tokens
+// and passwords are neither written into the config file nor visible in the
+// process list: ${NAME} anywhere in a value is replaced with the environment
+// variable NAME, and a value of file://path with the contents of the file,
+// without the trailing newline, e.g. file:///run/secrets/upload-token. Both
+// work in headers, e.g. "Authorization: Bearer ${UPLOAD_TOKEN}". A reference
+// to a variable that is not set or a file that cannot be read is an error.
+func resolveSecrets(c *Config) error {
+	return resolveValue(reflect.ValueOf(c).Elem(), "", false)
+}
+
+// resolveValue resolves the references in the strings of v, a setting named
+// name, if it is a secret setting or part of one, and looks for secret
+// settings in it otherwise.
+func resolveValue(v reflect.Value, name string, secret bool) error {
+	switch v.Kind() {
+	case reflect.String:
+		if !secret {
+			return nil
+		}
+		value, err := resolveSecret(v.String())
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		// Defaults share their slices with every config, leave them alone
+		if value != v.String() {
+			v.SetString(value)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			key, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+			key = firstNonEmpty(key, field.Name)
+			fieldName := joinSettingName(name, key)
+			fieldSecret := secret || secretSetting.MatchString(key) || secretSettingPaths[fieldName]
+			if err := resolveValue(v.Field(i), fieldName, fieldSecret); err != nil {
+				return err
+			}
+		}
+	case reflect.Ptr:
+		if !v.IsNil() {
+			return resolveValue(v.Elem(), name, secret)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if err := resolveValue(v.Index(i), fmt.Sprintf("%s[%d]", name, i), secret); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		// Maps such as body are templates, only headers are resolved
+		if !secret || v.Type().Elem().Kind() != reflect.String {
+			return nil
+		}
+		iter := v.MapRange()
+		for iter.Next() {
+			value, err := resolveSecret(iter.Value().String())
+			if err != nil {
+				return fmt.Errorf("%s: %w", joinSettingName(name, iter.Key().String()), err)
+			}
+			v.SetMapIndex(iter.Key(), reflect.ValueOf(value).Convert(v.Type().Elem()))
+		}
+	}
+	return nil
+}
+
+// resolveSecret resolves the references in a single value.
+func resolveSecret(value string) (string, error) {
+	var err error
+	value = envReference.ReplaceAllStringFunc(value, func(ref string) string {
+		if strings.HasPrefix(ref, "$$") {
+			return ref[1:]
+		}
+		name := ref[2 : len(ref)-1]
+		env, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %s is not set", name)
+		}
+		return env
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if path, ok := strings.CutPrefix(value, "file://"); ok {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		value = strings.TrimRight(string(data), "\r\n")
+	}
+	return value, nil
+}
+
+func joinSettingName(parent, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "." + name
+}
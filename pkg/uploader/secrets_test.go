@@ -0,0 +1,101 @@
+package uploader
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveSecret(t *testing.T) {
+	t.Setenv("UPLOAD_TEST_TOKEN", "abc123")
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "token")
+	if err := os.WriteFile(secretFile, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{name: "plain", value: "Bearer abc", want: "Bearer abc"},
+		{name: "env", value: "Bearer ${UPLOAD_TEST_TOKEN}", want: "Bearer abc123"},
+		{name: "env twice", value: "${UPLOAD_TEST_TOKEN}:${UPLOAD_TEST_TOKEN}", want: "abc123:abc123"},
+		{name: "escaped", value: "$${UPLOAD_TEST_TOKEN}", want: "${UPLOAD_TEST_TOKEN}"},
+		{name: "dollar without braces", value: "$UPLOAD_TEST_TOKEN", want: "$UPLOAD_TEST_TOKEN"},
+		{name: "unset", value: "${UPLOAD_TEST_UNSET}", wantErr: true},
+		{name: "file", value: "file://" + secretFile, want: "from-file"},
+		{name: "file in env", value: "file://${UPLOAD_TEST_DIR}/token", want: "from-file"},
+		{name: "missing file", value: "file://" + filepath.Join(dir, "missing"), wantErr: true},
+		{name: "file not at the start", value: "see file://" + secretFile, want: "see file://" + secretFile},
+	}
+	t.Setenv("UPLOAD_TEST_DIR", dir)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveSecret(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveSecret(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("resolveSecret(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveSecretsOnlyTouchesSecretSettings(t *testing.T) {
+	t.Setenv("UPLOAD_TEST_TOKEN", "abc123")
+
+	c := DefaultConfig()
+	c.Headers = map[string]string{"Authorization": "Bearer ${UPLOAD_TEST_TOKEN}"}
+	c.SFTP.Password = "${UPLOAD_TEST_TOKEN}"
+	c.StateRedis.URL = "redis://:${UPLOAD_TEST_TOKEN}@localhost:6379/0"
+	c.Targets = []TargetConfig{{Name: "backup", Headers: map[string]string{"X-Token": "${UPLOAD_TEST_TOKEN}"}}}
+	// Hook and plugin commands get variables of their own, which are not set
+	// here
+	c.Hooks.PreUpload = `clamscan "${UPLOAD_HOOK_FILE}"`
+	c.Hooks.PostFailure = `logger "${AUTO_UPLOAD_FILE}: ${UPLOAD_TEST_TOKEN}"`
+	c.Auth.Command = `vault read -field=token "${VAULT_PATH}"`
+	c.Plugins = []PluginConfig{{Name: "p", Command: "${PLUGIN_BIN}", Env: []string{"TOKEN=${UPLOAD_TEST_TOKEN}"}}}
+	c.ServerURL = "https://server.com/{{.Filename}}?v=${UPLOAD_TEST_TOKEN}"
+
+	if err := resolveSecrets(&c); err != nil {
+		t.Fatal(err)
+	}
+
+	checks := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"headers", c.Headers["Authorization"], "Bearer abc123"},
+		{"sftp.password", c.SFTP.Password, "abc123"},
+		{"state_redis.url", c.StateRedis.URL, "redis://:abc123@localhost:6379/0"},
+		{"targets[0].headers", c.Targets[0].Headers["X-Token"], "abc123"},
+		{"hooks.pre_upload", c.Hooks.PreUpload, `clamscan "${UPLOAD_HOOK_FILE}"`},
+		{"hooks.post_failure", c.Hooks.PostFailure, `logger "${AUTO_UPLOAD_FILE}: ${UPLOAD_TEST_TOKEN}"`},
+		{"auth.command", c.Auth.Command, `vault read -field=token "${VAULT_PATH}"`},
+		{"plugins[0].command", c.Plugins[0].Command, "${PLUGIN_BIN}"},
+		{"plugins[0].env", c.Plugins[0].Env[0], "TOKEN=${UPLOAD_TEST_TOKEN}"},
+		{"server_url", c.ServerURL, "https://server.com/{{.Filename}}?v=${UPLOAD_TEST_TOKEN}"},
+	}
+	for _, check := range checks {
+		if check.got != check.want {
+			t.Errorf("%s = %q, want %q", check.name, check.got, check.want)
+		}
+	}
+}
+
+func TestResolveSecretsNamesTheSetting(t *testing.T) {
+	c := DefaultConfig()
+	c.FTP.Password = "${UPLOAD_TEST_UNSET}"
+	err := resolveSecrets(&c)
+	if err == nil {
+		t.Fatal("resolveSecrets succeeded with an unset variable")
+	}
+	if want := "ftp.password: environment variable UPLOAD_TEST_UNSET is not set"; err.Error() != want {
+		t.Errorf("error = %q, want %q", err, want)
+	}
+}
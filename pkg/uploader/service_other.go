@@ -0,0 +1,10 @@
+//go:build !windows
+
+package uploader
+
+import "errors"
+
+// runService implements "auto-upload service", which only exists on Windows.
+func runService(args []string) error {
+	return errors.New("services are only supported on Windows, use -daemon or a systemd unit instead")
+}
@@ -0,0 +1,253 @@
+package uploader
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const serviceName = "auto-upload"
+
+// runService implements "auto-upload service install|uninstall|run".
+func runService(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: auto-upload service install|uninstall|run [flags]")
+	}
+
+	switch args[0] {
+	case "install":
+		return installService(args[1:])
+	case "uninstall":
+		return uninstallService()
+	case "run":
+		return runAsService(args[1:])
+	}
+	return fmt.Errorf("unknown service command: %s", args[0])
+}
+
+// installService registers a service that starts with Windows and runs the
+// uploader with the given flags, and an event log source for it. The
+// service runs in the current directory, so relative paths in the flags and
+// the config file mean the same as when run by hand.
+func installService(args []string) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	workDir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if args, err = absConfigArgs(args); err != nil {
+		return err
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connecting to the service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s is already installed", serviceName)
+	}
+
+	s, err := m.CreateService(serviceName, executable, mgr.Config{
+		DisplayName: "Auto Upload",
+		Description: "Uploads new files in the watched directories to a server",
+		StartType:   mgr.StartAutomatic,
+	}, append([]string{"service", "run", "-workdir", workDir}, args...)...)
+	if err != nil {
+		return fmt.Errorf("creating service: %w", err)
+	}
+	defer s.Close()
+
+	if err := eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return fmt.Errorf("registering event log source: %w", err)
+	}
+
+	fmt.Printf("Installed service %s, start it with 'sc start %s'\n", serviceName, serviceName)
+	return nil
+}
+
+// uninstallService stops the service if it is running and removes it along
+// with its event log source.
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connecting to the service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", serviceName)
+	}
+	defer s.Close()
+
+	if status, err := s.Query(); err == nil && status.State != svc.Stopped {
+		if _, err := s.Control(svc.Stop); err != nil {
+			logrus.Warnf("Could not stop service %s: %v", serviceName, err)
+		}
+	}
+	if err := s.Delete(); err != nil {
+		return fmt.Errorf("removing service: %w", err)
+	}
+	if err := eventlog.Remove(serviceName); err != nil {
+		return fmt.Errorf("removing event log source: %w", err)
+	}
+
+	fmt.Printf("Uninstalled service %s\n", serviceName)
+	return nil
+}
+
+// runAsService runs the uploader under the service manager, which starts
+// it with "service run -workdir <dir>" followed by the flags given to
+// "service install".
+func runAsService(args []string) error {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		return err
+	}
+	if !isService {
+		return errors.New("'service run' is started by the service manager, install the service with 'auto-upload service install'")
+	}
+
+	if len(args) >= 2 && args[0] == "-workdir" {
+		if err := os.Chdir(args[1]); err != nil {
+			return err
+		}
+		args = args[2:]
+	}
+
+	// A reload reads the flags from os.Args again
+	os.Args = append([]string{os.Args[0]}, args...)
+	registerFlags(flag.CommandLine, &cfg)
+	registerCommandFlags(flag.CommandLine)
+	flag.Parse()
+	if err := resolveSecrets(&cfg); err != nil {
+		return err
+	}
+
+	elog, err := eventlog.Open(serviceName)
+	if err != nil {
+		return fmt.Errorf("opening event log: %w", err)
+	}
+	defer elog.Close()
+
+	console = io.Discard
+	logrus.AddHook(eventLogHook{elog})
+	return svc.Run(serviceName, &windowsService{elog: elog})
+}
+
+type windowsService struct {
+	elog *eventlog.Log
+}
+
+// Execute runs the uploader until the service manager asks it to stop,
+// which shuts it down the same way as SIGTERM does elsewhere.
+func (s *windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	// Let Execute return the exit code instead of ending the process, so
+	// the service manager sees the service stop rather than crash
+	exited := make(chan int, 1)
+	exit = func(code int) {
+		exited <- code
+		select {}
+	}
+	logrus.StandardLogger().ExitFunc = exit
+
+	go func() {
+		run()
+		exited <- 0
+	}()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	s.elog.Info(1, "Service started")
+
+	for {
+		select {
+		case code := <-exited:
+			s.elog.Info(1, "Service stopped")
+			return false, uint32(code)
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				waitHint := cfg.ShutdownTimeout + 5*time.Second
+				status <- svc.Status{State: svc.StopPending, WaitHint: uint32(waitHint / time.Millisecond)}
+				shutdownSignals <- syscall.SIGTERM
+			}
+		}
+	}
+}
+
+// eventLogHook copies warnings and errors to the Windows event log, where
+// the service has no console to show them.
+type eventLogHook struct {
+	elog *eventlog.Log
+}
+
+func (h eventLogHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel, logrus.WarnLevel}
+}
+
+func (h eventLogHook) Fire(entry *logrus.Entry) error {
+	message, err := entry.String()
+	if err != nil {
+		return err
+	}
+	if entry.Level == logrus.WarnLevel {
+		return h.elog.Warning(1, message)
+	}
+	return h.elog.Error(1, message)
+}
+
+// absConfigArgs returns args with the -config flag made absolute, as the
+// config file is read before the service changes to its directory.
+func absConfigArgs(args []string) ([]string, error) {
+	args = append([]string(nil), args...)
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			break
+		}
+
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || name != "config" {
+			continue
+		}
+		if !hasValue {
+			if i+1 >= len(args) {
+				break
+			}
+			i++
+			value = args[i]
+		}
+
+		abs, err := filepath.Abs(value)
+		if err != nil {
+			return nil, err
+		}
+		if hasValue {
+			args[i] = arg[:len(arg)-len(value)] + abs
+		} else {
+			args[i] = abs
+		}
+	}
+	return args, nil
+}
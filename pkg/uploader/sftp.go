@@ -0,0 +1,316 @@
+package uploader
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SFTPConfig configures the SFTP backend.
+type SFTPConfig struct {
+	Host                  string `yaml:"host"`
+	User                  string `yaml:"user"`
+	Password              string `yaml:"password"`
+	KeyFile               string `yaml:"key_file"`
+	KeyPassphrase         string `yaml:"key_passphrase"`
+	KnownHosts            string `yaml:"known_hosts"`
+	HostKey               string `yaml:"host_key"`
+	InsecureIgnoreHostKey bool   `yaml:"insecure_ignore_host_key"`
+	RemoteDir             string `yaml:"remote_dir"`
+}
+
+// sftpBackend copies files to a remote directory over SFTP. Each file is
+// written under a temporary name and renamed once complete, so readers on
+// the server never see partial files. The connection is kept open between
+// uploads and re-established after a failure.
+type sftpBackend struct {
+	conf      SFTPConfig
+	sshConfig *ssh.ClientConfig
+
+	mu     sync.Mutex
+	conn   *ssh.Client
+	client *sftp.Client
+}
+
+func newSFTPBackend(conf SFTPConfig) (*sftpBackend, error) {
+	sshConfig, err := newSSHConfig(&conf, "sftp")
+	if err != nil {
+		return nil, err
+	}
+	return &sftpBackend{conf: conf, sshConfig: sshConfig}, nil
+}
+
+// newSSHConfig sets up the SSH connection of the sftp and scp backends,
+// which share the sftp settings, and fills in the default port and the
+// password from SFTP_PASSWORD.
+func newSSHConfig(conf *SFTPConfig, backend string) (*ssh.ClientConfig, error) {
+	if conf.Host == "" {
+		return nil, fmt.Errorf("%s backend needs a host", backend)
+	}
+	if _, _, err := net.SplitHostPort(conf.Host); err != nil {
+		conf.Host = net.JoinHostPort(conf.Host, "22")
+	}
+	if conf.Password == "" {
+		conf.Password = os.Getenv("SFTP_PASSWORD")
+	}
+
+	auth, err := sshAuthMethods(conf.KeyFile, conf.KeyPassphrase, conf.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	hostKeyCallback, err := sshHostKeyCallback(conf.KnownHosts, conf.HostKey, conf.InsecureIgnoreHostKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ssh.ClientConfig{
+		User:            conf.User,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+	}, nil
+}
+
+func (b *sftpBackend) upload(job *uploadJob) (*fileRecord, error) {
+	filePath := job.Path
+	file, info, err := openFile(job.context(), filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	remoteDir, err := renderTemplate(b.conf.RemoteDir, newFileTemplateData(job, info))
+	if err != nil {
+		return nil, fmt.Errorf("rendering remote directory: %w", err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	client, err := b.connect()
+	if err != nil {
+		return nil, retryable(err)
+	}
+
+	checksum, err := b.put(client, file, remoteDir, job.uploadName())
+	if err != nil {
+		// The connection may be broken, start with a fresh one next time
+		b.disconnect()
+		return nil, retryable(err)
+	}
+
+	rec := newFileRecord(filePath, info, checksum)
+	rec.RemoteURL = "sftp://" + b.conf.Host + "/" + strings.TrimPrefix(path.Join(remoteDir, job.uploadName()), "/")
+	return rec, nil
+}
+
+// stat looks up the file at remoteURL. The URL does not tell whether its
+// path is absolute or relative to the login directory, the remote directory
+// setting does.
+func (b *sftpBackend) stat(_ context.Context, remoteURL string) (int64, error) {
+	remotePath, ok := strings.CutPrefix(remoteURL, "sftp://"+b.conf.Host+"/")
+	if !ok {
+		return 0, ErrUnknownRemote
+	}
+	if strings.HasPrefix(b.conf.RemoteDir, "/") {
+		remotePath = "/" + remotePath
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	client, err := b.connect()
+	if err != nil {
+		return 0, err
+	}
+	info, err := client.Stat(remotePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, ErrRemoteMissing
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// put writes content to remoteDir/name through a temporary file and returns
+// the SHA-256 of what was written.
+func (b *sftpBackend) put(client *sftp.Client, content io.Reader, remoteDir, name string) (string, error) {
+	if remoteDir != "" {
+		if err := client.MkdirAll(remoteDir); err != nil {
+			return "", fmt.Errorf("creating remote directory %s: %w", remoteDir, err)
+		}
+	}
+
+	target := path.Join(remoteDir, name)
+	temp := path.Join(remoteDir, "."+name+".part")
+
+	remote, err := client.Create(temp)
+	if err != nil {
+		return "", fmt.Errorf("creating %s: %w", temp, err)
+	}
+
+	hash := sha256.New()
+	_, err = remote.ReadFrom(io.TeeReader(content, hash))
+	if closeErr := remote.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		client.Remove(temp)
+		return "", fmt.Errorf("writing %s: %w", temp, err)
+	}
+
+	if err := b.rename(client, temp, target); err != nil {
+		client.Remove(temp)
+		return "", fmt.Errorf("renaming %s to %s: %w", temp, target, err)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// rename moves temp over target. Plain SFTP rename fails if the target
+// exists, so the OpenSSH posix-rename extension is used where available.
+func (b *sftpBackend) rename(client *sftp.Client, temp, target string) error {
+	if _, ok := client.HasExtension("posix-rename@openssh.com"); ok {
+		return client.PosixRename(temp, target)
+	}
+
+	if err := client.Remove(target); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return client.Rename(temp, target)
+}
+
+func (b *sftpBackend) connect() (*sftp.Client, error) {
+	if b.client != nil {
+		return b.client, nil
+	}
+
+	conn, err := dialSSH("sftp", b.conf.Host, b.sshConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("starting sftp session: %w", err)
+	}
+
+	b.conn, b.client = conn, client
+	return client, nil
+}
+
+// dialSSH opens an SSH connection to host.
+func dialSSH(scheme, host string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	netConn, err := dialThroughProxy(scheme, host, config.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %s: %w", host, err)
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(netConn, host, config)
+	if err != nil {
+		netConn.Close()
+		return nil, fmt.Errorf("connecting to %s: %w", host, err)
+	}
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+func (b *sftpBackend) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.disconnect()
+}
+
+func (b *sftpBackend) disconnect() {
+	if b.client != nil {
+		b.client.Close()
+		b.conn.Close()
+		b.client, b.conn = nil, nil
+	}
+}
+
+func sshAuthMethods(keyFile, passphrase, password string) ([]ssh.AuthMethod, error) {
+	var methods []ssh.AuthMethod
+
+	if keyFile != "" {
+		key, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading ssh key: %w", err)
+		}
+
+		var signer ssh.Signer
+		if passphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(passphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parsing ssh key %s: %w", keyFile, err)
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+
+	if password != "" {
+		methods = append(methods, ssh.Password(password))
+	}
+
+	if len(methods) == 0 {
+		return nil, errors.New("no ssh authentication configured: set a key file or password")
+	}
+
+	return methods, nil
+}
+
+// sshHostKeyCallback verifies the server against a pinned host key (in
+// authorized_keys format or as a SHA256: fingerprint) or a known_hosts file.
+func sshHostKeyCallback(knownHostsFile, hostKey string, insecure bool) (ssh.HostKeyCallback, error) {
+	if insecure {
+		logrus.Warn("SSH host key verification is disabled, the connection can be intercepted")
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	if strings.HasPrefix(hostKey, "SHA256:") {
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if fingerprint := ssh.FingerprintSHA256(key); fingerprint != hostKey {
+				return fmt.Errorf("host key mismatch for %s: got %s", hostname, fingerprint)
+			}
+			return nil
+		}, nil
+	}
+
+	if hostKey != "" {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(hostKey))
+		if err != nil {
+			return nil, fmt.Errorf("parsing host key: %w", err)
+		}
+		return ssh.FixedHostKey(key), nil
+	}
+
+	if knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+
+	callback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading known hosts: %w", err)
+	}
+	return callback, nil
+}
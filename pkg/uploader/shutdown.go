@@ -0,0 +1,121 @@
+package uploader
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// stopping is closed once a shutdown signal has been received
+	stopping = make(chan struct{})
+
+	shutdownMu   sync.Mutex
+	shuttingDown bool
+	inFlight     sync.WaitGroup
+
+	// shutdownSignals receives the signals that shut the uploader down; the
+	// Windows service sends its stop requests here as well
+	shutdownSignals = make(chan os.Signal, 2)
+
+	// finished receives the exit code of a one-shot run once it is done
+	finished = make(chan int, 1)
+
+	// exit ends the process once shut down
+	exit = os.Exit
+)
+
+// handleShutdown waits for SIGINT or SIGTERM, or for a one-shot run to
+// finish, stops new uploads from starting and gives the running ones up to
+// cfg.ShutdownTimeout to finish before they are aborted, the state database
+// is closed and the process exits. A second signal aborts right away;
+// interrupted tus, chunked and GCS uploads resume from their saved progress
+// on the next start.
+func handleShutdown() {
+	signal.Notify(shutdownSignals, os.Interrupt, syscall.SIGTERM)
+
+	code := 0
+	select {
+	case sig := <-shutdownSignals:
+		logrus.Infof("Received %s, finishing in-flight uploads", sig)
+	case code = <-finished:
+	}
+	sdNotify("STOPPING=1")
+
+	done := stopUploads()
+	aborted := false
+	select {
+	case <-done:
+	case <-time.After(cfg.ShutdownTimeout):
+		logrus.Warnf("Uploads still running after %s, aborting them", cfg.ShutdownTimeout)
+		aborted = true
+	case sig := <-shutdownSignals:
+		logrus.Warnf("Received %s again, aborting uploads", sig)
+		aborted = true
+	}
+	if aborted {
+		code = 1
+		for _, upload := range currentUploads() {
+			logrus.Warnf("Interrupted upload of %s at %.1f%%", upload.Path, upload.Percent)
+		}
+		abortRunning(done)
+	}
+
+	stopServices()
+	if err := state.Close(); err != nil {
+		logrus.Error("Error closing state database:", err)
+		code = 1
+	}
+	removePIDFile()
+	logrus.Info("Shut down")
+	exit(code)
+}
+
+// stopUploads stops new uploads from starting and returns a channel that is
+// closed once the running ones are done.
+func stopUploads() <-chan struct{} {
+	shutdownMu.Lock()
+	if !shuttingDown {
+		shuttingDown = true
+		close(stopping)
+	}
+	shutdownMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		inFlight.Wait()
+		close(done)
+	}()
+	return done
+}
+
+// beginUpload registers an upload as in flight. It returns false once a
+// shutdown has started, in which case the file must be left for the next run.
+func beginUpload() bool {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+
+	if shuttingDown {
+		return false
+	}
+	inFlight.Add(1)
+	return true
+}
+
+func endUpload() {
+	inFlight.Done()
+}
+
+// shutdownStarted reports whether a shutdown has started.
+func shutdownStarted() bool {
+	select {
+	case <-stopping:
+		return true
+	default:
+		return false
+	}
+}
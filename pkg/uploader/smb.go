@@ -0,0 +1,225 @@
+package uploader
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hirochachacha/go-smb2"
+)
+
+// SMBConfig configures the SMB backend.
+type SMBConfig struct {
+	// Host is the file server as host[:port]
+	Host string `yaml:"host"`
+	// Share is the name of the share, e.g. uploads for \\host\uploads
+	Share    string `yaml:"share"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	Domain   string `yaml:"domain"`
+	// RemoteDir is a directory template inside the share, with / as the
+	// separator
+	RemoteDir string `yaml:"remote_dir"`
+	// RequireSigning refuses servers that do not sign their messages
+	RequireSigning bool `yaml:"require_signing"`
+}
+
+// smbBackend copies files to a Windows file share or Samba over SMB2/3. Each
+// file is written under a temporary name and renamed once complete, so
+// readers of the share never see partial files. The session is kept open
+// between uploads and re-established after a failure.
+type smbBackend struct {
+	conf   SMBConfig
+	dialer *smb2.Dialer
+
+	mu      sync.Mutex
+	conn    net.Conn
+	session *smb2.Session
+	share   *smb2.Share
+}
+
+// smbLogoffTimeout bounds the goodbye to a server that may be gone.
+const smbLogoffTimeout = 5 * time.Second
+
+func newSMBBackend(conf SMBConfig) (*smbBackend, error) {
+	if conf.Host == "" || conf.Share == "" {
+		return nil, errors.New("smb backend needs a host and a share")
+	}
+	if _, _, err := net.SplitHostPort(conf.Host); err != nil {
+		conf.Host = net.JoinHostPort(conf.Host, "445")
+	}
+	if conf.Password == "" {
+		conf.Password = os.Getenv("SMB_PASSWORD")
+	}
+	conf.RemoteDir = strings.Trim(conf.RemoteDir, "/")
+
+	return &smbBackend{
+		conf: conf,
+		dialer: &smb2.Dialer{
+			Negotiator: smb2.Negotiator{RequireMessageSigning: conf.RequireSigning},
+			Initiator: &smb2.NTLMInitiator{
+				User:     conf.User,
+				Password: conf.Password,
+				Domain:   conf.Domain,
+			},
+		},
+	}, nil
+}
+
+func (b *smbBackend) upload(job *uploadJob) (*fileRecord, error) {
+	filePath := job.Path
+	file, info, err := openFile(job.context(), filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	remoteDir, err := renderTemplate(b.conf.RemoteDir, newFileTemplateData(job, info))
+	if err != nil {
+		return nil, fmt.Errorf("rendering remote directory: %w", err)
+	}
+	// Paths in a share are relative to its root
+	remoteDir = strings.Trim(remoteDir, "/")
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	share, err := b.connect()
+	if err != nil {
+		return nil, retryable(err)
+	}
+
+	checksum, err := b.put(share, file, remoteDir, job.uploadName())
+	if errors.Is(err, os.ErrPermission) {
+		// Trying again does not get past the share's permissions
+		return nil, err
+	}
+	if err != nil {
+		// The connection may be broken, start with a fresh one next time
+		b.disconnect()
+		return nil, retryable(err)
+	}
+
+	rec := newFileRecord(filePath, info, checksum)
+	rec.RemoteURL = "smb://" + b.conf.Host + "/" + b.conf.Share + "/" + path.Join(remoteDir, job.uploadName())
+	return rec, nil
+}
+
+// stat looks up the file at remoteURL.
+func (b *smbBackend) stat(_ context.Context, remoteURL string) (int64, error) {
+	remotePath, ok := strings.CutPrefix(remoteURL, "smb://"+b.conf.Host+"/"+b.conf.Share+"/")
+	if !ok {
+		return 0, ErrUnknownRemote
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	share, err := b.connect()
+	if err != nil {
+		return 0, err
+	}
+	info, err := share.Stat(remotePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, ErrRemoteMissing
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// put writes content to remoteDir/name through a temporary file and returns
+// the SHA-256 of what was written.
+func (b *smbBackend) put(share *smb2.Share, content io.Reader, remoteDir, name string) (string, error) {
+	if remoteDir != "" {
+		if err := share.MkdirAll(remoteDir, 0o755); err != nil {
+			return "", fmt.Errorf("creating remote directory %s: %w", remoteDir, err)
+		}
+	}
+
+	target := path.Join(remoteDir, name)
+	temp := path.Join(remoteDir, "."+name+".part")
+
+	remote, err := share.Create(temp)
+	if err != nil {
+		return "", fmt.Errorf("creating %s: %w", temp, err)
+	}
+
+	hash := sha256.New()
+	_, err = remote.ReadFrom(io.TeeReader(content, hash))
+	if closeErr := remote.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		share.Remove(temp)
+		return "", fmt.Errorf("writing %s: %w", temp, err)
+	}
+
+	// SMB renames do not replace an existing file
+	if err := share.Remove(target); err != nil && !errors.Is(err, os.ErrNotExist) {
+		share.Remove(temp)
+		return "", fmt.Errorf("replacing %s: %w", target, err)
+	}
+	if err := share.Rename(temp, target); err != nil {
+		share.Remove(temp)
+		return "", fmt.Errorf("renaming %s to %s: %w", temp, target, err)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (b *smbBackend) connect() (*smb2.Share, error) {
+	if b.share != nil {
+		return b.share, nil
+	}
+
+	conn, err := dialThroughProxy("smb", b.conf.Host, cfg.HTTPClient.ConnectTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %s: %w", b.conf.Host, err)
+	}
+	session, err := b.dialer.Dial(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("logging in to %s: %w", b.conf.Host, err)
+	}
+	// The server is named in full, as the connection may go through a proxy
+	host, _, _ := net.SplitHostPort(b.conf.Host)
+	share, err := session.Mount(`\\` + host + `\` + b.conf.Share)
+	if err != nil {
+		session.Logoff()
+		conn.Close()
+		return nil, fmt.Errorf("mounting share %s: %w", b.conf.Share, err)
+	}
+
+	b.conn, b.session, b.share = conn, session, share
+	return share, nil
+}
+
+func (b *smbBackend) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.disconnect()
+}
+
+func (b *smbBackend) disconnect() {
+	if b.share == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), smbLogoffTimeout)
+	defer cancel()
+	b.share.WithContext(ctx).Umount()
+	b.session.WithContext(ctx).Logoff()
+	// Logging off closes the connection only when the server answers
+	b.conn.Close()
+	b.conn, b.session, b.share = nil, nil, nil
+}
@@ -0,0 +1,514 @@
+package uploader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	filesBucket     = []byte("files")
+	checksumsBucket = []byte("checksums")
+	tusBucket       = []byte("tus")
+	chunksBucket    = []byte("chunks")
+	gcsBucket       = []byte("gcs")
+	historyBucket   = []byte("history")
+	failedBucket    = []byte("failed")
+)
+
+// fileRecord is what the state store remembers about an uploaded file. The
+// size, modification time and checksum identify the exact content that was
+// sent for the path.
+type fileRecord struct {
+	Path       string    `json:"path"`
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"mod_time"`
+	SHA256     string    `json:"sha256,omitempty"`
+	UploadedAt time.Time `json:"uploaded_at"`
+	RemoteURL  string    `json:"remote_url,omitempty"`
+
+	// DuplicateOf is set when the file was not uploaded because the same
+	// content had already been uploaded from this path.
+	DuplicateOf string `json:"duplicate_of,omitempty"`
+
+	// UploadedBy is set when the file was uploaded by the uploader of
+	// another host watching the same directory, see ClaimConfig.
+	UploadedBy string `json:"uploaded_by,omitempty"`
+
+	// Vetoed is set when the pre-upload hook rejected the file.
+	Vetoed bool `json:"vetoed,omitempty"`
+
+	// Ignored is set when an operator gave up on a failed file, so it is
+	// not uploaded again.
+	Ignored bool `json:"ignored,omitempty"`
+
+	// Compression is set when the file was sent compressed, with the size
+	// that was actually sent next to the original Size.
+	Compression    string `json:"compression,omitempty"`
+	CompressedSize int64  `json:"compressed_size,omitempty"`
+
+	// Encryption is set when the file was encrypted before it was sent,
+	// with the ID of the key and the hex nonce prefix of the encrypted copy.
+	Encryption string `json:"encryption,omitempty"`
+	KeyID      string `json:"key_id,omitempty"`
+	Nonce      string `json:"nonce,omitempty"`
+
+	// MissingSince is set when a prune found the file gone, see
+	// RetentionConfig.
+	MissingSince *time.Time `json:"missing_since,omitempty"`
+}
+
+// failedUpload is the state kept for a file whose upload failed for good,
+// until it is uploaded successfully.
+type failedUpload struct {
+	Path     string    `json:"path"`
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failed_at"`
+	// Rejected is set when the server rejected the file with a 4xx status
+	Rejected bool `json:"rejected,omitempty"`
+	// MovedTo is where the file went in the dead-letter or quarantine
+	// directory
+	MovedTo string `json:"moved_to,omitempty"`
+}
+
+// stateStore keeps track of uploaded files, in an embedded bbolt database
+// or on a Redis server shared by several uploaders.
+type stateStore struct {
+	db stateDB
+}
+
+// stateDB stores the records of the state in buckets, by key.
+type stateDB interface {
+	// view runs fn in a read-only transaction
+	view(fn func(tx stateTx) error) error
+	// update runs fn in a transaction whose writes are committed together
+	// if fn succeeds
+	update(fn func(tx stateTx) error) error
+	Close() error
+}
+
+// stateTx reads and writes the records of a transaction.
+type stateTx interface {
+	// get returns the record under key, nil if there is none
+	get(bucket, key []byte) []byte
+	put(bucket, key, value []byte) error
+	delete(bucket, key []byte) error
+	// forEach calls fn for every record of bucket in the order of their
+	// keys, or backward, until fn returns an error
+	forEach(bucket []byte, backward bool, fn func(key, value []byte) error) error
+	// clear removes every record of bucket
+	clear(bucket []byte) error
+}
+
+// errStopIteration stops a forEach without failing it.
+var errStopIteration = errors.New("stop iteration")
+
+// stateBuckets are the buckets of the state database.
+var stateBuckets = [][]byte{filesBucket, checksumsBucket, tusBucket, chunksBucket, gcsBucket, driveBucket, historyBucket, failedBucket, targetsBucket, inodesBucket}
+
+// openState opens the state store of cfg.
+func openState() (*stateStore, error) {
+	switch cfg.StateBackend {
+	case "", stateBolt:
+		return openStateStore(cfg.StateDB)
+	case stateRedis:
+		return openRedisState(cfg.StateRedis)
+	}
+	return nil, fmt.Errorf("unknown state backend: %s", cfg.StateBackend)
+}
+
+// stateName describes where the state of cfg is kept, for messages.
+func stateName() string {
+	if cfg.StateBackend == stateRedis {
+		return redactURL(cfg.StateRedis.URL)
+	}
+	return cfg.StateDB
+}
+
+// openStateStore opens the state database at path, creating it if needed.
+// bbolt commits every update atomically, so a crash loses at most the update
+// in progress; a database damaged anyway, e.g. by a failing disk, is set
+// aside and rebuilt from what can still be read of it.
+func openStateStore(path string) (*stateStore, error) {
+	db, err := openStateDB(path)
+	if errors.Is(err, errStateDamaged) {
+		logrus.Errorf("State database %s is damaged: %v", path, err)
+		db, err = recoverStateDB(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range stateBuckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("initializing state database: %w", err)
+	}
+
+	return &stateStore{db: boltState{db}}, nil
+}
+
+func (s *stateStore) Close() error {
+	return s.db.Close()
+}
+
+// get returns the record stored for path, or nil if the path has never been
+// uploaded.
+func (s *stateStore) get(path string) (*fileRecord, error) {
+	rec := &fileRecord{}
+	found, err := s.getJSON(filesBucket, path, rec)
+	if !found {
+		return nil, err
+	}
+	return rec, err
+}
+
+func (s *stateStore) put(rec *fileRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	return s.db.update(func(tx stateTx) error {
+		if err := tx.put(filesBucket, []byte(rec.Path), data); err != nil {
+			return err
+		}
+		// The checksum keeps pointing to the file that was actually uploaded
+		if rec.SHA256 != "" && rec.DuplicateOf == "" {
+			return tx.put(checksumsBucket, []byte(rec.SHA256), []byte(rec.Path))
+		}
+		return nil
+	})
+}
+
+// forget drops the record of an uploaded file, so it counts as new again.
+// The checksum is dropped too if it points to the file, so other files with
+// the same content are not taken for duplicates of it.
+func (s *stateStore) forget(rec *fileRecord) error {
+	return s.db.update(func(tx stateTx) error {
+		if err := tx.delete(filesBucket, []byte(rec.Path)); err != nil {
+			return err
+		}
+		if rec.SHA256 != "" && string(tx.get(checksumsBucket, []byte(rec.SHA256))) == rec.Path {
+			return tx.delete(checksumsBucket, []byte(rec.SHA256))
+		}
+		return nil
+	})
+}
+
+// addHistory appends an upload to the history, which unlike the files
+// bucket keeps every upload of a path, also after the file was moved away.
+func (s *stateStore) addHistory(rec *fileRecord) error {
+	key := rec.UploadedAt.UTC().Format("20060102T150405.000000000Z") + " " + rec.Path
+	return s.putJSON(historyBucket, key, rec)
+}
+
+// history calls fn for every recorded upload, oldest first.
+func (s *stateStore) history(fn func(rec *fileRecord) error) error {
+	return s.db.view(func(tx stateTx) error {
+		return tx.forEach(historyBucket, false, func(_, data []byte) error {
+			rec := &fileRecord{}
+			if err := json.Unmarshal(data, rec); err != nil {
+				return err
+			}
+			return fn(rec)
+		})
+	})
+}
+
+// failedUploads returns the files whose upload failed for good, most recent
+// failure first.
+func (s *stateStore) failedUploads() ([]*failedUpload, error) {
+	failed := []*failedUpload{}
+	err := s.db.view(func(tx stateTx) error {
+		return tx.forEach(failedBucket, false, func(_, data []byte) error {
+			upload := &failedUpload{}
+			if err := json.Unmarshal(data, upload); err != nil {
+				return err
+			}
+			failed = append(failed, upload)
+			return nil
+		})
+	})
+	sort.Slice(failed, func(i, j int) bool {
+		return failed[i].FailedAt.After(failed[j].FailedAt)
+	})
+	return failed, err
+}
+
+// files calls fn for the record of every file that is currently known as
+// uploaded.
+func (s *stateStore) files(fn func(rec *fileRecord) error) error {
+	return s.db.view(func(tx stateTx) error {
+		return tx.forEach(filesBucket, false, func(_, data []byte) error {
+			rec := &fileRecord{}
+			if err := json.Unmarshal(data, rec); err != nil {
+				return err
+			}
+			return fn(rec)
+		})
+	})
+}
+
+// recentHistory returns up to limit of the most recent uploads, newest
+// first.
+func (s *stateStore) recentHistory(limit int) ([]*fileRecord, error) {
+	records := []*fileRecord{}
+	err := s.db.view(func(tx stateTx) error {
+		return tx.forEach(historyBucket, true, func(_, data []byte) error {
+			if len(records) >= limit {
+				return errStopIteration
+			}
+			rec := &fileRecord{}
+			if err := json.Unmarshal(data, rec); err != nil {
+				return err
+			}
+			records = append(records, rec)
+			return nil
+		})
+	})
+	return records, err
+}
+
+// pathForChecksum returns the path that content with the given SHA-256 was
+// uploaded from, or "" if it is unknown.
+func (s *stateStore) pathForChecksum(checksum string) (string, error) {
+	var path string
+	err := s.db.view(func(tx stateTx) error {
+		path = string(tx.get(checksumsBucket, []byte(checksum)))
+		return nil
+	})
+	return path, err
+}
+
+func (s *stateStore) getJSON(bucket []byte, key string, v interface{}) (bool, error) {
+	var data []byte
+	err := s.db.view(func(tx stateTx) error {
+		if stored := tx.get(bucket, []byte(key)); stored != nil {
+			data = append(data, stored...)
+		}
+		return nil
+	})
+	if err != nil || data == nil {
+		return false, err
+	}
+	return true, json.Unmarshal(data, v)
+}
+
+func (s *stateStore) putJSON(bucket []byte, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return s.db.update(func(tx stateTx) error {
+		return tx.put(bucket, []byte(key), data)
+	})
+}
+
+func (s *stateStore) delete(bucket []byte, key string) error {
+	return s.db.update(func(tx stateTx) error {
+		return tx.delete(bucket, []byte(key))
+	})
+}
+
+// boltState is the state in a bbolt database.
+type boltState struct {
+	db *bolt.DB
+}
+
+func (b boltState) view(fn func(tx stateTx) error) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (b boltState) update(fn func(tx stateTx) error) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (b boltState) Close() error {
+	return b.db.Close()
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (t boltTx) get(bucket, key []byte) []byte {
+	return t.tx.Bucket(bucket).Get(key)
+}
+
+func (t boltTx) put(bucket, key, value []byte) error {
+	return t.tx.Bucket(bucket).Put(key, value)
+}
+
+func (t boltTx) delete(bucket, key []byte) error {
+	return t.tx.Bucket(bucket).Delete(key)
+}
+
+func (t boltTx) forEach(bucket []byte, backward bool, fn func(key, value []byte) error) error {
+	cursor := t.tx.Bucket(bucket).Cursor()
+	first, next := cursor.First, cursor.Next
+	if backward {
+		first, next = cursor.Last, cursor.Prev
+	}
+	for key, value := first(); key != nil; key, value = next() {
+		if err := fn(key, value); err != nil {
+			if err == errStopIteration {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (t boltTx) clear(bucket []byte) error {
+	if err := t.tx.DeleteBucket(bucket); err != nil {
+		return err
+	}
+	_, err := t.tx.CreateBucket(bucket)
+	return err
+}
+
+// newFileRecord builds a record for a file that has just been uploaded.
+func newFileRecord(path string, info os.FileInfo, checksum string) *fileRecord {
+	return &fileRecord{
+		Path:       path,
+		Size:       info.Size(),
+		ModTime:    info.ModTime(),
+		SHA256:     checksum,
+		UploadedAt: time.Now(),
+	}
+}
+
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// writeFileAtomic replaces the file at path with data, through a temporary
+// file renamed over it, so a crash leaves either the old or the new content.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	temp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	_, err = temp.Write(data)
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(temp.Name(), perm)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
+
+// importLogFile migrates the "<timestamp> - <path>" entries written to the
+// log file by older versions into the state store. Files that still exist
+// get their size, modification time and checksum recorded as they are now.
+// The records of a history file are imported as they are.
+func importLogFile(store *stateStore, logFilePath string) (int, error) {
+	logEntries, err := readLogFile(logFilePath)
+	if err != nil {
+		return 0, err
+	}
+
+	imported := 0
+	for _, entry := range logEntries {
+		var path, timestamp string
+		if strings.HasPrefix(entry, "{") {
+			var line struct {
+				fileRecord
+				Msg  string `json:"msg"`
+				Time string `json:"time"`
+			}
+			if err := json.Unmarshal([]byte(entry), &line); err != nil || line.Path == "" {
+				continue
+			}
+			if line.Msg == "" {
+				// A record of the history file
+				rec := &line.fileRecord
+				if err := store.put(rec); err != nil {
+					return imported, err
+				}
+				if err := store.addHistory(rec); err != nil {
+					return imported, err
+				}
+				imported++
+				continue
+			}
+			if line.Msg != "File recorded as uploaded" {
+				continue
+			}
+			// The record of an upload in a JSON log file
+			path, timestamp = line.Path, line.Time
+		} else {
+			var found bool
+			if timestamp, path, found = strings.Cut(entry, " - "); !found {
+				continue
+			}
+		}
+
+		uploadedAt, err := time.Parse(time.RFC3339, timestamp)
+		if err != nil {
+			// logrus lines share the file, skip anything that is not an upload entry
+			continue
+		}
+
+		rec := &fileRecord{Path: path, UploadedAt: uploadedAt}
+		if info, err := os.Stat(path); err == nil {
+			rec.Size = info.Size()
+			rec.ModTime = info.ModTime()
+			if rec.SHA256, err = hashFile(path); err != nil {
+				logrus.Warnf("Could not checksum %s: %v", path, err)
+			}
+		}
+
+		if err := store.put(rec); err != nil {
+			return imported, err
+		}
+		imported++
+	}
+
+	return imported, nil
+}
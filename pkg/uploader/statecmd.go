@@ -0,0 +1,335 @@
+package uploader
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// stateExportVersion is the version of the format written by "state
+// export". It goes up when a change would make older versions misread it.
+const stateExportVersion = 1
+
+// stateExport is the start of the document written by "state export". The
+// records follow under "buckets", by bucket and key:
+//
+//	{"version": 1, "exported_at": "...", "hostname": "...", "buckets": {
+//	  "files": {"/data/a.jpg": {"path": "/data/a.jpg", ...}, ...},
+//	  "checksums": {"<sha256>": "/data/a.jpg", ...},
+//	  ...
+//	}}
+type stateExport struct {
+	Version    int       `json:"version"`
+	ExportedAt time.Time `json:"exported_at"`
+	Hostname   string    `json:"hostname,omitempty"`
+}
+
+// exportedBuckets are the buckets "state export" writes. The inodes of hard
+// links only mean something on the file system they were read from.
+var exportedBuckets = [][]byte{filesBucket, checksumsBucket, historyBucket, failedBucket, targetsBucket, tusBucket, chunksBucket, gcsBucket, driveBucket}
+
+// isPlainBucket tells the buckets whose values are plain strings rather than
+// JSON.
+func isPlainBucket(name string) bool {
+	return name == string(checksumsBucket)
+}
+
+// runState implements "auto-upload state export|import|prune".
+func runState(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: auto-upload state export|import|prune [flags]")
+	}
+
+	switch args[0] {
+	case "export":
+		return runStateExport(args[1:])
+	case "import":
+		return runStateImport(args[1:])
+	case "prune":
+		return runStatePrune(args[1:])
+	}
+	return fmt.Errorf("unknown state command: %s", args[0])
+}
+
+// runStateExport writes the state database as JSON, to move it to another
+// machine or keep a backup that does not depend on the bbolt format.
+func runStateExport(args []string) error {
+	fs := flag.NewFlagSet("state export", flag.ExitOnError)
+	fs.StringVar(&configFile, "config", "", "YAML file to load settings from")
+	registerStateFlags(fs, &cfg)
+	output := fs.String("output", "", "File to write to instead of stdout")
+	fs.Parse(args)
+	if err := resolveSecrets(&cfg); err != nil {
+		return err
+	}
+
+	store, err := openState()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	w := bufio.NewWriter(out)
+
+	hostname, _ := os.Hostname()
+	exported := 0
+	err = store.db.view(func(tx stateTx) error {
+		header, err := json.Marshal(stateExport{Version: stateExportVersion, ExportedAt: time.Now().UTC(), Hostname: hostname})
+		if err != nil {
+			return err
+		}
+		// The records are streamed, the state of a large tree does not
+		// have to fit into memory
+		fmt.Fprintf(w, "%s,\n\"buckets\":{", header[:len(header)-1])
+		for i, name := range exportedBuckets {
+			if i > 0 {
+				w.WriteString(",")
+			}
+			fmt.Fprintf(w, "\n%q:{", name)
+			n := 0
+			err := tx.forEach(name, false, func(key, value []byte) error {
+				if n > 0 {
+					w.WriteString(",")
+				}
+				n++
+				keyJSON, err := json.Marshal(string(key))
+				if err != nil {
+					return err
+				}
+				if isPlainBucket(string(name)) {
+					if value, err = json.Marshal(string(value)); err != nil {
+						return err
+					}
+				} else if !json.Valid(value) {
+					return fmt.Errorf("record %s in %s is not JSON", key, name)
+				}
+				fmt.Fprintf(w, "\n%s:%s", keyJSON, value)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			exported += n
+			w.WriteString("}")
+		}
+		w.WriteString("}}\n")
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	logrus.Infof("Exported %d records from %s", exported, stateName())
+	return nil
+}
+
+// runStateImport reads a document written by "state export" into the state
+// database. The records are added to those there, replacing records of the
+// same key, or with -replace take the place of all of them.
+func runStateImport(args []string) error {
+	fs := flag.NewFlagSet("state import", flag.ExitOnError)
+	fs.StringVar(&configFile, "config", "", "YAML file to load settings from")
+	registerStateFlags(fs, &cfg)
+	replace := fs.Bool("replace", false, "Remove every record from the state database before the import")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: auto-upload state import [flags] <file>  (- reads stdin)")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err := resolveSecrets(&cfg); err != nil {
+		return err
+	}
+
+	var in io.Reader = os.Stdin
+	if fs.Arg(0) != "-" {
+		file, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+
+	store, err := openState()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if *replace {
+		err := store.db.update(func(tx stateTx) error {
+			for _, name := range stateBuckets {
+				if err := tx.clear(name); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	imported, err := importState(store, json.NewDecoder(bufio.NewReader(in)))
+	if err != nil {
+		return fmt.Errorf("importing %s after %d records: %w", fs.Arg(0), imported, err)
+	}
+	logrus.Infof("Imported %d records into %s", imported, stateName())
+	return nil
+}
+
+// importState reads the records of an export from dec into store, in
+// batches of a transaction each.
+func importState(store *stateStore, dec *json.Decoder) (int, error) {
+	if err := expectDelim(dec, '{'); err != nil {
+		return 0, err
+	}
+
+	version, imported := 0, 0
+	for dec.More() {
+		field, err := dec.Token()
+		if err != nil {
+			return imported, err
+		}
+		switch field {
+		case "version":
+			if err := dec.Decode(&version); err != nil {
+				return imported, err
+			}
+			if version < 1 || version > stateExportVersion {
+				return imported, fmt.Errorf("export format version %d is not supported, upgrade auto-upload", version)
+			}
+		case "buckets":
+			if version == 0 {
+				return imported, errors.New("not an export of auto-upload state")
+			}
+			n, err := importBuckets(store, dec)
+			imported += n
+			if err != nil {
+				return imported, err
+			}
+		default:
+			var skipped json.RawMessage
+			if err := dec.Decode(&skipped); err != nil {
+				return imported, err
+			}
+		}
+	}
+	if version == 0 {
+		return imported, errors.New("not an export of auto-upload state")
+	}
+	return imported, expectDelim(dec, '}')
+}
+
+func importBuckets(store *stateStore, dec *json.Decoder) (int, error) {
+	if err := expectDelim(dec, '{'); err != nil {
+		return 0, err
+	}
+
+	imported := 0
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return imported, err
+		}
+		name := token.(string)
+		if !isStateBucket(name) {
+			return imported, fmt.Errorf("unknown bucket %q", name)
+		}
+		if err := expectDelim(dec, '{'); err != nil {
+			return imported, err
+		}
+
+		var batch [][2][]byte
+		flush := func() error {
+			err := store.db.update(func(tx stateTx) error {
+				for _, record := range batch {
+					if err := tx.put([]byte(name), record[0], record[1]); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err == nil {
+				imported += len(batch)
+			}
+			batch = batch[:0]
+			return err
+		}
+		for dec.More() {
+			token, err := dec.Token()
+			if err != nil {
+				return imported, err
+			}
+			key := token.(string)
+			var value json.RawMessage
+			if err := dec.Decode(&value); err != nil {
+				return imported, err
+			}
+			data := []byte(value)
+			if isPlainBucket(name) {
+				var plain string
+				if err := json.Unmarshal(value, &plain); err != nil {
+					return imported, fmt.Errorf("record %s in %s: %w", key, name, err)
+				}
+				data = []byte(plain)
+			}
+			batch = append(batch, [2][]byte{[]byte(key), data})
+			if len(batch) == 1000 {
+				if err := flush(); err != nil {
+					return imported, err
+				}
+			}
+		}
+		if err := flush(); err != nil {
+			return imported, err
+		}
+		if err := expectDelim(dec, '}'); err != nil {
+			return imported, err
+		}
+	}
+	return imported, expectDelim(dec, '}')
+}
+
+func isStateBucket(name string) bool {
+	for _, bucket := range stateBuckets {
+		if string(bucket) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// expectDelim reads the next token of dec, which has to be delim.
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("expected %s, found %v", delim, token)
+	}
+	return nil
+}
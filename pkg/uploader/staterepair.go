@@ -0,0 +1,206 @@
+package uploader
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// errStateDamaged is returned by openStateDB for a state database that
+// fails its integrity check.
+var errStateDamaged = errors.New("state database damaged")
+
+// openStateDB opens the bbolt database at path and checks its integrity:
+// the meta pages and the freelist, and that every record can be read.
+func openStateDB(path string) (db *bolt.DB, err error) {
+	// A damaged page can make bbolt panic or read past the mapped file
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if r := recover(); r != nil {
+			if db != nil {
+				db.Close()
+			}
+			db, err = nil, fmt.Errorf("%w: %v", errStateDamaged, r)
+		}
+	}()
+
+	db, err = bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if errors.Is(err, bolt.ErrInvalid) || errors.Is(err, bolt.ErrChecksum) || errors.Is(err, bolt.ErrVersionMismatch) {
+		return nil, fmt.Errorf("%w: %v", errStateDamaged, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opening state database %s: %w", path, err)
+	}
+
+	// Not tx.Check: it panics on some damaged pages in a goroutine of its
+	// own, where the panic cannot be recovered
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+			return bucket.ForEach(func(key, value []byte) error {
+				if len(key) == 0 {
+					return fmt.Errorf("empty key in %s", name)
+				}
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%w: %v", errStateDamaged, err)
+	}
+	return db, nil
+}
+
+// recoverStateDB moves the damaged database at path aside and creates a
+// new one from the records that can still be read from it, and from the
+// history file if there is one.
+func recoverStateDB(path string) (*bolt.DB, error) {
+	damaged := fmt.Sprintf("%s.damaged-%s", path, time.Now().Format("20060102-150405"))
+	if err := os.Rename(path, damaged); err != nil {
+		return nil, fmt.Errorf("setting aside the damaged state database: %w", err)
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening state database %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range stateBuckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("initializing state database: %w", err)
+	}
+
+	salvaged, err := salvageState(damaged, db)
+	if err != nil {
+		logrus.Errorf("Error reading the damaged state database: %v", err)
+	}
+	imported := 0
+	if cfg.HistoryFile != "" {
+		// Recent uploads may be missing from what was salvaged
+		if imported, err = importLogFile(&stateStore{db: boltState{db}}, cfg.HistoryFile); err != nil && !os.IsNotExist(err) {
+			logrus.Errorf("Error importing the history file: %v", err)
+		}
+	}
+	logrus.Warnf("Rebuilt the state database with %d records read from the damaged one and %d uploads from the history file; the damaged one was kept as %s", salvaged, imported, damaged)
+	return db, nil
+}
+
+// salvageState copies the records that can be read from the damaged
+// database at path to db, bucket by bucket, up to the first damaged page of
+// each.
+func salvageState(path string, db *bolt.DB) (int, error) {
+	damaged, err := openDamaged(path)
+	if err != nil {
+		return 0, err
+	}
+	defer damaged.Close()
+
+	salvaged := 0
+	var incomplete []string
+	var readErr error
+	for _, name := range stateBuckets {
+		records, err := readBucket(damaged, name)
+		if err != nil {
+			incomplete = append(incomplete, string(name))
+			readErr = err
+		}
+		err = db.Update(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket(name)
+			for _, record := range records {
+				if err := bucket.Put(record[0], record[1]); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return salvaged, err
+		}
+		salvaged += len(records)
+	}
+	if len(incomplete) > 0 {
+		logrus.Warnf("Could not read all of %s from the damaged state database: %v", strings.Join(incomplete, ", "), readErr)
+	}
+	return salvaged, nil
+}
+
+func openDamaged(path string) (db *bolt.DB, err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if r := recover(); r != nil {
+			db, err = nil, fmt.Errorf("%v", r)
+		}
+	}()
+	return bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second, ReadOnly: true})
+}
+
+// readBucket returns the keys and values of a bucket of a damaged database
+// that can still be read: from the first key up to a damaged page, and from
+// the last key back down to it.
+func readBucket(db *bolt.DB, name []byte) ([][2][]byte, error) {
+	records, err := readRecords(db, name, false, nil)
+	if err == nil {
+		return records, nil
+	}
+	var after []byte
+	if len(records) > 0 {
+		after = records[len(records)-1][0]
+	}
+	tail, _ := readRecords(db, name, true, after)
+	for i := len(tail) - 1; i >= 0; i-- {
+		records = append(records, tail[i])
+	}
+	return records, err
+}
+
+// readRecords reads the records of a bucket in key order, or backwards down
+// to the key after, until it hits a damaged page.
+func readRecords(db *bolt.DB, name []byte, backwards bool, after []byte) (records [][2][]byte, err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(name)
+		if bucket == nil {
+			return nil
+		}
+		cursor := bucket.Cursor()
+		key, value := cursor.First()
+		if backwards {
+			key, value = cursor.Last()
+		}
+		for ; key != nil; key, value = nextRecord(cursor, backwards) {
+			if backwards && after != nil && bytes.Compare(key, after) <= 0 {
+				break
+			}
+			// Keys and values are only valid during the transaction
+			records = append(records, [2][]byte{append([]byte(nil), key...), append([]byte(nil), value...)})
+		}
+		return nil
+	})
+	return records, err
+}
+
+func nextRecord(cursor *bolt.Cursor, backwards bool) ([]byte, []byte) {
+	if backwards {
+		return cursor.Prev()
+	}
+	return cursor.Next()
+}
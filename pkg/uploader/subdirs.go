@@ -0,0 +1,222 @@
+package uploader
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	subdirArchiveTarGz = "tar.gz"
+	subdirArchiveZip   = "zip"
+)
+
+func validateSubdirArchive(format string) error {
+	switch format {
+	case "", subdirArchiveTarGz, subdirArchiveZip:
+		return nil
+	}
+	return fmt.Errorf("unknown archive format for subdirectories: %s (use tar.gz or zip)", format)
+}
+
+// unitFor returns the subdirectory of the watched directory that filePath
+// belongs to when subdirectories are uploaded as archives, or "" when the
+// file is uploaded on its own. Files directly in the watched directory are
+// uploaded on their own.
+func (d *watchDir) unitFor(filePath string) string {
+	if d.ArchiveSubdirs == "" {
+		return ""
+	}
+	rel, err := filepath.Rel(d.Path, filePath)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return ""
+	}
+
+	first, _, nested := strings.Cut(filepath.ToSlash(rel), "/")
+	if !nested {
+		if info, err := os.Stat(filePath); err != nil || !info.IsDir() {
+			return ""
+		}
+	}
+	return filepath.Join(d.Path, first)
+}
+
+// uploadUnit uploads a subdirectory as a single archive once nothing in it
+// has changed for subdir_stable_for, and then applies the after-upload
+// action to the whole directory. The include and exclude patterns pick the
+// files that go into the archive.
+func uploadUnit(dir *watchDir, unit string) error {
+	rec, err := state.get(unit)
+	if err != nil {
+		logrus.Error("Error reading upload state:", err)
+		return nil
+	}
+	if rec != nil {
+		return nil
+	}
+
+	files, latest, err := unitFiles(dir, unit)
+	if err != nil {
+		logrus.Errorf("Error reading directory %s: %v", unit, err)
+		return nil
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	if wait := cfg.SubdirStableFor - time.Since(latest); wait > 0 {
+		logrus.Debugf("Deferring %s: changed less than %s ago", unit, cfg.SubdirStableFor)
+		deferUpload(unit, wait)
+		return nil
+	}
+
+	tempDir, err := os.MkdirTemp("", "auto-upload-")
+	if err != nil {
+		logrus.Errorf("Failed to upload file: %s, %v", unit, err)
+		return err
+	}
+	name := filepath.Base(unit) + "." + dir.ArchiveSubdirs
+	archivePath := filepath.Join(tempDir, name)
+	if err := writeUnitArchive(archivePath, dir, files, dir.ArchiveSubdirs); err != nil {
+		os.RemoveAll(tempDir)
+		logrus.Errorf("Failed to upload file: %s, archiving: %v", unit, err)
+		return err
+	}
+	logrus.Infof("Archived %d files of %s", len(files), unit)
+
+	// The job is set up as if the archive sat next to the directory, so
+	// routes and templates see its name
+	job := newUploadJob(dir, filepath.Join(filepath.Dir(unit), name))
+	job.Path, job.Original = archivePath, unit
+	job.tempDirs = []string{tempDir}
+	if err := job.expand(); err != nil {
+		job.removeTemp()
+		logrus.Errorf("Failed to upload file: %s, %v", unit, err)
+		return err
+	}
+
+	info, err := os.Stat(archivePath)
+	if err != nil {
+		job.removeTemp()
+		return err
+	}
+	return sendJob(job, info.Size())
+}
+
+// unitFiles lists the files of a subdirectory that the filter allows, and
+// the latest modification time of anything in it.
+func unitFiles(dir *watchDir, unit string) ([]string, time.Time, error) {
+	var files []string
+	var latest time.Time
+	err := filepath.Walk(unit, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if relPath, err := filepath.Rel(dir.Path, path); err == nil && dir.filter.allows(relPath) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, latest, err
+}
+
+// writeUnitArchive streams the files into a tar.gz or zip archive at path.
+// Entries are named by their path below the watched directory, so the
+// archive unpacks into a directory of the subdirectory's name.
+func writeUnitArchive(path string, dir *watchDir, files []string, format string) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if format == subdirArchiveZip {
+		err = writeZip(out, dir, files)
+	} else {
+		err = writeTarGz(out, dir, files)
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func writeTarGz(w io.Writer, dir *watchDir, files []string) error {
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	for _, file := range files {
+		err := addArchiveEntry(dir, file, func(name string, info os.FileInfo) (io.Writer, error) {
+			header, err := tar.FileInfoHeader(info, "")
+			if err != nil {
+				return nil, err
+			}
+			header.Name = name
+			return tw, tw.WriteHeader(header)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func writeZip(w io.Writer, dir *watchDir, files []string) error {
+	zw := zip.NewWriter(w)
+	for _, file := range files {
+		err := addArchiveEntry(dir, file, func(name string, info os.FileInfo) (io.Writer, error) {
+			header, err := zip.FileInfoHeader(info)
+			if err != nil {
+				return nil, err
+			}
+			header.Name, header.Method = name, zip.Deflate
+			return zw.CreateHeader(header)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// addArchiveEntry copies a file into the entry created by create. The size
+// in the header is taken from the open file, so the copy matches it.
+func addArchiveEntry(dir *watchDir, file string, create func(name string, info os.FileInfo) (io.Writer, error)) error {
+	relPath, err := filepath.Rel(dir.Path, file)
+	if err != nil {
+		return err
+	}
+
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	w, err := create(filepath.ToSlash(relPath), info)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(w, in, info.Size()); err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	return nil
+}
@@ -0,0 +1,302 @@
+package uploader
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var targetsBucket = []byte("targets")
+
+// TargetConfig is a server that every file is uploaded to in addition to
+// server_url, e.g. a backup ingestion endpoint. Headers are added to the
+// top-level ones, and the response rules default to the top-level ones.
+type TargetConfig struct {
+	// Name identifies the target in the state database and the logs, it
+	// defaults to the URL
+	Name     string            `yaml:"name"`
+	URL      string            `yaml:"url"`
+	Headers  map[string]string `yaml:"headers"`
+	Response *ResponseConfig   `yaml:"response"`
+	// RateLimit defaults to the top-level one, counted for the target alone
+	RateLimit *RateLimitConfig `yaml:"rate_limit"`
+	// HealthURL is checked to find out whether a failed target is back in
+	// failover mode, it defaults to the URL
+	HealthURL string `yaml:"health_url"`
+}
+
+// uploadTarget is a resolved TargetConfig.
+type uploadTarget struct {
+	name      string
+	url       string
+	headers   map[string]string
+	rules     *responseRules
+	limiter   *rateLimiter
+	breaker   *circuitBreaker
+	healthURL string
+
+	concurrency *concurrencyLimit
+}
+
+func newTargets(confs []TargetConfig) ([]*uploadTarget, error) {
+	var targets []*uploadTarget
+	names := make(map[string]bool)
+	for _, conf := range confs {
+		if conf.URL == "" {
+			return nil, errors.New("target without url")
+		}
+		name := firstNonEmpty(conf.Name, conf.URL)
+		if names[name] {
+			return nil, fmt.Errorf("duplicate target: %s", name)
+		}
+		names[name] = true
+
+		rules := responseCheck
+		if conf.Response != nil {
+			var err error
+			if rules, err = newResponseRules(*conf.Response); err != nil {
+				return nil, fmt.Errorf("target %s: %w", name, err)
+			}
+		}
+		rateLimit := cfg.RateLimit
+		if conf.RateLimit != nil {
+			rateLimit = *conf.RateLimit
+		}
+		targets = append(targets, &uploadTarget{
+			name:      name,
+			url:       conf.URL,
+			headers:   conf.Headers,
+			rules:     rules,
+			limiter:   newRateLimiter(rateLimit),
+			breaker:   newCircuitBreaker(cfg.CircuitBreaker),
+			healthURL: firstNonEmpty(conf.HealthURL, conf.URL),
+
+			concurrency: newConcurrencyLimit(cfg.AdaptiveChunkConcurrency),
+		})
+	}
+	return targets, nil
+}
+
+// rules returns the response rules that decide whether the job's upload
+// succeeded.
+func (j *uploadJob) rules() *responseRules {
+	if j.Target != nil {
+		return j.Target.rules
+	}
+	return responseCheck
+}
+
+// setHeaders adds the configured headers for the job's target to req.
+// Header values may be templates, rendered for every request, so
+// "X-Request-ID: {{uuid}}" tells the requests apart and
+// "X-File-Hash: {{.SHA256}}" names the file in the server's logs. The
+// rendered values are logged at debug level to match the two logs up.
+func (j *uploadJob) setHeaders(req *http.Request) error {
+	var data *fileTemplateData
+	rendered := logrus.Fields{}
+	render := func(key, value string) (string, error) {
+		if !strings.Contains(value, "{{") {
+			return value, nil
+		}
+		if data == nil {
+			info, err := os.Stat(j.Path)
+			if err != nil {
+				return "", err
+			}
+			d := newFileTemplateData(j, info)
+			data = &d
+		}
+		value, err := renderTemplate(value, *data)
+		if err != nil {
+			return "", fmt.Errorf("rendering header %s: %w", key, err)
+		}
+		if !secretName.MatchString(key) {
+			rendered[key] = value
+		}
+		return value, nil
+	}
+
+	for key, value := range cfg.Headers {
+		value, err := render(key, value)
+		if err != nil {
+			return err
+		}
+		req.Header.Add(key, value)
+	}
+	if j.Target != nil {
+		for key, value := range j.Target.headers {
+			value, err := render(key, value)
+			if err != nil {
+				return err
+			}
+			req.Header.Set(key, value)
+		}
+	}
+	if len(rendered) > 0 {
+		logrus.WithFields(rendered).Debugf("%s %s for %s", req.Method, req.URL.Redacted(), j.Path)
+	}
+	return nil
+}
+
+// setProbeHeaders adds the configured headers to a request that is not about
+// a file, such as a health check. Templates that need a file are left out.
+func setProbeHeaders(req *http.Request) {
+	data := fileTemplateData{Now: time.Now()}
+	for key, value := range cfg.Headers {
+		if value, err := renderTemplate(value, data); err == nil {
+			req.Header.Add(key, value)
+		}
+	}
+}
+
+// stateKey is the key of the state kept apart for every target: the progress
+// of resumable uploads and the targets that already accepted the file.
+func (j *uploadJob) stateKey() string {
+	if j.Target != nil {
+		return j.Target.name + " " + j.Path
+	}
+	return j.Path
+}
+
+// mirrorBackend uploads every file to server_url and all targets in
+// parallel. The upload only counts as done once every target has accepted
+// it; targets that already have the file are skipped on a retry.
+type mirrorBackend struct {
+	backend
+	targets []*uploadTarget
+}
+
+func (b mirrorBackend) upload(job *uploadJob) (*fileRecord, error) {
+	info, err := os.Stat(job.Path)
+	if err != nil {
+		return nil, fmt.Errorf("reading file info: %w", err)
+	}
+	if _, err := job.checksum(); err != nil {
+		return nil, err
+	}
+
+	jobs := []*uploadJob{job}
+	for _, target := range b.targets {
+		targetJob, err := job.forTarget(target, info)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, targetJob)
+	}
+
+	recs := make([]*fileRecord, len(jobs))
+	errs := make([]error, len(jobs))
+	var wg sync.WaitGroup
+	for i, targetJob := range jobs {
+		key := targetJob.stateKey()
+		done := &fileRecord{}
+		found, err := state.getJSON(targetsBucket, key, done)
+		if err == nil && found && done.Size == info.Size() && done.ModTime.Equal(info.ModTime()) {
+			recs[i] = done
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, targetJob *uploadJob) {
+			defer wg.Done()
+			recs[i], errs[i] = b.backend.upload(targetJob)
+			if errs[i] != nil {
+				errs[i] = fmt.Errorf("%s: %w", targetName(targetJob), errs[i])
+				return
+			}
+			logrus.Infof("Uploaded %s to %s", targetJob.Path, targetName(targetJob))
+			if err := state.putJSON(targetsBucket, key, recs[i]); err != nil {
+				logrus.Error("Error saving target state:", err)
+			}
+		}(i, targetJob)
+	}
+	wg.Wait()
+
+	job.Response = jobs[0].Response
+	var failed mirrorError
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+	if len(failed) > 0 {
+		// Try again if any target may still accept the file
+		for _, err := range failed {
+			if isRetryable(err, cfg.Retry) {
+				return nil, retryable(failed)
+			}
+		}
+		return nil, failed
+	}
+
+	for _, targetJob := range jobs {
+		if err := state.delete(targetsBucket, targetJob.stateKey()); err != nil {
+			logrus.Error("Error clearing target state:", err)
+		}
+	}
+	return recs[0], nil
+}
+
+// forTarget returns a copy of the job that uploads to target.
+func (j *uploadJob) forTarget(target *uploadTarget, info os.FileInfo) (*uploadJob, error) {
+	targetJob := *j
+	targetJob.Target = target
+
+	var err error
+	if targetJob.URL, err = renderTemplate(target.url, newFileTemplateData(&targetJob, info)); err != nil {
+		return nil, fmt.Errorf("rendering url of target %s: %w", target.name, err)
+	}
+	return &targetJob, nil
+}
+
+func targetName(job *uploadJob) string {
+	if job.Target != nil {
+		return job.Target.name
+	}
+	return job.URL
+}
+
+// mirrorError holds the failures of the targets that did not accept a file.
+type mirrorError []error
+
+func (e mirrorError) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (e mirrorError) Unwrap() []error {
+	return e
+}
+
+// serverURLFlag handles repeated -server-url flags: the first one replaces
+// server_url from the config file, every further one adds a target.
+type serverURLFlag struct {
+	c   *Config
+	set bool
+}
+
+func (f *serverURLFlag) String() string {
+	if f.c == nil {
+		return ""
+	}
+	return f.c.ServerURL
+}
+
+func (f *serverURLFlag) Set(value string) error {
+	if !f.set {
+		f.c.ServerURL = value
+		f.set = true
+		return nil
+	}
+	f.c.Targets = append(f.c.Targets, TargetConfig{URL: value})
+	return nil
+}
@@ -0,0 +1,76 @@
+package uploader
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSetHeaders(t *testing.T) {
+	saved := cfg
+	t.Cleanup(func() { cfg = saved })
+	cfg = DefaultConfig()
+	cfg.Headers = map[string]string{
+		"Authorization": "Bearer abc",
+		"X-File-Name":   "{{.Filename}}",
+		"X-Path":        "{{.RelDir}}{{slug .Name}}",
+		"X-Overridden":  "top",
+	}
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "Scan 1.pdf")
+	if err := os.WriteFile(file, []byte("scan"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	job := &uploadJob{
+		Path:    file,
+		RelPath: "inbox/Scan 1.pdf",
+		Target:  &uploadTarget{name: "backup", headers: map[string]string{"X-Overridden": "{{.Ext}}"}},
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, "https://server.com/upload", nil)
+	if err := job.setHeaders(req); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"Authorization": "Bearer abc",
+		"X-File-Name":   "Scan 1.pdf",
+		"X-Path":        "inbox/scan-1",
+		"X-Overridden":  ".pdf",
+	}
+	for key, value := range want {
+		if got := req.Header.Values(key); len(got) != 1 || got[0] != value {
+			t.Errorf("header %s = %q, want %q", key, got, value)
+		}
+	}
+
+	cfg.Headers["X-Bad"] = "{{.Missing}}"
+	req, _ = http.NewRequest(http.MethodPost, "https://server.com/upload", nil)
+	if err := job.setHeaders(req); err == nil {
+		t.Error("setHeaders succeeded with a header that does not render")
+	}
+}
+
+func TestSetProbeHeaders(t *testing.T) {
+	saved := cfg
+	t.Cleanup(func() { cfg = saved })
+	cfg = DefaultConfig()
+	cfg.Headers = map[string]string{
+		"Authorization": "Bearer abc",
+		"X-Date":        `{{.Now.Format "2006"}}`,
+		"X-File-Name":   "{{.SHA256}}",
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "https://server.com/health", nil)
+	setProbeHeaders(req)
+	if got := req.Header.Get("Authorization"); got != "Bearer abc" {
+		t.Errorf("Authorization = %q, want %q", got, "Bearer abc")
+	}
+	if got := req.Header.Get("X-Date"); len(got) != 4 {
+		t.Errorf("X-Date = %q, want the year", got)
+	}
+	if got := req.Header.Values("X-File-Name"); len(got) != 0 {
+		t.Errorf("X-File-Name = %q, want it left out", got)
+	}
+}
@@ -0,0 +1,143 @@
+package uploader
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// fileTemplateData is what templates for the server URL, form fields and
+// remote names and paths can refer to, e.g.
+// "uploads/{{.ModTime.Format "2006/01/02"}}/". RelPath is the path
+// of the file below its watched directory and RelDir the directory part of it
+// with a trailing slash, empty for files directly in the watched directory,
+// so "uploads/{{.RelDir}}" mirrors the local folder structure.
+type fileTemplateData struct {
+	Filename string
+	Name     string
+	Ext      string
+	RelPath  string
+	RelDir   string
+	Size     int64
+	ModTime  time.Time
+	Now      time.Time
+
+	job *uploadJob
+}
+
+// templateFuncs are the functions templates can use besides the built-in
+// ones, mostly to fit file names to what a server accepts, e.g.
+// "{{.Now.Format "20060102"}}-{{slug .Filename}}".
+var templateFuncs = template.FuncMap{
+	"slug":    slug,
+	"lower":   strings.ToLower,
+	"upper":   strings.ToUpper,
+	"replace": func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+	"uuid":    newUUID,
+}
+
+var slugUnsafe = regexp.MustCompile(`[^a-z0-9._-]+`)
+
+// slug lowercases a name and replaces everything but letters, digits, dots,
+// dashes and underscores with dashes, e.g. "Report Q1.PDF" becomes
+// "report-q1.pdf".
+func slug(name string) string {
+	return strings.Trim(slugUnsafe.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
+
+// SHA256 hashes the file the first time a template uses it.
+func (d fileTemplateData) SHA256() (string, error) {
+	if d.job == nil {
+		return "", errors.New("no file to hash")
+	}
+	return d.job.checksum()
+}
+
+// newUUID returns a random (version 4) UUID, a new one every time a template
+// calls it.
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func newFileTemplateData(job *uploadJob, info os.FileInfo) fileTemplateData {
+	filename := filepath.Base(job.Path)
+	ext := filepath.Ext(filename)
+
+	relDir := path.Dir(job.RelPath) + "/"
+	if relDir == "./" {
+		relDir = ""
+	}
+
+	return fileTemplateData{
+		Filename: filename,
+		Name:     strings.TrimSuffix(filename, ext),
+		Ext:      ext,
+		RelPath:  job.RelPath,
+		RelDir:   relDir,
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+		Now:      time.Now(),
+		job:      job,
+	}
+}
+
+// expand renders the templates in the server URL, the file name and the
+// string form fields of a job for its file.
+func (j *uploadJob) expand() error {
+	info, err := os.Stat(j.Path)
+	if err != nil {
+		return err
+	}
+	data := newFileTemplateData(j, info)
+
+	if j.URL, err = renderTemplate(j.URL, data); err != nil {
+		return fmt.Errorf("rendering server url: %w", err)
+	}
+	if j.FileName, err = renderTemplate(j.FileName, data); err != nil {
+		return fmt.Errorf("rendering file name: %w", err)
+	}
+	if strings.ContainsAny(j.FileName, `/\`) || j.FileName == "." || j.FileName == ".." {
+		return fmt.Errorf("invalid file name %q", j.FileName)
+	}
+
+	for key, value := range j.Fields {
+		text, ok := value.(string)
+		if !ok {
+			continue
+		}
+		if j.Fields[key], err = renderTemplate(text, data); err != nil {
+			return fmt.Errorf("rendering field %s: %w", key, err)
+		}
+	}
+
+	return nil
+}
+
+func renderTemplate(text string, data fileTemplateData) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+
+	tmpl, err := template.New("").Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var out strings.Builder
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", err
+	}
+
+	return out.String(), nil
+}
@@ -0,0 +1,80 @@
+package uploader
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	data := fileTemplateData{
+		Filename: "Report Q1.PDF",
+		Name:     "Report Q1",
+		Ext:      ".PDF",
+		RelPath:  "2024/Report Q1.PDF",
+		RelDir:   "2024/",
+		Size:     1234,
+		ModTime:  time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC),
+	}
+
+	tests := []struct {
+		name    string
+		text    string
+		want    string
+		wantErr bool
+	}{
+		{name: "plain", text: "https://server.com/upload", want: "https://server.com/upload"},
+		{name: "fields", text: "{{.RelDir}}{{.Name}}{{.Ext}} {{.Size}}", want: "2024/Report Q1.PDF 1234"},
+		{name: "mod time", text: `uploads/{{.ModTime.Format "2006/01/02"}}/`, want: "uploads/2024/03/05/"},
+		{name: "slug", text: "{{slug .Filename}}", want: "report-q1.pdf"},
+		{name: "lower and upper", text: "{{lower .Ext}}{{upper .Name}}", want: ".pdfREPORT Q1"},
+		{name: "replace", text: `{{replace " " "_" .Filename}}`, want: "Report_Q1.PDF"},
+		{name: "unknown field", text: "{{.Missing}}", wantErr: true},
+		{name: "unknown function", text: "{{nope .Filename}}", wantErr: true},
+		{name: "hash without a file", text: "{{.SHA256}}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderTemplate(tt.text, data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("renderTemplate(%q) error = %v, wantErr %v", tt.text, err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("renderTemplate(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSlug(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"report.pdf", "report.pdf"},
+		{"Report Q1.PDF", "report-q1.pdf"},
+		{"  spaced  out  ", "spaced-out"},
+		{"été/2024 (copy).txt", "t-2024-copy-.txt"},
+		{"under_score-dash", "under_score-dash"},
+	}
+	for _, tt := range tests {
+		if got := slug(tt.name); got != tt.want {
+			t.Errorf("slug(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNewUUID(t *testing.T) {
+	v4 := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id := newUUID()
+		if !v4.MatchString(id) {
+			t.Fatalf("newUUID() = %q, not a version 4 UUID", id)
+		}
+		if seen[id] {
+			t.Fatalf("newUUID() returned %q twice", id)
+		}
+		seen[id] = true
+	}
+}
@@ -0,0 +1,126 @@
+package uploader
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"golang.org/x/time/rate"
+	"gopkg.in/yaml.v3"
+)
+
+// bandwidthLimiter caps the combined rate of all uploads, nil if unlimited.
+var bandwidthLimiter *rate.Limiter
+
+// maxThrottledRead bounds a single read from a throttled file, so the
+// limiter releases data in small steps instead of whole buffers at once.
+const maxThrottledRead = 64 << 10
+
+// Bandwidth is a transfer rate in bytes per second, written like a size with
+// an optional "/s" such as "5MB/s".
+type Bandwidth ByteSize
+
+func (b *Bandwidth) String() string {
+	return (*ByteSize)(b).String()
+}
+
+func (b *Bandwidth) Set(value string) error {
+	value = strings.TrimSpace(value)
+	if strings.HasSuffix(strings.ToLower(value), "/s") {
+		value = value[:len(value)-2]
+	}
+	return (*ByteSize)(b).Set(value)
+}
+
+func (b *Bandwidth) UnmarshalYAML(node *yaml.Node) error {
+	return b.Set(node.Value)
+}
+
+func newBandwidthLimiter(limit Bandwidth) *rate.Limiter {
+	if limit <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(limit), int(min(limit, maxThrottledRead)))
+}
+
+// sourceFile is a file opened for upload. Its reads are held back to stay
+// within the overall -max-bandwidth and the -max-bandwidth-per-file of
+// this file, which its chunks sent in parallel share, whichever backend ends
+// up reading it, and counted towards the progress of the upload. Reads fail
+// once ctx ends.
+type sourceFile struct {
+	ctx      context.Context
+	file     *os.File
+	limiters []*rate.Limiter
+	maxRead  int
+	progress *uploadProgress
+}
+
+func newSourceFile(ctx context.Context, file *os.File, size int64) *sourceFile {
+	f := &sourceFile{ctx: ctx, file: file, maxRead: maxThrottledRead, progress: startProgress(file.Name(), size)}
+	for _, limiter := range []*rate.Limiter{bandwidthLimiter, newBandwidthLimiter(cfg.MaxBandwidthPerFile)} {
+		if limiter != nil {
+			f.limiters = append(f.limiters, limiter)
+			f.maxRead = min(f.maxRead, limiter.Burst())
+		}
+	}
+	return f
+}
+
+func (f *sourceFile) Read(p []byte) (int, error) {
+	if f.ctx.Err() != nil {
+		return 0, context.Cause(f.ctx)
+	}
+	n, err := f.file.Read(f.limit(p))
+	if waitErr := f.wait(n); err == nil {
+		err = waitErr
+	}
+	return n, err
+}
+
+// ReadAt reads in steps like Read but, as io.ReaderAt requires, only returns
+// early with an error.
+func (f *sourceFile) ReadAt(p []byte, off int64) (int, error) {
+	read := 0
+	for read < len(p) {
+		if f.ctx.Err() != nil {
+			return read, context.Cause(f.ctx)
+		}
+		n, err := f.file.ReadAt(f.limit(p[read:]), off+int64(read))
+		if waitErr := f.wait(n); err == nil {
+			err = waitErr
+		}
+		read += n
+		if err != nil {
+			return read, err
+		}
+	}
+	return read, nil
+}
+
+func (f *sourceFile) Close() error {
+	f.progress.stop()
+	return f.file.Close()
+}
+
+func (f *sourceFile) limit(p []byte) []byte {
+	if len(f.limiters) > 0 && len(p) > f.maxRead {
+		return p[:f.maxRead]
+	}
+	return p
+}
+
+// wait counts n bytes read and holds them back for the bandwidth limits. It
+// fails once ctx ends.
+func (f *sourceFile) wait(n int) error {
+	f.progress.add(n)
+	for _, limiter := range f.limiters {
+		if err := limiter.WaitN(f.ctx, n); err != nil {
+			// A wait past the deadline is refused right away, but the
+			// upload would not get any further before it either
+			<-f.ctx.Done()
+			return context.Cause(f.ctx)
+		}
+	}
+	return nil
+}
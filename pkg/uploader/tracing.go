@@ -0,0 +1,177 @@
+package uploader
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.25.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracingConfig sends OpenTelemetry traces of the uploads to a collector
+// over OTLP/HTTP, e.g. Jaeger or Tempo. A file's trace has a span for its
+// time in the queue, for the upload with an event per failed attempt and the
+// HTTP requests in it, and for writing the state; every directory scan has
+// its own. It only changes on restart.
+type TracingConfig struct {
+	// Endpoint is the collector's base URL, e.g. http://localhost:4318;
+	// tracing is off without it
+	Endpoint string `yaml:"endpoint"`
+	// Headers are sent with every export, e.g. for the collector's auth
+	Headers     map[string]string `yaml:"headers"`
+	ServiceName string            `yaml:"service_name"`
+	// SampleRatio is the share of the files traced, from 0 to 1
+	SampleRatio float64 `yaml:"sample_ratio"`
+	// Propagate sends the trace context to the server in a traceparent
+	// header with the uploads of the http backend, so its spans join the
+	// file's trace
+	Propagate bool `yaml:"propagate"`
+}
+
+// tracer starts the spans of the uploader. It does nothing until
+// startTracing installs a tracer provider.
+var tracer = otel.Tracer("auto-upload")
+
+// tracerProvider exports the spans, nil while tracing is off.
+var tracerProvider *sdktrace.TracerProvider
+
+// startTracing sets up the export of the spans to conf.Endpoint.
+func startTracing(conf TracingConfig) error {
+	if conf.Endpoint == "" {
+		return nil
+	}
+	if conf.SampleRatio < 0 || conf.SampleRatio > 1 {
+		return fmt.Errorf("tracing sample_ratio must be between 0 and 1, not %v", conf.SampleRatio)
+	}
+
+	ctx := context.Background()
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(conf.Endpoint), otlptracehttp.WithHeaders(conf.Headers))
+	if err != nil {
+		return fmt.Errorf("setting up tracing: %w", err)
+	}
+	res, err := resource.New(ctx,
+		resource.WithFromEnv(),
+		resource.WithHost(),
+		resource.WithAttributes(semconv.ServiceName(firstNonEmpty(conf.ServiceName, "auto-upload"))),
+	)
+	if err != nil {
+		return fmt.Errorf("setting up tracing: %w", err)
+	}
+
+	tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(conf.SampleRatio))),
+	)
+	otel.SetTracerProvider(tracerProvider)
+	if conf.Propagate {
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+	}
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		logrus.Warn("Tracing: ", err)
+	}))
+	logrus.Infof("Sending traces to %s", conf.Endpoint)
+	return nil
+}
+
+// stopTracing exports the spans that are still buffered.
+func stopTracing() {
+	if tracerProvider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		logrus.Warn("Error exporting the last traces: ", err)
+	}
+	tracerProvider = nil
+}
+
+// endSpan ends span, marking it failed with err.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// startTrace starts the trace of a job that is about to be uploaded, back
+// from when its file was queued, with spans for the time in the queue and
+// the preparation since.
+func startTrace(job *uploadJob) {
+	now := time.Now()
+	start := job.started
+	if !job.queued.IsZero() {
+		start = job.queued
+	}
+	ctx, span := tracer.Start(job.context(), "file", trace.WithTimestamp(start), trace.WithAttributes(
+		attribute.String("file.path", firstNonEmpty(job.Original, job.Path)),
+		attribute.String("file.dir", job.Dir.Path),
+		attribute.String("upload.url", job.URL),
+	))
+	if !job.queued.IsZero() {
+		_, queued := tracer.Start(ctx, "queue", trace.WithTimestamp(job.queued))
+		queued.End(trace.WithTimestamp(job.started))
+	}
+	_, prepared := tracer.Start(ctx, "prepare", trace.WithTimestamp(job.started))
+	prepared.End(trace.WithTimestamp(now))
+	job.ctx, job.span = ctx, span
+}
+
+// endTrace ends the trace of a job, marking it failed with err.
+func (j *uploadJob) endTrace(err error) {
+	if j.span != nil {
+		endSpan(j.span, err)
+		j.span = nil
+	}
+}
+
+// traceContext returns a context with the job's trace, for spans of its
+// own after the upload.
+func (j *uploadJob) traceContext() context.Context {
+	return trace.ContextWithSpan(context.Background(), j.span)
+}
+
+// tracingTransport wraps the HTTP requests in client spans and passes the
+// trace context on to the server.
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+func (t tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := tracer.Start(req.Context(), "HTTP "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(req.Method),
+			semconv.URLFull(req.URL.Redacted()),
+			semconv.ServerAddress(req.URL.Hostname()),
+		),
+	)
+	if span.SpanContext().IsValid() {
+		req = req.Clone(ctx)
+		otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+	span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+	if resp.StatusCode >= 400 {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+	span.End()
+	return resp, nil
+}
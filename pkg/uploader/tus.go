@@ -0,0 +1,385 @@
+package uploader
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const tusVersion = "1.0.0"
+
+// tusUpload is the persisted progress of a tus upload, so an interrupted
+// upload can continue from the last offset the server acknowledged. An
+// upload sent in parallel has Parts, partial uploads of the file from their
+// Start, which are concatenated into the file once they are all sent.
+type tusUpload struct {
+	URL     string      `json:"url"`
+	Size    int64       `json:"size"`
+	ModTime time.Time   `json:"mod_time"`
+	Offset  int64       `json:"offset"`
+	Start   int64       `json:"start,omitempty"`
+	Parts   []tusUpload `json:"parts,omitempty"`
+}
+
+// tusExtensions caches the extensions of the tus servers by URL.
+var tusExtensions sync.Map
+
+// sendFileTus uploads a file with the tus.io resumable upload protocol,
+// resuming a previous upload of the same file content if one is known.
+func sendFileTus(job *uploadJob) (*fileRecord, error) {
+	filePath := job.Path
+	file, info, err := openFile(job.context(), filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	client := httpClient
+
+	upload, err := resumeTusUpload(client, job, info)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case upload == nil && cfg.ChunkParallelism > 1 && info.Size() > int64(cfg.TusChunkSize) && tusSupports(client, job, "concatenation"):
+		if upload, err = createTusParts(client, job, info); err != nil {
+			return nil, err
+		}
+	case upload == nil:
+		if upload, err = createTusUpload(client, job, info); err != nil {
+			return nil, err
+		}
+	case len(upload.Parts) > 0:
+		logrus.Infof("Resuming upload of %s in %d parts", filePath, len(upload.Parts))
+	default:
+		logrus.Infof("Resuming upload of %s at offset %d", filePath, upload.Offset)
+	}
+
+	if len(upload.Parts) > 0 {
+		if err := sendTusParts(client, job, file, upload); err != nil {
+			return nil, err
+		}
+	}
+
+	for upload.Offset < upload.Size {
+		if err := patchTusUpload(client, job, file, upload); err != nil {
+			return nil, err
+		}
+		if err := state.putJSON(tusBucket, job.stateKey(), upload); err != nil {
+			logrus.Error("Error saving upload offset:", err)
+		}
+	}
+
+	if err := state.delete(tusBucket, job.stateKey()); err != nil {
+		logrus.Error("Error clearing upload offset:", err)
+	}
+
+	checksum, err := job.checksum()
+	if err != nil {
+		logrus.Warnf("Could not checksum %s: %v", filePath, err)
+	}
+
+	rec := newFileRecord(filePath, info, checksum)
+	rec.RemoteURL = upload.URL
+	return rec, nil
+}
+
+// resumeTusUpload looks up a stored upload for the file and asks the server
+// for its current offset. It returns nil if there is nothing to resume.
+func resumeTusUpload(client *http.Client, job *uploadJob, info os.FileInfo) (*tusUpload, error) {
+	upload := &tusUpload{}
+	found, err := state.getJSON(tusBucket, job.stateKey(), upload)
+	if err != nil {
+		return nil, err
+	}
+
+	// A changed file can not continue an upload of its old content
+	if !found || upload.Size != info.Size() || !upload.ModTime.Equal(info.ModTime()) {
+		return nil, nil
+	}
+	if len(upload.Parts) > 0 {
+		for i := range upload.Parts {
+			offset, err := tusOffset(client, job, upload.Parts[i].URL)
+			if offset < 0 || err != nil {
+				return nil, err
+			}
+			upload.Parts[i].Offset = offset
+		}
+		return upload, nil
+	}
+
+	offset, err := tusOffset(client, job, upload.URL)
+	if offset < 0 || err != nil {
+		return nil, err
+	}
+	upload.Offset = offset
+
+	return upload, nil
+}
+
+// tusOffset asks the server for the offset of the upload at target. It
+// returns -1 if the server no longer has the upload.
+func tusOffset(client *http.Client, job *uploadJob, target string) (int64, error) {
+	req, err := newTusRequest(job, http.MethodHead, target, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		// The server has expired the upload, start over
+		return -1, nil
+	case resp.StatusCode >= 300:
+		return 0, newStatusError(resp)
+	}
+
+	offset, err := strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid Upload-Offset in response: %w", err)
+	}
+	return offset, nil
+}
+
+func createTusUpload(client *http.Client, job *uploadJob, info os.FileInfo) (*tusUpload, error) {
+	req, err := newTusRequest(job, http.MethodPost, job.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Upload-Length", strconv.FormatInt(info.Size(), 10))
+	req.Header.Set("Upload-Metadata", tusMetadata(job.uploadName(), job.Fields))
+	job.setChecksumHeader(req)
+	job.setIdempotencyHeader(req)
+
+	location, err := postTusCreation(client, req)
+	if err != nil {
+		return nil, err
+	}
+
+	upload := &tusUpload{
+		URL:     location,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+	if err := state.putJSON(tusBucket, job.stateKey(), upload); err != nil {
+		logrus.Error("Error saving upload location:", err)
+	}
+
+	return upload, nil
+}
+
+// patchTusUpload sends the next chunk of the file and advances the offset to
+// the one confirmed by the server.
+func patchTusUpload(client *http.Client, job *uploadJob, file *sourceFile, upload *tusUpload) error {
+	length := upload.Size - upload.Offset
+	if cfg.TusChunkSize > 0 && length > int64(cfg.TusChunkSize) {
+		length = int64(cfg.TusChunkSize)
+	}
+
+	body := io.NewSectionReader(file, upload.Start+upload.Offset, length)
+	req, err := newTusRequest(job, http.MethodPatch, upload.URL, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = length
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return newStatusError(resp)
+	}
+
+	offset, err := strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid Upload-Offset in response: %w", err)
+	}
+	if offset <= upload.Offset {
+		return fmt.Errorf("server did not accept any data at offset %d", upload.Offset)
+	}
+	upload.Offset = offset
+
+	return nil
+}
+
+// createTusParts splits the file into cfg.ChunkParallelism partial uploads,
+// none smaller than the tus chunk size, for the concatenation extension.
+func createTusParts(client *http.Client, job *uploadJob, info os.FileInfo) (*tusUpload, error) {
+	count := int64(cfg.ChunkParallelism)
+	if chunkSize := int64(cfg.TusChunkSize); chunkSize > 0 {
+		count = min(count, (info.Size()+chunkSize-1)/chunkSize)
+	}
+	partSize := (info.Size() + count - 1) / count
+
+	upload := &tusUpload{Size: info.Size(), ModTime: info.ModTime()}
+	for start := int64(0); start < info.Size(); start += partSize {
+		req, err := newTusRequest(job, http.MethodPost, job.URL, nil)
+		if err != nil {
+			return nil, err
+		}
+		length := min(partSize, info.Size()-start)
+		req.Header.Set("Upload-Length", strconv.FormatInt(length, 10))
+		req.Header.Set("Upload-Concat", "partial")
+
+		location, err := postTusCreation(client, req)
+		if err != nil {
+			return nil, fmt.Errorf("creating part %d: %w", len(upload.Parts)+1, err)
+		}
+		upload.Parts = append(upload.Parts, tusUpload{URL: location, Size: length, Start: start})
+	}
+	if err := state.putJSON(tusBucket, job.stateKey(), upload); err != nil {
+		logrus.Error("Error saving upload location:", err)
+	}
+
+	return upload, nil
+}
+
+// sendTusParts sends the partial uploads of upload, cfg.ChunkParallelism
+// at a time, and concatenates them into the upload of the file.
+func sendTusParts(client *http.Client, job *uploadJob, file *sourceFile, upload *tusUpload) error {
+	var mu sync.Mutex
+	lengths := make([]int64, len(upload.Parts))
+	for i, part := range upload.Parts {
+		lengths[i] = part.Size - part.Offset
+	}
+	err := sendChunks(job, lengths, func(i int) error {
+		mu.Lock()
+		part := upload.Parts[i]
+		mu.Unlock()
+
+		for part.Offset < part.Size {
+			if err := patchTusUpload(client, job, file, &part); err != nil {
+				return fmt.Errorf("part %d: %w", i+1, err)
+			}
+
+			mu.Lock()
+			upload.Parts[i] = part
+			if err := state.putJSON(tusBucket, job.stateKey(), upload); err != nil {
+				logrus.Error("Error saving upload offset:", err)
+			}
+			mu.Unlock()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	urls := make([]string, len(upload.Parts))
+	for i, part := range upload.Parts {
+		urls[i] = part.URL
+	}
+	req, err := newTusRequest(job, http.MethodPost, job.URL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Upload-Concat", "final;"+strings.Join(urls, " "))
+	req.Header.Set("Upload-Metadata", tusMetadata(job.uploadName(), job.Fields))
+	job.setChecksumHeader(req)
+	job.setIdempotencyHeader(req)
+
+	location, err := postTusCreation(client, req)
+	if err != nil {
+		return fmt.Errorf("concatenating parts: %w", err)
+	}
+	upload.URL = location
+	upload.Offset = upload.Size
+	return nil
+}
+
+// postTusCreation sends a request creating an upload and returns the URL
+// of the new upload.
+func postTusCreation(client *http.Client, req *http.Request) (string, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return "", newStatusError(resp)
+	}
+
+	location, err := resp.Location()
+	if err != nil {
+		return "", fmt.Errorf("upload created without a location: %w", err)
+	}
+	return location.String(), nil
+}
+
+// tusSupports reports whether the tus server of job has the extension, as
+// it answers an OPTIONS request. A server that fails to answer has none.
+func tusSupports(client *http.Client, job *uploadJob, extension string) bool {
+	extensions, ok := tusExtensions.Load(job.URL)
+	if !ok {
+		req, err := newTusRequest(job, http.MethodOptions, job.URL, nil)
+		if err != nil {
+			return false
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			logrus.Warnf("Could not ask %s for its tus extensions: %v", redactURL(job.URL), err)
+			return false
+		}
+		resp.Body.Close()
+		extensions, _ = tusExtensions.LoadOrStore(job.URL, strings.Split(resp.Header.Get("Tus-Extension"), ","))
+	}
+	for _, name := range extensions.([]string) {
+		if strings.TrimSpace(name) == extension {
+			return true
+		}
+	}
+	return false
+}
+
+func newTusRequest(job *uploadJob, method, target string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(job.context(), method, target, body)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+
+	if err := job.setHeaders(req); err != nil {
+		return nil, err
+	}
+	req.Header.Set("Tus-Resumable", tusVersion)
+
+	return req, nil
+}
+
+// tusMetadata encodes the file name and extra body fields as the
+// Upload-Metadata header: comma-separated keys with base64 encoded values.
+func tusMetadata(fileName string, fields map[string]interface{}) string {
+	pairs := []string{"filename " + base64.StdEncoding.EncodeToString([]byte(fileName))}
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := fmt.Sprintf("%v", fields[key])
+		pairs = append(pairs, key+" "+base64.StdEncoding.EncodeToString([]byte(value)))
+	}
+
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,137 @@
+package uploader
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// runUpload implements "auto-upload upload <paths...>": it uploads the given
+// files and the files below the given directories once and exits, failing
+// if any of the uploads failed. Paths inside a configured directory use its
+// settings, others the top-level ones. Files that were uploaded before are
+// skipped, as when watching.
+func runUpload(args []string) error {
+	fs := flag.NewFlagSet("upload", flag.ExitOnError)
+	fs.StringVar(&configFile, "config", "", "YAML file to load settings from; flags override its values")
+	registerFlags(fs, &cfg)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: auto-upload upload [flags] <paths...>")
+		fs.PrintDefaults()
+	}
+	if err := setFlagsFromEnv(fs); err != nil {
+		return err
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err := resolveSecrets(&cfg); err != nil {
+		return err
+	}
+
+	if err := setupLogging(&cfg); err != nil {
+		return err
+	}
+
+	var err error
+	if state, err = openState(); err != nil {
+		return err
+	}
+	defer state.Close()
+	go handleShutdown()
+
+	if cfg.UploadDir != "" || len(cfg.Directories) > 0 {
+		if dirs, err = cfg.watchDirs(); err != nil {
+			return err
+		}
+	}
+	if err := startUploader(); err != nil {
+		return err
+	}
+
+	var failed int
+	for _, path := range fs.Args() {
+		failed += len(uploadPath(path))
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d uploads failed", failed)
+	}
+	return nil
+}
+
+// uploadPath uploads a file, or every file below a directory, and returns
+// the errors of the uploads that failed.
+func uploadPath(path string) []error {
+	info, err := os.Stat(path)
+	if err != nil {
+		logrus.Errorf("Failed to upload %s: %v", path, err)
+		return []error{err}
+	}
+
+	root := path
+	if !info.IsDir() {
+		root = filepath.Dir(path)
+	}
+	dir := dirFor(dirs, path)
+	if dir == nil {
+		// A directory of its own with the top-level settings
+		c := cfg
+		c.UploadDir, c.Directories = root, nil
+		adhoc, err := c.watchDirs()
+		if err != nil {
+			return []error{err}
+		}
+		dir = adhoc[0]
+	} else {
+		// The state is keyed by the paths found below the directory
+		absDir, err := filepath.Abs(dir.Path)
+		if err != nil {
+			return []error{err}
+		}
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			return []error{err}
+		}
+		rel, err := filepath.Rel(absDir, absPath)
+		if err != nil {
+			return []error{err}
+		}
+		path = filepath.Join(dir.Path, rel)
+	}
+
+	if !info.IsDir() {
+		if err := uploadFile(dir, path, time.Time{}); err != nil {
+			return []error{fmt.Errorf("%s: %w", path, err)}
+		}
+		return flushBatch()
+	}
+
+	var errs []error
+	err = filepath.Walk(path, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			if err := uploadFile(dir, filePath, time.Time{}); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", filePath, err))
+			}
+		} else if dir.unitFor(filePath) == filePath {
+			if err := uploadFile(dir, filePath, time.Time{}); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", filePath, err))
+			}
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		logrus.Errorf("Failed to upload %s: %v", path, err)
+		errs = append(errs, err)
+	}
+	return append(errs, flushBatch()...)
+}
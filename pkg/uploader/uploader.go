@@ -0,0 +1,128 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Uploader embeds the behavior of the auto-upload command in another
+// program: it watches the configured directories and uploads new files, and
+// uploads given files on request, keeping track of them in the state
+// database. Log output goes to the standard logrus logger; the settings for
+// the log file, PID file and admin API are only used by the command.
+//
+// The package keeps its settings, state database and queue in package-level
+// variables, so only one Uploader can be open in a process at a time; New
+// fails while another one is open. Directories with settings of their own
+// cover most needs for a second one.
+type Uploader struct {
+	closed bool
+}
+
+// opened is set while an Uploader is open.
+var opened atomic.Bool
+
+// New opens the state database and sets up the upload backend for conf,
+// which usually starts out as DefaultConfig().
+func New(conf Config) (*Uploader, error) {
+	if !opened.CompareAndSwap(false, true) {
+		return nil, errors.New("an uploader is already open in this process")
+	}
+
+	cfg = conf
+	shutdownMu.Lock()
+	stopping, shuttingDown = make(chan struct{}), false
+	shutdownMu.Unlock()
+	resetUploadsContext()
+
+	var err error
+	if state, err = openState(); err != nil {
+		opened.Store(false)
+		return nil, err
+	}
+
+	dirs = nil
+	if cfg.UploadDir != "" || len(cfg.Directories) > 0 {
+		dirs, err = cfg.watchDirs()
+	}
+	if err == nil {
+		err = startUploader()
+	}
+	if err != nil {
+		state.Close()
+		opened.Store(false)
+		return nil, err
+	}
+	return &Uploader{}, nil
+}
+
+// Run uploads the files in the watched directories and keeps watching them
+// for new files until ctx is done. It then waits up to ShutdownTimeout for
+// the running uploads to finish, aborts them if they do not, and returns.
+func (u *Uploader) Run(ctx context.Context) error {
+	if u.closed {
+		return errors.New("uploader is closed")
+	}
+	if len(dirs) == 0 {
+		return errors.New("no upload directory configured: set UploadDir or Directories")
+	}
+	if err := lockDirs(dirs); err != nil {
+		return err
+	}
+
+	watched := make(chan error, 1)
+	go func() { watched <- watch() }()
+
+	select {
+	case err := <-watched:
+		stopUploads()
+		return err
+	case <-ctx.Done():
+	}
+
+	done := stopUploads()
+	select {
+	case <-done:
+	case <-time.After(cfg.ShutdownTimeout):
+		abortRunning(done)
+		return fmt.Errorf("uploads still running after %s", cfg.ShutdownTimeout)
+	}
+	return <-watched
+}
+
+// Upload uploads a file, or every file below a directory, right away and
+// returns the errors of the uploads that failed. Paths inside a watched
+// directory use its settings, others the top-level ones. Files that were
+// uploaded before are skipped.
+func (u *Uploader) Upload(path string) error {
+	if u.closed {
+		return errors.New("uploader is closed")
+	}
+	return errors.Join(uploadPath(path)...)
+}
+
+// Close releases the state database, the connections of the backend, the
+// message bus and the MQTT broker, which is told the device went offline, the
+// plugins, the claims and the locks on the watched directories, and exports
+// the last traces. Run must have returned before.
+func (u *Uploader) Close() error {
+	if u.closed {
+		return nil
+	}
+	u.closed = true
+
+	if closer, ok := uploader.(closer); ok {
+		closer.close()
+	}
+	stopServices()
+	for _, lock := range dirLocks {
+		lock.Close()
+	}
+	dirLocks = nil
+	err := state.Close()
+	opened.Store(false)
+	return err
+}
@@ -0,0 +1,46 @@
+package uploader
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// Version is the version of auto-upload, set when building a release with
+//
+//	go build -ldflags "-X auto-upload/pkg/uploader.Version=1.4.0"
+//
+// Builds from go install report the version of the module instead.
+var Version string
+
+func version() string {
+	if Version != "" {
+		return Version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return strings.TrimPrefix(info.Main.Version, "v")
+	}
+	return "dev"
+}
+
+// defaultUserAgent names the uploader and its version in the server's logs,
+// e.g. auto-upload/1.4.0 (linux; amd64).
+func defaultUserAgent() string {
+	return fmt.Sprintf("auto-upload/%s (%s; %s)", version(), runtime.GOOS, runtime.GOARCH)
+}
+
+// userAgentTransport sets the configured User-Agent on requests that do not
+// have one from the headers setting.
+type userAgentTransport struct {
+	base http.RoundTripper
+}
+
+func (t userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if userAgent := cfg.HTTPClient.UserAgent; userAgent != "" && req.Header.Get("User-Agent") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", userAgent)
+	}
+	return t.base.RoundTrip(req)
+}
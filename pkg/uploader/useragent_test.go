@@ -0,0 +1,61 @@
+package uploader
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestDefaultUserAgent(t *testing.T) {
+	saved := Version
+	t.Cleanup(func() { Version = saved })
+
+	Version = "1.4.0"
+	if got, want := defaultUserAgent(), regexp.MustCompile(`^auto-upload/1\.4\.0 \([a-z0-9]+; [a-z0-9]+\)$`); !want.MatchString(got) {
+		t.Errorf("defaultUserAgent() = %q, want it to match %s", got, want)
+	}
+	Version = ""
+	if got := version(); got == "" {
+		t.Error("version() is empty without a Version")
+	}
+}
+
+func TestUserAgentTransport(t *testing.T) {
+	saved := cfg
+	t.Cleanup(func() { cfg = saved })
+	cfg = DefaultConfig()
+	cfg.HTTPClient.UserAgent = "auto-upload/test"
+
+	var got string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("User-Agent")
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: userAgentTransport{http.DefaultTransport}}
+
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{name: "configured", want: "auto-upload/test"},
+		{name: "from the headers setting", header: "scanner/2.0", want: "scanner/2.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+			if tt.header != "" {
+				req.Header.Set("User-Agent", tt.header)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if got != tt.want {
+				t.Errorf("User-Agent = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
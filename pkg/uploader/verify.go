@@ -0,0 +1,198 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+var (
+	// ErrRemoteMissing is returned when the server no longer has an
+	// uploaded file.
+	ErrRemoteMissing = errors.New("missing on the server")
+	// ErrUnknownRemote is returned by a statter or a Backend's Verify for a
+	// remote URL it did not upload to, e.g. one recorded before the backend was changed.
+	ErrUnknownRemote = errors.New("not uploaded by this backend")
+)
+
+// statter is implemented by backends that can look up the files they
+// uploaded, for remote URLs a plain HTTP request cannot check.
+type statter interface {
+	// stat returns the size of the file at remoteURL on the server, -1 if
+	// the server does not tell, or ErrRemoteMissing if it is gone.
+	stat(ctx context.Context, remoteURL string) (int64, error)
+}
+
+// runVerify implements "auto-upload verify": it checks that the server
+// still has every uploaded file with a recorded remote URL, and fails if any
+// of them is missing or has another size there. With -repair those files
+// are forgotten by the state store, so the next start uploads them again.
+func runVerify(args []string) error {
+	var repair bool
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	fs.StringVar(&configFile, "config", "", "YAML file to load settings from; flags override its values")
+	fs.BoolVar(&repair, "repair", false, "Forget the files the server no longer has, or has with another size, so the next start uploads them again")
+	registerFlags(fs, &cfg)
+	fs.Parse(args)
+	if err := resolveSecrets(&cfg); err != nil {
+		return err
+	}
+
+	transport, err := newHTTPTransport()
+	if err != nil {
+		return err
+	}
+	httpClient = &http.Client{Transport: transport, Timeout: cfg.HTTPClient.RequestTimeout}
+
+	// Object stores and file servers are asked through the backend, with
+	// its credentials
+	var remote statter
+	if cfg.Backend != "" && cfg.Backend != "http" {
+		b, err := newBackend(cfg.Backend)
+		if err != nil {
+			return err
+		}
+		if closer, ok := b.(closer); ok {
+			defer closer.close()
+		}
+		if guarded, ok := b.(guardedBackend); ok {
+			b = guarded.backend
+		}
+		remote, _ = b.(statter)
+	}
+
+	store, err := openState()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	var records []*fileRecord
+	err = store.files(func(rec *fileRecord) error {
+		records = append(records, rec)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "STATUS\tPATH\tREMOTE URL")
+	var checked, missing, resized, requeued, unchecked int
+	for _, rec := range records {
+		size, err := statRemote(context.Background(), remote, rec.RemoteURL)
+		if errors.Is(err, ErrUnknownRemote) {
+			unchecked++
+			continue
+		}
+
+		checked++
+		status := "ok"
+		switch expected := expectedSize(rec); {
+		case errors.Is(err, ErrRemoteMissing):
+			status = "missing"
+			missing++
+		case err != nil:
+			status = "error: " + err.Error()
+		case size >= 0 && expected >= 0 && size != expected:
+			status = fmt.Sprintf("size %d on the server, %d uploaded", size, expected)
+			resized++
+		}
+
+		if repair && status != "ok" && !strings.HasPrefix(status, "error: ") {
+			if _, err := os.Stat(rec.Path); err != nil {
+				// The file was removed since, there is nothing to upload again
+				status += ", gone locally"
+			} else if err := store.forget(rec); err != nil {
+				return err
+			} else {
+				status += ", requeued"
+				requeued++
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", status, rec.Path, rec.RemoteURL)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("%d files checked, %d missing, %d with another size, %d without a remote URL to check\n", checked, missing, resized, unchecked)
+	if repair {
+		fmt.Printf("%d files will be uploaded again on the next start\n", requeued)
+	}
+
+	if left := missing + resized - requeued; left > 0 {
+		return fmt.Errorf("%d files are missing or differ on the server", left)
+	}
+	return nil
+}
+
+// statRemote looks up the file at remoteURL through the backend, or like the
+// http backend for uploads over HTTP.
+func statRemote(ctx context.Context, remote statter, remoteURL string) (int64, error) {
+	if remote != nil {
+		if size, err := remote.stat(ctx, remoteURL); !errors.Is(err, ErrUnknownRemote) {
+			return size, err
+		}
+	}
+	return httpBackend{}.Verify(ctx, remoteURL)
+}
+
+// expectedSize returns the size the server should have for the file of rec,
+// or -1 if it cannot be told: encrypted copies are larger, and a pre-upload
+// hook may have sent another file in its place.
+func expectedSize(rec *fileRecord) int64 {
+	switch {
+	case rec.Encryption != "" || cfg.Hooks.PreUpload != "":
+		return -1
+	case rec.Compression != "":
+		return rec.CompressedSize
+	}
+	return rec.Size
+}
+
+// checkRemote asks the server whether it has the file at remoteURL, with a
+// HEAD request or a GET request for servers that do not support HEAD.
+func checkRemote(ctx context.Context, remoteURL string) error {
+	resp, err := remoteRequest(ctx, http.MethodHead, remoteURL)
+	if err == nil && (resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented) {
+		resp, err = remoteRequest(ctx, http.MethodGet, remoteURL)
+	}
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 300 {
+		return missingIfNotFound(&statusError{StatusCode: resp.StatusCode, Status: resp.Status})
+	}
+	return nil
+}
+
+// missingIfNotFound turns a 404 or 410 response into ErrRemoteMissing.
+func missingIfNotFound(err error) error {
+	var statusErr *statusError
+	if errors.As(err, &statusErr) && (statusErr.StatusCode == http.StatusNotFound || statusErr.StatusCode == http.StatusGone) {
+		return ErrRemoteMissing
+	}
+	return err
+}
+
+func remoteRequest(ctx context.Context, method, remoteURL string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, remoteURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	setProbeHeaders(req)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	// Only the status matters, the body of a GET is not read
+	resp.Body.Close()
+	return resp, nil
+}
@@ -0,0 +1,171 @@
+package uploader
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+// notifySettleDelay is how long a file must go without new events before it
+// is uploaded, so files that are still being written are not sent half done.
+const notifySettleDelay = 1 * time.Second
+
+// watchWithNotify uploads the files already present in the watched
+// directories and then reacts to fsnotify CREATE/WRITE events, only looking
+// at the changed paths. Files are started from the queue, a file at a time
+// in each of its lanes, in between handling events, so a file with a higher
+// priority that shows up during a backlog goes next. It returns nil once a
+// shutdown starts, and an error if the watcher could not be set up or stops
+// unexpectedly.
+func watchWithNotify(dirs []*watchDir) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	for _, dir := range dirs {
+		if err := addWatchRecursive(watcher, dir, dir.Path); err != nil {
+			return err
+		}
+	}
+
+	// Pick up everything that was there before the watch was established
+	scanBacklog(dirs)
+
+	watcherBeat(notifySettleDelay)
+	pending := make(map[string]time.Time)
+	ticker := time.NewTicker(notifySettleDelay / 2)
+	defer ticker.Stop()
+
+	ready := make(chan struct{})
+	close(ready)
+	// idle is set when none of the queued files can go, until the next
+	// event, tick or upload that is over
+	idle := false
+	for {
+		// next is only ready while there are files to upload
+		var next <-chan struct{}
+		if !paused.Load() && !idle && queue.len() > 0 {
+			next = ready
+		}
+
+		select {
+		case <-next:
+			idle = !uploadNext(nil)
+			if (idle || queue.len() == 0) && queue.running() == 0 {
+				flushBatch()
+			}
+			continue
+
+		case <-laneFreed:
+			if queue.len() == 0 && queue.running() == 0 {
+				flushBatch()
+			}
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return errors.New("watcher event channel closed")
+			}
+			handleWatchEvent(watcher, event, pending)
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return errors.New("watcher error channel closed")
+			}
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				// Events were dropped, so fall back to a full scan to catch up
+				logrus.Warn("Watcher event queue overflowed, rescanning directories")
+				for _, dir := range dirs {
+					watchForNewFiles(dir)
+				}
+			} else {
+				logrus.Error("Watcher error:", err)
+			}
+
+		case <-controlRequests:
+			runControlRequests()
+
+		case <-stopping:
+			return nil
+
+		case <-ticker.C:
+			watcherBeat(notifySettleDelay)
+			for path, last := range pending {
+				if time.Since(last) >= notifySettleDelay {
+					delete(pending, path)
+					if dir := dirFor(dirs, path); dir != nil {
+						queue.add(dir, path)
+					}
+				}
+			}
+		}
+		idle = false
+	}
+}
+
+func handleWatchEvent(watcher *fsnotify.Watcher, event fsnotify.Event, pending map[string]time.Time) {
+	if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+		delete(pending, event.Name)
+		queue.remove(event.Name)
+		return
+	}
+
+	if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Write) {
+		return
+	}
+
+	info, err := os.Stat(event.Name)
+	if err != nil {
+		// The file is already gone again
+		delete(pending, event.Name)
+		return
+	}
+
+	if !info.IsDir() {
+		pending[event.Name] = time.Now()
+		return
+	}
+
+	dir := dirFor(dirs, event.Name)
+	if event.Has(fsnotify.Create) && dir != nil && !dir.isBeyondDepth(event.Name) {
+		// New directories need their own watch, and may already contain
+		// files that were created before the watch was added
+		if err := addWatchRecursive(watcher, dir, event.Name); err != nil {
+			logrus.Error("Error watching new directory:", err)
+		}
+		filepath.Walk(event.Name, func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.IsDir() && dir.isBeyondDepth(path) {
+				return filepath.SkipDir
+			}
+			if err == nil && !info.IsDir() {
+				pending[path] = time.Now()
+			}
+			return nil
+		})
+	}
+}
+
+// addWatchRecursive adds a watch for root and every directory below it within
+// the max_depth of dir, since fsnotify only reports events for the direct
+// children of a watched directory.
+func addWatchRecursive(watcher *fsnotify.Watcher, dir *watchDir, root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() && dir.isBeyondDepth(path) {
+			return filepath.SkipDir
+		}
+		if info.IsDir() {
+			return watcher.Add(path)
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,347 @@
+package uploader
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// WebDAVConfig configures the WebDAV backend.
+type WebDAVConfig struct {
+	URL                string `yaml:"url"`
+	User               string `yaml:"user"`
+	Password           string `yaml:"password"`
+	RemoteDir          string `yaml:"remote_dir"`
+	CAFile             string `yaml:"ca_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// webdavBackend uploads files with PUT to a WebDAV server such as Nextcloud,
+// ownCloud or Apache mod_dav, creating missing directories with MKCOL. The
+// authentication scheme (basic or digest) follows the server's challenge.
+type webdavBackend struct {
+	conf   WebDAVConfig
+	base   *url.URL
+	client *http.Client
+
+	mu        sync.Mutex
+	challenge *authChallenge
+	created   map[string]bool
+}
+
+func newWebDAVBackend(conf WebDAVConfig) (*webdavBackend, error) {
+	base, err := url.Parse(conf.URL)
+	if err != nil || base.Host == "" {
+		return nil, fmt.Errorf("invalid webdav url: %s", conf.URL)
+	}
+	if conf.Password == "" {
+		conf.Password = os.Getenv("WEBDAV_PASSWORD")
+	}
+
+	tlsConfig, err := tlsClientConfig(conf.CAFile, conf.InsecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+	if conf.InsecureSkipVerify {
+		logrus.Warn("WebDAV certificate verification is disabled, the connection can be intercepted")
+	}
+
+	transport := newTransport()
+	transport.TLSClientConfig = tlsConfig
+
+	return &webdavBackend{
+		conf:    conf,
+		base:    base,
+		client:  &http.Client{Transport: userAgentTransport{transport}, Timeout: cfg.HTTPClient.RequestTimeout},
+		created: make(map[string]bool),
+	}, nil
+}
+
+func (b *webdavBackend) upload(job *uploadJob) (*fileRecord, error) {
+	filePath := job.Path
+	file, info, err := openFile(job.context(), filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	remoteDir, err := renderTemplate(b.conf.RemoteDir, newFileTemplateData(job, info))
+	if err != nil {
+		return nil, fmt.Errorf("rendering remote directory: %w", err)
+	}
+
+	checksum, err := job.checksum()
+	if err != nil {
+		return nil, fmt.Errorf("hashing file: %w", err)
+	}
+
+	if err := b.mkdirAll(job.context(), remoteDir); err != nil {
+		return nil, err
+	}
+
+	contentType := job.contentType()
+
+	target := b.base.JoinPath(remoteDir, job.uploadName())
+	body := func() io.Reader { return io.NewSectionReader(file, 0, info.Size()) }
+	resp, err := b.do(job.context(), http.MethodPut, target, body, info.Size(), http.Header{"Content-Type": {contentType}})
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusConflict {
+		// The parent collection is gone, it was probably removed on the
+		// server since it was created. Create it again on the next attempt.
+		b.mu.Lock()
+		b.created = make(map[string]bool)
+		b.mu.Unlock()
+		return nil, retryable(newStatusError(resp))
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent {
+		return nil, newStatusError(resp)
+	}
+
+	rec := newFileRecord(filePath, info, checksum)
+	remote := *target
+	remote.User = nil
+	rec.RemoteURL = remote.String()
+	return rec, nil
+}
+
+// stat looks up the file at remoteURL with a HEAD request.
+func (b *webdavBackend) stat(ctx context.Context, remoteURL string) (int64, error) {
+	remote, err := url.Parse(remoteURL)
+	if err != nil || remote.Host != b.base.Host {
+		return 0, ErrUnknownRemote
+	}
+	remote.User = b.base.User
+
+	resp, err := b.do(ctx, http.MethodHead, remote, nil, 0, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return 0, missingIfNotFound(newStatusError(resp))
+	}
+	return resp.ContentLength, nil
+}
+
+// mkdirAll creates every missing collection of dir below the base URL.
+// Collections that were created or found before are remembered, so the
+// common case costs no extra requests.
+func (b *webdavBackend) mkdirAll(ctx context.Context, dir string) error {
+	current := ""
+	for _, part := range strings.Split(strings.Trim(dir, "/"), "/") {
+		if part == "" {
+			continue
+		}
+		current = path.Join(current, part)
+
+		b.mu.Lock()
+		known := b.created[current]
+		b.mu.Unlock()
+		if known {
+			continue
+		}
+
+		resp, err := b.do(ctx, "MKCOL", b.base.JoinPath(current+"/"), nil, 0, nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		// 405 means the collection already exists
+		if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusMethodNotAllowed {
+			return fmt.Errorf("creating %s: %w", current, newStatusError(resp))
+		}
+
+		b.mu.Lock()
+		b.created[current] = true
+		b.mu.Unlock()
+	}
+	return nil
+}
+
+// do sends an authenticated request. If the server rejects it with a new
+// challenge, the request is repeated once with matching credentials; body
+// returns a fresh reader for each attempt.
+func (b *webdavBackend) do(ctx context.Context, method string, target *url.URL, body func() io.Reader, length int64, header http.Header) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		var reader io.Reader = http.NoBody
+		if body != nil {
+			reader = body()
+		}
+
+		req, err := http.NewRequestWithContext(ctx, method, target.String(), reader)
+		if err != nil {
+			return nil, fmt.Errorf("creating request: %w", err)
+		}
+		req.ContentLength = length
+		for name, values := range header {
+			req.Header[name] = values
+		}
+
+		b.mu.Lock()
+		if b.challenge != nil {
+			b.challenge.authorize(req, b.conf.User, b.conf.Password)
+		}
+		b.mu.Unlock()
+
+		resp, err := b.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 || b.conf.User == "" {
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		challenge, err := parseAuthChallenge(resp.Header.Values("WWW-Authenticate"))
+		if err != nil {
+			return nil, err
+		}
+		b.mu.Lock()
+		b.challenge = challenge
+		b.mu.Unlock()
+	}
+}
+
+// authChallenge is the authentication scheme requested by a server with
+// WWW-Authenticate, used for HTTP basic and digest (RFC 7616) auth.
+type authChallenge struct {
+	scheme string
+	params map[string]string
+	count  int
+}
+
+// parseAuthChallenge picks digest over basic when the server offers both.
+func parseAuthChallenge(headers []string) (*authChallenge, error) {
+	var basic *authChallenge
+	for _, header := range headers {
+		scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+		switch strings.ToLower(scheme) {
+		case "digest":
+			return &authChallenge{scheme: "digest", params: parseAuthParams(rest)}, nil
+		case "basic":
+			basic = &authChallenge{scheme: "basic"}
+		}
+	}
+	if basic == nil {
+		return nil, fmt.Errorf("unsupported authentication: %s", strings.Join(headers, ", "))
+	}
+	return basic, nil
+}
+
+// parseAuthParams splits a list like realm="a, b", qop="auth", stale=false.
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for s != "" {
+		s = strings.TrimLeft(s, " ,")
+		key, rest, found := strings.Cut(s, "=")
+		if !found {
+			break
+		}
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				b.WriteByte(rest[i])
+			}
+			value, s = b.String(), rest[min(i+1, len(rest)):]
+		} else {
+			value, s, _ = strings.Cut(rest, ",")
+		}
+
+		params[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(value)
+	}
+	return params
+}
+
+func (c *authChallenge) authorize(req *http.Request, user, password string) {
+	if c.scheme == "basic" {
+		req.SetBasicAuth(user, password)
+		return
+	}
+
+	algorithm := c.params["algorithm"]
+	var newHash func() hash.Hash
+	switch strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS") {
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		newHash = md5.New
+	}
+	h := func(s string) string {
+		sum := newHash()
+		sum.Write([]byte(s))
+		return hex.EncodeToString(sum.Sum(nil))
+	}
+
+	realm, nonce := c.params["realm"], c.params["nonce"]
+	uri := req.URL.RequestURI()
+	cnonce := randomHex(16)
+
+	ha1 := h(user + ":" + realm + ":" + password)
+	if strings.HasSuffix(strings.ToUpper(algorithm), "-SESS") {
+		ha1 = h(ha1 + ":" + nonce + ":" + cnonce)
+	}
+	ha2 := h(req.Method + ":" + uri)
+
+	fields := []string{
+		fmt.Sprintf("username=%q", user),
+		fmt.Sprintf("realm=%q", realm),
+		fmt.Sprintf("nonce=%q", nonce),
+		fmt.Sprintf("uri=%q", uri),
+	}
+	if algorithm != "" {
+		fields = append(fields, "algorithm="+algorithm)
+	}
+
+	if qopAuth(c.params["qop"]) {
+		c.count++
+		nc := fmt.Sprintf("%08x", c.count)
+		response := h(ha1 + ":" + nonce + ":" + nc + ":" + cnonce + ":auth:" + ha2)
+		fields = append(fields, fmt.Sprintf("response=%q", response), "qop=auth", "nc="+nc, fmt.Sprintf("cnonce=%q", cnonce))
+	} else {
+		fields = append(fields, fmt.Sprintf("response=%q", h(ha1+":"+nonce+":"+ha2)))
+	}
+	if opaque, ok := c.params["opaque"]; ok {
+		fields = append(fields, fmt.Sprintf("opaque=%q", opaque))
+	}
+
+	req.Header.Set("Authorization", "Digest "+strings.Join(fields, ", "))
+}
+
+func qopAuth(qop string) bool {
+	for _, value := range strings.Split(qop, ",") {
+		if strings.TrimSpace(value) == "auth" {
+			return true
+		}
+	}
+	return false
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,211 @@
+package uploader
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Upload events webhooks can be sent for.
+const (
+	eventSuccess        = "success"
+	eventFailure        = "failure"
+	eventRetryExhausted = "retry_exhausted"
+	eventRejected       = "rejected"
+)
+
+// webhookTimeout bounds a webhook request, so a slow receiver holds up the
+// next upload only briefly.
+const webhookTimeout = 30 * time.Second
+
+// WebhookConfig is an HTTP endpoint notified of upload events.
+type WebhookConfig struct {
+	URL string `yaml:"url"`
+	// Events limits the webhook to some of success, failure (an error that
+	// is not retried), retry_exhausted and rejected (a 4xx status that is
+	// not retried); empty means all of them
+	Events []string `yaml:"events"`
+	// Template is a Go template for the request body, with the fields of the
+	// event and a json function to quote values, e.g.
+	// {"text": {{json (printf "Upload of %s failed: %s" .RelPath .Error)}}}.
+	// Without it the event is sent as a JSON object.
+	Template string            `yaml:"template"`
+	Headers  map[string]string `yaml:"headers"`
+}
+
+// webhookEvent is what a webhook is told about an upload.
+type webhookEvent struct {
+	Event     string    `json:"event"`
+	File      string    `json:"file"`
+	RelPath   string    `json:"rel_path"`
+	Dir       string    `json:"dir"`
+	Size      int64     `json:"size,omitempty"`
+	SHA256    string    `json:"sha256,omitempty"`
+	ServerURL string    `json:"server_url,omitempty"`
+	RemoteURL string    `json:"remote_url,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Attempts  int       `json:"attempts,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+type webhook struct {
+	conf     WebhookConfig
+	events   map[string]bool
+	template *template.Template
+}
+
+var (
+	webhooks      []*webhook
+	webhookClient = &http.Client{Transport: userAgentTransport{http.DefaultTransport}, Timeout: webhookTimeout}
+)
+
+var webhookFuncs = template.FuncMap{
+	"json": func(value interface{}) (string, error) {
+		data, err := json.Marshal(value)
+		return string(data), err
+	},
+}
+
+func newWebhooks(confs []WebhookConfig) ([]*webhook, error) {
+	var hooks []*webhook
+	for _, conf := range confs {
+		if conf.URL == "" {
+			return nil, errors.New("webhook without url")
+		}
+
+		hook := &webhook{conf: conf}
+		for _, event := range conf.Events {
+			switch event {
+			case eventSuccess, eventFailure, eventRetryExhausted, eventRejected:
+			default:
+				return nil, fmt.Errorf("unknown webhook event: %s", event)
+			}
+			if hook.events == nil {
+				hook.events = make(map[string]bool)
+			}
+			hook.events[event] = true
+		}
+
+		if conf.Template != "" {
+			tmpl, err := template.New("").Funcs(webhookFuncs).Option("missingkey=error").Parse(conf.Template)
+			if err != nil {
+				return nil, fmt.Errorf("parsing webhook template for %s: %w", conf.URL, err)
+			}
+			hook.template = tmpl
+		}
+		hooks = append(hooks, hook)
+	}
+
+	if len(hooks) > 0 {
+		webhookClient.Transport = newTransport()
+	}
+	return hooks, nil
+}
+
+// notifyWebhooks sends the outcome of an upload to every webhook interested
+// in it. Failures to deliver are logged and otherwise ignored.
+func notifyWebhooks(job *uploadJob, rec *fileRecord, uploadErr error) {
+	if len(webhooks) == 0 {
+		return
+	}
+
+	event := newUploadEvent(job, rec, uploadErr)
+	for _, hook := range webhooks {
+		if hook.events != nil && !hook.events[event.Event] {
+			continue
+		}
+		if err := hook.send(event); err != nil {
+			logrus.Errorf("Webhook %s failed for %s: %v", hook.conf.URL, event.File, err)
+		}
+	}
+}
+
+// newUploadEvent describes the outcome of an upload for webhooks and the
+// message bus.
+func newUploadEvent(job *uploadJob, rec *fileRecord, uploadErr error) webhookEvent {
+	event := webhookEvent{
+		Event:     eventSuccess,
+		File:      firstNonEmpty(job.Original, job.Path),
+		RelPath:   job.RelPath,
+		Dir:       job.Dir.Path,
+		SHA256:    job.Checksum,
+		ServerURL: job.URL,
+		Time:      time.Now(),
+	}
+	if rec != nil {
+		event.Size, event.SHA256, event.RemoteURL = rec.Size, rec.SHA256, rec.RemoteURL
+	}
+	if uploadErr != nil {
+		event.Event, event.Error = eventFailure, uploadErr.Error()
+		var exhausted *exhaustedError
+		if errors.As(uploadErr, &exhausted) {
+			event.Event, event.Attempts = eventRetryExhausted, exhausted.attempts
+		} else if isRejection(uploadErr) {
+			event.Event = eventRejected
+		}
+	}
+
+	return event
+}
+
+func (h *webhook) send(event webhookEvent) error {
+	var body bytes.Buffer
+	if h.template != nil {
+		if err := h.template.Execute(&body, event); err != nil {
+			return fmt.Errorf("rendering template: %w", err)
+		}
+	} else if err := json.NewEncoder(&body).Encode(event); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(uploadsCtx, http.MethodPost, h.conf.URL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range h.conf.Headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &statusError{StatusCode: resp.StatusCode, Status: strings.TrimSpace(resp.Status)}
+	}
+	return nil
+}
+
+// webhookFlag handles repeated -webhook flags, each adding a webhook for all
+// events with the default JSON body.
+type webhookFlag struct {
+	c *Config
+}
+
+func (f *webhookFlag) String() string {
+	if f.c == nil {
+		return ""
+	}
+	var urls []string
+	for _, hook := range f.c.Webhooks {
+		urls = append(urls, hook.URL)
+	}
+	return strings.Join(urls, ",")
+}
+
+func (f *webhookFlag) Set(value string) error {
+	f.c.Webhooks = append(f.c.Webhooks, WebhookConfig{URL: value})
+	return nil
+}
@@ -0,0 +1,222 @@
+package uploader
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+// WebSocketConfig configures the websocket backend.
+type WebSocketConfig struct {
+	// URL is the ws:// or wss:// endpoint
+	URL string `yaml:"url"`
+	// Headers are sent with the handshake that opens the connection
+	Headers            map[string]string `yaml:"headers"`
+	Token              string            `yaml:"token"`
+	CAFile             string            `yaml:"ca_file"`
+	InsecureSkipVerify bool              `yaml:"insecure_skip_verify"`
+	ChunkSize          ByteSize          `yaml:"chunk_size"`
+	// Timeout limits sending a file and waiting for the server's answer;
+	// 0 waits forever
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// websocketBackend streams files over a single WebSocket connection that is
+// kept open between uploads, so flaky links do not pay for a TLS handshake
+// per file. It is experimental. Each file is a text frame with its details
+// (websocketHeader), its content in binary frames and an end frame, and the
+// server answers with a websocketReply. Files go one at a time; a broken
+// connection is opened again for the next upload.
+type websocketBackend struct {
+	conf   WebSocketConfig
+	dialer *websocket.Dialer
+	header http.Header
+
+	mu   sync.Mutex
+	conn *websocket.Conn
+}
+
+// websocketHeader is the frame that starts a file.
+type websocketHeader struct {
+	Type        string            `json:"type"`
+	Filename    string            `json:"filename"`
+	RelPath     string            `json:"rel_path"`
+	Size        int64             `json:"size"`
+	ContentType string            `json:"content_type"`
+	SHA256      string            `json:"sha256"`
+	Fields      map[string]string `json:"fields,omitempty"`
+}
+
+// websocketReply is the server's answer once a file is in. A reply with an
+// error fails the upload, and its status, an HTTP status code, decides
+// whether it is retried like with HTTP uploads.
+type websocketReply struct {
+	Status int    `json:"status"`
+	URL    string `json:"url"`
+	Error  string `json:"error"`
+}
+
+func newWebSocketBackend(conf WebSocketConfig) (*websocketBackend, error) {
+	target, err := url.Parse(conf.URL)
+	if err != nil || target.Host == "" || target.Scheme != "ws" && target.Scheme != "wss" {
+		return nil, fmt.Errorf("websocket backend needs a ws:// or wss:// url, got %q", conf.URL)
+	}
+	if conf.ChunkSize <= 0 {
+		conf.ChunkSize = 256 << 10
+	}
+
+	tlsConfig, err := tlsClientConfig(conf.CAFile, conf.InsecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+	if conf.InsecureSkipVerify {
+		logrus.Warn("WebSocket certificate verification is disabled, the connection can be intercepted")
+	}
+
+	header := make(http.Header)
+	for key, value := range conf.Headers {
+		header.Set(key, value)
+	}
+	if token := firstNonEmpty(conf.Token, os.Getenv("WEBSOCKET_TOKEN")); token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+
+	return &websocketBackend{
+		conf:   conf,
+		header: header,
+		dialer: &websocket.Dialer{
+			NetDial: func(_, addr string) (net.Conn, error) {
+				return dialThroughProxy(target.Scheme, addr, cfg.HTTPClient.ConnectTimeout)
+			},
+			TLSClientConfig:  tlsConfig,
+			HandshakeTimeout: cfg.HTTPClient.ConnectTimeout,
+		},
+	}, nil
+}
+
+func (b *websocketBackend) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn != nil {
+		b.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		b.conn.Close()
+		b.conn = nil
+	}
+}
+
+// connect opens the connection unless it is open. b.mu must be held.
+func (b *websocketBackend) connect() (*websocket.Conn, error) {
+	if b.conn != nil {
+		return b.conn, nil
+	}
+	conn, resp, err := b.dialer.Dial(b.conf.URL, b.header)
+	if err != nil {
+		if resp != nil {
+			// The server refused the handshake
+			return nil, newStatusError(resp)
+		}
+		return nil, retryable(fmt.Errorf("connecting to %s: %w", b.conf.URL, err))
+	}
+	b.conn = conn
+	return conn, nil
+}
+
+func (b *websocketBackend) upload(job *uploadJob) (*fileRecord, error) {
+	filePath := job.Path
+	file, info, err := openFile(job.context(), filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	checksum, err := job.checksum()
+	if err != nil {
+		return nil, fmt.Errorf("hashing file: %w", err)
+	}
+
+	fields := make(map[string]string, len(job.Fields))
+	for key, value := range job.Fields {
+		fields[key] = fmt.Sprintf("%v", value)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	conn, err := b.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := b.send(conn, file, websocketHeader{
+		Type:        "file",
+		Filename:    job.uploadName(),
+		RelPath:     job.RelPath,
+		Size:        info.Size(),
+		ContentType: job.contentType(),
+		SHA256:      checksum,
+		Fields:      fields,
+	})
+	if err != nil {
+		// What the server got of the file is unknown, start over on a new
+		// connection
+		conn.Close()
+		b.conn = nil
+		return nil, err
+	}
+	if reply.Error != "" {
+		if reply.Status == 0 {
+			reply.Status = http.StatusInternalServerError
+		}
+		return nil, &statusError{StatusCode: reply.Status, Status: reply.Error}
+	}
+
+	rec := newFileRecord(filePath, info, checksum)
+	rec.RemoteURL = reply.URL
+	return rec, nil
+}
+
+// send streams a file over conn and waits for the server's reply. Failures
+// of the connection are worth retrying, unlike those reading the file.
+func (b *websocketBackend) send(conn *websocket.Conn, file io.Reader, header websocketHeader) (*websocketReply, error) {
+	deadline := time.Time{}
+	if b.conf.Timeout > 0 {
+		deadline = time.Now().Add(b.conf.Timeout)
+	}
+	conn.SetWriteDeadline(deadline)
+	conn.SetReadDeadline(deadline)
+
+	if err := conn.WriteJSON(header); err != nil {
+		return nil, retryable(err)
+	}
+	chunk := make([]byte, b.conf.ChunkSize)
+	for {
+		n, err := io.ReadFull(file, chunk)
+		if n > 0 {
+			if err := conn.WriteMessage(websocket.BinaryMessage, chunk[:n]); err != nil {
+				return nil, retryable(err)
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := conn.WriteJSON(map[string]string{"type": "end"}); err != nil {
+		return nil, retryable(err)
+	}
+
+	reply := &websocketReply{}
+	if err := conn.ReadJSON(reply); err != nil {
+		return nil, retryable(fmt.Errorf("reading reply: %w", err))
+	}
+	return reply, nil
+}
@@ -0,0 +1,5 @@
+// Package uploadpb is the gRPC service the grpc backend uploads files to,
+// generated from upload.proto.
+package uploadpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative upload.proto
@@ -0,0 +1,129 @@
+// The gRPC service the grpc backend uploads files to. Implement Uploader in
+// the ingestion service and point auto-upload at it with -backend=grpc.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: upload.proto
+
+package uploadpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Uploader_Upload_FullMethodName = "/autoupload.v1.Uploader/Upload"
+)
+
+// UploaderClient is the client API for Uploader service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Uploader receives files from auto-upload.
+type UploaderClient interface {
+	// Upload streams one file: a first message with its info, then its
+	// content in chunks. The server answers once it has stored the file, or
+	// with an error status, e.g. UNAVAILABLE to have the upload retried or
+	// INVALID_ARGUMENT to reject the file.
+	Upload(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[UploadRequest, UploadResponse], error)
+}
+
+type uploaderClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewUploaderClient(cc grpc.ClientConnInterface) UploaderClient {
+	return &uploaderClient{cc}
+}
+
+func (c *uploaderClient) Upload(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[UploadRequest, UploadResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Uploader_ServiceDesc.Streams[0], Uploader_Upload_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[UploadRequest, UploadResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Uploader_UploadClient = grpc.ClientStreamingClient[UploadRequest, UploadResponse]
+
+// UploaderServer is the server API for Uploader service.
+// All implementations must embed UnimplementedUploaderServer
+// for forward compatibility.
+//
+// Uploader receives files from auto-upload.
+type UploaderServer interface {
+	// Upload streams one file: a first message with its info, then its
+	// content in chunks. The server answers once it has stored the file, or
+	// with an error status, e.g. UNAVAILABLE to have the upload retried or
+	// INVALID_ARGUMENT to reject the file.
+	Upload(grpc.ClientStreamingServer[UploadRequest, UploadResponse]) error
+	mustEmbedUnimplementedUploaderServer()
+}
+
+// UnimplementedUploaderServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedUploaderServer struct{}
+
+func (UnimplementedUploaderServer) Upload(grpc.ClientStreamingServer[UploadRequest, UploadResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method Upload not implemented")
+}
+func (UnimplementedUploaderServer) mustEmbedUnimplementedUploaderServer() {}
+func (UnimplementedUploaderServer) testEmbeddedByValue()                  {}
+
+// UnsafeUploaderServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to UploaderServer will
+// result in compilation errors.
+type UnsafeUploaderServer interface {
+	mustEmbedUnimplementedUploaderServer()
+}
+
+func RegisterUploaderServer(s grpc.ServiceRegistrar, srv UploaderServer) {
+	// If the following call pancis, it indicates UnimplementedUploaderServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Uploader_ServiceDesc, srv)
+}
+
+func _Uploader_Upload_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(UploaderServer).Upload(&grpc.GenericServerStream[UploadRequest, UploadResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Uploader_UploadServer = grpc.ClientStreamingServer[UploadRequest, UploadResponse]
+
+// Uploader_ServiceDesc is the grpc.ServiceDesc for Uploader service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Uploader_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "autoupload.v1.Uploader",
+	HandlerType: (*UploaderServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Upload",
+			Handler:       _Uploader_Upload_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "upload.proto",
+}